@@ -0,0 +1,275 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zencoder/disque-go/disque"
+	"golang.org/x/net/context"
+)
+
+// timestampLength is the length of the push time leading every payload
+const timestampLength = 19
+
+// config describes a benchmark run
+type config struct {
+	servers []string
+	queue   string
+	// cycle is the number of fetched jobs after which a connection moves to
+	// the node producing most of them
+	cycle    int
+	capacity int
+
+	producers int
+	consumers int
+	// jobs is the number of jobs pushed, unbounded if zero
+	jobs int
+	// duration is the time after which producers stop, unbounded if zero
+	duration time.Duration
+
+	size         int
+	options      map[string]string
+	pushTimeout  time.Duration
+	batch        int
+	fetchTimeout time.Duration
+}
+
+// result is the outcome of a benchmark run
+type result struct {
+	Cycle    int           `json:"cycle"`
+	Produced int           `json:"produced"`
+	Consumed int           `json:"consumed"`
+	Errors   int           `json:"errors"`
+	Elapsed  time.Duration `json:"elapsed"`
+	// Push is the latency of ADDJOB
+	Push *latencies `json:"push"`
+	// Fetch is the latency of GETJOB, one sample per batch
+	Fetch *latencies `json:"fetch"`
+	// EndToEnd is the time from push to fetch of each job
+	EndToEnd *latencies `json:"end_to_end"`
+}
+
+// benchmark runs producers and consumers concurrently through a pool
+type benchmark struct {
+	config config
+	pool   *disque.Pool
+
+	// deadline is when producers stop, zero if unbounded
+	deadline time.Time
+	// pushed counts the jobs producers claimed, successfully pushed or not
+	pushed   int64
+	produced int64
+	consumed int64
+	errors   int64
+	// producing is closed once every producer has stopped
+	producing chan struct{}
+
+	mu                    sync.Mutex
+	push, fetch, endToEnd []time.Duration
+}
+
+// runBenchmark pushes and fetches jobs as configured, returning the
+// throughput and latencies observed
+func runBenchmark(c config) (r *result, err error) {
+	if c.producers == 0 && c.consumers == 0 {
+		return nil, errors.New("At least one producer or consumer is required")
+	}
+	if c.producers > 0 && c.jobs <= 0 && c.duration <= 0 {
+		return nil, errors.New("Either a number of jobs or a duration is required")
+	}
+	if c.capacity <= 0 {
+		c.capacity = c.producers + c.consumers
+	}
+	if c.size < timestampLength {
+		c.size = timestampLength
+	}
+
+	b := &benchmark{
+		config:    c,
+		pool:      disque.NewPool(c.servers, c.cycle, c.capacity, c.capacity, time.Hour),
+		producing: make(chan struct{}),
+	}
+	defer b.pool.Close()
+
+	// fail early if the cluster is unreachable
+	var d *disque.Disque
+	if d, err = b.pool.Get(context.Background()); err != nil {
+		return
+	}
+	b.pool.Put(d)
+
+	start := time.Now()
+	if c.duration > 0 {
+		b.deadline = start.Add(c.duration)
+	}
+	var producers, consumers sync.WaitGroup
+	for i := 0; i < c.producers; i++ {
+		producers.Add(1)
+		go func() {
+			defer producers.Done()
+			b.produce()
+		}()
+	}
+	for i := 0; i < c.consumers; i++ {
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			b.consume()
+		}()
+	}
+	producers.Wait()
+	close(b.producing)
+	consumers.Wait()
+
+	r = &result{
+		Cycle:    c.cycle,
+		Produced: int(b.produced),
+		Consumed: int(b.consumed),
+		Errors:   int(b.errors),
+		Elapsed:  time.Since(start),
+		Push:     summarize(b.push),
+		Fetch:    summarize(b.fetch),
+		EndToEnd: summarize(b.endToEnd),
+	}
+	return
+}
+
+// produce pushes jobs until enough were pushed or the deadline passed
+func (b *benchmark) produce() {
+	padding := strings.Repeat("x", b.config.size-timestampLength)
+	samples := make([]time.Duration, 0)
+
+	for {
+		if b.config.jobs > 0 && atomic.AddInt64(&b.pushed, 1) > int64(b.config.jobs) {
+			break
+		}
+		start := time.Now()
+		if !b.deadline.IsZero() && !start.Before(b.deadline) {
+			break
+		}
+		err := b.withConn(func(d *disque.Disque) (err error) {
+			_, err = d.PushWithOptions(b.config.queue, payload(start, padding), b.config.pushTimeout, b.config.options)
+			return
+		})
+		if err != nil {
+			atomic.AddInt64(&b.errors, 1)
+			continue
+		}
+		samples = append(samples, time.Since(start))
+		atomic.AddInt64(&b.produced, 1)
+	}
+	b.record(&b.push, samples)
+}
+
+// consume fetches and acknowledges jobs until the producers have stopped and
+// every job they pushed was fetched, or the queue is found empty
+func (b *benchmark) consume() {
+	var fetchSamples, endToEndSamples []time.Duration
+	for {
+		done := false
+		select {
+		case <-b.producing:
+			done = true
+		default:
+		}
+		if done && b.config.producers > 0 && atomic.LoadInt64(&b.consumed) >= atomic.LoadInt64(&b.produced) {
+			break
+		}
+
+		var jobs []*disque.Job
+		start := time.Now()
+		err := b.withConn(func(d *disque.Disque) (err error) {
+			if jobs, err = d.FetchMultiple(b.config.queue, b.config.batch, b.config.fetchTimeout); err != nil || len(jobs) == 0 {
+				return
+			}
+			fetched := time.Now()
+			fetchSamples = append(fetchSamples, fetched.Sub(start))
+			pipeline := d.Pipeline()
+			for _, job := range jobs {
+				if pushed, ok := pushTime(job.Message); ok {
+					endToEndSamples = append(endToEndSamples, fetched.Sub(pushed))
+				}
+				pipeline.Ack(job.JobID)
+			}
+			_, err = pipeline.Execute()
+			return
+		})
+		if err != nil {
+			atomic.AddInt64(&b.errors, 1)
+		} else {
+			atomic.AddInt64(&b.consumed, int64(len(jobs)))
+		}
+		if done && (err != nil || len(jobs) == 0) {
+			break
+		}
+	}
+	b.record(&b.fetch, fetchSamples)
+	b.record(&b.endToEnd, endToEndSamples)
+}
+
+// withConn runs fn with a connection from the pool, discarding the
+// connection if fn fails
+func (b *benchmark) withConn(fn func(d *disque.Disque) error) (err error) {
+	var d *disque.Disque
+	if d, err = b.pool.Get(context.Background()); err != nil {
+		return
+	}
+	if err = fn(d); err != nil {
+		d.Close()
+		b.pool.Put(nil)
+		return
+	}
+	b.pool.Put(d)
+	return
+}
+
+// record adds the samples of a worker to a set of samples
+func (b *benchmark) record(set *[]time.Duration, samples []time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	*set = append(*set, samples...)
+}
+
+// payload builds a job body starting with the push time, padded to the configured size
+func payload(pushed time.Time, padding string) string {
+	return fmt.Sprintf("%0*d", timestampLength, pushed.UnixNano()) + padding
+}
+
+// pushTime extracts the push time from a job body built by payload
+func pushTime(message string) (pushed time.Time, ok bool) {
+	if len(message) < timestampLength {
+		return
+	}
+	nanos, err := strconv.ParseInt(message[:timestampLength], 10, 64)
+	if err != nil {
+		return
+	}
+	return time.Unix(0, nanos), true
+}
+
+// parseOptions parses ADDJOB options given as a comma-separated list of
+// NAME=value pairs, or NAME alone for flags such as ASYNC
+func parseOptions(value string) (options map[string]string, err error) {
+	options = make(map[string]string)
+	if value == "" {
+		return
+	}
+	for _, option := range strings.Split(value, ",") {
+		parts := strings.SplitN(strings.TrimSpace(option), "=", 2)
+		name := strings.ToUpper(parts[0])
+		if name == "" {
+			return nil, fmt.Errorf("Malformed job option: %q", option)
+		}
+		if len(parts) == 1 {
+			options[name] = "true"
+		} else {
+			options[name] = parts[1]
+		}
+	}
+	return
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disque"
+	"github.com/zencoder/disque-go/disquetest"
+)
+
+type BenchSuite struct {
+	suite.Suite
+	server *disquetest.Server
+}
+
+func TestBenchSuite(t *testing.T) {
+	suite.Run(t, new(BenchSuite))
+}
+
+func (s *BenchSuite) SetupTest() {
+	s.server = disquetest.NewServer()
+}
+
+func (s *BenchSuite) TearDownTest() {
+	s.server.Close()
+}
+
+func (s *BenchSuite) SetupSuite() {
+}
+
+func (s *BenchSuite) config() config {
+	return config{
+		servers:      []string{s.server.Addr},
+		queue:        "queueBench",
+		cycle:        1000,
+		producers:    2,
+		consumers:    2,
+		jobs:         40,
+		size:         128,
+		pushTimeout:  time.Second,
+		batch:        4,
+		fetchTimeout: 10 * time.Millisecond,
+	}
+}
+
+func (s *BenchSuite) queueLength() int {
+	d := disque.NewDisque([]string{s.server.Addr}, 1000)
+	s.Nil(d.Initialize())
+	defer d.Close()
+	queueLength, err := d.QueueLength("queueBench")
+	s.Nil(err)
+	return queueLength
+}
+
+func (s *BenchSuite) TestRunBenchmark() {
+	c := s.config()
+	c.options = map[string]string{"TTL": "60"}
+	r, err := runBenchmark(c)
+	s.Nil(err)
+	s.Equal(40, r.Produced)
+	s.Equal(40, r.Consumed)
+	s.Equal(0, r.Errors)
+	s.Equal(40, r.Push.Count)
+	s.Equal(40, r.EndToEnd.Count)
+	s.True(r.Fetch.Count >= 10)
+	s.True(r.Push.P50 <= r.Push.P99)
+	s.Equal(0, s.queueLength())
+}
+
+func (s *BenchSuite) TestProducersOnly() {
+	c := s.config()
+	c.consumers = 0
+	r, err := runBenchmark(c)
+	s.Nil(err)
+	s.Equal(40, r.Produced)
+	s.Equal(0, r.Consumed)
+	s.Equal(40, s.queueLength())
+
+	// consumers alone drain the queue and stop once it is empty
+	c = s.config()
+	c.producers = 0
+	r, err = runBenchmark(c)
+	s.Nil(err)
+	s.Equal(40, r.Consumed)
+	s.Equal(0, s.queueLength())
+}
+
+func (s *BenchSuite) TestDuration() {
+	c := s.config()
+	c.jobs = 0
+	c.duration = 50 * time.Millisecond
+	r, err := runBenchmark(c)
+	s.Nil(err)
+	s.True(r.Produced > 0)
+	s.Equal(r.Produced, r.Consumed)
+}
+
+func (s *BenchSuite) TestPushErrors() {
+	c := s.config()
+	c.producers = 1
+	c.consumers = 0
+	c.jobs = 5
+	// a failed push is retried once
+	s.server.FailNext("ADDJOB", "ERR rejected")
+	s.server.FailNext("ADDJOB", "ERR rejected")
+	r, err := runBenchmark(c)
+	s.Nil(err)
+	s.Equal(1, r.Errors)
+	s.Equal(4, r.Produced)
+}
+
+func (s *BenchSuite) TestInvalidConfig() {
+	c := s.config()
+	c.producers = 0
+	c.consumers = 0
+	_, err := runBenchmark(c)
+	s.NotNil(err)
+
+	c = s.config()
+	c.jobs = 0
+	_, err = runBenchmark(c)
+	s.NotNil(err)
+}
+
+func (s *BenchSuite) TestPayload() {
+	pushed := time.Unix(0, 1234567890123456789)
+	message := payload(pushed, "xxx")
+	s.Equal(timestampLength+3, len(message))
+	t, ok := pushTime(message)
+	s.True(ok)
+	s.True(pushed.Equal(t))
+
+	_, ok = pushTime("short")
+	s.False(ok)
+	_, ok = pushTime("not a timestamp at all")
+	s.False(ok)
+}
+
+func (s *BenchSuite) TestParseOptions() {
+	options, err := parseOptions("ttl=60, RETRY=30,ASYNC")
+	s.Nil(err)
+	s.Equal(map[string]string{"TTL": "60", "RETRY": "30", "ASYNC": "true"}, options)
+
+	options, err = parseOptions("")
+	s.Nil(err)
+	s.Equal(0, len(options))
+
+	_, err = parseOptions("=60")
+	s.NotNil(err)
+}
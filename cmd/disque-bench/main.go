@@ -0,0 +1,103 @@
+// Command disque-bench generates load on a Disque cluster through a connection
+// pool, and reports throughput and latency percentiles of producers and
+// consumers.
+//
+// Usage:
+//
+//     disque-bench [-servers host:port,...] [-fake nodes] [-producers n] [-consumers n]
+//                  [-jobs n] [-duration d] [-size bytes] [-options TTL=60,RETRY=30]
+//                  [-batch n] [-cycle n,...] [-json]
+//
+// The seed nodes default to the comma-separated list in the DISQUE_SERVERS
+// environment variable, or 127.0.0.1:7711. With -fake, the benchmark runs
+// against an in-process fake cluster of the given number of nodes instead.
+// Giving several values to -cycle runs the benchmark once per value, to
+// compare how often connections move to the node producing most jobs.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zencoder/disque-go/disquetest"
+)
+
+const defaultServers = "127.0.0.1:7711"
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout, os.Stderr); err != nil {
+		if err != flag.ErrHelp {
+			fmt.Fprintf(os.Stderr, "disque-bench: %s\n", err)
+		}
+		os.Exit(1)
+	}
+}
+
+// run parses the flags and runs the benchmark once per cycle
+func run(args []string, stdout io.Writer, stderr io.Writer) (err error) {
+	servers := os.Getenv("DISQUE_SERVERS")
+	if servers == "" {
+		servers = defaultServers
+	}
+
+	c := config{}
+	flags := flag.NewFlagSet("disque-bench", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&servers, "servers", servers, "Comma-separated list of seed nodes")
+	fake := flags.Int("fake", 0, "Number of nodes of an in-process fake cluster to run against instead of -servers")
+	flags.StringVar(&c.queue, "queue", "disque-bench", "Queue jobs are pushed to and fetched from")
+	flags.IntVar(&c.producers, "producers", 4, "Number of concurrent producers")
+	flags.IntVar(&c.consumers, "consumers", 4, "Number of concurrent consumers")
+	flags.IntVar(&c.capacity, "pool", 0, "Number of connections in the pool, one per producer and consumer if unset")
+	flags.IntVar(&c.jobs, "jobs", 10000, "Number of jobs pushed, unbounded if 0")
+	flags.DurationVar(&c.duration, "duration", 0, "Time after which producers stop, unbounded if 0")
+	flags.IntVar(&c.size, "size", 64, "Size of job bodies in bytes")
+	options := flags.String("options", "", "ADDJOB options, such as TTL=60,RETRY=30,ASYNC")
+	flags.DurationVar(&c.pushTimeout, "push-timeout", time.Second, "ADDJOB timeout")
+	flags.IntVar(&c.batch, "batch", 1, "Number of jobs fetched at once")
+	flags.DurationVar(&c.fetchTimeout, "fetch-timeout", 100*time.Millisecond, "Time to wait for jobs before a consumer considers the queue empty")
+	cycles := flags.String("cycle", "1000", "Comma-separated numbers of jobs fetched before switching to the node producing most of them, one run each")
+	asJSON := flags.Bool("json", false, "Print results as JSON")
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	if flags.NArg() > 0 {
+		flags.Usage()
+		return fmt.Errorf("Unexpected arguments: %s", strings.Join(flags.Args(), " "))
+	}
+
+	if c.options, err = parseOptions(*options); err != nil {
+		return
+	}
+	var cycleValues []int
+	for _, value := range strings.Split(*cycles, ",") {
+		var cycle int
+		if cycle, err = strconv.Atoi(strings.TrimSpace(value)); err != nil || cycle <= 0 {
+			return fmt.Errorf("Invalid cycle: %q", value)
+		}
+		cycleValues = append(cycleValues, cycle)
+	}
+
+	c.servers = strings.Split(servers, ",")
+	if *fake > 0 {
+		cluster := disquetest.NewCluster(*fake)
+		defer cluster.Close()
+		c.servers = cluster.Addrs()
+	}
+
+	results := make([]*result, 0, len(cycleValues))
+	for _, cycle := range cycleValues {
+		c.cycle = cycle
+		var r *result
+		if r, err = runBenchmark(c); err != nil {
+			return
+		}
+		results = append(results, r)
+	}
+	return printResults(stdout, results, *asJSON)
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+)
+
+type MainSuite struct {
+	suite.Suite
+	server *disquetest.Server
+}
+
+func TestMainSuite(t *testing.T) {
+	suite.Run(t, new(MainSuite))
+}
+
+func (s *MainSuite) SetupTest() {
+	s.server = disquetest.NewServer()
+}
+
+func (s *MainSuite) TearDownTest() {
+	s.server.Close()
+}
+
+func (s *MainSuite) SetupSuite() {
+}
+
+func (s *MainSuite) TestRun() {
+	stdout := &bytes.Buffer{}
+	err := run([]string{"-servers", s.server.Addr, "-jobs", "50", "-producers", "2", "-consumers", "2", "-batch", "5"}, stdout, &bytes.Buffer{})
+	s.Nil(err)
+	lines := strings.Split(strings.TrimSpace(stdout.String()), "\n")
+	s.Equal(4, len(lines))
+	s.Contains(lines[0], "P99")
+	s.Contains(lines[1], "push")
+	s.Contains(lines[3], "end-to-end")
+}
+
+func (s *MainSuite) TestFakeCluster() {
+	stdout := &bytes.Buffer{}
+	err := run([]string{"-fake", "3", "-jobs", "20", "-cycle", "1,100", "-json"}, stdout, &bytes.Buffer{})
+	s.Nil(err)
+
+	var results []*result
+	s.Nil(json.Unmarshal(stdout.Bytes(), &results))
+	s.Equal(2, len(results))
+	s.Equal(1, results[0].Cycle)
+	s.Equal(100, results[1].Cycle)
+	for _, r := range results {
+		s.Equal(20, r.Produced)
+		s.Equal(20, r.Consumed)
+		s.Equal(20, r.Push.Count)
+	}
+}
+
+func (s *MainSuite) TestInvalidFlags() {
+	err := run([]string{"-servers", s.server.Addr, "-cycle", "1,x"}, &bytes.Buffer{}, &bytes.Buffer{})
+	s.Equal(`Invalid cycle: "x"`, err.Error())
+
+	err = run([]string{"-servers", s.server.Addr, "-options", "TTL=60,,"}, &bytes.Buffer{}, &bytes.Buffer{})
+	s.NotNil(err)
+
+	err = run([]string{"-servers", s.server.Addr, "extra"}, &bytes.Buffer{}, &bytes.Buffer{})
+	s.Equal("Unexpected arguments: extra", err.Error())
+}
+
+func (s *MainSuite) TestUnreachableCluster() {
+	addr := s.server.Addr
+	s.server.Close()
+	err := run([]string{"-servers", addr, "-jobs", "1"}, &bytes.Buffer{}, &bytes.Buffer{})
+	s.NotNil(err)
+}
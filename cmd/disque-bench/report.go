@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// latencies summarizes a set of latency samples
+type latencies struct {
+	Count int           `json:"count"`
+	Mean  time.Duration `json:"mean"`
+	P50   time.Duration `json:"p50"`
+	P90   time.Duration `json:"p90"`
+	P99   time.Duration `json:"p99"`
+	Max   time.Duration `json:"max"`
+}
+
+type durations []time.Duration
+
+func (d durations) Len() int           { return len(d) }
+func (d durations) Less(i, j int) bool { return d[i] < d[j] }
+func (d durations) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+// summarize computes the mean and percentiles of samples, which it sorts
+func summarize(samples []time.Duration) *latencies {
+	l := &latencies{Count: len(samples)}
+	if len(samples) == 0 {
+		return l
+	}
+	sort.Sort(durations(samples))
+
+	var total time.Duration
+	for _, sample := range samples {
+		total += sample
+	}
+	l.Mean = total / time.Duration(len(samples))
+	l.P50 = percentile(samples, 50)
+	l.P90 = percentile(samples, 90)
+	l.P99 = percentile(samples, 99)
+	l.Max = samples[len(samples)-1]
+	return l
+}
+
+// percentile returns the nearest-rank percentile of sorted samples
+func percentile(sorted []time.Duration, p int) time.Duration {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// printResults writes the results of the runs as a table, or as JSON
+func printResults(w io.Writer, results []*result, asJSON bool) error {
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		return encoder.Encode(results)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "CYCLE\tOPERATION\tJOBS\tJOBS/S\tMEAN\tP50\tP90\tP99\tMAX\tERRORS")
+	for _, r := range results {
+		rows := []struct {
+			name    string
+			jobs    int
+			latency *latencies
+		}{
+			{"push", r.Produced, r.Push},
+			{"fetch", r.Consumed, r.Fetch},
+			{"end-to-end", r.Consumed, r.EndToEnd},
+		}
+		for i, row := range rows {
+			errors := ""
+			if i == 0 {
+				errors = fmt.Sprint(r.Errors)
+			}
+			l := row.latency
+			fmt.Fprintf(tw, "%d\t%s\t%d\t%.0f\t%s\t%s\t%s\t%s\t%s\t%s\n",
+				r.Cycle, row.name, row.jobs, rate(row.jobs, r.Elapsed),
+				display(l, l.Mean), display(l, l.P50), display(l, l.P90), display(l, l.P99), display(l, l.Max), errors)
+		}
+	}
+	return tw.Flush()
+}
+
+// rate returns the number of jobs per second
+func rate(jobs int, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(jobs) / elapsed.Seconds()
+}
+
+// display formats a latency truncated to microseconds, or a dash without samples
+func display(l *latencies, d time.Duration) string {
+	if l.Count == 0 {
+		return "-"
+	}
+	return (d - d%time.Microsecond).String()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type ReportSuite struct {
+	suite.Suite
+}
+
+func TestReportSuite(t *testing.T) {
+	suite.Run(t, new(ReportSuite))
+}
+
+func (s *ReportSuite) SetupTest() {
+}
+
+func (s *ReportSuite) SetupSuite() {
+}
+
+func (s *ReportSuite) TestSummarize() {
+	samples := make([]time.Duration, 0, 100)
+	for i := 100; i > 0; i-- {
+		samples = append(samples, time.Duration(i)*time.Millisecond)
+	}
+	l := summarize(samples)
+	s.Equal(100, l.Count)
+	s.Equal(50500*time.Microsecond, l.Mean)
+	s.Equal(50*time.Millisecond, l.P50)
+	s.Equal(90*time.Millisecond, l.P90)
+	s.Equal(99*time.Millisecond, l.P99)
+	s.Equal(100*time.Millisecond, l.Max)
+
+	l = summarize([]time.Duration{time.Second})
+	s.Equal(time.Second, l.P50)
+	s.Equal(time.Second, l.P99)
+
+	l = summarize(nil)
+	s.Equal(0, l.Count)
+	s.Equal(time.Duration(0), l.Max)
+}
+
+func (s *ReportSuite) TestPrintResults() {
+	r := &result{
+		Cycle:    10,
+		Produced: 100,
+		Consumed: 100,
+		Errors:   2,
+		Elapsed:  2 * time.Second,
+		Push:     summarize([]time.Duration{1500 * time.Nanosecond}),
+		Fetch:    summarize(nil),
+		EndToEnd: summarize(nil),
+	}
+	buf := &bytes.Buffer{}
+	s.Nil(printResults(buf, []*result{r}, false))
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	s.Equal(4, len(lines))
+	s.Equal([]string{"10", "push", "100", "50", "1µs", "1µs", "1µs", "1µs", "1µs", "2"}, strings.Fields(lines[1]))
+	s.Equal([]string{"10", "fetch", "100", "50", "-", "-", "-", "-", "-"}, strings.Fields(lines[2]))
+
+	buf.Reset()
+	s.Nil(printResults(buf, []*result{r}, true))
+	s.Contains(buf.String(), `"produced":100`)
+}
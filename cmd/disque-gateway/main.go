@@ -0,0 +1,50 @@
+// Command disque-gateway serves queue operations of a Disque cluster as a
+// JSON over HTTP API. See the httpgateway package for the endpoints.
+//
+// The bearer token required from clients is read from the
+// DISQUE_GATEWAY_TOKEN environment variable, authentication being disabled
+// if it is unset.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/zencoder/disque-go/disque"
+	"github.com/zencoder/disque-go/httpgateway"
+)
+
+func main() {
+	servers := os.Getenv("DISQUE_SERVERS")
+	if servers == "" {
+		servers = "127.0.0.1:7711"
+	}
+
+	listen := flag.String("listen", ":8080", "Address to listen on")
+	flag.StringVar(&servers, "servers", servers, "Comma-separated list of seed nodes")
+	capacity := flag.Int("pool", 20, "Number of connections to the cluster, which bounds the number of concurrent fetches")
+	maxBodyBytes := flag.Int64("max-body", httpgateway.DefaultMaxBodyBytes, "Size in bytes beyond which request bodies are refused")
+	maxPollTimeout := flag.Duration("max-poll", httpgateway.DefaultMaxPollTimeout, "Longest time a fetch waits for jobs")
+	maxFetchCount := flag.Int("max-count", httpgateway.DefaultMaxFetchCount, "Largest number of jobs returned by a fetch")
+	maxPushTimeout := flag.Duration("max-push", httpgateway.DefaultMaxPushTimeout, "Longest time a push waits for the job to be replicated")
+	flag.Parse()
+
+	pool := disque.NewPool(strings.Split(servers, ","), 1000, *capacity, *capacity, time.Hour)
+	defer pool.Close()
+
+	gateway := httpgateway.New(pool, httpgateway.Options{
+		Token:          os.Getenv("DISQUE_GATEWAY_TOKEN"),
+		MaxBodyBytes:   *maxBodyBytes,
+		MaxPollTimeout: *maxPollTimeout,
+		MaxFetchCount:  *maxFetchCount,
+		MaxPushTimeout: *maxPushTimeout,
+	})
+	log.Printf("Serving Disque cluster %s on %s", servers, *listen)
+	if err := http.ListenAndServe(*listen, gateway); err != nil {
+		log.Fatalf("Error while serving requests, exception: %s", err)
+	}
+}
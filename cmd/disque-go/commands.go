@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zencoder/disque-go/disque"
+)
+
+var commands map[string]*command
+
+func init() {
+	commands = map[string]*command{
+		"push":  {"[flags] <queue> [job]", "Push a job given as argument, or read from stdin", cmdPush},
+		"fetch": {"[flags] <queue>", "Fetch jobs from a queue", cmdFetch},
+		"ack":   {"<job-id>...", "Acknowledge jobs", cmdAck},
+		"nack":  {"<job-id>...", "Put jobs back in their queue", cmdNack},
+		"show":  {"<job-id>", "Show the details of a job as JSON", cmdShow},
+		"qlen":  {"<queue>", "Show the number of jobs in a queue", cmdQueueLength},
+		"qstat": {"<queue>", "Show the state of a queue", cmdQueueStats},
+		"qpeek": {"[flags] <queue>", "Show jobs in a queue without dequeuing them", cmdQueuePeek},
+		"jscan": {"[flags]", "List jobs, optionally filtered by queue and state", cmdJobScan},
+		"nodes": {"", "List the nodes of the cluster", cmdNodes},
+		"pause": {"[flags] <queue>", "Show or change the pause state of a queue", cmdPause},
+	}
+}
+
+func cmdPush(c *cli, args []string) (err error) {
+	flags := c.flagSet("push")
+	timeout := flags.Duration("timeout", time.Second, "Time to wait for the job to be replicated")
+	delay := flags.Duration("delay", 0, "Time before the job is queued")
+	retry := flags.Duration("retry", 0, "Time before the job is queued again if not acknowledged")
+	ttl := flags.Duration("ttl", 0, "Time to live of the job")
+	replicate := flags.Int("replicate", 0, "Number of nodes the job is replicated to")
+	maxlen := flags.Int("maxlen", 0, "Refuse the job if the queue holds this many jobs")
+	async := flags.Bool("async", false, "Replicate the job asynchronously")
+	lines := flags.Bool("lines", false, "Push every line read from stdin as a separate job")
+	if err = c.parse(flags, args, 1, 2); err != nil {
+		return
+	}
+
+	options := make(map[string]string)
+	for option, value := range map[string]time.Duration{"DELAY": *delay, "RETRY": *retry, "TTL": *ttl} {
+		if value > 0 {
+			var seconds int64
+			if seconds, err = durationSeconds(option, value); err != nil {
+				return
+			}
+			options[option] = strconv.FormatInt(seconds, 10)
+		}
+	}
+	for option, value := range map[string]int{"REPLICATE": *replicate, "MAXLEN": *maxlen} {
+		if value > 0 {
+			options[option] = strconv.Itoa(value)
+		}
+	}
+	if *async {
+		options["ASYNC"] = "true"
+	}
+
+	var jobs []string
+	if flags.NArg() == 2 && flags.Arg(1) != "-" {
+		jobs = []string{flags.Arg(1)}
+	} else if *lines {
+		scanner := bufio.NewScanner(c.in)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				jobs = append(jobs, line)
+			}
+		}
+		if err = scanner.Err(); err != nil {
+			return
+		}
+	} else {
+		var job []byte
+		if job, err = ioutil.ReadAll(c.in); err != nil {
+			return
+		}
+		jobs = []string{strings.TrimSuffix(string(job), "\n")}
+	}
+
+	jobIDs := make([]string, 0, len(jobs))
+	rows := make([][]string, 0, len(jobs))
+	for _, job := range jobs {
+		var jobID string
+		if jobID, err = c.d.PushWithOptions(flags.Arg(0), job, *timeout, options); err != nil {
+			break
+		}
+		jobIDs = append(jobIDs, jobID)
+		rows = append(rows, []string{jobID})
+	}
+	if printErr := c.out.table(nil, rows, jobIDs); err == nil {
+		err = printErr
+	}
+	return
+}
+
+// durationSeconds converts the value of a duration flag to the seconds
+// expected by ADDJOB, rounding up. Values under a second are rejected rather
+// than truncated to zero, which for RETRY would make the job at-most-once.
+func durationSeconds(option string, value time.Duration) (seconds int64, err error) {
+	if value < time.Second {
+		return 0, fmt.Errorf("Invalid -%s: %s is less than a second", strings.ToLower(option), value)
+	}
+	return int64((value + time.Second - 1) / time.Second), nil
+}
+
+func cmdFetch(c *cli, args []string) (err error) {
+	flags := c.flagSet("fetch")
+	count := flags.Int("count", 1, "Number of jobs to fetch")
+	timeout := flags.Duration("timeout", time.Second, "Time to wait for jobs")
+	ack := flags.Bool("ack", false, "Acknowledge the jobs once fetched")
+	if err = c.parse(flags, args, 1, 1); err != nil {
+		return
+	}
+
+	var jobs []*disque.Job
+	if jobs, err = c.d.FetchMultiple(flags.Arg(0), *count, *timeout); err != nil {
+		return
+	}
+	if *ack {
+		for _, job := range jobs {
+			if err = c.d.Ack(job.JobID); err != nil {
+				return
+			}
+		}
+	}
+	return c.printJobs(jobs, true)
+}
+
+func cmdAck(c *cli, args []string) (err error) {
+	flags := c.flagSet("ack")
+	if err = c.parse(flags, args, 1, -1); err != nil {
+		return
+	}
+	for _, jobID := range flags.Args() {
+		if err = c.d.Ack(jobID); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func cmdNack(c *cli, args []string) (err error) {
+	flags := c.flagSet("nack")
+	if err = c.parse(flags, args, 1, -1); err != nil {
+		return
+	}
+	for _, jobID := range flags.Args() {
+		if err = c.d.Nack(jobID); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func cmdShow(c *cli, args []string) (err error) {
+	flags := c.flagSet("show")
+	if err = c.parse(flags, args, 1, 1); err != nil {
+		return
+	}
+	var details *disque.JobDetails
+	if details, err = c.d.GetJobDetails(flags.Arg(0)); err == nil {
+		err = c.out.json(newJobJSON(details))
+	}
+	return
+}
+
+func cmdQueueLength(c *cli, args []string) (err error) {
+	flags := c.flagSet("qlen")
+	if err = c.parse(flags, args, 1, 1); err != nil {
+		return
+	}
+	var queueLength int
+	if queueLength, err = c.d.QueueLength(flags.Arg(0)); err == nil {
+		err = c.out.value(strconv.Itoa(queueLength), queueLength)
+	}
+	return
+}
+
+func cmdQueueStats(c *cli, args []string) (err error) {
+	flags := c.flagSet("qstat")
+	if err = c.parse(flags, args, 1, 1); err != nil {
+		return
+	}
+	var stats *disque.QueueStats
+	if stats, err = c.d.QueueStats(flags.Arg(0)); err != nil {
+		return
+	}
+	rows := [][]string{
+		{"name", stats.Name},
+		{"len", strconv.FormatInt(stats.Length, 10)},
+		{"age", stats.Age.String()},
+		{"idle", stats.Idle.String()},
+		{"blocked", strconv.FormatInt(stats.Blocked, 10)},
+		{"import-from", strings.Join(stats.ImportFrom, ",")},
+		{"import-rate", strconv.FormatInt(stats.ImportRate, 10)},
+		{"jobs-in", strconv.FormatInt(stats.JobsIn, 10)},
+		{"jobs-out", strconv.FormatInt(stats.JobsOut, 10)},
+		{"pause", string(stats.Pause)},
+	}
+	extra := make([]string, 0, len(stats.Extra))
+	for field := range stats.Extra {
+		extra = append(extra, field)
+	}
+	sort.Strings(extra)
+	for _, field := range extra {
+		rows = append(rows, []string{field, fmt.Sprint(stats.Extra[field])})
+	}
+	return c.out.table([]string{"FIELD", "VALUE"}, rows, stats)
+}
+
+func cmdQueuePeek(c *cli, args []string) (err error) {
+	flags := c.flagSet("qpeek")
+	count := flags.Int("count", 10, "Number of jobs to show, the newest first if negative")
+	if err = c.parse(flags, args, 1, 1); err != nil {
+		return
+	}
+	var jobs []*disque.Job
+	if jobs, err = c.d.Peek(flags.Arg(0), *count); err == nil {
+		err = c.printJobs(jobs, false)
+	}
+	return
+}
+
+func cmdJobScan(c *cli, args []string) (err error) {
+	flags := c.flagSet("jscan")
+	queue := flags.String("queue", "", "Only list jobs in this queue")
+	states := flags.String("state", "", "Only list jobs in these comma-separated states: wait-repl, active, queued or acked")
+	count := flags.Int("count", 0, "Number of jobs returned by each JSCAN, a hint for the server")
+	busyLoop := flags.Bool("busyloop", false, "Block the server until the scan is complete")
+	details := flags.Bool("details", false, "Show the details of every job")
+	if err = c.parse(flags, args, 0, 0); err != nil {
+		return
+	}
+
+	options := disque.ScanOptions{Queue: *queue, Count: *count, BusyLoop: *busyLoop}
+	if *states != "" {
+		options.States = strings.Split(*states, ",")
+	}
+	if !*details {
+		var jobIDs []string
+		if jobIDs, err = c.d.ScanAll(options); err != nil {
+			return
+		}
+		rows := make([][]string, 0, len(jobIDs))
+		for _, jobID := range jobIDs {
+			rows = append(rows, []string{jobID})
+		}
+		return c.out.table(nil, rows, jobIDs)
+	}
+
+	jobs := make([]*disque.JobDetails, 0)
+	for cursor := "0"; ; {
+		var page []*disque.JobDetails
+		if cursor, page, err = c.d.ScanDetails(cursor, options); err != nil {
+			return
+		}
+		jobs = append(jobs, page...)
+		if cursor == "0" {
+			break
+		}
+	}
+	rows := make([][]string, 0, len(jobs))
+	values := make([]*jobJSON, 0, len(jobs))
+	for _, job := range jobs {
+		values = append(values, newJobJSON(job))
+		rows = append(rows, []string{
+			job.JobID,
+			job.QueueName,
+			job.State,
+			strconv.FormatInt(job.Nacks, 10),
+			strconv.FormatInt(job.AdditionalDeliveries, 10),
+			job.CreatedAt.Format(time.RFC3339),
+		})
+	}
+	return c.out.table([]string{"ID", "QUEUE", "STATE", "NACKS", "ADDITIONAL-DELIVERIES", "CREATED-AT"}, rows, values)
+}
+
+func cmdNodes(c *cli, args []string) (err error) {
+	flags := c.flagSet("nodes")
+	if err = c.parse(flags, args, 0, 0); err != nil {
+		return
+	}
+	nodes := c.d.Nodes()
+	prefixes := make([]string, 0, len(nodes))
+	for prefix := range nodes {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	rows := make([][]string, 0, len(nodes))
+	for _, prefix := range prefixes {
+		rows = append(rows, []string{prefix, nodes[prefix]})
+	}
+	return c.out.table([]string{"PREFIX", "ADDRESS"}, rows, nodes)
+}
+
+func cmdPause(c *cli, args []string) (err error) {
+	flags := c.flagSet("pause")
+	mode := flags.String("mode", "", "Pause state to apply: none, in, out or all; the current state is shown if unset")
+	broadcast := flags.Bool("broadcast", false, "Apply the pause state to every node in the cluster")
+	if err = c.parse(flags, args, 1, 1); err != nil {
+		return
+	}
+	var state disque.PauseMode
+	if *mode == "" {
+		state, err = c.d.QueuePauseState(flags.Arg(0))
+	} else {
+		state, err = c.d.PauseQueue(flags.Arg(0), disque.PauseOptions{Mode: disque.PauseMode(*mode), Broadcast: *broadcast})
+	}
+	if err == nil {
+		err = c.out.value(string(state), state)
+	}
+	return
+}
+
+// printJobs prints fetched or peeked jobs, along with their counters when fetched
+func (c *cli) printJobs(jobs []*disque.Job, counters bool) error {
+	header := []string{"QUEUE", "ID", "MESSAGE"}
+	if counters {
+		header = []string{"QUEUE", "ID", "NACKS", "ADDITIONAL-DELIVERIES", "MESSAGE"}
+	}
+	rows := make([][]string, 0, len(jobs))
+	for _, job := range jobs {
+		if counters {
+			rows = append(rows, []string{
+				job.QueueName,
+				job.JobID,
+				strconv.FormatInt(job.Nacks, 10),
+				strconv.FormatInt(job.AdditionalDeliveries, 10),
+				job.Message,
+			})
+		} else {
+			rows = append(rows, []string{job.QueueName, job.JobID, job.Message})
+		}
+	}
+	return c.out.table(header, rows, jobs)
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disque"
+	"github.com/zencoder/disque-go/disquetest"
+)
+
+type CommandsSuite struct {
+	suite.Suite
+	server *disquetest.Server
+}
+
+func TestCommandsSuite(t *testing.T) {
+	suite.Run(t, new(CommandsSuite))
+}
+
+func (s *CommandsSuite) SetupTest() {
+	s.server = disquetest.NewServer()
+}
+
+func (s *CommandsSuite) TearDownTest() {
+	s.server.Close()
+}
+
+func (s *CommandsSuite) SetupSuite() {
+}
+
+// run runs the tool against the test server, returning its output
+func (s *CommandsSuite) run(stdin string, args ...string) (output string, err error) {
+	out := &bytes.Buffer{}
+	args = append([]string{"-servers", s.server.Addr}, args...)
+	err = run(args, strings.NewReader(stdin), out, &bytes.Buffer{})
+	return out.String(), err
+}
+
+func (s *CommandsSuite) push(queueName string, jobs ...string) (jobIDs []string) {
+	output, err := s.run(strings.Join(jobs, "\n"), "push", "-lines", queueName)
+	s.Nil(err)
+	return strings.Fields(output)
+}
+
+func (s *CommandsSuite) TestPush() {
+	output, err := s.run("", "push", "-ttl", "1h", "-retry", "30s", "-replicate", "1", "queueCli", "job1")
+	s.Nil(err)
+	jobID := strings.TrimSpace(output)
+	s.NotEmpty(jobID)
+
+	output, err = s.run("", "-format", "json", "show", jobID)
+	s.Nil(err)
+	details := &jobJSON{}
+	s.Nil(json.Unmarshal([]byte(output), details))
+	s.Equal("job1", details.Message)
+	s.Equal("queueCli", details.QueueName)
+	// durations are given in seconds, as to the flags
+	s.Equal(float64(3600), details.TTL)
+	s.Equal(float64(30), details.Retry)
+}
+
+func (s *CommandsSuite) TestPushDurations() {
+	_, err := s.run("", "push", "-retry", "500ms", "queueCli", "job1")
+	s.Equal("Invalid -retry: 500ms is less than a second", err.Error())
+	output, err := s.run("", "qlen", "queueCli")
+	s.Nil(err)
+	s.Equal("0\n", output)
+
+	// durations are rounded up to whole seconds
+	output, err = s.run("", "push", "-ttl", "90.5s", "-delay", "1500ms", "queueCli", "job2")
+	s.Nil(err)
+	output, err = s.run("", "-format", "json", "show", strings.TrimSpace(output))
+	s.Nil(err)
+	details := &jobJSON{}
+	s.Nil(json.Unmarshal([]byte(output), details))
+	s.Equal(float64(91), details.TTL)
+	s.Equal(float64(2), details.Delay)
+}
+
+func (s *CommandsSuite) TestPushFromStdin() {
+	output, err := s.run("line one\nline two\n", "push", "queueCli")
+	s.Nil(err)
+	s.Equal(1, len(strings.Fields(output)))
+
+	jobIDs := s.push("queueCli", "job2", "job3")
+	s.Equal(2, len(jobIDs))
+
+	output, err = s.run("", "qlen", "queueCli")
+	s.Nil(err)
+	s.Equal("3\n", output)
+
+	output, err = s.run("", "-format", "json", "fetch", "-count", "3", "-ack", "queueCli")
+	s.Nil(err)
+	var jobs []*disque.Job
+	s.Nil(json.Unmarshal([]byte(output), &jobs))
+	s.Equal(3, len(jobs))
+	s.Equal("line one\nline two", jobs[0].Message)
+	s.Equal("job3", jobs[2].Message)
+}
+
+func (s *CommandsSuite) TestFetchAckAndNack() {
+	jobIDs := s.push("queueCli", "job1", "job2")
+
+	output, err := s.run("", "fetch", "-count", "2", "queueCli")
+	s.Nil(err)
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	s.Equal(3, len(lines))
+	s.Equal([]string{"QUEUE", "ID", "NACKS", "ADDITIONAL-DELIVERIES", "MESSAGE"}, strings.Fields(lines[0]))
+	s.Equal([]string{"queueCli", jobIDs[0], "0", "0", "job1"}, strings.Fields(lines[1]))
+
+	_, err = s.run("", "nack", jobIDs[0])
+	s.Nil(err)
+	_, err = s.run("", "ack", jobIDs[1])
+	s.Nil(err)
+
+	output, err = s.run("", "qlen", "queueCli")
+	s.Nil(err)
+	s.Equal("1\n", output)
+
+	_, err = s.run("", "ack", "not-a-job-id")
+	s.NotNil(err)
+}
+
+func (s *CommandsSuite) TestQueuePeek() {
+	jobIDs := s.push("queueCli", "job1", "job2", "job3")
+
+	output, err := s.run("", "qpeek", "-count", "-2", "queueCli")
+	s.Nil(err)
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	s.Equal(3, len(lines))
+	s.Equal([]string{"queueCli", jobIDs[2], "job3"}, strings.Fields(lines[1]))
+	s.Equal([]string{"queueCli", jobIDs[1], "job2"}, strings.Fields(lines[2]))
+
+	// peeking leaves the jobs queued
+	output, err = s.run("", "qlen", "queueCli")
+	s.Nil(err)
+	s.Equal("3\n", output)
+}
+
+func (s *CommandsSuite) TestQueueStats() {
+	s.push("queueCli", "job1", "job2")
+
+	output, err := s.run("", "qstat", "queueCli")
+	s.Nil(err)
+	s.Contains(output, "FIELD")
+	s.Contains(output, "jobs-in")
+
+	output, err = s.run("", "-format", "json", "qstat", "queueCli")
+	s.Nil(err)
+	stats := &disque.QueueStats{}
+	s.Nil(json.Unmarshal([]byte(output), stats))
+	s.Equal(int64(2), stats.Length)
+}
+
+func (s *CommandsSuite) TestJobScan() {
+	jobIDs := s.push("queueCli", "job1", "job2")
+	s.push("otherQueueCli", "job3")
+
+	output, err := s.run("", "jscan", "-queue", "queueCli", "-state", "queued,active")
+	s.Nil(err)
+	scanned := strings.Fields(output)
+	s.Equal(2, len(scanned))
+	s.Contains(scanned, jobIDs[0])
+	s.Contains(scanned, jobIDs[1])
+
+	output, err = s.run("", "-format", "json", "jscan", "-details", "-queue", "otherQueueCli")
+	s.Nil(err)
+	var details []*jobJSON
+	s.Nil(json.Unmarshal([]byte(output), &details))
+	s.Equal(1, len(details))
+	s.Equal("job3", details[0].Message)
+
+	output, err = s.run("", "jscan", "-details")
+	s.Nil(err)
+	s.Equal(4, len(strings.Split(strings.TrimSpace(output), "\n")))
+}
+
+func (s *CommandsSuite) TestNodes() {
+	output, err := s.run("", "nodes")
+	s.Nil(err)
+	s.Equal([]string{"PREFIX", "ADDRESS", s.server.Prefix(), s.server.Addr}, strings.Fields(output))
+
+	output, err = s.run("", "-format", "json", "nodes")
+	s.Nil(err)
+	nodes := make(map[string]string)
+	s.Nil(json.Unmarshal([]byte(output), &nodes))
+	s.Equal(map[string]string{s.server.Prefix(): s.server.Addr}, nodes)
+}
+
+func (s *CommandsSuite) TestPause() {
+	output, err := s.run("", "pause", "queueCli")
+	s.Nil(err)
+	s.Equal("none\n", output)
+
+	output, err = s.run("", "pause", "-mode", "in", "queueCli")
+	s.Nil(err)
+	s.Equal("in\n", output)
+
+	_, err = s.run("", "push", "queueCli", "job1")
+	s.Equal(disque.ErrQueuePaused, err)
+
+	output, err = s.run("", "-format", "json", "pause", "-mode", "none", "queueCli")
+	s.Nil(err)
+	s.Equal("\"none\"\n", output)
+}
@@ -0,0 +1,123 @@
+// Command disque-go performs operations on Disque queues from the command line.
+//
+// Usage:
+//
+//     disque-go [-servers host:port,...] [-format table|json] <command> [arguments]
+//
+// Run disque-go -h for the list of commands, and disque-go <command> -h for
+// the arguments of a command. The seed nodes default to the comma-separated
+// list in the DISQUE_SERVERS environment variable, or 127.0.0.1:7711.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/zencoder/disque-go/disque"
+)
+
+const defaultServers = "127.0.0.1:7711"
+
+// command is a subcommand of the tool
+type command struct {
+	// usage describes the arguments of the command
+	usage       string
+	description string
+	run         func(c *cli, args []string) error
+}
+
+// cli holds the state shared by the subcommands
+type cli struct {
+	// d is connected once the arguments of the subcommand were parsed
+	d   *disque.Disque
+	in  io.Reader
+	out *printer
+	// errOut receives usage messages
+	errOut io.Writer
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr); err != nil && err != flag.ErrHelp {
+		fmt.Fprintf(os.Stderr, "disque-go: %s\n", err)
+		os.Exit(1)
+	}
+}
+
+// run parses the global flags and runs the requested command
+func run(args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) (err error) {
+	servers := os.Getenv("DISQUE_SERVERS")
+	if servers == "" {
+		servers = defaultServers
+	}
+
+	flags := flag.NewFlagSet("disque-go", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&servers, "servers", servers, "Comma-separated list of seed nodes")
+	format := flags.String("format", formatTable, "Output format, table or json")
+	cycle := flags.Int("cycle", 1000, "Number of jobs fetched before switching to the node producing most of them")
+	flags.Usage = func() {
+		fmt.Fprintf(stderr, "Usage: disque-go [flags] <command> [arguments]\n\nFlags:\n")
+		flags.PrintDefaults()
+		fmt.Fprintf(stderr, "\nCommands:\n")
+		names := make([]string, 0, len(commands))
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(stderr, "  %-7s %s\n", name, commands[name].description)
+		}
+	}
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("No command given")
+	}
+
+	name := flags.Arg(0)
+	cmd, ok := commands[name]
+	if !ok {
+		return fmt.Errorf("Unknown command: %s", name)
+	}
+	var out *printer
+	if out, err = newPrinter(*format, stdout); err != nil {
+		return
+	}
+
+	d := disque.NewDisque(strings.Split(servers, ","), *cycle)
+	defer d.Close()
+
+	return cmd.run(&cli{d: d, in: stdin, out: out, errOut: stderr}, flags.Args()[1:])
+}
+
+// flagSet creates the flag set of a subcommand
+func (c *cli) flagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(c.errOut)
+	flags.Usage = func() {
+		fmt.Fprintf(c.errOut, "Usage: disque-go %s %s\n\n%s\n", name, commands[name].usage, commands[name].description)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+// parse parses the flags of a subcommand, checking the number of positional
+// arguments is between min and max, max being unbounded if negative, then
+// connects to the cluster
+func (c *cli) parse(flags *flag.FlagSet, args []string, min int, max int) (err error) {
+	if err = flags.Parse(args); err != nil {
+		return
+	}
+	if flags.NArg() < min || (max >= 0 && flags.NArg() > max) {
+		flags.Usage()
+		return fmt.Errorf("Wrong number of arguments for %s", flags.Name())
+	}
+	return c.d.Initialize()
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+)
+
+type MainSuite struct {
+	suite.Suite
+	server *disquetest.Server
+}
+
+func TestMainSuite(t *testing.T) {
+	suite.Run(t, new(MainSuite))
+}
+
+func (s *MainSuite) SetupTest() {
+	s.server = disquetest.NewServer()
+}
+
+func (s *MainSuite) TearDownTest() {
+	s.server.Close()
+}
+
+func (s *MainSuite) SetupSuite() {
+}
+
+func (s *MainSuite) TestNoCommand() {
+	stderr := &bytes.Buffer{}
+	err := run([]string{"-servers", s.server.Addr}, strings.NewReader(""), &bytes.Buffer{}, stderr)
+	s.NotNil(err)
+	s.Contains(stderr.String(), "qstat")
+}
+
+func (s *MainSuite) TestUnknownCommand() {
+	err := run([]string{"-servers", s.server.Addr, "frobnicate"}, strings.NewReader(""), &bytes.Buffer{}, &bytes.Buffer{})
+	s.Equal("Unknown command: frobnicate", err.Error())
+}
+
+func (s *MainSuite) TestUnknownFormat() {
+	err := run([]string{"-servers", s.server.Addr, "-format", "xml", "nodes"}, strings.NewReader(""), &bytes.Buffer{}, &bytes.Buffer{})
+	s.Equal("Unknown output format: xml", err.Error())
+}
+
+func (s *MainSuite) TestUnreachableCluster() {
+	addr := s.server.Addr
+	s.server.Close()
+	err := run([]string{"-servers", addr, "nodes"}, strings.NewReader(""), &bytes.Buffer{}, &bytes.Buffer{})
+	s.NotNil(err)
+}
+
+func (s *MainSuite) TestHelpWhileUnreachable() {
+	addr := s.server.Addr
+	s.server.Close()
+	stderr := &bytes.Buffer{}
+	err := run([]string{"-servers", addr, "push", "-h"}, strings.NewReader(""), &bytes.Buffer{}, stderr)
+	s.Equal(flag.ErrHelp, err)
+	s.Contains(stderr.String(), "Usage: disque-go push")
+}
+
+func (s *MainSuite) TestWrongNumberOfArguments() {
+	stderr := &bytes.Buffer{}
+	err := run([]string{"-servers", s.server.Addr, "qlen"}, strings.NewReader(""), &bytes.Buffer{}, stderr)
+	s.Equal("Wrong number of arguments for qlen", err.Error())
+	s.Contains(stderr.String(), "Usage: disque-go qlen <queue>")
+}
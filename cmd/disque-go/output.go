@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/zencoder/disque-go/disque"
+)
+
+// Output formats
+const (
+	formatTable = "table"
+	formatJSON  = "json"
+)
+
+// printer writes the results of commands in the requested format
+type printer struct {
+	format string
+	w      io.Writer
+}
+
+func newPrinter(format string, w io.Writer) (p *printer, err error) {
+	if format != formatTable && format != formatJSON {
+		return nil, fmt.Errorf("Unknown output format: %s", format)
+	}
+	return &printer{format: format, w: w}, nil
+}
+
+// table prints rows under a header, or value as JSON. Without a header, rows
+// are printed on their own, which suits lists of job IDs.
+func (p *printer) table(header []string, rows [][]string, value interface{}) (err error) {
+	if p.format == formatJSON {
+		return p.json(value)
+	}
+	tw := tabwriter.NewWriter(p.w, 0, 8, 2, ' ', 0)
+	if header != nil {
+		fmt.Fprintln(tw, strings.Join(header, "\t"))
+	}
+	for _, row := range rows {
+		cells := make([]string, len(row))
+		for i, c := range row {
+			cells[i] = cell(c)
+		}
+		fmt.Fprintln(tw, strings.Join(cells, "\t"))
+	}
+	return tw.Flush()
+}
+
+// value prints text on its own line, or value as JSON
+func (p *printer) value(text string, value interface{}) (err error) {
+	if p.format == formatJSON {
+		return p.json(value)
+	}
+	_, err = fmt.Fprintln(p.w, text)
+	return
+}
+
+// json prints value as indented JSON, whatever the format
+func (p *printer) json(value interface{}) (err error) {
+	var b []byte
+	if b, err = json.MarshalIndent(value, "", "  "); err == nil {
+		_, err = fmt.Fprintf(p.w, "%s\n", b)
+	}
+	return
+}
+
+// cell quotes values that would break the layout of a table
+func cell(value string) string {
+	if strings.ContainsAny(value, "\t\r\n") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// jobJSON is the JSON form of the details of a job, with durations in
+// seconds as given to the flags of the commands
+type jobJSON struct {
+	JobID                string
+	QueueName            string
+	State                string
+	ReplicationFactor    int
+	TTL                  float64
+	CreatedAt            time.Time
+	Delay                float64
+	Retry                float64
+	Nacks                int64
+	AdditionalDeliveries int64
+	NodesDelivered       []string
+	NodesConfirmed       []string
+	NextRequeueWithin    float64
+	NextAwakeWithin      float64
+	Message              string
+	Extra                map[string]interface{} `json:",omitempty"`
+}
+
+func newJobJSON(details *disque.JobDetails) *jobJSON {
+	return &jobJSON{
+		JobID:                details.JobID,
+		QueueName:            details.QueueName,
+		State:                details.State,
+		ReplicationFactor:    details.ReplicationFactor,
+		TTL:                  details.TTL.Seconds(),
+		CreatedAt:            details.CreatedAt,
+		Delay:                details.Delay.Seconds(),
+		Retry:                details.Retry.Seconds(),
+		Nacks:                details.Nacks,
+		AdditionalDeliveries: details.AdditionalDeliveries,
+		NodesDelivered:       details.NodesDelivered,
+		NodesConfirmed:       details.NodesConfirmed,
+		NextRequeueWithin:    details.NextRequeueWithin.Seconds(),
+		NextAwakeWithin:      details.NextAwakeWithin.Seconds(),
+		Message:              details.Message,
+		Extra:                details.Extra,
+	}
+}
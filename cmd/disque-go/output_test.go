@@ -0,0 +1,52 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type OutputSuite struct {
+	suite.Suite
+}
+
+func TestOutputSuite(t *testing.T) {
+	suite.Run(t, new(OutputSuite))
+}
+
+func (s *OutputSuite) SetupTest() {
+}
+
+func (s *OutputSuite) SetupSuite() {
+}
+
+func (s *OutputSuite) TestTable() {
+	out := &bytes.Buffer{}
+	p, err := newPrinter(formatTable, out)
+	s.Nil(err)
+	s.Nil(p.table([]string{"QUEUE", "MESSAGE"}, [][]string{{"q", "a\tb"}, {"queue", "c"}}, nil))
+	s.Equal("QUEUE  MESSAGE\nq      \"a\\tb\"\nqueue  c\n", out.String())
+}
+
+func (s *OutputSuite) TestTableWithoutHeader() {
+	out := &bytes.Buffer{}
+	p, err := newPrinter(formatTable, out)
+	s.Nil(err)
+	s.Nil(p.table(nil, [][]string{{"D-1"}, {"D-2"}}, nil))
+	s.Equal("D-1\nD-2\n", out.String())
+}
+
+func (s *OutputSuite) TestJSON() {
+	out := &bytes.Buffer{}
+	p, err := newPrinter(formatJSON, out)
+	s.Nil(err)
+	s.Nil(p.table([]string{"ID"}, [][]string{{"D-1"}}, []string{"D-1"}))
+	s.Nil(p.value("3", 3))
+	s.Equal("[\n  \"D-1\"\n]\n3\n", out.String())
+}
+
+func (s *OutputSuite) TestUnknownFormat() {
+	_, err := newPrinter("xml", &bytes.Buffer{})
+	s.NotNil(err)
+}
@@ -0,0 +1,350 @@
+package disque
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Defaults used by an Autoscaler when the corresponding option is unset
+const (
+	DefaultAutoscalePollInterval      = 5 * time.Second
+	DefaultAutoscaleJobsPerWorker     = 10
+	DefaultAutoscaleHysteresis        = 0.2
+	DefaultAutoscaleScaleUpCooldown   = 30 * time.Second
+	DefaultAutoscaleScaleDownCooldown = 2 * time.Minute
+	DefaultAutoscalePoolHeadroom      = 1
+)
+
+// Actions reported by an AutoscaleDecision
+const (
+	AutoscaleUp   = "up"
+	AutoscaleDown = "down"
+	AutoscaleHold = "hold"
+)
+
+// AutoscalerOptions configures an Autoscaler
+type AutoscalerOptions struct {
+	// QueueNames are the queues whose state drives the number of workers
+	QueueNames []string
+	// MinWorkers and MaxWorkers bound the number of workers
+	MinWorkers int
+	MaxWorkers int
+	// JobsPerWorker is the number of queued jobs a single worker is expected to keep up with,
+	// DefaultAutoscaleJobsPerWorker if unset
+	JobsPerWorker int
+	// MaxIdle adds a worker whenever a queue has not been served for longer, disabled if unset
+	MaxIdle time.Duration
+	// Hysteresis is the fraction by which the load must exceed, or fall short of,
+	// the current number of workers before scaling, DefaultAutoscaleHysteresis if unset
+	Hysteresis float64
+	// PollInterval is the time between two evaluations, DefaultAutoscalePollInterval if unset
+	PollInterval time.Duration
+	// ScaleUpCooldown and ScaleDownCooldown are the minimum time since the last change
+	// before scaling up or down again
+	ScaleUpCooldown   time.Duration
+	ScaleDownCooldown time.Duration
+	// Pool, if set, has its capacity kept equal to the number of workers plus
+	// PoolHeadroom, up to its maximum capacity
+	Pool *Pool
+	// PoolHeadroom is the number of pool connections kept on top of one per
+	// worker, for the connection polling QSTAT and other users of the pool,
+	// DefaultAutoscalePoolHeadroom if unset
+	PoolHeadroom int
+	// OnDecision is invoked with the outcome of every evaluation
+	OnDecision func(decision *AutoscaleDecision)
+}
+
+// AutoscaleDecision is the outcome of an evaluation of the queues
+type AutoscaleDecision struct {
+	Time time.Time
+	// Action is one of AutoscaleUp, AutoscaleDown or AutoscaleHold
+	Action string
+	Reason string
+	// From and To are the number of workers before and after the decision
+	From int
+	To   int
+	// Backlog is the number of jobs queued across every queue
+	Backlog int64
+	// InRate and OutRate are the number of jobs queued and dequeued per second
+	// since the previous evaluation
+	InRate  float64
+	OutRate float64
+	// Idle is the longest time any queue has not been served
+	Idle time.Duration
+	// Load is the number of workers needed according to the queues
+	Load float64
+}
+
+// Autoscaler runs a varying number of worker goroutines, adjusting it to the
+// state of the queues the workers consume. Every evaluation polls QSTAT for
+// each queue, derives the number of workers needed from the backlog, the rates
+// at which jobs are queued and dequeued and the idle time of the queues, and
+// scales within the configured bounds. Hysteresis and cooldowns keep the
+// number of workers from flapping.
+//
+// QSTAT only reports the jobs known to the node it runs on, so on a cluster
+// of several nodes the autoscaler sees the queues as the node of its
+// connection does.
+type Autoscaler struct {
+	d       *Disque
+	worker  func(ctx context.Context)
+	options AutoscalerOptions
+
+	// now returns the current time, replaced in tests
+	now func() time.Time
+
+	mu         sync.Mutex
+	ctx        context.Context
+	workers    []*autoscaledWorker
+	lastScaled time.Time
+	lastPolled time.Time
+	lastStats  map[string]*QueueStats
+}
+
+type autoscaledWorker struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// NewAutoscaler creates an autoscaler running worker in each worker goroutine.
+// worker must return once its context is done. Queue statistics are polled
+// through the given connection.
+func NewAutoscaler(d *Disque, worker func(ctx context.Context), options AutoscalerOptions) *Autoscaler {
+	if options.JobsPerWorker <= 0 {
+		options.JobsPerWorker = DefaultAutoscaleJobsPerWorker
+	}
+	if options.Hysteresis == 0 {
+		options.Hysteresis = DefaultAutoscaleHysteresis
+	}
+	if options.PollInterval == 0 {
+		options.PollInterval = DefaultAutoscalePollInterval
+	}
+	if options.ScaleUpCooldown == 0 {
+		options.ScaleUpCooldown = DefaultAutoscaleScaleUpCooldown
+	}
+	if options.ScaleDownCooldown == 0 {
+		options.ScaleDownCooldown = DefaultAutoscaleScaleDownCooldown
+	}
+	if options.PoolHeadroom == 0 {
+		options.PoolHeadroom = DefaultAutoscalePoolHeadroom
+	}
+	if options.MaxWorkers < options.MinWorkers {
+		options.MaxWorkers = options.MinWorkers
+	}
+	return &Autoscaler{
+		d:         d,
+		worker:    worker,
+		options:   options,
+		now:       time.Now,
+		workers:   make([]*autoscaledWorker, 0),
+		lastStats: make(map[string]*QueueStats),
+	}
+}
+
+// Workers returns the number of running workers
+func (a *Autoscaler) Workers() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.workers)
+}
+
+// Run starts MinWorkers workers and scales them until ctx is done, at which
+// point every worker is stopped.
+func (a *Autoscaler) Run(ctx context.Context) {
+	a.start(ctx)
+	defer a.stop()
+
+	ticker := time.NewTicker(a.options.PollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if _, err := a.step(); err != nil {
+			log.Printf("Error while autoscaling workers, exception: %s", err)
+		}
+	}
+}
+
+// start runs the minimum number of workers under ctx
+func (a *Autoscaler) start(ctx context.Context) {
+	if err := a.resizePool(a.options.MinWorkers); err != nil {
+		log.Printf("Error while resizing pool for %d workers, exception: %s", a.options.MinWorkers, err)
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ctx = ctx
+	a.scale(a.options.MinWorkers)
+}
+
+// stop stops every worker
+func (a *Autoscaler) stop() {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.scale(0)
+}
+
+// step evaluates the queues once and scales the workers accordingly. The pool
+// is resized without holding a.mu, since shrinking it waits for connections
+// to be returned.
+func (a *Autoscaler) step() (decision *AutoscaleDecision, err error) {
+	if decision, err = a.evaluate(); err != nil {
+		return
+	}
+
+	if decision.To > decision.From {
+		// the pool grows before workers are started
+		err = a.resizePool(decision.To)
+	}
+	if decision.To != decision.From {
+		a.mu.Lock()
+		a.scale(decision.To)
+		a.lastScaled = decision.Time
+		a.mu.Unlock()
+	}
+	if decision.To < decision.From {
+		// and shrinks once they are stopped
+		err = a.resizePool(decision.To)
+	}
+	if a.options.OnDecision != nil {
+		a.options.OnDecision(decision)
+	}
+	return
+}
+
+// evaluate polls the queues and decides on the number of workers
+func (a *Autoscaler) evaluate() (decision *AutoscaleDecision, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	stats := make(map[string]*QueueStats)
+	for _, queueName := range a.options.QueueNames {
+		if stats[queueName], err = a.d.QueueStats(queueName); err != nil {
+			return
+		}
+	}
+
+	decision = a.decide(now, stats)
+	a.lastStats = stats
+	a.lastPolled = now
+	return
+}
+
+// decide computes the number of workers needed from the state of the queues.
+// Callers must hold a.mu.
+func (a *Autoscaler) decide(now time.Time, stats map[string]*QueueStats) *AutoscaleDecision {
+	current := len(a.workers)
+	decision := &AutoscaleDecision{
+		Time:   now,
+		Action: AutoscaleHold,
+		From:   current,
+		To:     current,
+	}
+
+	elapsed := now.Sub(a.lastPolled).Seconds()
+	for queueName, s := range stats {
+		decision.Backlog += s.Length
+		if s.Length > 0 && s.Idle > decision.Idle {
+			decision.Idle = s.Idle
+		}
+		if last, ok := a.lastStats[queueName]; ok && elapsed > 0 {
+			decision.InRate += float64(s.JobsIn-last.JobsIn) / elapsed
+			decision.OutRate += float64(s.JobsOut-last.JobsOut) / elapsed
+		}
+	}
+
+	// enough workers to work through the backlog
+	load := float64(decision.Backlog) / float64(a.options.JobsPerWorker)
+	reason := fmt.Sprintf("backlog of %d jobs", decision.Backlog)
+	if decision.OutRate > 0 && decision.InRate > decision.OutRate && current > 0 {
+		// enough workers to keep up with jobs being queued
+		if byRate := float64(current) * decision.InRate / decision.OutRate; byRate > load {
+			load = byRate
+			reason = fmt.Sprintf("%.1f jobs/s queued, %.1f jobs/s dequeued", decision.InRate, decision.OutRate)
+		}
+	}
+	if a.options.MaxIdle > 0 && decision.Idle > a.options.MaxIdle && load < float64(current+1) {
+		load = float64(current + 1)
+		reason = fmt.Sprintf("queue not served for %s", decision.Idle)
+	}
+	decision.Load = load
+
+	target := int(math.Ceil(load))
+	if target < a.options.MinWorkers {
+		target = a.options.MinWorkers
+	}
+	if target > a.options.MaxWorkers {
+		target = a.options.MaxWorkers
+	}
+
+	h := a.options.Hysteresis
+	switch {
+	case target > current && load > float64(current)*(1+h):
+		if since := now.Sub(a.lastScaled); since < a.options.ScaleUpCooldown {
+			decision.Reason = fmt.Sprintf("%s, scale up on cooldown for %s", reason, a.options.ScaleUpCooldown-since)
+			return decision
+		}
+		decision.Action = AutoscaleUp
+	case target < current && load < float64(current)*(1-h):
+		if since := now.Sub(a.lastScaled); since < a.options.ScaleDownCooldown {
+			decision.Reason = fmt.Sprintf("%s, scale down on cooldown for %s", reason, a.options.ScaleDownCooldown-since)
+			return decision
+		}
+		decision.Action = AutoscaleDown
+	default:
+		decision.Reason = reason
+		return decision
+	}
+	decision.To = target
+	decision.Reason = reason
+	return decision
+}
+
+// scale starts or stops workers until n are running. Callers must hold a.mu.
+func (a *Autoscaler) scale(n int) {
+	for len(a.workers) < n {
+		ctx, cancel := context.WithCancel(a.ctx)
+		w := &autoscaledWorker{cancel: cancel, done: make(chan struct{})}
+		go func() {
+			defer close(w.done)
+			a.worker(ctx)
+		}()
+		a.workers = append(a.workers, w)
+	}
+
+	stopped := a.workers[n:]
+	a.workers = a.workers[:n]
+	for _, w := range stopped {
+		w.cancel()
+	}
+	for _, w := range stopped {
+		<-w.done
+	}
+}
+
+// resizePool sets the capacity of the pool for n workers
+func (a *Autoscaler) resizePool(n int) (err error) {
+	if a.options.Pool == nil {
+		return
+	}
+	capacity := n + a.options.PoolHeadroom
+	if maxCapacity := int(a.options.Pool.pool.MaxCap()); capacity > maxCapacity {
+		capacity = maxCapacity
+	}
+	if capacity < 1 {
+		// a capacity of 0 closes the pool
+		capacity = 1
+	}
+	if err = a.options.Pool.SetCapacity(capacity); err != nil {
+		err = fmt.Errorf("Failed to resize pool to %d connections: %s", capacity, err)
+	}
+	return
+}
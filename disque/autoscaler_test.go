@@ -0,0 +1,287 @@
+package disque
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+	"golang.org/x/net/context"
+)
+
+type AutoscalerSuite struct {
+	suite.Suite
+	server *disquetest.Server
+	d      *Disque
+	clock  *fakeClock
+}
+
+func TestAutoscalerSuite(t *testing.T) {
+	suite.Run(t, new(AutoscalerSuite))
+}
+
+func (s *AutoscalerSuite) SetupTest() {
+	s.server = disquetest.NewServer()
+	s.d = NewDisque([]string{s.server.Addr}, 1000)
+	s.Nil(s.d.Initialize())
+	s.clock = &fakeClock{now: time.Now()}
+}
+
+func (s *AutoscalerSuite) TearDownTest() {
+	s.d.Close()
+	s.server.Close()
+}
+
+func (s *AutoscalerSuite) SetupSuite() {
+}
+
+// idleWorker does nothing until it is stopped
+func idleWorker(ctx context.Context) {
+	<-ctx.Done()
+}
+
+func (s *AutoscalerSuite) newAutoscaler(options AutoscalerOptions) *Autoscaler {
+	a := NewAutoscaler(s.d, idleWorker, options)
+	a.now = s.clock.Now
+	a.start(context.Background())
+	return a
+}
+
+func (s *AutoscalerSuite) push(queueName string, count int) {
+	pipeline := s.d.Pipeline()
+	for i := 0; i < count; i++ {
+		pipeline.Push(queueName, "asdf", time.Second)
+	}
+	_, err := pipeline.Execute()
+	s.Nil(err)
+}
+
+func (s *AutoscalerSuite) TestStartsMinWorkers() {
+	a := s.newAutoscaler(AutoscalerOptions{MinWorkers: 2, MaxWorkers: 5})
+	defer a.stop()
+
+	s.Equal(2, a.Workers())
+}
+
+func (s *AutoscalerSuite) TestScaleUpWithBacklog() {
+	var decisions []*AutoscaleDecision
+	a := s.newAutoscaler(AutoscalerOptions{
+		QueueNames: []string{"queueAutoscale1", "queueAutoscale2"},
+		MinWorkers: 1,
+		MaxWorkers: 10,
+		OnDecision: func(decision *AutoscaleDecision) {
+			decisions = append(decisions, decision)
+		},
+	})
+	defer a.stop()
+	s.push("queueAutoscale1", 30)
+	s.push("queueAutoscale2", 20)
+
+	decision, err := a.step()
+	s.Nil(err)
+	s.Equal(AutoscaleUp, decision.Action)
+	s.EqualValues(50, decision.Backlog)
+	s.Equal(1, decision.From)
+	s.Equal(5, decision.To)
+	s.Equal(5, a.Workers())
+	s.Equal([]*AutoscaleDecision{decision}, decisions)
+}
+
+func (s *AutoscalerSuite) TestMaxWorkers() {
+	a := s.newAutoscaler(AutoscalerOptions{QueueNames: []string{"queueAutoscale3"}, MinWorkers: 1, MaxWorkers: 3})
+	defer a.stop()
+	s.push("queueAutoscale3", 100)
+
+	decision, err := a.step()
+	s.Nil(err)
+	s.Equal(3, decision.To)
+	s.Equal(3, a.Workers())
+}
+
+func (s *AutoscalerSuite) TestScaleUpCooldown() {
+	a := s.newAutoscaler(AutoscalerOptions{
+		QueueNames:      []string{"queueAutoscale4"},
+		MinWorkers:      1,
+		MaxWorkers:      10,
+		ScaleUpCooldown: time.Minute,
+	})
+	defer a.stop()
+	s.push("queueAutoscale4", 20)
+	a.step()
+	s.Equal(2, a.Workers())
+
+	s.push("queueAutoscale4", 40)
+	s.clock.Advance(30 * time.Second)
+	decision, err := a.step()
+	s.Nil(err)
+	s.Equal(AutoscaleHold, decision.Action)
+	s.Contains(decision.Reason, "cooldown")
+	s.Equal(2, a.Workers())
+
+	s.clock.Advance(30 * time.Second)
+	decision, err = a.step()
+	s.Nil(err)
+	s.Equal(AutoscaleUp, decision.Action)
+	s.Equal(6, a.Workers())
+}
+
+func (s *AutoscalerSuite) TestHysteresis() {
+	a := s.newAutoscaler(AutoscalerOptions{QueueNames: []string{"queueAutoscale5"}, MinWorkers: 5, MaxWorkers: 10})
+	defer a.stop()
+
+	// 5.5 workers worth of backlog is within 20% of the 5 running
+	s.push("queueAutoscale5", 55)
+	decision, err := a.step()
+	s.Nil(err)
+	s.Equal(AutoscaleHold, decision.Action)
+	s.Equal(5, a.Workers())
+
+	s.push("queueAutoscale5", 10)
+	decision, err = a.step()
+	s.Nil(err)
+	s.Equal(AutoscaleUp, decision.Action)
+	s.Equal(7, a.Workers())
+}
+
+func (s *AutoscalerSuite) TestScaleDown() {
+	a := s.newAutoscaler(AutoscalerOptions{
+		QueueNames:        []string{"queueAutoscale6"},
+		MinWorkers:        1,
+		MaxWorkers:        10,
+		ScaleDownCooldown: time.Minute,
+	})
+	defer a.stop()
+	s.push("queueAutoscale6", 40)
+	a.step()
+	s.Equal(4, a.Workers())
+
+	jobs, _ := s.d.FetchMultiple("queueAutoscale6", 40, time.Second)
+	s.Equal(40, len(jobs))
+
+	decision, err := a.step()
+	s.Nil(err)
+	s.Equal(AutoscaleHold, decision.Action)
+	s.Equal(4, a.Workers())
+
+	s.clock.Advance(time.Minute)
+	decision, err = a.step()
+	s.Nil(err)
+	s.Equal(AutoscaleDown, decision.Action)
+	s.Equal(1, a.Workers())
+}
+
+func (s *AutoscalerSuite) TestScaleUpWhenFallingBehind() {
+	a := s.newAutoscaler(AutoscalerOptions{
+		QueueNames:    []string{"queueAutoscale7"},
+		MinWorkers:    2,
+		MaxWorkers:    10,
+		JobsPerWorker: 1000,
+	})
+	defer a.stop()
+	a.step()
+
+	// jobs are queued twice as fast as they are dequeued
+	s.push("queueAutoscale7", 20)
+	s.d.FetchMultiple("queueAutoscale7", 10, time.Second)
+	s.clock.Advance(10 * time.Second)
+
+	decision, err := a.step()
+	s.Nil(err)
+	s.Equal(2.0, decision.InRate)
+	s.Equal(1.0, decision.OutRate)
+	s.Equal(AutoscaleUp, decision.Action)
+	s.Equal(4, a.Workers())
+}
+
+func (s *AutoscalerSuite) TestScalesPool() {
+	p := NewPool([]string{s.server.Addr}, 1000, 1, 4, time.Hour)
+	defer p.Close()
+	a := s.newAutoscaler(AutoscalerOptions{
+		QueueNames: []string{"queueAutoscale8"},
+		MinWorkers: 1,
+		MaxWorkers: 10,
+		Pool:       p,
+	})
+	defer a.stop()
+	// one connection is kept on top of the workers
+	s.Equal(2, int(p.Stats().Capacity))
+
+	s.push("queueAutoscale8", 60)
+	a.step()
+	s.Equal(6, a.Workers())
+	// the pool cannot grow beyond its maximum capacity
+	s.Equal(4, int(p.Stats().Capacity))
+}
+
+func (s *AutoscalerSuite) TestRunStopsWorkers() {
+	running := make(chan struct{}, 10)
+	a := NewAutoscaler(s.d, func(ctx context.Context) {
+		running <- struct{}{}
+		<-ctx.Done()
+	}, AutoscalerOptions{MinWorkers: 3, MaxWorkers: 3, PollInterval: 10 * time.Millisecond})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		a.Run(ctx)
+		close(done)
+	}()
+	for i := 0; i < 3; i++ {
+		<-running
+	}
+
+	cancel()
+	<-done
+	s.Equal(0, a.Workers())
+}
+
+func (s *AutoscalerSuite) TestScaleDownWithPooledConnection() {
+	p := NewPool([]string{s.server.Addr}, 1000, 1, 10, time.Hour)
+	defer p.Close()
+	d, err := p.Get(context.Background())
+	s.Nil(err)
+	defer p.Put(d)
+
+	// every worker holds a connection of the pool, as does the autoscaler
+	a := NewAutoscaler(d, func(ctx context.Context) {
+		conn, err := p.Get(ctx)
+		if err == nil {
+			<-ctx.Done()
+			p.Put(conn)
+		}
+	}, AutoscalerOptions{
+		QueueNames:        []string{"queueAutoscale9"},
+		MinWorkers:        1,
+		MaxWorkers:        10,
+		ScaleDownCooldown: time.Minute,
+		Pool:              p,
+	})
+	a.now = s.clock.Now
+	a.start(context.Background())
+	defer a.stop()
+
+	s.push("queueAutoscale9", 40)
+	_, err = a.step()
+	s.Nil(err)
+	s.Equal(4, a.Workers())
+	s.Equal(5, int(p.Stats().Capacity))
+
+	jobs, _ := s.d.FetchMultiple("queueAutoscale9", 40, time.Second)
+	s.Equal(40, len(jobs))
+	s.clock.Advance(time.Minute)
+
+	done := make(chan struct{})
+	go func() {
+		decision, err := a.step()
+		s.Nil(err)
+		s.Equal(AutoscaleDown, decision.Action)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		s.Fail("Scaling down did not complete")
+	}
+	s.Equal(1, a.Workers())
+	s.Equal(2, int(p.Stats().Capacity))
+}
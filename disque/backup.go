@@ -0,0 +1,319 @@
+package disque
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// DefaultImportBatchSize is the number of jobs re-created in a single pipeline
+const DefaultImportBatchSize = 100
+
+// BackupRecord is a job as written to a backup, one JSON object per line.
+// Times are given in seconds.
+type BackupRecord struct {
+	JobID                string    `json:"id"`
+	QueueName            string    `json:"queue"`
+	State                string    `json:"state"`
+	ReplicationFactor    int       `json:"repl"`
+	TTL                  int64     `json:"ttl"`
+	CreatedAt            time.Time `json:"ctime"`
+	Delay                int64     `json:"delay"`
+	Retry                int64     `json:"retry"`
+	Nacks                int64     `json:"nacks"`
+	AdditionalDeliveries int64     `json:"additional_deliveries"`
+	Message              string    `json:"body"`
+	ExportedAt           time.Time `json:"exported_at"`
+	// Envelope is set if the message is an Envelope created by this package
+	Envelope bool `json:"envelope,omitempty"`
+}
+
+// ExportOptions selects the jobs written to a backup
+type ExportOptions struct {
+	// Queues restricts the backup to the given queues, every queue if empty
+	Queues []string
+	// States restricts the backup to jobs in any of the given states, every state if empty
+	States []string
+	// Gzip compresses the backup
+	Gzip bool
+	// ResetCounters records every job as never delivered, rather than with
+	// its number of nacks and additional deliveries, so that jobs imported
+	// with PreserveCounters start over
+	ResetCounters bool
+}
+
+// ImportOptions selects the jobs re-created from a backup
+type ImportOptions struct {
+	// Queues restricts the restore to the given queues, every queue if empty
+	Queues []string
+	// States restricts the restore to jobs in any of the given states. If
+	// empty, every job that was not acknowledged is restored.
+	States []string
+	// KeepTTL restores jobs with the TTL they had left when the backup was
+	// taken. By default the time elapsed since also counts, so that jobs
+	// expire when they would have on the original cluster.
+	KeepTTL bool
+	// Timeout for adding jobs, one second if unset
+	Timeout time.Duration
+	// BatchSize is the number of jobs re-created at once, DefaultImportBatchSize if unset
+	BatchSize int
+	// PreserveCounters wraps each job in an Envelope carrying the delivery
+	// counters recorded in the backup, with the original message as payload.
+	// Jobs exported as envelopes, such as idempotent pushes or workflow
+	// steps, get the counters added instead.
+	PreserveCounters bool
+}
+
+// ImportResult reports the outcome of a restore
+type ImportResult struct {
+	// Imported is the number of jobs re-created
+	Imported int
+	// Expired is the number of jobs skipped because their TTL elapsed
+	Expired int
+	// Skipped is the number of jobs left out by the filters
+	Skipped int
+}
+
+// Export writes the jobs known to the node this connection is using to w,
+// as JSON Lines, using JSCAN and SHOW. It returns the number of jobs written.
+// The backup is not a consistent snapshot: jobs may change while it is taken.
+func (d *Disque) Export(w io.Writer, options ExportOptions) (count int, err error) {
+	if options.Gzip {
+		zw := gzip.NewWriter(w)
+		defer func() {
+			if closeErr := zw.Close(); err == nil {
+				err = closeErr
+			}
+		}()
+		w = zw
+	}
+	bw := bufio.NewWriter(w)
+	encoder := json.NewEncoder(bw)
+
+	queues := options.Queues
+	if len(queues) == 0 {
+		queues = []string{""}
+	}
+	for _, queueName := range queues {
+		scan := ScanOptions{Queue: queueName, States: options.States}
+		for cursor := "0"; ; {
+			var page []*JobDetails
+			if cursor, page, err = d.ScanDetails(cursor, scan); err != nil {
+				return
+			}
+			exportedAt := d.now()
+			for _, details := range page {
+				record := newBackupRecord(details, exportedAt)
+				if options.ResetCounters {
+					record.Nacks = 0
+					record.AdditionalDeliveries = 0
+				}
+				if err = encoder.Encode(record); err != nil {
+					return
+				}
+				count++
+			}
+			if cursor == "0" {
+				break
+			}
+		}
+	}
+	err = bw.Flush()
+	return
+}
+
+// ExportFile writes a backup to the file at path, compressed if the path ends with .gz
+func (d *Disque) ExportFile(path string, options ExportOptions) (count int, err error) {
+	var f *os.File
+	if f, err = os.Create(path); err != nil {
+		return
+	}
+	defer func() {
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+	options.Gzip = options.Gzip || strings.HasSuffix(path, ".gz")
+	return d.Export(f, options)
+}
+
+// Import re-creates the jobs of a backup read from r, which may be
+// compressed. Jobs are added with their remaining TTL and delay, their retry
+// and, up to the number of nodes in the cluster, their replication factor.
+// Disque assigns new IDs to the jobs, and their delivery counters start over:
+// with PreserveCounters, the counters of the backup are passed on in the
+// envelope of each job, which consumers decode with ParseEnvelope.
+func (d *Disque) Import(r io.Reader, options ImportOptions) (result *ImportResult, err error) {
+	result = &ImportResult{}
+	if options.Timeout <= 0 {
+		options.Timeout = time.Second
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultImportBatchSize
+	}
+
+	br := bufio.NewReader(r)
+	if magic, _ := br.Peek(2); len(magic) == 2 && magic[0] == 0x1f && magic[1] == 0x8b {
+		var zr *gzip.Reader
+		if zr, err = gzip.NewReader(br); err != nil {
+			return
+		}
+		defer zr.Close()
+		br = bufio.NewReader(zr)
+	}
+
+	replicas := len(d.Nodes())
+	pipeline := d.Pipeline()
+	decoder := json.NewDecoder(br)
+	for line := 1; ; line++ {
+		record := &BackupRecord{}
+		if err = decoder.Decode(record); err == io.EOF {
+			break
+		} else if err != nil {
+			return result, fmt.Errorf("Malformed backup record %d: %s", line, err)
+		}
+		if !options.includes(record) {
+			result.Skipped++
+			continue
+		}
+
+		now := d.now()
+		if options.KeepTTL {
+			now = record.ExportedAt
+		}
+		jobOptions, ok := preservingOptions(record.details(), now, replicas)
+		if !ok {
+			result.Expired++
+			continue
+		}
+		message := record.Message
+		if options.PreserveCounters {
+			if message, err = record.envelope(); err != nil {
+				return
+			}
+		}
+		pipeline.PushWithOptions(record.QueueName, message, options.Timeout, jobOptions)
+		if pipeline.Len() >= options.BatchSize {
+			if err = importBatch(pipeline, result); err != nil {
+				return
+			}
+			pipeline = d.Pipeline()
+		}
+	}
+	err = importBatch(pipeline, result)
+	return
+}
+
+// ImportFile re-creates the jobs of the backup in the file at path
+func (d *Disque) ImportFile(path string, options ImportOptions) (result *ImportResult, err error) {
+	var f *os.File
+	if f, err = os.Open(path); err != nil {
+		return
+	}
+	defer f.Close()
+	return d.Import(f, options)
+}
+
+// importBatch executes the pushes queued in a pipeline, counting every job
+// that was added and returning the error of the first one that was not
+func importBatch(pipeline *Pipeline, result *ImportResult) (err error) {
+	if pipeline.Len() == 0 {
+		return
+	}
+	var results []*PipelineResult
+	if results, err = pipeline.Execute(); err != nil {
+		return
+	}
+	for _, r := range results {
+		if r.Err == nil {
+			result.Imported++
+		} else if err == nil {
+			err = r.Err
+		}
+	}
+	return
+}
+
+// includes returns true if the filters select the record
+func (o ImportOptions) includes(record *BackupRecord) bool {
+	if len(o.Queues) > 0 && !containsString(o.Queues, record.QueueName) {
+		return false
+	}
+	if len(o.States) == 0 {
+		return record.State != JobStateAcked
+	}
+	return containsString(o.States, record.State)
+}
+
+func newBackupRecord(details *JobDetails, exportedAt time.Time) *BackupRecord {
+	return &BackupRecord{
+		JobID:                details.JobID,
+		QueueName:            details.QueueName,
+		State:                details.State,
+		ReplicationFactor:    details.ReplicationFactor,
+		TTL:                  int64(details.TTL.Seconds()),
+		CreatedAt:            details.CreatedAt,
+		Delay:                int64(details.Delay.Seconds()),
+		Retry:                int64(details.Retry.Seconds()),
+		Nacks:                details.Nacks,
+		AdditionalDeliveries: details.AdditionalDeliveries,
+		Message:              details.Message,
+		ExportedAt:           exportedAt,
+		Envelope:             isEnvelope(details.Message),
+	}
+}
+
+// isEnvelope returns true if the message is an Envelope created by this package
+func isEnvelope(message string) bool {
+	envelope := &Envelope{}
+	return json.Unmarshal([]byte(message), envelope) == nil && envelope.wrapped()
+}
+
+// envelope returns the message of the job wrapped in an Envelope carrying its
+// delivery counters, or with the counters added if it was exported as an
+// envelope. Any other message is wrapped as is, even if it looks like one.
+func (r *BackupRecord) envelope() (message string, err error) {
+	envelope := &Envelope{}
+	if !r.Envelope || json.Unmarshal([]byte(r.Message), envelope) != nil {
+		envelope = &Envelope{Kind: EnvelopeImported, Payload: r.Message}
+	}
+	envelope.Nacks = r.Nacks
+	envelope.AdditionalDeliveries = r.AdditionalDeliveries
+
+	var body []byte
+	if body, err = json.Marshal(envelope); err == nil {
+		message = string(body)
+	}
+	return
+}
+
+// details returns the job details recorded in the backup
+func (r *BackupRecord) details() *JobDetails {
+	return &JobDetails{
+		JobID:                r.JobID,
+		QueueName:            r.QueueName,
+		State:                r.State,
+		ReplicationFactor:    r.ReplicationFactor,
+		TTL:                  time.Duration(r.TTL) * time.Second,
+		CreatedAt:            r.CreatedAt,
+		Delay:                time.Duration(r.Delay) * time.Second,
+		Retry:                time.Duration(r.Retry) * time.Second,
+		Nacks:                r.Nacks,
+		AdditionalDeliveries: r.AdditionalDeliveries,
+		Message:              r.Message,
+	}
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
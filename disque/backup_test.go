@@ -0,0 +1,292 @@
+package disque
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+)
+
+type BackupSuite struct {
+	suite.Suite
+	server *disquetest.Server
+	d      *Disque
+}
+
+func TestBackupSuite(t *testing.T) {
+	suite.Run(t, new(BackupSuite))
+}
+
+func (s *BackupSuite) SetupTest() {
+	s.server = disquetest.NewServer()
+	s.d = NewDisque([]string{s.server.Addr}, 1000)
+	s.Nil(s.d.Initialize())
+}
+
+func (s *BackupSuite) TearDownTest() {
+	s.d.Close()
+	s.server.Close()
+}
+
+func (s *BackupSuite) SetupSuite() {
+}
+
+func (s *BackupSuite) records(backup []byte) (records []*BackupRecord) {
+	scanner := bufio.NewScanner(bytes.NewReader(backup))
+	for scanner.Scan() {
+		record := &BackupRecord{}
+		s.Nil(json.Unmarshal(scanner.Bytes(), record))
+		records = append(records, record)
+	}
+	return
+}
+
+func (s *BackupSuite) TestExport() {
+	jobID, err := s.d.PushWithOptions("queueBackup", "job1", time.Second, map[string]string{"TTL": "3600", "RETRY": "30"})
+	s.Nil(err)
+	_, err = s.d.Push("queueOther", "job2", time.Second)
+	s.Nil(err)
+
+	var backup bytes.Buffer
+	count, err := s.d.Export(&backup, ExportOptions{})
+	s.Nil(err)
+	s.Equal(2, count)
+
+	var buf bytes.Buffer
+	count, err = s.d.Export(&buf, ExportOptions{Queues: []string{"queueBackup"}})
+	s.Nil(err)
+	s.Equal(1, count)
+	records := s.records(buf.Bytes())
+	s.Equal(jobID, records[0].JobID)
+	s.Equal("queueBackup", records[0].QueueName)
+	s.Equal(JobStateQueued, records[0].State)
+	s.Equal("job1", records[0].Message)
+	s.Equal(int64(3600), records[0].TTL)
+	s.Equal(int64(30), records[0].Retry)
+	s.False(records[0].ExportedAt.IsZero())
+	s.False(records[0].Envelope)
+
+	// envelopes are flagged in the backup
+	_, err = s.d.PushIdempotent("queueIdempotent", "key1", "job3", time.Second)
+	s.Nil(err)
+	buf.Reset()
+	_, err = s.d.Export(&buf, ExportOptions{Queues: []string{"queueIdempotent"}})
+	s.Nil(err)
+	s.True(s.records(buf.Bytes())[0].Envelope)
+}
+
+func (s *BackupSuite) TestExportStates() {
+	s.d.Push("queueBackup", "job1", time.Second)
+	s.d.Push("queueBackup", "job2", time.Second)
+	_, err := s.d.Fetch("queueBackup", time.Second)
+	s.Nil(err)
+
+	var buf bytes.Buffer
+	count, err := s.d.Export(&buf, ExportOptions{States: []string{JobStateQueued}})
+	s.Nil(err)
+	s.Equal(1, count)
+	s.Equal("job2", s.records(buf.Bytes())[0].Message)
+}
+
+func (s *BackupSuite) TestExportResetCounters() {
+	s.d.Push("queueBackup", "job1", time.Second)
+	job, err := s.d.Fetch("queueBackup", time.Second)
+	s.Nil(err)
+	s.Nil(s.d.Nack(job.JobID))
+
+	var buf bytes.Buffer
+	_, err = s.d.Export(&buf, ExportOptions{})
+	s.Nil(err)
+	s.Equal(int64(1), s.records(buf.Bytes())[0].Nacks)
+
+	buf.Reset()
+	_, err = s.d.Export(&buf, ExportOptions{ResetCounters: true})
+	s.Nil(err)
+	s.Equal(int64(0), s.records(buf.Bytes())[0].Nacks)
+}
+
+func (s *BackupSuite) TestExportGzip() {
+	s.d.Push("queueBackup", "job1", time.Second)
+
+	var buf bytes.Buffer
+	_, err := s.d.Export(&buf, ExportOptions{Gzip: true})
+	s.Nil(err)
+	zr, err := gzip.NewReader(&buf)
+	s.Nil(err)
+	backup, err := ioutil.ReadAll(zr)
+	s.Nil(err)
+	s.Equal("job1", s.records(backup)[0].Message)
+}
+
+func (s *BackupSuite) TestImport() {
+	s.d.PushWithOptions("queueBackup", "job1", time.Second, map[string]string{"TTL": "3600", "RETRY": "30"})
+	s.d.Push("queueBackup", "job2", time.Second)
+	s.d.Push("queueOther", "job3", time.Second)
+
+	var buf bytes.Buffer
+	_, err := s.d.Export(&buf, ExportOptions{Gzip: true})
+	s.Nil(err)
+
+	target := disquetest.NewServer()
+	defer target.Close()
+	d := NewDisque([]string{target.Addr}, 1000)
+	s.Nil(d.Initialize())
+	defer d.Close()
+
+	result, err := d.Import(&buf, ImportOptions{Queues: []string{"queueBackup"}, BatchSize: 1})
+	s.Nil(err)
+	s.Equal(2, result.Imported)
+	s.Equal(1, result.Skipped)
+
+	queueLength, err := d.QueueLength("queueBackup")
+	s.Nil(err)
+	s.Equal(2, queueLength)
+	queueLength, err = d.QueueLength("queueOther")
+	s.Nil(err)
+	s.Equal(0, queueLength)
+
+	jobs, err := d.FetchMultiple("queueBackup", 2, time.Second)
+	s.Nil(err)
+	job := jobs[0]
+	if job.Message != "job1" {
+		job = jobs[1]
+	}
+	s.Equal("job1", job.Message)
+	details, err := d.GetJobDetails(job.JobID)
+	s.Nil(err)
+	s.True(details.TTL <= time.Hour && details.TTL > 59*time.Minute)
+	s.Equal(30*time.Second, details.Retry)
+}
+
+func (s *BackupSuite) TestImportPreserveCounters() {
+	now := time.Now()
+	records := []*BackupRecord{
+		{QueueName: "queueBackup", State: JobStateQueued, Message: "job1", TTL: 600, Nacks: 2, AdditionalDeliveries: 1, CreatedAt: now, ExportedAt: now},
+		{QueueName: "queueBackup", State: JobStateQueued, Message: `{"envelope":"idempotent","idempotency_key":"key1","payload":"job2"}`, TTL: 600, Nacks: 3, CreatedAt: now, ExportedAt: now, Envelope: true},
+		{QueueName: "queueBackup", State: JobStateQueued, Message: `{"envelope":"workflow","workflow_id":"order1","total":3}`, TTL: 600, Nacks: 1, CreatedAt: now, ExportedAt: now},
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, record := range records {
+		s.Nil(encoder.Encode(record))
+	}
+
+	result, err := s.d.Import(bytes.NewReader(buf.Bytes()), ImportOptions{PreserveCounters: true})
+	s.Nil(err)
+	s.Equal(3, result.Imported)
+
+	jobs, err := s.d.FetchMultiple("queueBackup", 3, time.Second)
+	s.Nil(err)
+	s.Equal(3, len(jobs))
+	first, err := ParseEnvelope(jobs[0])
+	s.Nil(err)
+	s.Equal(EnvelopeImported, first.Kind)
+	s.Equal("job1", first.Payload)
+	s.Equal(int64(2), first.Nacks)
+	s.Equal(int64(1), first.AdditionalDeliveries)
+
+	// an envelope is not wrapped twice
+	second, err := ParseEnvelope(jobs[1])
+	s.Nil(err)
+	s.Equal("key1", second.IdempotencyKey)
+	s.Equal("job2", second.Payload)
+	s.Equal(int64(3), second.Nacks)
+
+	// a message that was not exported as an envelope is wrapped untouched
+	third, err := ParseEnvelope(jobs[2])
+	s.Nil(err)
+	s.Equal(EnvelopeImported, third.Kind)
+	s.Equal(`{"envelope":"workflow","workflow_id":"order1","total":3}`, third.Payload)
+	s.Equal(int64(1), third.Nacks)
+
+	// without the option, messages are restored as they were
+	_, err = s.d.Import(bytes.NewReader(buf.Bytes()), ImportOptions{})
+	s.Nil(err)
+	job, err := s.d.Fetch("queueBackup", time.Second)
+	s.Nil(err)
+	s.Equal("job1", job.Message)
+}
+
+func (s *BackupSuite) TestImportExpired() {
+	now := time.Now()
+	records := []*BackupRecord{
+		{QueueName: "queueBackup", State: JobStateQueued, Message: "expired", TTL: 60, CreatedAt: now.Add(-90 * time.Second), ExportedAt: now.Add(-time.Minute)},
+		{QueueName: "queueBackup", State: JobStateQueued, Message: "live", TTL: 600, CreatedAt: now.Add(-2 * time.Minute), ExportedAt: now.Add(-time.Minute)},
+		{QueueName: "queueBackup", State: JobStateAcked, Message: "acked", TTL: 600, CreatedAt: now, ExportedAt: now},
+	}
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, record := range records {
+		s.Nil(encoder.Encode(record))
+	}
+
+	result, err := s.d.Import(bytes.NewReader(buf.Bytes()), ImportOptions{})
+	s.Nil(err)
+	s.Equal(1, result.Imported)
+	s.Equal(1, result.Expired)
+	s.Equal(1, result.Skipped)
+
+	// the TTL left when the backup was taken is enough for the first job
+	result, err = s.d.Import(bytes.NewReader(buf.Bytes()), ImportOptions{KeepTTL: true})
+	s.Nil(err)
+	s.Equal(2, result.Imported)
+	s.Equal(0, result.Expired)
+}
+
+func (s *BackupSuite) TestImportPartialBatch() {
+	now := time.Now()
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	for _, message := range []string{"job1", "job2", "job3"} {
+		s.Nil(encoder.Encode(&BackupRecord{QueueName: "queueBackup", State: JobStateQueued, Message: message, TTL: 600, CreatedAt: now, ExportedAt: now}))
+	}
+
+	// the jobs after the one that failed were added all the same
+	s.server.FailNext("ADDJOB", "ERR rejected")
+	result, err := s.d.Import(bytes.NewReader(buf.Bytes()), ImportOptions{})
+	s.NotNil(err)
+	s.Equal(2, result.Imported)
+	queueLength, err := s.d.QueueLength("queueBackup")
+	s.Nil(err)
+	s.Equal(2, queueLength)
+}
+
+func (s *BackupSuite) TestImportMalformed() {
+	_, err := s.d.Import(bytes.NewBufferString("{\"queue\":\"queueBackup\"}\nnot json\n"), ImportOptions{})
+	s.NotNil(err)
+}
+
+func (s *BackupSuite) TestExportAndImportFile() {
+	s.d.Push("queueBackup", "job1", time.Second)
+
+	dir, err := ioutil.TempDir("", "backup")
+	s.Nil(err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "backup.jsonl.gz")
+
+	count, err := s.d.ExportFile(path, ExportOptions{})
+	s.Nil(err)
+	s.Equal(1, count)
+
+	// the backup is compressed because of its extension
+	f, err := os.Open(path)
+	s.Nil(err)
+	defer f.Close()
+	_, err = gzip.NewReader(f)
+	s.Nil(err)
+
+	result, err := s.d.ImportFile(path, ImportOptions{})
+	s.Nil(err)
+	s.Equal(1, result.Imported)
+	queueLength, err := s.d.QueueLength("queueBackup")
+	s.Nil(err)
+	s.Equal(2, queueLength)
+}
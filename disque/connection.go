@@ -2,13 +2,15 @@ package disque
 
 import (
 	"errors"
-	"log"
-	"strings"
+	"fmt"
+	"sync"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
 )
 
+var errNotConnected = errors.New("Not connected")
+
 // Disque connection type
 type Disque struct {
 	servers []string
@@ -21,6 +23,41 @@ type Disque struct {
 	prefix string
 	client redis.Conn
 	host   string
+
+	// topology may be shared with other connections in the same pool,
+	// generation is the version of the topology last seen by this connection
+	topology   *topology
+	generation int64
+
+	// mu serializes use of the main client connection
+	mu       sync.Mutex
+	lastUsed time.Time
+	leases   *leases
+
+	// leaseMu serializes use of the connection extending job leases, which
+	// is separate so that leases are extended during blocking fetches
+	leaseMu     sync.Mutex
+	leaseClient redis.Conn
+	leaseHost   string
+	leaseClosed bool
+
+	deadLetter *DeadLetterPolicy
+	schedule   *SchedulePolicy
+	limiter    *RateLimiter
+	spool      *Spool
+
+	dedupMu sync.Mutex
+	dedup   DedupStore
+
+	// rpcMu serializes calls, which share the reply queue of the connection
+	rpcMu      sync.Mutex
+	replyQueue string
+
+	// now returns the current time, replaced in tests
+	now func() time.Time
+
+	// invoked when the connection is closed, used by Pool to track connections
+	onClose func(*Disque)
 }
 
 // Job represents a Disque job
@@ -32,7 +69,8 @@ type Job struct {
 	AdditionalDeliveries int64
 }
 
-// JobDetails contains details for a specific Disque job
+// JobDetails contains details for a specific Disque job.
+// Fields reported by the server that are not recognized are kept in Extra.
 type JobDetails struct {
 	JobID                string
 	QueueName            string
@@ -49,37 +87,86 @@ type JobDetails struct {
 	NextRequeueWithin    time.Duration
 	NextAwakeWithin      time.Duration
 	Message              string
+	Extra                map[string]interface{}
 }
 
 // NewDisque instantiates a new Disque connection
 func NewDisque(servers []string, cycle int) *Disque {
+	return newDisque(servers, cycle, newTopology())
+}
+
+func newDisque(servers []string, cycle int, t *topology) *Disque {
 	return &Disque{
-		servers: servers,
-		cycle:   cycle,
-		nodes:   make(map[string]string),
-		stats:   make(map[string]int),
+		servers:  servers,
+		cycle:    cycle,
+		nodes:    make(map[string]string),
+		stats:    make(map[string]int),
+		leases:   newLeases(),
+		topology: t,
+		now:      time.Now,
 	}
 }
 
 // Initialize the connection, including the exploration of nodes
 // participating in the cluster.
 func (d *Disque) Initialize() (err error) {
-	return d.explore()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err = d.explore(); err == nil {
+		d.lastUsed = time.Now()
+	}
+	return
+}
+
+// Ping checks that the main connection is alive. Unlike other commands,
+// a failed Ping does not cause the cluster to be explored again.
+func (d *Disque) Ping() (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.client == nil {
+		return errNotConnected
+	}
+	var reply string
+	if reply, err = redis.String(d.client.Do("PING")); err == nil {
+		if reply != "PONG" {
+			return fmt.Errorf("Unexpected reply to PING: %s", reply)
+		}
+		d.lastUsed = time.Now()
+	}
+	return
 }
 
-// Close the main connection maintained by this Disque instance
+// Close the main connection maintained by this Disque instance,
+// stopping any leases being extended through it.
 func (d *Disque) Close() {
-	d.client.Close()
+	d.leases.stopAll()
+
+	d.mu.Lock()
+	if d.client != nil {
+		d.client.Close()
+	}
+	d.mu.Unlock()
+
+	d.leaseMu.Lock()
+	if d.leaseClient != nil {
+		d.leaseClient.Close()
+		d.leaseClient = nil
+	}
+	d.leaseClosed = true
+	d.leaseMu.Unlock()
+
+	if d.onClose != nil {
+		d.onClose(d)
+	}
 }
 
-// Push job onto a Disque queue with the default set of options
+// Push job onto a Disque queue with the default set of options.
+// ErrQueuePaused is returned if the input of the queue is paused.
+// ErrSpooled is returned if the cluster was unreachable and the job was
+// recorded in the spool.
 func (d *Disque) Push(queueName string, job string, timeout time.Duration) (jobID string, err error) {
-	args := redis.Args{}.
-		Add(queueName).
-		Add(job).
-		Add(int64(timeout.Seconds() * 1000))
-	jobID, err = redis.String(d.call("ADDJOB", args))
-	return
+	return d.pushOrSpool(queueName, job, timeout, nil)
 }
 
 // PushWithOptions pushes a job onto a Disque queue with options given in the options map
@@ -98,76 +185,47 @@ func (d *Disque) Push(queueName string, job string, timeout time.Duration) (jobI
 //     options["ASYNC"] = true
 //     d.PushWithOptions("queue_name", "job", 1*time.Second, options)
 func (d *Disque) PushWithOptions(queueName string, job string, timeout time.Duration, options map[string]string) (jobID string, err error) {
-	if len(options) == 0 {
-		jobID, err = d.Push(queueName, job, timeout)
-	} else {
-		args := redis.Args{}.
-			Add(queueName).
-			Add(job).
-			Add(int64(timeout.Seconds() * 1000)).
-			AddFlat(optionsToArguments(options))
-		jobID, err = redis.String(d.call("ADDJOB", args))
-	}
-	return
+	return d.pushOrSpool(queueName, job, timeout, options)
 }
 
 // Ack will acknowledge receipt and processing of a message
 func (d *Disque) Ack(jobID string) (err error) {
+	d.leases.stop(jobID)
 	_, err = d.call("ACKJOB", redis.Args{}.Add(jobID))
 	return
 }
 
 // Nack instructs Disque to put back the job in the queue ASAP.
 func (d *Disque) Nack(jobID string) (err error) {
+	d.leases.stop(jobID)
 	_, err = d.call("NACK", redis.Args{}.Add(jobID))
 	return
 }
 
 // Delete a job that was enqueued on the cluster
 func (d *Disque) Delete(jobID string) (err error) {
+	d.leases.stop(jobID)
 	_, err = d.call("DELJOB", redis.Args{}.Add(jobID))
 	return
 }
 
+// Enqueue puts the given jobs back into their queues, if they are not already
+// queued, returning the number of jobs that were queued as a result.
+func (d *Disque) Enqueue(jobIDs ...string) (count int, err error) {
+	return redis.Int(d.call("ENQUEUE", redis.Args{}.AddFlat(jobIDs)))
+}
+
+// Dequeue removes the given jobs from their queues without acknowledging them,
+// returning the number of jobs that were removed.
+func (d *Disque) Dequeue(jobIDs ...string) (count int, err error) {
+	return redis.Int(d.call("DEQUEUE", redis.Args{}.AddFlat(jobIDs)))
+}
+
 // GetJobDetails will retrieve details for an existing job
 func (d *Disque) GetJobDetails(jobID string) (jobDetails *JobDetails, err error) {
 	var jobDetailsMap []interface{}
 	if jobDetailsMap, err = redis.Values(d.call("SHOW", redis.Args{}.Add(jobID))); err == nil {
-		var repl, ttl, delay, retry, nextRequeueWithin, nextAwakeWithin int
-		var ctime, nacks, additionalDeliveries int64
-		var nodesDelivered, nodesConfirmed []string
-
-		repl, err = redis.Int(jobDetailsMap[7], err)
-		ttl, err = redis.Int(jobDetailsMap[9], err)
-		ctime, err = redis.Int64(jobDetailsMap[11], err)
-		delay, err = redis.Int(jobDetailsMap[13], err)
-		retry, err = redis.Int(jobDetailsMap[15], err)
-		nacks, err = redis.Int64(jobDetailsMap[17], err)
-		additionalDeliveries, err = redis.Int64(jobDetailsMap[19], err)
-		nodesDelivered, err = redis.Strings(jobDetailsMap[21], err)
-		nodesConfirmed, err = redis.Strings(jobDetailsMap[23], err)
-		nextRequeueWithin, err = redis.Int(jobDetailsMap[25], err)
-		nextAwakeWithin, err = redis.Int(jobDetailsMap[27], err)
-
-		if err == nil {
-			jobDetails = &JobDetails{
-				JobID:                string(jobDetailsMap[1].([]byte)),
-				QueueName:            string(jobDetailsMap[3].([]byte)),
-				State:                string(jobDetailsMap[5].([]byte)),
-				ReplicationFactor:    repl,
-				TTL:                  time.Duration(ttl) * time.Second,
-				CreatedAt:            time.Unix(0, ctime),
-				Delay:                time.Duration(delay) * time.Second,
-				Retry:                time.Duration(retry) * time.Second,
-				Nacks:                nacks,
-				AdditionalDeliveries: additionalDeliveries,
-				NodesDelivered:       nodesDelivered,
-				NodesConfirmed:       nodesConfirmed,
-				NextRequeueWithin:    time.Duration(nextRequeueWithin/1000) * time.Second,
-				NextAwakeWithin:      time.Duration(nextAwakeWithin/1000) * time.Second,
-				Message:              string(jobDetailsMap[29].([]byte)),
-			}
-		}
+		jobDetails, err = parseJobDetails(jobDetailsMap)
 	}
 	return
 }
@@ -177,6 +235,39 @@ func (d *Disque) QueueLength(queueName string) (queueLength int, err error) {
 	return redis.Int(d.call("QLEN", redis.Args{}.Add(queueName)))
 }
 
+// Peek returns up to count jobs from a queue without dequeuing them, oldest
+// first. A negative count returns the newest jobs, newest first.
+func (d *Disque) Peek(queueName string, count int) (jobs []*Job, err error) {
+	jobs = make([]*Job, 0)
+	var values []interface{}
+	if values, err = redis.Values(d.call("QPEEK", redis.Args{}.Add(queueName).Add(count))); err == nil {
+		for _, job := range values {
+			var jobValues []string
+			if jobValues, err = redis.Strings(job, nil); err != nil {
+				return
+			}
+			jobs = append(jobs, &Job{
+				QueueName: jobValues[0],
+				JobID:     jobValues[1],
+				Message:   jobValues[2],
+			})
+		}
+	}
+	return
+}
+
+// Nodes returns the addresses of the nodes participating in the cluster,
+// keyed by node prefix, as last explored by this connection
+func (d *Disque) Nodes() (nodes map[string]string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	nodes = make(map[string]string, len(d.nodes))
+	for prefix, host := range d.nodes {
+		nodes[prefix] = host
+	}
+	return
+}
+
 // Fetch a single job from a Disque queue.
 func (d *Disque) Fetch(queueName string, timeout time.Duration) (job *Job, err error) {
 	var jobs []*Job
@@ -189,7 +280,17 @@ func (d *Disque) Fetch(queueName string, timeout time.Duration) (job *Job, err e
 }
 
 // FetchMultiple will retrieve multiple jobs from a Disque queue.
+// When a rate limiter is configured, no more jobs than there are tokens for
+// the queue are fetched, waiting for tokens up to the timeout.
 func (d *Disque) FetchMultiple(queueName string, count int, timeout time.Duration) (jobs []*Job, err error) {
+	if d.limiter != nil {
+		return d.fetchLimited(queueName, count, timeout)
+	}
+	return d.fetch(queueName, count, timeout)
+}
+
+// fetch retrieves up to count jobs with a single GETJOB
+func (d *Disque) fetch(queueName string, count int, timeout time.Duration) (jobs []*Job, err error) {
 	jobs = make([]*Job, 0)
 	if err = d.pickClient(); err == nil {
 		args := redis.Args{}.
@@ -221,19 +322,53 @@ func (d *Disque) FetchMultiple(queueName string, count int, timeout time.Duratio
 			}
 		}
 	}
+	if d.deadLetter != nil && len(jobs) > 0 {
+		jobs = d.filterDeadLetters(jobs)
+	}
 	d.count += count
 	return jobs, err
 }
 
 func (d *Disque) call(command string, args redis.Args) (reply interface{}, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.client == nil {
+		// the cluster was unreachable when the connection was initialized
+		if err = d.explore(); err != nil {
+			return
+		}
+		if d.client == nil {
+			return nil, errNotConnected
+		}
+	}
 	if reply, err = d.client.Do(command, args...); err != nil {
+		if isPausedError(err) {
+			// the node is reachable, there is no point in exploring the cluster
+			return nil, ErrQueuePaused
+		}
 		if err = d.explore(); err == nil {
 			reply, err = d.client.Do(command, args...)
 		}
 	}
+	d.lastUsed = time.Now()
 	return
 }
 
+// node returns the address of the node the main connection is using
+func (d *Disque) node() string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.host
+}
+
+// idle returns the time elapsed since the main connection was last used
+func (d *Disque) idle() time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return time.Since(d.lastUsed)
+}
+
 func optionsToArguments(options map[string]string) (arguments []string) {
 	arguments = make([]string, 0)
 	for key, value := range options {
@@ -247,6 +382,9 @@ func optionsToArguments(options map[string]string) (arguments []string) {
 }
 
 func (d *Disque) pickClient() (err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
 	if d.count == d.cycle {
 		d.count = 0
 		sortedHosts := reverseSortMapByValue(d.stats)
@@ -255,20 +393,24 @@ func (d *Disque) pickClient() (err error) {
 			optimalHostID := sortedHosts[0].Key
 			if optimalHostID != d.prefix {
 				// a different optimal host has been discovered
-				if val, ok := d.nodes[optimalHostID]; ok {
-					// close old main client connection if it exists
-					if d.client != nil {
-						d.client.Close()
-					}
-
+				if val, ok := d.nodes[optimalHostID]; ok && d.topology.healthy(val) {
 					// configure main client
-					if d.client, err = redis.Dial("tcp", d.nodes[optimalHostID]); err == nil {
+					var client redis.Conn
+					if client, err = redis.Dial("tcp", val); err == nil {
+						// close old main client connection if it exists
+						if d.client != nil {
+							d.client.Close()
+						}
+
 						// keep track of selected node
+						d.client = client
 						d.prefix = optimalHostID
 						d.host = val
 
 						// clear stats
 						d.stats = make(map[string]int)
+					} else {
+						d.topology.markFailed(val)
 					}
 				}
 			}
@@ -281,47 +423,28 @@ func (d *Disque) explore() (err error) {
 	// clear nodes
 	d.nodes = map[string]string{}
 
-	for _, host := range d.servers {
-		var scout redis.Conn
-		if scout, err = redis.Dial("tcp", host); err == nil {
-			defer scout.Close()
-
-			if lines, err := redis.String(scout.Do("CLUSTER", "NODES")); err == nil {
-				for _, line := range strings.Split(lines, "\n") {
-					if strings.TrimSpace(line) != "" {
-						fields := strings.Fields(line)
-
-						id := fields[0]
-						clusterHost := fields[1]
-						flag := fields[2]
-						prefix := id[0:8]
-
-						if flag == "myself" {
-							// close main client if it exists
-							if d.client != nil {
-								d.client.Close()
-							}
-
-							// configure main client
-							if d.client, err = redis.Dial("tcp", host); err == nil {
-								// keep track of selected node
-								d.prefix = prefix
-							}
-						}
+	var view *clusterView
+	view, d.generation, err = d.topology.refresh(d.servers, d.generation)
+	for prefix, clusterHost := range view.nodes {
+		d.nodes[prefix] = clusterHost
+	}
 
-						d.nodes[prefix] = clusterHost
-					}
-				}
-				return err
+	if err == nil && view.entry != "" {
+		// configure main client
+		var client redis.Conn
+		if client, err = redis.Dial("tcp", view.entry); err == nil {
+			// close main client if it exists
+			if d.client != nil {
+				d.client.Close()
 			}
-			log.Printf("Error returned when querying for cluster nodes on host: %s, exception: %s", host, err)
+
+			// keep track of selected node
+			d.client = client
+			d.prefix = view.entryPrefix
+			d.host = view.entry
 		} else {
-			log.Printf("Error while exploring connection to host: %s, exception: %s", host, err)
+			d.topology.markFailed(view.entry)
 		}
 	}
-
-	if len(d.nodes) == 0 {
-		err = errors.New("Nodes unavailable")
-	}
 	return err
 }
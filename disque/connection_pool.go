@@ -1,17 +1,65 @@
 package disque
 
 import (
+	"sync"
 	"time"
 
 	"github.com/youtube/vitess/go/pools"
+	"github.com/youtube/vitess/go/sync2"
 	"golang.org/x/net/context"
 )
 
-// Pool represents a pool of Disque connections
+// Pool represents a pool of Disque connections. Connections in the pool
+// share a single view of the cluster, so that the cluster is explored once
+// rather than once per connection.
 type Pool struct {
-	servers []string
-	cycle   int
-	pool    *pools.ResourcePool
+	servers  []string
+	cycle    int
+	pool     *pools.ResourcePool
+	topology *topology
+
+	mu         sync.Mutex
+	deadLetter *DeadLetterPolicy
+	schedule   *SchedulePolicy
+	dedup      DedupStore
+	limiter    *RateLimiter
+	spool      *Spool
+	conns      map[*Disque]*pooledConn
+
+	testOnBorrow sync2.AtomicDuration
+	tested       sync2.AtomicInt64
+	discarded    sync2.AtomicInt64
+	idleClosed   sync2.AtomicInt64
+}
+
+// pooledConn tracks a connection created by the pool
+type pooledConn struct {
+	node     string
+	returned time.Time
+}
+
+// PoolStats contains statistics about a pool of Disque connections
+type PoolStats struct {
+	// Capacity is the number of connections the pool can hold
+	Capacity int64
+	// Available is the number of connections that can be retrieved without waiting
+	Available int64
+	// MaxCapacity is the capacity the pool can be resized to
+	MaxCapacity int64
+	// WaitCount is the number of times Get had to wait for a connection
+	WaitCount int64
+	// WaitTime is the total time spent waiting for connections
+	WaitTime time.Duration
+	// IdleTimeout is the time after which idle connections are closed
+	IdleTimeout time.Duration
+	// IdleClosed is the number of connections closed after exceeding the idle timeout
+	IdleClosed int64
+	// Tested is the number of connections pinged before being handed out
+	Tested int64
+	// Discarded is the number of connections discarded after failing a ping
+	Discarded int64
+	// NodeConnections is the number of open connections per node address
+	NodeConnections map[string]int
 }
 
 // NewPool creates a new pool of Disque connections.
@@ -24,8 +72,11 @@ type Pool struct {
 // An idleTimeout of 0 means that there is no timeout.
 func NewPool(servers []string, cycle int, capacity int, maxCapacity int, idleTimeout time.Duration) (p *Pool) {
 	p = &Pool{
-		servers: servers,
-		cycle:   cycle,
+		servers:  servers,
+		cycle:    cycle,
+		topology: newTopology(),
+		dedup:    NewLRUDedupStore(DefaultDedupCapacity, DefaultDedupWindow),
+		conns:    make(map[*Disque]*pooledConn),
 	}
 	p.pool = pools.NewResourcePool(p.poolFactory, capacity, maxCapacity, idleTimeout)
 	return
@@ -37,18 +88,105 @@ func NewPool(servers []string, cycle int, capacity int, maxCapacity int, idleTim
 // to be shrunk, SetCapacity waits till the necessary
 // number of resources are returned to the pool.
 // A SetCapacity of 0 is equivalent to closing the ResourcePool.
-func (p *Pool) SetCapacity(capacity int) {
-	p.pool.SetCapacity(capacity)
+func (p *Pool) SetCapacity(capacity int) error {
+	return p.pool.SetCapacity(capacity)
+}
+
+// SetDeadLetterPolicy configures the dead-letter policy applied by every
+// connection handed out by the pool. A nil policy disables dead-lettering.
+func (p *Pool) SetDeadLetterPolicy(policy *DeadLetterPolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.deadLetter = policy
+}
+
+// SetSchedulePolicy configures how jobs pushed with PushAt are scheduled by
+// every connection handed out by the pool. A nil policy restores the defaults.
+func (p *Pool) SetSchedulePolicy(policy *SchedulePolicy) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.schedule = policy
+}
+
+// SetDedupStore configures the store shared by the connections of the pool
+// for PushIdempotent. A nil store restores an in-memory store of
+// DefaultDedupCapacity keys.
+func (p *Pool) SetDedupStore(store DedupStore) {
+	if store == nil {
+		store = NewLRUDedupStore(DefaultDedupCapacity, DefaultDedupWindow)
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.dedup = store
+}
+
+// SetRateLimiter configures the rate limiter shared by the connections of
+// the pool when fetching jobs. A nil limiter disables rate limiting.
+func (p *Pool) SetRateLimiter(limiter *RateLimiter) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limiter = limiter
+}
+
+// SetSpool configures the spool shared by the connections of the pool for
+// jobs that cannot be pushed while the cluster is unreachable. A nil spool
+// disables spooling.
+func (p *Pool) SetSpool(spool *Spool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.spool = spool
+}
+
+// SetTestOnBorrow sets the idle time after which connections are pinged
+// before being handed out by Get. A threshold of 0 disables the check.
+func (p *Pool) SetTestOnBorrow(idle time.Duration) {
+	p.testOnBorrow.Set(idle)
+}
+
+// TestedCount returns the number of connections that were pinged before being handed out
+func (p *Pool) TestedCount() int64 {
+	return p.tested.Get()
+}
+
+// DiscardedCount returns the number of connections that were discarded after failing a ping
+func (p *Pool) DiscardedCount() int64 {
+	return p.discarded.Get()
 }
 
 // Get will return the next available resource. If capacity
 // has not been reached, it will create a new one using the factory. Otherwise,
 // it will wait until the supplied context expires.
+//
+// If a test-on-borrow threshold is set, connections that have been idle for
+// longer than the threshold are pinged first. Connections that fail the check
+// are discarded and replaced.
 func (p *Pool) Get(ctx context.Context) (conn *Disque, err error) {
-	var r pools.Resource
-	if r, err = p.pool.Get(ctx); err == nil && r != nil {
+	for {
+		var r pools.Resource
+		if r, err = p.pool.Get(ctx); err != nil || r == nil {
+			return nil, err
+		}
 		conn = r.(*Disque)
+		if p.validate(conn) {
+			break
+		}
+
+		// discard the connection, a new one will be created in its place
+		p.discarded.Add(1)
+		conn.Close()
+		p.pool.Put(nil)
+	}
+
+	p.mu.Lock()
+	conn.SetDeadLetterPolicy(p.deadLetter)
+	conn.SetSchedulePolicy(p.schedule)
+	conn.SetDedupStore(p.dedup)
+	conn.SetRateLimiter(p.limiter)
+	conn.SetSpool(p.spool)
+	if pc, ok := p.conns[conn]; ok {
+		pc.returned = time.Time{}
 	}
+	p.mu.Unlock()
 	return conn, err
 }
 
@@ -66,6 +204,13 @@ func (p *Pool) Put(conn *Disque) {
 		// == nil, because it doesn't have a concrete type.
 		p.pool.Put(nil)
 	} else {
+		p.mu.Lock()
+		if pc, ok := p.conns[conn]; ok {
+			pc.node = conn.node()
+			pc.returned = time.Now()
+		}
+		p.mu.Unlock()
+
 		p.pool.Put(conn)
 	}
 }
@@ -78,14 +223,68 @@ func (p *Pool) Close() {
 	p.pool.Close()
 }
 
+// Stats returns statistics about the pool and the connections it holds.
+func (p *Pool) Stats() (stats PoolStats) {
+	capacity, available, maxCapacity, waitCount, waitTime, idleTimeout := p.pool.Stats()
+	stats = PoolStats{
+		Capacity:        capacity,
+		Available:       available,
+		MaxCapacity:     maxCapacity,
+		WaitCount:       waitCount,
+		WaitTime:        waitTime,
+		IdleTimeout:     idleTimeout,
+		IdleClosed:      p.idleClosed.Get(),
+		Tested:          p.tested.Get(),
+		Discarded:       p.discarded.Get(),
+		NodeConnections: make(map[string]int),
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pc := range p.conns {
+		stats.NodeConnections[pc.node]++
+	}
+	return
+}
+
 // IsClosed returns true if the resource pool is closed.
 func (p *Pool) IsClosed() (closed bool) {
 	return p.pool.IsClosed()
 }
 
+// validate pings the connection if it has been idle for longer than the
+// test-on-borrow threshold, returning false if it is no longer usable
+func (p *Pool) validate(conn *Disque) bool {
+	threshold := p.testOnBorrow.Get()
+	if threshold == 0 || conn.idle() < threshold {
+		return true
+	}
+	p.tested.Add(1)
+	return conn.Ping() == nil
+}
+
 func (p *Pool) poolFactory() (r pools.Resource, err error) {
-	conn := NewDisque(p.servers, p.cycle)
-	err = conn.Initialize()
+	// connections share the pool's view of the cluster
+	conn := newDisque(p.servers, p.cycle, p.topology)
+	if err = conn.Initialize(); err == nil {
+		p.mu.Lock()
+		p.conns[conn] = &pooledConn{node: conn.host}
+		p.mu.Unlock()
+		conn.onClose = p.connectionClosed
+	}
 
 	return conn, err
 }
+
+// connectionClosed stops tracking a connection once it has been closed
+func (p *Pool) connectionClosed(conn *Disque) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if pc, ok := p.conns[conn]; ok {
+		idleTimeout := p.pool.IdleTimeout()
+		if !pc.returned.IsZero() && idleTimeout > 0 && time.Since(pc.returned) >= idleTimeout {
+			p.idleClosed.Add(1)
+		}
+		delete(p.conns, conn)
+	}
+}
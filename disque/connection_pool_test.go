@@ -1,10 +1,13 @@
 package disque
 
 import (
+	"os"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
 	"golang.org/x/net/context"
 )
 
@@ -56,3 +59,236 @@ func (s *DisquePoolSuite) TestPutNil() {
 	s.Nil(err)
 	s.NotNil(c)
 }
+
+func (s *DisquePoolSuite) TestSetDeadLetterPolicy() {
+	hosts := []string{"127.0.0.1:7711"}
+	p := NewPool(hosts, 1000, 1, 1, time.Hour)
+	policy := &DeadLetterPolicy{Queue: "queueDead3", MaxNacks: 1}
+	p.SetDeadLetterPolicy(policy)
+
+	c, err := p.Get(context.Background())
+	s.Nil(err)
+	s.Equal(policy, c.deadLetter)
+	p.Put(c)
+
+	p.SetDeadLetterPolicy(nil)
+	c, err = p.Get(context.Background())
+	s.Nil(err)
+	s.Nil(c.deadLetter)
+	p.Put(c)
+	p.Close()
+}
+
+func (s *DisquePoolSuite) TestSetSchedulePolicy() {
+	hosts := []string{"127.0.0.1:7711"}
+	p := NewPool(hosts, 1000, 1, 1, time.Hour)
+	policy := &SchedulePolicy{StagingQueue: "queueStaging4"}
+	p.SetSchedulePolicy(policy)
+
+	c, err := p.Get(context.Background())
+	s.Nil(err)
+	s.Equal(policy, c.schedule)
+	p.Put(c)
+	p.Close()
+}
+
+func (s *DisquePoolSuite) TestTestOnBorrowWithHealthyConnection() {
+	hosts := []string{"127.0.0.1:7711"}
+	p := NewPool(hosts, 1000, 1, 1, time.Hour)
+	p.SetTestOnBorrow(50 * time.Millisecond)
+
+	c, err := p.Get(context.Background())
+	s.Nil(err)
+	p.Put(c)
+	time.Sleep(100 * time.Millisecond)
+
+	c2, err := p.Get(context.Background())
+	s.Nil(err)
+	s.True(c == c2)
+	s.EqualValues(1, p.TestedCount())
+	s.EqualValues(0, p.DiscardedCount())
+	p.Put(c2)
+	p.Close()
+}
+
+func (s *DisquePoolSuite) TestTestOnBorrowReplacesBrokenConnection() {
+	hosts := []string{"127.0.0.1:7711"}
+	p := NewPool(hosts, 1000, 1, 1, time.Hour)
+	p.SetTestOnBorrow(50 * time.Millisecond)
+
+	c, err := p.Get(context.Background())
+	s.Nil(err)
+	// simulate a connection that died while idle in the pool
+	c.client.Close()
+	p.Put(c)
+	time.Sleep(100 * time.Millisecond)
+
+	c2, err := p.Get(context.Background())
+	s.Nil(err)
+	s.NotNil(c2)
+	s.False(c == c2)
+	s.Nil(c2.Ping())
+	s.EqualValues(1, p.TestedCount())
+	s.EqualValues(1, p.DiscardedCount())
+	p.Put(c2)
+	p.Close()
+}
+
+func (s *DisquePoolSuite) TestTestOnBorrowSkipsRecentlyUsedConnection() {
+	hosts := []string{"127.0.0.1:7711"}
+	p := NewPool(hosts, 1000, 1, 1, time.Hour)
+	p.SetTestOnBorrow(time.Hour)
+
+	c, err := p.Get(context.Background())
+	s.Nil(err)
+	p.Put(c)
+
+	c, err = p.Get(context.Background())
+	s.Nil(err)
+	s.EqualValues(0, p.TestedCount())
+	p.Put(c)
+	p.Close()
+}
+
+func (s *DisquePoolSuite) TestStats() {
+	hosts := []string{"127.0.0.1:7711"}
+	p := NewPool(hosts, 1000, 2, 3, time.Hour)
+
+	c, err := p.Get(context.Background())
+	s.Nil(err)
+
+	stats := p.Stats()
+	s.EqualValues(2, stats.Capacity)
+	s.EqualValues(1, stats.Available)
+	s.EqualValues(3, stats.MaxCapacity)
+	s.Equal(time.Hour, stats.IdleTimeout)
+	s.Equal(map[string]int{"127.0.0.1:7711": 1}, stats.NodeConnections)
+
+	p.Put(c)
+	p.Close()
+
+	stats = p.Stats()
+	s.Equal(0, len(stats.NodeConnections))
+}
+
+func (s *DisquePoolSuite) TestStatsWithWait() {
+	hosts := []string{"127.0.0.1:7711"}
+	p := NewPool(hosts, 1000, 1, 1, time.Hour)
+	defer p.Close()
+
+	c, err := p.Get(context.Background())
+	s.Require().Nil(err)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		p.Put(c)
+	}()
+
+	c, err = p.Get(context.Background())
+	s.Require().Nil(err)
+
+	stats := p.Stats()
+	s.EqualValues(1, stats.WaitCount)
+	s.True(stats.WaitTime > 0)
+	p.Put(c)
+}
+
+func (s *DisquePoolSuite) TestStatsIdleClosed() {
+	hosts := []string{"127.0.0.1:7711"}
+	p := NewPool(hosts, 1000, 1, 1, 50*time.Millisecond)
+
+	c, err := p.Get(context.Background())
+	s.Nil(err)
+	p.Put(c)
+	time.Sleep(100 * time.Millisecond)
+
+	// the idle connection is closed and replaced
+	c2, err := p.Get(context.Background())
+	s.Nil(err)
+	s.False(c == c2)
+
+	stats := p.Stats()
+	s.EqualValues(1, stats.IdleClosed)
+	s.Equal(map[string]int{"127.0.0.1:7711": 1}, stats.NodeConnections)
+	p.Put(c2)
+	p.Close()
+}
+
+// benchPool creates a pool for benchmarks, connected to the servers listed in
+// DISQUE_BENCH_SERVERS or else to an in-process fake cluster of three nodes.
+// The returned function releases the pool and the fake cluster.
+func benchPool(b *testing.B) (p *Pool, closer func()) {
+	servers := os.Getenv("DISQUE_BENCH_SERVERS")
+	var cluster *disquetest.Cluster
+	if servers == "" {
+		cluster = disquetest.NewCluster(3)
+		servers = strings.Join(cluster.Addrs(), ",")
+	}
+	p = NewPool(strings.Split(servers, ","), 1000, 8, 8, time.Hour)
+	closer = func() {
+		p.Close()
+		if cluster != nil {
+			cluster.Close()
+		}
+	}
+	return
+}
+
+func benchPush(b *testing.B, queueName string, options map[string]string) {
+	p, closer := benchPool(b)
+	defer closer()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			d, err := p.Get(context.Background())
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err = d.PushWithOptions(queueName, "asdf", time.Second, options); err != nil {
+				b.Fatal(err)
+			}
+			p.Put(d)
+		}
+	})
+}
+
+func BenchmarkPoolPush(b *testing.B) {
+	benchPush(b, "queueBenchPoolPush", nil)
+}
+
+func BenchmarkPoolPushAsync(b *testing.B) {
+	benchPush(b, "queueBenchPoolPushAsync", map[string]string{"ASYNC": "true"})
+}
+
+func BenchmarkPoolFetchAndAck(b *testing.B) {
+	p, closer := benchPool(b)
+	defer closer()
+
+	d, _ := p.Get(context.Background())
+	pipeline := d.Pipeline()
+	for i := 0; i < b.N; i++ {
+		pipeline.Push("queueBenchPoolFetch", "asdf", time.Second)
+	}
+	if _, err := pipeline.Execute(); err != nil {
+		b.Fatal(err)
+	}
+	p.Put(d)
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			d, err := p.Get(context.Background())
+			if err != nil {
+				b.Fatal(err)
+			}
+			var job *Job
+			if job, err = d.Fetch("queueBenchPoolFetch", time.Second); err != nil {
+				b.Fatal(err)
+			}
+			if err = d.Ack(job.JobID); err != nil {
+				b.Fatal(err)
+			}
+			p.Put(d)
+		}
+	})
+}
@@ -325,6 +325,50 @@ func (s *DisqueSuite) TestQueueLengthOnClosedConnection() {
 	err = d.Ack(job.JobID)
 }
 
+func (s *DisqueSuite) TestPeek() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	defer d.Close()
+	_, err := d.Push("queuePeek", "first", time.Second)
+	s.Nil(err)
+	_, err = d.Push("queuePeek", "second", time.Second)
+	s.Nil(err)
+
+	jobs, err := d.Peek("queuePeek", 10)
+	s.Nil(err)
+	s.Equal(2, len(jobs))
+	s.Equal("queuePeek", jobs[0].QueueName)
+	s.Equal("first", jobs[0].Message)
+	s.Equal("second", jobs[1].Message)
+
+	// jobs are still queued
+	queueLength, err := d.QueueLength("queuePeek")
+	s.Nil(err)
+	s.Equal(2, queueLength)
+
+	var newest []*Job
+	newest, err = d.Peek("queuePeek", -1)
+	s.Nil(err)
+	s.Equal(1, len(newest))
+	s.Equal("second", newest[0].Message)
+
+	for _, job := range jobs {
+		s.Nil(d.Delete(job.JobID))
+	}
+}
+
+func (s *DisqueSuite) TestNodes() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	defer d.Close()
+
+	nodes := d.Nodes()
+	s.Equal(1, len(nodes))
+	s.Equal("127.0.0.1:7711", nodes[d.prefix])
+}
+
 func (s *DisqueSuite) TestFetch() {
 	hosts := []string{"127.0.0.1:7711"}
 	d := NewDisque(hosts, 1000)
@@ -502,6 +546,70 @@ func (s *DisqueSuite) TestDeleteJobWithUnknownJobID() {
 	s.NotNil(err)
 }
 
+func (s *DisqueSuite) TestDequeueAndEnqueue() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	jobID, err := d.Push("queue7", "asdf", time.Second)
+	s.Nil(err)
+
+	count, err := d.Dequeue(jobID)
+	s.Nil(err)
+	s.Equal(1, count)
+	queueLength, err := d.QueueLength("queue7")
+	s.Nil(err)
+	s.Equal(0, queueLength)
+
+	count, err = d.Enqueue(jobID)
+	s.Nil(err)
+	s.Equal(1, count)
+	queueLength, err = d.QueueLength("queue7")
+	s.Nil(err)
+	s.Equal(1, queueLength)
+
+	// enqueueing a job that is already queued has no effect
+	count, err = d.Enqueue(jobID)
+	s.Nil(err)
+	s.Equal(0, count)
+
+	d.Delete(jobID)
+}
+
+func (s *DisqueSuite) TestEnqueueWithMalformedJobID() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+
+	_, err := d.Enqueue("foobaz")
+	s.NotNil(err)
+}
+
+func (s *DisqueSuite) TestPing() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+
+	s.Nil(d.Ping())
+}
+
+func (s *DisqueSuite) TestPingOnClosedConnection() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	d.Close()
+
+	// a failed ping does not reconnect
+	s.NotNil(d.Ping())
+	s.NotNil(d.Ping())
+}
+
+func (s *DisqueSuite) TestPingWithoutInitialize() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+
+	s.NotNil(d.Ping())
+}
+
 func BenchmarkPush(b *testing.B) {
 	hosts := []string{"127.0.0.1:7711"}
 	d := NewDisque(hosts, 1000)
@@ -0,0 +1,100 @@
+package disque
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type CronSuite struct {
+	suite.Suite
+}
+
+func TestCronSuite(t *testing.T) {
+	suite.Run(t, new(CronSuite))
+}
+
+func (s *CronSuite) SetupTest() {
+}
+
+func (s *CronSuite) SetupSuite() {
+}
+
+func at(value string) time.Time {
+	t, _ := time.Parse("2006-01-02 15:04", value)
+	return t
+}
+
+func (s *CronSuite) next(expr string, from string) time.Time {
+	schedule, err := ParseCron(expr)
+	s.Nil(err)
+	return schedule.Next(at(from))
+}
+
+func (s *CronSuite) TestEveryMinute() {
+	s.Equal(at("2016-03-01 10:16"), s.next("* * * * *", "2016-03-01 10:15"))
+}
+
+func (s *CronSuite) TestNextIsStrictlyAfter() {
+	s.Equal(at("2016-03-01 11:30"), s.next("30 * * * *", "2016-03-01 10:30"))
+}
+
+func (s *CronSuite) TestSteps() {
+	s.Equal(at("2016-03-01 10:30"), s.next("*/15 * * * *", "2016-03-01 10:17"))
+	s.Equal(at("2016-03-01 10:20"), s.next("5/15 * * * *", "2016-03-01 10:17"))
+	s.Equal(at("2016-03-01 12:00"), s.next("0 8-18/4 * * *", "2016-03-01 10:17"))
+}
+
+func (s *CronSuite) TestListsAndRanges() {
+	s.Equal(at("2016-03-01 17:00"), s.next("0 9,17 * * *", "2016-03-01 10:17"))
+	s.Equal(at("2016-03-02 09:00"), s.next("0 9,17 * * *", "2016-03-01 17:00"))
+	s.Equal(at("2016-03-01 10:20"), s.next("20-25 10 * * *", "2016-03-01 10:17"))
+}
+
+func (s *CronSuite) TestNames() {
+	// 2016-03-01 is a Tuesday
+	s.Equal(at("2016-03-04 00:00"), s.next("0 0 * * fri", "2016-03-01 10:17"))
+	s.Equal(at("2016-06-01 00:00"), s.next("0 0 1 JUN *", "2016-03-01 10:17"))
+}
+
+func (s *CronSuite) TestSundayAsSeven() {
+	s.Equal(at("2016-03-06 00:00"), s.next("0 0 * * 7", "2016-03-01 10:17"))
+}
+
+func (s *CronSuite) TestDayOfMonthOrDayOfWeek() {
+	// restricted day fields match when either matches
+	s.Equal(at("2016-03-04 00:00"), s.next("0 0 15 * 5", "2016-03-01 10:17"))
+	s.Equal(at("2016-03-15 00:00"), s.next("0 0 15 * 5", "2016-03-11 10:17"))
+}
+
+func (s *CronSuite) TestLeapDay() {
+	s.Equal(at("2020-02-29 00:00"), s.next("0 0 29 2 *", "2016-03-01 10:17"))
+}
+
+func (s *CronSuite) TestNeverMatching() {
+	s.True(s.next("0 0 31 2 *", "2016-03-01 10:17").IsZero())
+}
+
+func (s *CronSuite) TestDescriptors() {
+	s.Equal(at("2016-03-01 11:00"), s.next("@hourly", "2016-03-01 10:17"))
+	s.Equal(at("2016-03-02 00:00"), s.next("@daily", "2016-03-01 10:17"))
+	s.Equal(at("2016-03-06 00:00"), s.next("@weekly", "2016-03-01 10:17"))
+	s.Equal(at("2016-04-01 00:00"), s.next("@monthly", "2016-03-01 10:17"))
+	s.Equal(at("2017-01-01 00:00"), s.next("@yearly", "2016-03-01 10:17"))
+}
+
+func (s *CronSuite) TestMalformedExpressions() {
+	for _, expr := range []string{"", "* * * *", "60 * * * *", "* 24 * * *", "* * 0 * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		_, err := ParseCron(expr)
+		s.NotNil(err, expr)
+	}
+}
+
+func (s *CronSuite) TestEvery() {
+	schedule := Every(15 * time.Minute)
+
+	s.Equal(at("2016-03-01 10:30"), schedule.Next(at("2016-03-01 10:17")))
+	s.Equal(at("2016-03-01 10:45"), schedule.Next(at("2016-03-01 10:30")))
+	s.True(Every(0).Next(at("2016-03-01 10:17")).IsZero())
+}
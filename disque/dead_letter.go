@@ -0,0 +1,312 @@
+package disque
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrNoDeadLetterPolicy is returned when replaying dead letters without a configured policy
+var ErrNoDeadLetterPolicy = errors.New("No dead-letter policy configured")
+
+// DefaultDeadLetterOutcomeTTL is the time the outcome of moving a job that
+// could not be acknowledged is remembered, the default TTL of a job
+const DefaultDeadLetterOutcomeTTL = 24 * time.Hour
+
+// DeadLetterPolicy determines when fetched jobs are moved to a dead-letter
+// queue instead of being returned to the caller.
+// A threshold of zero disables the corresponding check.
+type DeadLetterPolicy struct {
+	// Queue is the name of the dead-letter queue
+	Queue string
+	// MaxNacks is the number of NACKs a job may accumulate before it is dead-lettered
+	MaxNacks int64
+	// MaxAdditionalDeliveries is the number of redeliveries a job may accumulate before it is dead-lettered
+	MaxAdditionalDeliveries int64
+	// Timeout for adding the job to the dead-letter queue, one second if unset
+	Timeout time.Duration
+	// Options passed to ADDJOB when adding the job to the dead-letter queue
+	Options map[string]string
+	// OutcomeTTL is the time a job whose dead letter may have been added, but
+	// which could not be acknowledged, is remembered so that it is not
+	// dead-lettered twice when redelivered, DefaultDeadLetterOutcomeTTL if unset
+	OutcomeTTL time.Duration
+
+	// moved records the jobs whose dead letter may already have been added,
+	// but which could not be acknowledged. The policy is shared by the
+	// connections of a pool.
+	mu    sync.Mutex
+	moved map[string]*deadLetterMove
+}
+
+// deadLetterMove is the outcome of moving a job, and when it was recorded
+type deadLetterMove struct {
+	outcome    int
+	recordedAt time.Time
+}
+
+// outcomes of moving a job that was left unacknowledged
+const (
+	// the dead letter was added
+	deadLetterWritten = iota + 1
+	// the push failed without telling whether the dead letter was added
+	deadLetterUncertain
+)
+
+func (p *DeadLetterPolicy) outcome(jobID string, now time.Time) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	move, ok := p.moved[jobID]
+	if !ok {
+		return 0
+	}
+	if p.expired(move, now) {
+		delete(p.moved, jobID)
+		return 0
+	}
+	return move.outcome
+}
+
+// record remembers the outcome of moving a job, forgetting the outcomes that
+// expired, such as those of jobs that were never redelivered
+func (p *DeadLetterPolicy) record(jobID string, outcome int, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.moved == nil {
+		p.moved = make(map[string]*deadLetterMove)
+	}
+	for id, move := range p.moved {
+		if p.expired(move, now) {
+			delete(p.moved, id)
+		}
+	}
+	p.moved[jobID] = &deadLetterMove{outcome: outcome, recordedAt: now}
+}
+
+func (p *DeadLetterPolicy) expired(move *deadLetterMove, now time.Time) bool {
+	ttl := p.OutcomeTTL
+	if ttl <= 0 {
+		ttl = DefaultDeadLetterOutcomeTTL
+	}
+	return now.Sub(move.recordedAt) >= ttl
+}
+
+func (p *DeadLetterPolicy) forget(jobID string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.moved, jobID)
+}
+
+// DeadLetter is the payload of a job stored on a dead-letter queue.
+// It carries the original message along with the counters that caused
+// the job to be dead-lettered.
+type DeadLetter struct {
+	QueueName            string    `json:"queue"`
+	JobID                string    `json:"job_id"`
+	Message              string    `json:"message"`
+	Nacks                int64     `json:"nacks"`
+	AdditionalDeliveries int64     `json:"additional_deliveries"`
+	Reason               string    `json:"reason"`
+	DeadLetteredAt       time.Time `json:"dead_lettered_at"`
+}
+
+// reason returns why the job violates the policy, or an empty string if it does not
+func (p *DeadLetterPolicy) reason(job *Job) string {
+	if job.QueueName == p.Queue {
+		// never dead-letter jobs that are already on the dead-letter queue
+		return ""
+	}
+	if p.MaxNacks > 0 && job.Nacks > p.MaxNacks {
+		return fmt.Sprintf("nacked %d times", job.Nacks)
+	}
+	if p.MaxAdditionalDeliveries > 0 && job.AdditionalDeliveries > p.MaxAdditionalDeliveries {
+		return fmt.Sprintf("delivered %d additional times", job.AdditionalDeliveries)
+	}
+	return ""
+}
+
+// SetDeadLetterPolicy configures the dead-letter policy applied to fetched jobs.
+// A nil policy disables dead-lettering.
+func (d *Disque) SetDeadLetterPolicy(policy *DeadLetterPolicy) {
+	d.deadLetter = policy
+}
+
+// ParseDeadLetter decodes a job fetched from a dead-letter queue
+func ParseDeadLetter(job *Job) (deadLetter *DeadLetter, err error) {
+	deadLetter = &DeadLetter{}
+	if err = json.Unmarshal([]byte(job.Message), deadLetter); err != nil {
+		deadLetter = nil
+	}
+	return
+}
+
+// ReplayDeadLetters fetches up to count jobs from the dead-letter queue and
+// pushes each original message back onto the queue it came from.
+// Dead-lettered jobs are acknowledged once they have been pushed back. If a
+// job cannot be replayed, it and the rest of the batch are put back in the
+// dead-letter queue.
+func (d *Disque) ReplayDeadLetters(count int, timeout time.Duration) (replayed int, err error) {
+	if d.deadLetter == nil {
+		return 0, ErrNoDeadLetterPolicy
+	}
+
+	var jobs []*Job
+	if jobs, err = d.FetchMultiple(d.deadLetter.Queue, count, timeout); err != nil {
+		return
+	}
+	for i, job := range jobs {
+		if err = d.replayDeadLetter(job, timeout); err != nil {
+			pipeline := d.Pipeline()
+			for _, remaining := range jobs[i:] {
+				pipeline.Nack(remaining.JobID)
+			}
+			pipeline.Execute()
+			return
+		}
+		replayed++
+	}
+	return
+}
+
+func (d *Disque) replayDeadLetter(job *Job, timeout time.Duration) (err error) {
+	var deadLetter *DeadLetter
+	if deadLetter, err = ParseDeadLetter(job); err != nil {
+		return
+	}
+	if _, err = d.addJob(deadLetter.QueueName, deadLetter.Message, timeout, nil); err != nil {
+		return
+	}
+	return d.Ack(job.JobID)
+}
+
+// filterDeadLetters moves jobs that violate the dead-letter policy to the
+// dead-letter queue, returning the jobs that should be handed to the caller.
+func (d *Disque) filterDeadLetters(jobs []*Job) (accepted []*Job) {
+	accepted = make([]*Job, 0, len(jobs))
+	rejected := make([]*Job, 0)
+	reasons := make([]string, 0)
+	for _, job := range jobs {
+		if reason := d.deadLetter.reason(job); reason == "" {
+			accepted = append(accepted, job)
+		} else {
+			rejected = append(rejected, job)
+			reasons = append(reasons, reason)
+		}
+	}
+	d.moveToDeadLetters(rejected, reasons)
+	return
+}
+
+// moveToDeadLetters moves jobs to the dead-letter queue for the given reasons.
+// The dead letters of jobs redelivered after an earlier move with an unknown
+// outcome are looked up in a single scan of the dead-letter queue. Jobs that
+// could not be moved are redelivered once their retry period elapses.
+func (d *Disque) moveToDeadLetters(jobs []*Job, reasons []string) {
+	policy := d.deadLetter
+	now := d.now()
+	outcomes := make([]int, len(jobs))
+	uncertain := make([]string, 0)
+	for i, job := range jobs {
+		if outcomes[i] = policy.outcome(job.JobID, now); outcomes[i] == deadLetterUncertain {
+			uncertain = append(uncertain, job.JobID)
+		}
+	}
+	var found map[string]bool
+	var findErr error
+	if len(uncertain) > 0 {
+		found, findErr = d.findDeadLetters(uncertain)
+	}
+
+	for i, job := range jobs {
+		var err error
+		if outcomes[i] == deadLetterUncertain && findErr != nil {
+			err = findErr
+		} else {
+			err = d.moveToDeadLetter(job, reasons[i], outcomes[i] == deadLetterWritten || found[job.JobID])
+		}
+		if err != nil {
+			log.Printf("Error while moving job %s to dead-letter queue %s, exception: %s", job.JobID, policy.Queue, err)
+		}
+	}
+}
+
+// moveToDeadLetter adds a dead letter for the job and acknowledges the job.
+// A job whose dead letter was already added is only acknowledged, rather
+// than dead-lettered again.
+func (d *Disque) moveToDeadLetter(job *Job, reason string, added bool) (err error) {
+	policy := d.deadLetter
+	if added {
+		return d.ackDeadLettered(job)
+	}
+
+	var payload []byte
+	if payload, err = json.Marshal(&DeadLetter{
+		QueueName:            job.QueueName,
+		JobID:                job.JobID,
+		Message:              job.Message,
+		Nacks:                job.Nacks,
+		AdditionalDeliveries: job.AdditionalDeliveries,
+		Reason:               reason,
+		DeadLetteredAt:       d.now(),
+	}); err != nil {
+		return
+	}
+	timeout := policy.Timeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	if _, err = d.addJob(policy.Queue, string(payload), timeout, policy.Options); err != nil {
+		if _, rejected := err.(redis.Error); !rejected && err != ErrQueuePaused {
+			policy.record(job.JobID, deadLetterUncertain, d.now())
+		}
+		return
+	}
+	policy.record(job.JobID, deadLetterWritten, d.now())
+	return d.ackDeadLettered(job)
+}
+
+// discard moves a job that cannot be processed to the dead-letter queue if a
+// dead-letter policy is configured, or acknowledges it otherwise. A job that
+// could not be discarded is redelivered once its retry period elapses.
+func (d *Disque) discard(job *Job, reason string) {
+	if d.deadLetter != nil {
+		d.moveToDeadLetters([]*Job{job}, []string{reason})
+	} else if err := d.Ack(job.JobID); err != nil {
+		log.Printf("Error while discarding job %s, exception: %s", job.JobID, err)
+	}
+}
+
+// ackDeadLettered acknowledges a job whose dead letter was added
+func (d *Disque) ackDeadLettered(job *Job) (err error) {
+	if err = d.Ack(job.JobID); err == nil {
+		d.deadLetter.forget(job.JobID)
+	}
+	return
+}
+
+// findDeadLetters scans the dead-letter queue once for dead letters of the
+// given jobs, stopping as soon as every one was found
+func (d *Disque) findDeadLetters(jobIDs []string) (found map[string]bool, err error) {
+	found = make(map[string]bool)
+	for cursor := "0"; len(found) < len(jobIDs); {
+		var jobs []*JobDetails
+		if cursor, jobs, err = d.ScanDetails(cursor, ScanOptions{Queue: d.deadLetter.Queue}); err != nil {
+			return nil, err
+		}
+		for _, job := range jobs {
+			deadLetter := &DeadLetter{}
+			if json.Unmarshal([]byte(job.Message), deadLetter) == nil && containsString(jobIDs, deadLetter.JobID) {
+				found[deadLetter.JobID] = true
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	return
+}
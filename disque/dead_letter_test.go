@@ -0,0 +1,320 @@
+package disque
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+)
+
+type DeadLetterSuite struct {
+	suite.Suite
+}
+
+func TestDeadLetterSuite(t *testing.T) {
+	suite.Run(t, new(DeadLetterSuite))
+}
+
+func (s *DeadLetterSuite) SetupTest() {
+}
+
+func (s *DeadLetterSuite) SetupSuite() {
+}
+
+func (s *DeadLetterSuite) TestReasonBelowThresholds() {
+	policy := &DeadLetterPolicy{Queue: "dlq", MaxNacks: 2, MaxAdditionalDeliveries: 2}
+
+	s.Equal("", policy.reason(&Job{QueueName: "queue1", Nacks: 2, AdditionalDeliveries: 2}))
+}
+
+func (s *DeadLetterSuite) TestReasonAboveNackThreshold() {
+	policy := &DeadLetterPolicy{Queue: "dlq", MaxNacks: 2}
+
+	s.Equal("nacked 3 times", policy.reason(&Job{QueueName: "queue1", Nacks: 3}))
+}
+
+func (s *DeadLetterSuite) TestReasonAboveDeliveryThreshold() {
+	policy := &DeadLetterPolicy{Queue: "dlq", MaxAdditionalDeliveries: 1}
+
+	s.Equal("delivered 2 additional times", policy.reason(&Job{QueueName: "queue1", AdditionalDeliveries: 2}))
+}
+
+func (s *DeadLetterSuite) TestReasonWithDisabledThresholds() {
+	policy := &DeadLetterPolicy{Queue: "dlq"}
+
+	s.Equal("", policy.reason(&Job{QueueName: "queue1", Nacks: 100, AdditionalDeliveries: 100}))
+}
+
+func (s *DeadLetterSuite) TestReasonForJobOnDeadLetterQueue() {
+	policy := &DeadLetterPolicy{Queue: "dlq", MaxNacks: 1}
+
+	s.Equal("", policy.reason(&Job{QueueName: "dlq", Nacks: 5}))
+}
+
+func (s *DeadLetterSuite) TestParseDeadLetterWithMalformedMessage() {
+	deadLetter, err := ParseDeadLetter(&Job{Message: "not json"})
+
+	s.NotNil(err)
+	s.Nil(deadLetter)
+}
+
+func (s *DeadLetterSuite) TestFetchMovesJobToDeadLetterQueue() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	d.SetDeadLetterPolicy(&DeadLetterPolicy{Queue: "queueDead1", MaxNacks: 1})
+
+	jobID, err := d.Push("queueDLQ1", "asdf", time.Second)
+	s.Nil(err)
+
+	// nack the job twice to exceed the threshold
+	for i := 0; i < 2; i++ {
+		job, err := d.Fetch("queueDLQ1", time.Second)
+		s.Nil(err)
+		s.NotNil(job)
+		s.Nil(d.Nack(job.JobID))
+	}
+
+	job, err := d.Fetch("queueDLQ1", 100*time.Millisecond)
+	s.Nil(err)
+	s.Nil(job)
+
+	// the original job has been acknowledged
+	jobDetails, err := d.GetJobDetails(jobID)
+	s.NotNil(err)
+	s.Nil(jobDetails)
+
+	job, err = d.Fetch("queueDead1", time.Second)
+	s.Nil(err)
+	s.NotNil(job)
+
+	deadLetter, err := ParseDeadLetter(job)
+	s.Nil(err)
+	s.Equal("queueDLQ1", deadLetter.QueueName)
+	s.Equal(jobID, deadLetter.JobID)
+	s.Equal("asdf", deadLetter.Message)
+	s.EqualValues(2, deadLetter.Nacks)
+	s.Equal("nacked 2 times", deadLetter.Reason)
+	d.Ack(job.JobID)
+}
+
+func (s *DeadLetterSuite) TestReplayDeadLetters() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	d.SetDeadLetterPolicy(&DeadLetterPolicy{Queue: "queueDead2", MaxNacks: 1})
+
+	_, err := d.Push("queueDLQ2", "asdf", time.Second)
+	s.Nil(err)
+	for i := 0; i < 2; i++ {
+		job, _ := d.Fetch("queueDLQ2", time.Second)
+		d.Nack(job.JobID)
+	}
+	job, err := d.Fetch("queueDLQ2", 100*time.Millisecond)
+	s.Nil(job)
+
+	replayed, err := d.ReplayDeadLetters(10, time.Second)
+	s.Nil(err)
+	s.Equal(1, replayed)
+
+	var queueLength int
+	queueLength, err = d.QueueLength("queueDead2")
+	s.Nil(err)
+	s.Equal(0, queueLength)
+
+	job, err = d.Fetch("queueDLQ2", time.Second)
+	s.Nil(err)
+	s.NotNil(job)
+	s.Equal("asdf", job.Message)
+	s.EqualValues(0, job.Nacks)
+	d.Ack(job.JobID)
+}
+
+func (s *DeadLetterSuite) TestReplayDeadLettersWithoutPolicy() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+
+	replayed, err := d.ReplayDeadLetters(10, time.Second)
+	s.Equal(ErrNoDeadLetterPolicy, err)
+	s.Equal(0, replayed)
+}
+
+// overDelivered connects to a fake server and pushes a job nacked often
+// enough for the next fetch to dead-letter it under the policy
+func (s *DeadLetterSuite) overDelivered(server *disquetest.Server, queueName string, policy *DeadLetterPolicy) (d *Disque, jobID string) {
+	d = NewDisque([]string{server.Addr}, 1000)
+	s.Nil(d.Initialize())
+	jobID, err := d.Push(queueName, "asdf", time.Second)
+	s.Nil(err)
+	for i := int64(0); i <= policy.MaxNacks; i++ {
+		job, err := d.Fetch(queueName, time.Second)
+		s.Nil(err)
+		s.Nil(d.Nack(job.JobID))
+	}
+	d.SetDeadLetterPolicy(policy)
+	return
+}
+
+func (s *DeadLetterSuite) queueLength(d *Disque, queueName string) int {
+	queueLength, err := d.QueueLength(queueName)
+	s.Nil(err)
+	return queueLength
+}
+
+func (s *DeadLetterSuite) TestFailedAckIsNotDeadLetteredTwice() {
+	server := disquetest.NewServer()
+	defer server.Close()
+	d, jobID := s.overDelivered(server, "queueDLQ3", &DeadLetterPolicy{Queue: "queueDead3", MaxNacks: 1})
+	defer d.Close()
+
+	// the command is attempted twice, once more after exploring the cluster
+	server.FailNext("ACKJOB", "ERR failed")
+	server.FailNext("ACKJOB", "ERR failed")
+	job, err := d.Fetch("queueDLQ3", 10*time.Millisecond)
+	s.Nil(err)
+	s.Nil(job)
+	s.Equal(1, s.queueLength(d, "queueDead3"))
+
+	// once redelivered, the job is only acknowledged
+	_, err = d.Enqueue(jobID)
+	s.Nil(err)
+	job, err = d.Fetch("queueDLQ3", 10*time.Millisecond)
+	s.Nil(err)
+	s.Nil(job)
+	s.Equal(1, s.queueLength(d, "queueDead3"))
+	_, err = d.GetJobDetails(jobID)
+	s.NotNil(err)
+}
+
+func (s *DeadLetterSuite) TestUncertainPushIsNotDeadLetteredTwice() {
+	server := disquetest.NewServer()
+	defer server.Close()
+	policy := &DeadLetterPolicy{Queue: "queueDead4", MaxNacks: 1}
+	d, jobID := s.overDelivered(server, "queueDLQ4", policy)
+	defer d.Close()
+
+	// a previous push failed, although the dead letter was added
+	_, err := d.Push("queueDead4", `{"queue":"queueDLQ4","job_id":"`+jobID+`"}`, time.Second)
+	s.Nil(err)
+	policy.record(jobID, deadLetterUncertain, time.Now())
+
+	pushes := server.CommandCount("ADDJOB")
+	job, err := d.Fetch("queueDLQ4", 10*time.Millisecond)
+	s.Nil(err)
+	s.Nil(job)
+	s.Equal(pushes, server.CommandCount("ADDJOB"))
+	s.Equal(1, s.queueLength(d, "queueDead4"))
+	s.Equal(0, policy.outcome(jobID, time.Now()))
+}
+
+func (s *DeadLetterSuite) TestRejectedPushIsRetried() {
+	server := disquetest.NewServer()
+	defer server.Close()
+	policy := &DeadLetterPolicy{Queue: "queueDead5", MaxNacks: 1}
+	d, jobID := s.overDelivered(server, "queueDLQ5", policy)
+	defer d.Close()
+
+	server.FailNext("ADDJOB", "ERR rejected")
+	server.FailNext("ADDJOB", "ERR rejected")
+	job, err := d.Fetch("queueDLQ5", 10*time.Millisecond)
+	s.Nil(err)
+	s.Nil(job)
+	s.Equal(0, s.queueLength(d, "queueDead5"))
+	s.Equal(0, policy.outcome(jobID, time.Now()))
+
+	_, err = d.Enqueue(jobID)
+	s.Nil(err)
+	_, err = d.Fetch("queueDLQ5", 10*time.Millisecond)
+	s.Nil(err)
+	s.Equal(1, s.queueLength(d, "queueDead5"))
+}
+
+func (s *DeadLetterSuite) TestReplayFailureRequeuesBatch() {
+	server := disquetest.NewServer()
+	defer server.Close()
+	d := NewDisque([]string{server.Addr}, 1000)
+	s.Nil(d.Initialize())
+	defer d.Close()
+	d.SetDeadLetterPolicy(&DeadLetterPolicy{Queue: "queueDead6", MaxNacks: 1})
+	for i := 0; i < 3; i++ {
+		_, err := d.Push("queueDead6", `{"queue":"queueDLQ6","message":"asdf"}`, time.Second)
+		s.Nil(err)
+	}
+
+	server.FailNext("ADDJOB", "ERR rejected")
+	server.FailNext("ADDJOB", "ERR rejected")
+	replayed, err := d.ReplayDeadLetters(10, 10*time.Millisecond)
+	s.NotNil(err)
+	s.Equal(0, replayed)
+	s.Equal(3, s.queueLength(d, "queueDead6"))
+
+	replayed, err = d.ReplayDeadLetters(10, 10*time.Millisecond)
+	s.Nil(err)
+	s.Equal(3, replayed)
+	s.Equal(3, s.queueLength(d, "queueDLQ6"))
+}
+
+func (s *DeadLetterSuite) TestOutcomesExpire() {
+	policy := &DeadLetterPolicy{Queue: "queueDead7", OutcomeTTL: time.Minute}
+	now := time.Now()
+	policy.record("job1", deadLetterUncertain, now)
+	policy.record("job2", deadLetterWritten, now)
+	s.Equal(deadLetterUncertain, policy.outcome("job1", now.Add(30*time.Second)))
+
+	// expired outcomes are forgotten when looked up or when another is recorded
+	s.Equal(0, policy.outcome("job1", now.Add(time.Minute)))
+	policy.record("job3", deadLetterUncertain, now.Add(time.Minute))
+	s.Equal(1, len(policy.moved))
+	s.Equal(deadLetterUncertain, policy.outcome("job3", now.Add(time.Minute)))
+}
+
+func (s *DeadLetterSuite) TestUncertainPushesAreLookedUpInOneScan() {
+	server := disquetest.NewServer()
+	defer server.Close()
+	d := NewDisque([]string{server.Addr}, 1000)
+	s.Nil(d.Initialize())
+	defer d.Close()
+	clock := &fakeClock{now: time.Now()}
+	d.now = clock.Now
+
+	jobIDs := make([]string, 0)
+	for _, message := range []string{"job1", "job2"} {
+		jobID, err := d.Push("queueDLQ8", message, time.Second)
+		s.Nil(err)
+		jobIDs = append(jobIDs, jobID)
+	}
+	for i := 0; i < 2; i++ {
+		jobs, err := d.FetchMultiple("queueDLQ8", 2, time.Second)
+		s.Nil(err)
+		for _, job := range jobs {
+			s.Nil(d.Nack(job.JobID))
+		}
+	}
+
+	// the dead letter of the first job was added, that of the second was not
+	policy := &DeadLetterPolicy{Queue: "queueDead8", MaxNacks: 1}
+	_, err := d.Push("queueDead8", `{"queue":"queueDLQ8","job_id":"`+jobIDs[0]+`"}`, time.Second)
+	s.Nil(err)
+	policy.record(jobIDs[0], deadLetterUncertain, clock.Now())
+	policy.record(jobIDs[1], deadLetterUncertain, clock.Now())
+	d.SetDeadLetterPolicy(policy)
+
+	scans := server.CommandCount("JSCAN")
+	jobs, err := d.FetchMultiple("queueDLQ8", 2, 10*time.Millisecond)
+	s.Nil(err)
+	s.Equal(0, len(jobs))
+	s.Equal(scans+1, server.CommandCount("JSCAN"))
+	s.Equal(2, s.queueLength(d, "queueDead8"))
+	s.Equal(0, len(policy.moved))
+
+	// dead letters are dated by the clock of the connection
+	d.SetDeadLetterPolicy(nil)
+	jobs, err = d.FetchMultiple("queueDead8", 2, time.Second)
+	s.Nil(err)
+	deadLetter, err := ParseDeadLetter(jobs[1])
+	s.Nil(err)
+	s.Equal(jobIDs[1], deadLetter.JobID)
+	s.True(clock.Now().Equal(deadLetter.DeadLetteredAt))
+}
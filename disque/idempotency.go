@@ -0,0 +1,231 @@
+package disque
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/youtube/vitess/go/cache"
+)
+
+// Defaults of the DedupStore used when none is configured
+const (
+	DefaultDedupCapacity = 10000
+	DefaultDedupWindow   = 10 * time.Minute
+)
+
+// ErrPushInProgress is returned by PushIdempotent while another push with the
+// same idempotency key has not completed
+var ErrPushInProgress = errors.New("Push with the same idempotency key in progress")
+
+// DedupRecord is the outcome of a push with an idempotency key
+type DedupRecord struct {
+	QueueName string
+	// JobID is empty until the push completes, or if its outcome is unknown
+	JobID string
+	// Uncertain is set when the push failed without telling whether the job was added
+	Uncertain bool
+	// Spooled is set when the job was recorded in the spool, to be added once
+	// the cluster is reachable again
+	Spooled    bool
+	RecordedAt time.Time
+}
+
+// DedupStore records the jobs pushed with idempotency keys. Stores shared by
+// several connections must implement Reserve atomically.
+type DedupStore interface {
+	// Get returns the record for the key, if it is still within the deduplication window
+	Get(key string) (record *DedupRecord, ok bool)
+	// Reserve records a push in progress for the key, unless there is a
+	// record for the key within the window that is not uncertain. It returns
+	// the record found, if any, and whether the push was recorded.
+	Reserve(key string, record *DedupRecord) (existing *DedupRecord, reserved bool)
+	// Set records the outcome of a push
+	Set(key string, record *DedupRecord)
+	// Delete forgets the key
+	Delete(key string)
+}
+
+// LRUDedupStore is an in-memory DedupStore keeping up to a fixed number of
+// keys, evicting the least recently used ones first
+type LRUDedupStore struct {
+	// mu makes Reserve atomic with respect to the other methods
+	mu     sync.Mutex
+	cache  *cache.LRUCache
+	window time.Duration
+}
+
+// dedupValue adapts a DedupRecord to the LRU cache, every record counting for one
+type dedupValue struct {
+	record *DedupRecord
+}
+
+func (v *dedupValue) Size() int {
+	return 1
+}
+
+// NewLRUDedupStore creates a store holding up to capacity keys for the given window
+func NewLRUDedupStore(capacity int64, window time.Duration) *LRUDedupStore {
+	return &LRUDedupStore{
+		cache:  cache.NewLRUCache(capacity),
+		window: window,
+	}
+}
+
+// Get returns the record for the key, if it was recorded within the window
+func (s *LRUDedupStore) Get(key string) (record *DedupRecord, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(key)
+}
+
+func (s *LRUDedupStore) get(key string) (record *DedupRecord, ok bool) {
+	var value cache.Value
+	if value, ok = s.cache.Get(key); !ok {
+		return nil, false
+	}
+	record = value.(*dedupValue).record
+	if time.Since(record.RecordedAt) > s.window {
+		s.cache.Delete(key)
+		return nil, false
+	}
+	return record, true
+}
+
+// Reserve records a push in progress for the key, unless a record that is
+// not uncertain exists within the window
+func (s *LRUDedupStore) Reserve(key string, record *DedupRecord) (existing *DedupRecord, reserved bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var ok bool
+	if existing, ok = s.get(key); ok && !existing.Uncertain {
+		return existing, false
+	}
+	s.cache.Set(key, &dedupValue{record: record})
+	return existing, true
+}
+
+// Set records the outcome of a push
+func (s *LRUDedupStore) Set(key string, record *DedupRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache.Set(key, &dedupValue{record: record})
+}
+
+// Delete forgets the key
+func (s *LRUDedupStore) Delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cache.Delete(key)
+}
+
+// SetDedupStore configures the store used by PushIdempotent. A nil store
+// restores an in-memory store of DefaultDedupCapacity keys.
+func (d *Disque) SetDedupStore(store DedupStore) {
+	d.dedupMu.Lock()
+	defer d.dedupMu.Unlock()
+	d.dedup = store
+}
+
+func (d *Disque) dedupStore() DedupStore {
+	d.dedupMu.Lock()
+	defer d.dedupMu.Unlock()
+	if d.dedup == nil {
+		d.dedup = NewLRUDedupStore(DefaultDedupCapacity, DefaultDedupWindow)
+	}
+	return d.dedup
+}
+
+// PushIdempotent pushes a job wrapped in an Envelope carrying the idempotency
+// key, unless a job was already pushed with the same key within the
+// deduplication window, in which case the ID of the original job is returned.
+// ErrPushInProgress is returned while another push with the same key has not
+// completed, and ErrSpooled while the original job waits in the spool.
+//
+// If a previous push with the same key failed without telling whether the job
+// was added, for instance because it timed out, the queue is scanned for a job
+// carrying the key before pushing again. A job that was already acknowledged
+// cannot be found this way and is pushed again.
+func (d *Disque) PushIdempotent(queueName string, key string, job string, timeout time.Duration) (jobID string, err error) {
+	store := d.dedupStore()
+	record := &DedupRecord{QueueName: queueName, RecordedAt: time.Now()}
+	existing, reserved := store.Reserve(key, record)
+	if !reserved {
+		switch {
+		case existing.JobID != "":
+			return existing.JobID, nil
+		case existing.Spooled:
+			// the job may have been replayed since
+			if jobID, err = d.findIdempotent(existing.QueueName, key); err == nil && jobID == "" {
+				err = ErrSpooled
+			}
+			if jobID != "" {
+				store.Set(key, &DedupRecord{QueueName: existing.QueueName, JobID: jobID, RecordedAt: existing.RecordedAt})
+			}
+			return
+		default:
+			return "", ErrPushInProgress
+		}
+	}
+	if existing != nil {
+		// the outcome of the previous push is unknown
+		if jobID, err = d.findIdempotent(existing.QueueName, key); err != nil {
+			store.Set(key, existing)
+			return
+		}
+		if jobID != "" {
+			store.Set(key, &DedupRecord{QueueName: existing.QueueName, JobID: jobID, RecordedAt: existing.RecordedAt})
+			return
+		}
+	}
+
+	var body []byte
+	if body, err = json.Marshal(&Envelope{Kind: EnvelopeIdempotent, IdempotencyKey: key, Payload: job}); err != nil {
+		store.Delete(key)
+		return
+	}
+	if jobID, err = d.Push(queueName, string(body), timeout); err != nil {
+		if _, rejected := err.(redis.Error); rejected || err == ErrQueuePaused || err == ErrSpoolFull {
+			// the job was definitely not added
+			store.Delete(key)
+		} else if err == ErrSpooled {
+			store.Set(key, &DedupRecord{QueueName: queueName, Spooled: true, RecordedAt: record.RecordedAt})
+		} else {
+			store.Set(key, &DedupRecord{QueueName: queueName, Uncertain: true, RecordedAt: record.RecordedAt})
+		}
+		return
+	}
+	store.Set(key, &DedupRecord{QueueName: queueName, JobID: jobID, RecordedAt: record.RecordedAt})
+	return
+}
+
+// ParseEnvelope decodes a job pushed with PushIdempotent, an RPC request, a
+// workflow step or a job restored by Import with PreserveCounters
+func ParseEnvelope(job *Job) (envelope *Envelope, err error) {
+	envelope = &Envelope{}
+	if err = json.Unmarshal([]byte(job.Message), envelope); err != nil {
+		envelope = nil
+	}
+	return
+}
+
+// findIdempotent scans the queue for a job carrying the idempotency key
+func (d *Disque) findIdempotent(queueName string, key string) (jobID string, err error) {
+	cursor := "0"
+	for {
+		var jobs []*JobDetails
+		if cursor, jobs, err = d.ScanDetails(cursor, ScanOptions{Queue: queueName}); err != nil {
+			return
+		}
+		for _, job := range jobs {
+			if envelope, ok := parseEnvelope(job.Message, EnvelopeIdempotent); ok && envelope.IdempotencyKey == key {
+				return job.JobID, nil
+			}
+		}
+		if cursor == "0" {
+			return
+		}
+	}
+}
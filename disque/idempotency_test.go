@@ -0,0 +1,246 @@
+package disque
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+	"golang.org/x/net/context"
+)
+
+type IdempotencySuite struct {
+	suite.Suite
+	server *disquetest.Server
+	d      *Disque
+}
+
+func TestIdempotencySuite(t *testing.T) {
+	suite.Run(t, new(IdempotencySuite))
+}
+
+func (s *IdempotencySuite) SetupTest() {
+	s.server = disquetest.NewServer()
+	s.d = NewDisque([]string{s.server.Addr}, 1000)
+	s.Nil(s.d.Initialize())
+}
+
+func (s *IdempotencySuite) TearDownTest() {
+	s.d.Close()
+	s.server.Close()
+}
+
+func (s *IdempotencySuite) SetupSuite() {
+}
+
+func (s *IdempotencySuite) TestLRUDedupStore() {
+	store := NewLRUDedupStore(2, time.Minute)
+	store.Set("key1", &DedupRecord{JobID: "job1", RecordedAt: time.Now()})
+	store.Set("key2", &DedupRecord{JobID: "job2", RecordedAt: time.Now()})
+
+	record, ok := store.Get("key1")
+	s.True(ok)
+	s.Equal("job1", record.JobID)
+
+	// the least recently used key is evicted
+	store.Set("key3", &DedupRecord{JobID: "job3", RecordedAt: time.Now()})
+	_, ok = store.Get("key2")
+	s.False(ok)
+	_, ok = store.Get("key1")
+	s.True(ok)
+
+	store.Delete("key1")
+	_, ok = store.Get("key1")
+	s.False(ok)
+}
+
+func (s *IdempotencySuite) TestLRUDedupStoreWindow() {
+	store := NewLRUDedupStore(10, time.Minute)
+	store.Set("key1", &DedupRecord{JobID: "job1", RecordedAt: time.Now().Add(-2 * time.Minute)})
+
+	_, ok := store.Get("key1")
+	s.False(ok)
+}
+
+func (s *IdempotencySuite) TestPushIdempotent() {
+	jobID, err := s.d.PushIdempotent("queueIdempotent1", "key1", "asdf", time.Second)
+	s.Nil(err)
+	s.NotEmpty(jobID)
+
+	duplicateID, err := s.d.PushIdempotent("queueIdempotent1", "key1", "asdf", time.Second)
+	s.Nil(err)
+	s.Equal(jobID, duplicateID)
+	s.Equal(1, s.server.CommandCount("ADDJOB"))
+
+	otherID, err := s.d.PushIdempotent("queueIdempotent1", "key2", "asdf", time.Second)
+	s.Nil(err)
+	s.NotEqual(jobID, otherID)
+
+	job, err := s.d.Fetch("queueIdempotent1", time.Second)
+	s.Nil(err)
+	envelope, err := ParseEnvelope(job)
+	s.Nil(err)
+	s.Equal("key1", envelope.IdempotencyKey)
+	s.Equal("asdf", envelope.Payload)
+}
+
+func (s *IdempotencySuite) TestPushIdempotentAfterWindow() {
+	s.d.SetDedupStore(NewLRUDedupStore(10, time.Millisecond))
+
+	jobID, err := s.d.PushIdempotent("queueIdempotent2", "key1", "asdf", time.Second)
+	s.Nil(err)
+	time.Sleep(10 * time.Millisecond)
+
+	secondID, err := s.d.PushIdempotent("queueIdempotent2", "key1", "asdf", time.Second)
+	s.Nil(err)
+	s.NotEqual(jobID, secondID)
+}
+
+func (s *IdempotencySuite) TestPushIdempotentWithUnknownOutcome() {
+	// a previous push was sent, but its reply was lost
+	jobID, err := s.d.Push("queueIdempotent3", `{"envelope":"idempotent","idempotency_key":"key1","payload":"asdf"}`, time.Second)
+	s.Nil(err)
+	store := NewLRUDedupStore(10, time.Minute)
+	store.Set("key1", &DedupRecord{QueueName: "queueIdempotent3", Uncertain: true, RecordedAt: time.Now()})
+	s.d.SetDedupStore(store)
+
+	duplicateID, err := s.d.PushIdempotent("queueIdempotent3", "key1", "asdf", time.Second)
+	s.Nil(err)
+	s.Equal(jobID, duplicateID)
+	s.Equal(1, s.server.CommandCount("ADDJOB"))
+
+	record, ok := store.Get("key1")
+	s.True(ok)
+	s.Equal(jobID, record.JobID)
+}
+
+func (s *IdempotencySuite) TestPushIdempotentWithUnknownOutcomeNotAdded() {
+	store := NewLRUDedupStore(10, time.Minute)
+	store.Set("key1", &DedupRecord{QueueName: "queueIdempotent4", Uncertain: true, RecordedAt: time.Now()})
+	s.d.SetDedupStore(store)
+
+	jobID, err := s.d.PushIdempotent("queueIdempotent4", "key1", "asdf", time.Second)
+	s.Nil(err)
+	s.NotEmpty(jobID)
+	s.Equal(1, s.server.CommandCount("ADDJOB"))
+}
+
+func (s *IdempotencySuite) TestRejectedPushIsForgotten() {
+	// the command is attempted twice, once more after exploring the cluster
+	s.server.FailNext("ADDJOB", "ERR rejected")
+	s.server.FailNext("ADDJOB", "ERR rejected")
+
+	_, err := s.d.PushIdempotent("queueIdempotent5", "key1", "asdf", time.Second)
+	s.NotNil(err)
+
+	jobID, err := s.d.PushIdempotent("queueIdempotent5", "key1", "asdf", time.Second)
+	s.Nil(err)
+	s.NotEmpty(jobID)
+	// the cluster is not scanned for a job that was rejected
+	s.Equal(0, s.server.CommandCount("JSCAN"))
+}
+
+func (s *IdempotencySuite) TestPoolSharesDedupStore() {
+	p := NewPool([]string{s.server.Addr}, 1000, 2, 2, time.Hour)
+	defer p.Close()
+
+	first, err := p.Get(context.Background())
+	s.Nil(err)
+	second, err := p.Get(context.Background())
+	s.Nil(err)
+	defer p.Put(first)
+	defer p.Put(second)
+
+	jobID, err := first.PushIdempotent("queueIdempotent6", "key1", "asdf", time.Second)
+	s.Nil(err)
+	duplicateID, err := second.PushIdempotent("queueIdempotent6", "key1", "asdf", time.Second)
+	s.Nil(err)
+	s.Equal(jobID, duplicateID)
+}
+
+func (s *IdempotencySuite) TestLRUDedupStoreReserve() {
+	store := NewLRUDedupStore(10, time.Minute)
+	existing, reserved := store.Reserve("key1", &DedupRecord{QueueName: "queue1", RecordedAt: time.Now()})
+	s.True(reserved)
+	s.Nil(existing)
+
+	// a push in progress holds the key
+	existing, reserved = store.Reserve("key1", &DedupRecord{QueueName: "queue2", RecordedAt: time.Now()})
+	s.False(reserved)
+	s.Equal("queue1", existing.QueueName)
+
+	// an uncertain push is taken over
+	store.Set("key1", &DedupRecord{QueueName: "queue1", Uncertain: true, RecordedAt: time.Now()})
+	existing, reserved = store.Reserve("key1", &DedupRecord{QueueName: "queue2", RecordedAt: time.Now()})
+	s.True(reserved)
+	s.True(existing.Uncertain)
+	record, _ := store.Get("key1")
+	s.Equal("queue2", record.QueueName)
+}
+
+func (s *IdempotencySuite) TestPushInProgress() {
+	store := NewLRUDedupStore(10, time.Minute)
+	store.Set("key1", &DedupRecord{QueueName: "queueIdempotent7", RecordedAt: time.Now()})
+	s.d.SetDedupStore(store)
+
+	_, err := s.d.PushIdempotent("queueIdempotent7", "key1", "asdf", time.Second)
+	s.Equal(ErrPushInProgress, err)
+	s.Equal(0, s.server.CommandCount("ADDJOB"))
+}
+
+func (s *IdempotencySuite) TestConcurrentPushesAddOneJob() {
+	p := NewPool([]string{s.server.Addr}, 1000, 8, 8, time.Hour)
+	defer p.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d, err := p.Get(context.Background())
+			s.Nil(err)
+			defer p.Put(d)
+			if _, err = d.PushIdempotent("queueIdempotent8", "key1", "asdf", time.Second); err != nil {
+				s.Equal(ErrPushInProgress, err)
+			}
+		}()
+	}
+	wg.Wait()
+	s.Equal(1, s.server.CommandCount("ADDJOB"))
+}
+
+func (s *IdempotencySuite) TestSpooledPushIsPending() {
+	dir, err := ioutil.TempDir("", "disque-idempotency")
+	s.Nil(err)
+	defer os.RemoveAll(dir)
+	spool, err := OpenSpool(filepath.Join(dir, "spool"), SpoolOptions{})
+	s.Nil(err)
+	defer spool.Close()
+	s.d.SetSpool(spool)
+
+	addr := s.server.Addr
+	s.server.Close()
+	_, err = s.d.PushIdempotent("queueIdempotent9", "key1", "asdf", time.Second)
+	s.Equal(ErrSpooled, err)
+
+	// retrying does not spool a second copy
+	s.server, err = disquetest.NewServerOn(addr)
+	s.Nil(err)
+	_, err = s.d.PushIdempotent("queueIdempotent9", "key1", "asdf", time.Second)
+	s.Equal(ErrSpooled, err)
+	s.Equal(1, spool.Depth())
+	s.Equal(0, s.server.CommandCount("ADDJOB"))
+
+	// once replayed, the job is found in the queue
+	replayed, err := s.d.ReplaySpool()
+	s.Nil(err)
+	s.Equal(1, replayed)
+	jobID, err := s.d.PushIdempotent("queueIdempotent9", "key1", "asdf", time.Second)
+	s.Nil(err)
+	s.NotEmpty(jobID)
+	s.Equal(1, s.server.CommandCount("ADDJOB"))
+}
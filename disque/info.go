@@ -0,0 +1,260 @@
+package disque
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ServerInfo contains the state of a Disque node as reported by INFO.
+// Fields that are not recognized, or whose value could not be parsed, are
+// kept in Extra, keyed by the lowercase name of their section and their name,
+// such as "cpu.used_cpu_sys".
+type ServerInfo struct {
+	Server      ServerSection      `info:"server"`
+	Clients     ClientsSection     `info:"clients"`
+	Memory      MemorySection      `info:"memory"`
+	Jobs        JobsSection        `info:"jobs"`
+	Queues      QueuesSection      `info:"queues"`
+	Persistence PersistenceSection `info:"persistence"`
+	Stats       StatsSection       `info:"stats"`
+	Extra       map[string]string
+}
+
+// ServerSection contains general information about a Disque node
+type ServerSection struct {
+	Version         string `info:"disque_version"`
+	GitSHA1         string `info:"disque_git_sha1"`
+	GitDirty        bool   `info:"disque_git_dirty"`
+	BuildID         string `info:"disque_build_id"`
+	OS              string `info:"os"`
+	ArchBits        int64  `info:"arch_bits"`
+	MultiplexingAPI string `info:"multiplexing_api"`
+	GCCVersion      string `info:"gcc_version"`
+	ProcessID       int64  `info:"process_id"`
+	RunID           string `info:"run_id"`
+	TCPPort         int64  `info:"tcp_port"`
+	UptimeInSeconds int64  `info:"uptime_in_seconds"`
+	UptimeInDays    int64  `info:"uptime_in_days"`
+	Hz              int64  `info:"hz"`
+	ConfigFile      string `info:"config_file"`
+}
+
+// ClientsSection contains information about the clients connected to a Disque node
+type ClientsSection struct {
+	ConnectedClients        int64 `info:"connected_clients"`
+	ClientLongestOutputList int64 `info:"client_longest_output_list"`
+	ClientBiggestInputBuf   int64 `info:"client_biggest_input_buf"`
+	BlockedClients          int64 `info:"blocked_clients"`
+}
+
+// MemorySection contains information about the memory used by a Disque node
+type MemorySection struct {
+	UsedMemory            int64   `info:"used_memory"`
+	UsedMemoryHuman       string  `info:"used_memory_human"`
+	UsedMemoryRSS         int64   `info:"used_memory_rss"`
+	UsedMemoryPeak        int64   `info:"used_memory_peak"`
+	UsedMemoryPeakHuman   string  `info:"used_memory_peak_human"`
+	MemFragmentationRatio float64 `info:"mem_fragmentation_ratio"`
+	MemAllocator          string  `info:"mem_allocator"`
+}
+
+// JobsSection contains information about the jobs known to a Disque node
+type JobsSection struct {
+	RegisteredJobs int64 `info:"registered_jobs"`
+}
+
+// QueuesSection contains information about the queues known to a Disque node
+type QueuesSection struct {
+	RegisteredQueues int64 `info:"registered_queues"`
+}
+
+// PersistenceSection contains information about the AOF persistence of a Disque node
+type PersistenceSection struct {
+	Loading                  bool   `info:"loading"`
+	AOFEnabled               bool   `info:"aof_enabled"`
+	AOFState                 string `info:"aof_state"`
+	AOFRewriteInProgress     bool   `info:"aof_rewrite_in_progress"`
+	AOFRewriteScheduled      bool   `info:"aof_rewrite_scheduled"`
+	AOFLastRewriteTimeSec    int64  `info:"aof_last_rewrite_time_sec"`
+	AOFCurrentRewriteTimeSec int64  `info:"aof_current_rewrite_time_sec"`
+	AOFLastBgrewriteStatus   string `info:"aof_last_bgrewrite_status"`
+	AOFLastWriteStatus       string `info:"aof_last_write_status"`
+}
+
+// StatsSection contains general statistics of a Disque node
+type StatsSection struct {
+	TotalConnectionsReceived int64   `info:"total_connections_received"`
+	TotalCommandsProcessed   int64   `info:"total_commands_processed"`
+	InstantaneousOpsPerSec   int64   `info:"instantaneous_ops_per_sec"`
+	TotalNetInputBytes       int64   `info:"total_net_input_bytes"`
+	TotalNetOutputBytes      int64   `info:"total_net_output_bytes"`
+	InstantaneousInputKbps   float64 `info:"instantaneous_input_kbps"`
+	InstantaneousOutputKbps  float64 `info:"instantaneous_output_kbps"`
+	RejectedConnections      int64   `info:"rejected_connections"`
+	LatestForkUsec           int64   `info:"latest_fork_usec"`
+}
+
+// Info retrieves the state of the node this connection is using.
+// With no sections, the default set of sections is returned; otherwise each
+// of the given sections is requested in turn.
+func (d *Disque) Info(sections ...string) (info *ServerInfo, err error) {
+	return queryInfo(func(args redis.Args) (interface{}, error) {
+		return d.call("INFO", args)
+	}, sections)
+}
+
+// InfoAll retrieves the state of every node known to this connection,
+// keyed by node address. Nodes that could not be queried are left out of
+// the result and reported through the returned error.
+func (d *Disque) InfoAll(sections ...string) (infos map[string]*ServerInfo, err error) {
+	d.mu.Lock()
+	hosts := make([]string, 0, len(d.nodes))
+	for _, host := range d.nodes {
+		hosts = append(hosts, host)
+	}
+	d.mu.Unlock()
+
+	infos = make(map[string]*ServerInfo)
+	failures := make([]string, 0)
+	for _, host := range hosts {
+		var info *ServerInfo
+		if info, err = infoFromHost(host, sections); err == nil {
+			infos[host] = info
+		} else {
+			failures = append(failures, fmt.Sprintf("%s: %s", host, err))
+		}
+	}
+
+	err = nil
+	if len(failures) > 0 {
+		err = fmt.Errorf("Unable to retrieve info from nodes: %s", strings.Join(failures, ", "))
+	}
+	return
+}
+
+func infoFromHost(host string, sections []string) (info *ServerInfo, err error) {
+	var scout redis.Conn
+	if scout, err = redis.Dial("tcp", host); err == nil {
+		defer scout.Close()
+
+		info, err = queryInfo(func(args redis.Args) (interface{}, error) {
+			return scout.Do("INFO", args...)
+		}, sections)
+	}
+	return
+}
+
+// queryInfo issues one INFO command per section using do, parsing every reply into a single ServerInfo
+func queryInfo(do func(args redis.Args) (interface{}, error), sections []string) (info *ServerInfo, err error) {
+	info = newServerInfo()
+	if len(sections) == 0 {
+		sections = []string{""}
+	}
+	for _, section := range sections {
+		args := redis.Args{}
+		if section != "" {
+			args = args.Add(section)
+		}
+		var text string
+		if text, err = redis.String(do(args)); err != nil {
+			return nil, err
+		}
+		if err = parseInfo(text, info); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+func newServerInfo() *ServerInfo {
+	return &ServerInfo{
+		Extra: make(map[string]string),
+	}
+}
+
+// parseInfo parses the text returned by INFO into info. Fields are assigned
+// using the info tags of the section structs; unknown fields, including every
+// field of an unknown section, and fields whose value is malformed are kept in
+// info.Extra.
+func parseInfo(text string, info *ServerInfo) (err error) {
+	sections := reflect.ValueOf(info).Elem()
+
+	var section reflect.Value
+	var sectionName string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			sectionName = strings.ToLower(strings.TrimSpace(line[1:]))
+			section = taggedField(sections, sectionName)
+			continue
+		}
+
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return fmt.Errorf("Malformed info line: %q", line)
+		}
+		name, value := line[:i], line[i+1:]
+
+		var field reflect.Value
+		if section.IsValid() {
+			field = taggedField(section, name)
+		}
+		if !field.IsValid() || setInfoField(field, value) != nil {
+			info.Extra[extraInfoKey(sectionName, name)] = value
+		}
+	}
+	return
+}
+
+// extraInfoKey returns the key of a field in ServerInfo.Extra, so that fields
+// of the same name in different sections are kept apart
+func extraInfoKey(section string, name string) string {
+	if section == "" {
+		return name
+	}
+	return section + "." + name
+}
+
+// taggedField returns the field of the struct v with the given info tag,
+// or the zero Value if there is none
+func taggedField(v reflect.Value, tag string) reflect.Value {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		if t.Field(i).Tag.Get("info") == tag {
+			return v.Field(i)
+		}
+	}
+	return reflect.Value{}
+}
+
+func setInfoField(field reflect.Value, value string) (err error) {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(value)
+	case reflect.Int64:
+		var n int64
+		if n, err = strconv.ParseInt(value, 10, 64); err == nil {
+			field.SetInt(n)
+		}
+	case reflect.Float64:
+		var f float64
+		if f, err = strconv.ParseFloat(value, 64); err == nil {
+			field.SetFloat(f)
+		}
+	case reflect.Bool:
+		var n int64
+		if n, err = strconv.ParseInt(value, 10, 64); err == nil {
+			field.SetBool(n != 0)
+		}
+	default:
+		err = fmt.Errorf("unsupported field type %s", field.Kind())
+	}
+	return
+}
@@ -0,0 +1,170 @@
+package disque
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type InfoSuite struct {
+	suite.Suite
+}
+
+func TestInfoSuite(t *testing.T) {
+	suite.Run(t, new(InfoSuite))
+}
+
+func (s *InfoSuite) SetupTest() {
+}
+
+func (s *InfoSuite) SetupSuite() {
+}
+
+const infoText = "# Server\r\n" +
+	"disque_version:1.0-rc1\r\n" +
+	"disque_git_sha1:0192ba7e\r\n" +
+	"disque_git_dirty:1\r\n" +
+	"os:Linux 4.1.13 x86_64\r\n" +
+	"arch_bits:64\r\n" +
+	"tcp_port:7711\r\n" +
+	"uptime_in_seconds:3600\r\n" +
+	"\r\n" +
+	"# Clients\r\n" +
+	"connected_clients:3\r\n" +
+	"blocked_clients:1\r\n" +
+	"\r\n" +
+	"# Memory\r\n" +
+	"used_memory:1048576\r\n" +
+	"used_memory_human:1.00M\r\n" +
+	"mem_fragmentation_ratio:1.53\r\n" +
+	"\r\n" +
+	"# Jobs\r\n" +
+	"registered_jobs:12\r\n" +
+	"\r\n" +
+	"# Queues\r\n" +
+	"registered_queues:4\r\n" +
+	"\r\n" +
+	"# Persistence\r\n" +
+	"loading:0\r\n" +
+	"aof_enabled:1\r\n" +
+	"aof_state:on\r\n" +
+	"\r\n" +
+	"# Stats\r\n" +
+	"total_commands_processed:42\r\n" +
+	"instantaneous_input_kbps:0.25\r\n" +
+	"sync_full:0\r\n" +
+	"\r\n" +
+	"# CPU\r\n" +
+	"used_cpu_sys:0.52\r\n"
+
+func (s *InfoSuite) TestParseInfo() {
+	info := newServerInfo()
+
+	err := parseInfo(infoText, info)
+
+	s.Nil(err)
+	s.Equal("1.0-rc1", info.Server.Version)
+	s.True(info.Server.GitDirty)
+	s.EqualValues(64, info.Server.ArchBits)
+	s.EqualValues(7711, info.Server.TCPPort)
+	s.EqualValues(3600, info.Server.UptimeInSeconds)
+	s.EqualValues(3, info.Clients.ConnectedClients)
+	s.EqualValues(1, info.Clients.BlockedClients)
+	s.EqualValues(1048576, info.Memory.UsedMemory)
+	s.Equal("1.00M", info.Memory.UsedMemoryHuman)
+	s.Equal(1.53, info.Memory.MemFragmentationRatio)
+	s.EqualValues(12, info.Jobs.RegisteredJobs)
+	s.EqualValues(4, info.Queues.RegisteredQueues)
+	s.False(info.Persistence.Loading)
+	s.True(info.Persistence.AOFEnabled)
+	s.Equal("on", info.Persistence.AOFState)
+	s.EqualValues(42, info.Stats.TotalCommandsProcessed)
+	s.Equal(0.25, info.Stats.InstantaneousInputKbps)
+}
+
+func (s *InfoSuite) TestParseInfoKeepsUnknownFields() {
+	info := newServerInfo()
+
+	err := parseInfo(infoText, info)
+
+	s.Nil(err)
+	s.Equal(2, len(info.Extra))
+	s.Equal("0", info.Extra["stats.sync_full"])
+	s.Equal("0.52", info.Extra["cpu.used_cpu_sys"])
+}
+
+func (s *InfoSuite) TestParseInfoKeepsSectionsApart() {
+	info := newServerInfo()
+
+	err := parseInfo("# Custom\r\nstate:ok\r\n# Other\r\nstate:fail\r\n", info)
+
+	s.Nil(err)
+	s.Equal("ok", info.Extra["custom.state"])
+	s.Equal("fail", info.Extra["other.state"])
+}
+
+func (s *InfoSuite) TestParseInfoWithMalformedNumber() {
+	info := newServerInfo()
+
+	err := parseInfo("# Memory\r\nused_memory:lots\r\nused_memory_rss:2048\r\n", info)
+
+	s.Nil(err)
+	s.EqualValues(0, info.Memory.UsedMemory)
+	s.EqualValues(2048, info.Memory.UsedMemoryRSS)
+	s.Equal("lots", info.Extra["memory.used_memory"])
+}
+
+func (s *InfoSuite) TestParseInfoWithMalformedLine() {
+	info := newServerInfo()
+
+	err := parseInfo("# Memory\r\nused_memory\r\n", info)
+
+	s.NotNil(err)
+}
+
+func (s *InfoSuite) TestInfo() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+
+	info, err := d.Info()
+	s.Nil(err)
+	s.NotNil(info)
+	s.EqualValues(7711, info.Server.TCPPort)
+	s.True(info.Clients.ConnectedClients > 0)
+	s.True(info.Memory.UsedMemory > 0)
+}
+
+func (s *InfoSuite) TestInfoWithSections() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+
+	info, err := d.Info("memory", "jobs")
+	s.Nil(err)
+	s.True(info.Memory.UsedMemory > 0)
+	s.Equal("", info.Server.Version)
+}
+
+func (s *InfoSuite) TestInfoAll() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+
+	infos, err := d.InfoAll("server")
+	s.Nil(err)
+	s.Equal(1, len(infos))
+	s.NotNil(infos["127.0.0.1:7711"])
+}
+
+func (s *InfoSuite) TestInfoAllWithUnreachableNode() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	d.nodes["host2"] = "127.0.0.1:7722"
+
+	infos, err := d.InfoAll("server")
+	s.NotNil(err)
+	s.Equal(1, len(infos))
+	s.NotNil(infos["127.0.0.1:7711"])
+}
@@ -0,0 +1,131 @@
+package disque
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// fields that must be present in every SHOW reply, regardless of server version
+var requiredJobDetailsFields = []string{"id", "queue", "state", "body"}
+
+// parseJobDetails converts the key/value pairs returned by SHOW into JobDetails.
+// Fields are matched by name so that the order of fields in the reply does not
+// matter. Fields that are not recognized are kept in JobDetails.Extra.
+func parseJobDetails(values []interface{}) (jobDetails *JobDetails, err error) {
+	if len(values)%2 != 0 {
+		return nil, fmt.Errorf("Malformed job details: odd number of elements (%d)", len(values))
+	}
+
+	jobDetails = &JobDetails{
+		Extra: make(map[string]interface{}),
+	}
+	seen := make(map[string]bool)
+
+	for i := 0; i < len(values); i += 2 {
+		var name string
+		if name, err = redis.String(values[i], nil); err != nil {
+			return nil, fmt.Errorf("Malformed job details: field name at position %d: %s", i, err)
+		}
+		seen[name] = true
+
+		value := values[i+1]
+		switch name {
+		case "id":
+			jobDetails.JobID, err = redis.String(value, nil)
+		case "queue":
+			jobDetails.QueueName, err = redis.String(value, nil)
+		case "state":
+			jobDetails.State, err = redis.String(value, nil)
+		case "repl":
+			jobDetails.ReplicationFactor, err = redis.Int(value, nil)
+		case "ttl":
+			jobDetails.TTL, err = parseDuration(value, time.Second)
+		case "ctime":
+			var ctime int64
+			if ctime, err = redis.Int64(value, nil); err == nil {
+				jobDetails.CreatedAt = time.Unix(0, ctime)
+			}
+		case "delay":
+			jobDetails.Delay, err = parseDuration(value, time.Second)
+		case "retry":
+			jobDetails.Retry, err = parseDuration(value, time.Second)
+		case "nacks":
+			jobDetails.Nacks, err = redis.Int64(value, nil)
+		case "additional-deliveries":
+			jobDetails.AdditionalDeliveries, err = redis.Int64(value, nil)
+		case "nodes-delivered":
+			jobDetails.NodesDelivered, err = parseStrings(value)
+		case "nodes-confirmed":
+			jobDetails.NodesConfirmed, err = parseStrings(value)
+		case "next-requeue-within":
+			jobDetails.NextRequeueWithin, err = parseMilliseconds(value)
+		case "next-awake-within":
+			jobDetails.NextAwakeWithin, err = parseMilliseconds(value)
+		case "body":
+			jobDetails.Message, err = redis.String(value, nil)
+		default:
+			jobDetails.Extra[name] = convertReply(value)
+		}
+
+		if err != nil {
+			return nil, fmt.Errorf("Malformed job details: field %q: %s", name, err)
+		}
+	}
+
+	for _, name := range requiredJobDetailsFields {
+		if !seen[name] {
+			return nil, fmt.Errorf("Malformed job details: missing field %q", name)
+		}
+	}
+	return
+}
+
+// parseDuration converts an integer reply into a duration of the given unit.
+// A nil reply is treated as zero.
+func parseDuration(value interface{}, unit time.Duration) (d time.Duration, err error) {
+	if value == nil {
+		return
+	}
+	var n int64
+	if n, err = redis.Int64(value, nil); err == nil {
+		d = time.Duration(n) * unit
+	}
+	return
+}
+
+// parseMilliseconds converts a millisecond reply into a duration truncated
+// to whole seconds, matching the precision reported by earlier releases.
+func parseMilliseconds(value interface{}) (d time.Duration, err error) {
+	if d, err = parseDuration(value, time.Millisecond); err == nil {
+		d = d - d%time.Second
+	}
+	return
+}
+
+// parseStrings converts a multi-bulk reply into a slice of strings.
+// A nil reply is treated as an empty list.
+func parseStrings(value interface{}) (s []string, err error) {
+	if value == nil {
+		return []string{}, nil
+	}
+	return redis.Strings(value, nil)
+}
+
+// convertReply turns a raw reply into plain Go values, converting bulk
+// strings into strings and recursing into multi-bulk replies.
+func convertReply(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, element := range v {
+			converted[i] = convertReply(element)
+		}
+		return converted
+	default:
+		return v
+	}
+}
@@ -0,0 +1,158 @@
+package disque
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+)
+
+type JobDetailsSuite struct {
+	suite.Suite
+}
+
+func TestJobDetailsSuite(t *testing.T) {
+	suite.Run(t, new(JobDetailsSuite))
+}
+
+func (s *JobDetailsSuite) SetupTest() {
+}
+
+func (s *JobDetailsSuite) SetupSuite() {
+}
+
+// reply as returned by SHOW on current releases
+func currentShowReply() []interface{} {
+	return []interface{}{
+		[]byte("id"), []byte("D-dcb833cf-8YL1NT17e9+wsA/09NqxscQI-05a1"),
+		[]byte("queue"), []byte("queue1"),
+		[]byte("state"), []byte("queued"),
+		[]byte("repl"), int64(3),
+		[]byte("ttl"), int64(86400),
+		[]byte("ctime"), int64(1454532866000000000),
+		[]byte("delay"), int64(30),
+		[]byte("retry"), int64(8640),
+		[]byte("nacks"), int64(2),
+		[]byte("additional-deliveries"), int64(1),
+		[]byte("nodes-delivered"), []interface{}{[]byte("dcb833cf"), []byte("b31479c3")},
+		[]byte("nodes-confirmed"), []interface{}{},
+		[]byte("next-requeue-within"), int64(8639867),
+		[]byte("next-awake-within"), int64(8639367),
+		[]byte("body"), []byte("asdf"),
+	}
+}
+
+func (s *JobDetailsSuite) TestParseCurrentReply() {
+	jobDetails, err := parseJobDetails(currentShowReply())
+
+	s.Nil(err)
+	s.Equal("D-dcb833cf-8YL1NT17e9+wsA/09NqxscQI-05a1", jobDetails.JobID)
+	s.Equal("queue1", jobDetails.QueueName)
+	s.Equal("queued", jobDetails.State)
+	s.Equal(3, jobDetails.ReplicationFactor)
+	s.Equal(24*time.Hour, jobDetails.TTL)
+	s.Equal(time.Unix(0, 1454532866000000000), jobDetails.CreatedAt)
+	s.Equal(30*time.Second, jobDetails.Delay)
+	s.Equal(8640*time.Second, jobDetails.Retry)
+	s.EqualValues(2, jobDetails.Nacks)
+	s.EqualValues(1, jobDetails.AdditionalDeliveries)
+	s.Equal([]string{"dcb833cf", "b31479c3"}, jobDetails.NodesDelivered)
+	s.Equal([]string{}, jobDetails.NodesConfirmed)
+	s.Equal(8639*time.Second, jobDetails.NextRequeueWithin)
+	s.Equal(8639*time.Second, jobDetails.NextAwakeWithin)
+	s.Equal("asdf", jobDetails.Message)
+	s.Equal(0, len(jobDetails.Extra))
+}
+
+func (s *JobDetailsSuite) TestParseReplyInDifferentOrder() {
+	reply := currentShowReply()
+	// move the body to the front of the reply
+	reordered := append([]interface{}{}, reply[28:]...)
+	reordered = append(reordered, reply[:28]...)
+
+	jobDetails, err := parseJobDetails(reordered)
+
+	s.Nil(err)
+	s.Equal("asdf", jobDetails.Message)
+	s.Equal("queue1", jobDetails.QueueName)
+	s.EqualValues(2, jobDetails.Nacks)
+}
+
+func (s *JobDetailsSuite) TestParseOlderReplyWithoutCounters() {
+	reply := []interface{}{
+		[]byte("id"), []byte("D-dcb833cf-8YL1NT17e9+wsA/09NqxscQI-05a1"),
+		[]byte("queue"), []byte("queue1"),
+		[]byte("state"), []byte("active"),
+		[]byte("repl"), int64(1),
+		[]byte("ttl"), int64(86400),
+		[]byte("ctime"), int64(1454532866000000000),
+		[]byte("delay"), int64(0),
+		[]byte("retry"), int64(8640),
+		[]byte("nodes-delivered"), []interface{}{[]byte("dcb833cf")},
+		[]byte("nodes-confirmed"), []interface{}{},
+		[]byte("next-requeue-within"), int64(8639867),
+		[]byte("next-awake-within"), nil,
+		[]byte("body"), []byte("asdf"),
+	}
+
+	jobDetails, err := parseJobDetails(reply)
+
+	s.Nil(err)
+	s.Equal("active", jobDetails.State)
+	s.EqualValues(0, jobDetails.Nacks)
+	s.EqualValues(0, jobDetails.AdditionalDeliveries)
+	s.Equal(time.Duration(0), jobDetails.NextAwakeWithin)
+	s.Equal("asdf", jobDetails.Message)
+}
+
+func (s *JobDetailsSuite) TestParseNewerReplyWithUnknownFields() {
+	reply := append(currentShowReply(),
+		[]byte("last-delivery"), int64(1454532867000),
+		[]byte("tags"), []interface{}{[]byte("a"), []byte("b")},
+	)
+
+	jobDetails, err := parseJobDetails(reply)
+
+	s.Nil(err)
+	s.Equal("asdf", jobDetails.Message)
+	s.Equal(2, len(jobDetails.Extra))
+	s.Equal(int64(1454532867000), jobDetails.Extra["last-delivery"])
+	s.Equal([]interface{}{"a", "b"}, jobDetails.Extra["tags"])
+}
+
+func (s *JobDetailsSuite) TestParseReplyWithMissingField() {
+	reply := currentShowReply()[:28]
+
+	jobDetails, err := parseJobDetails(reply)
+
+	s.NotNil(err)
+	s.Nil(jobDetails)
+	s.Contains(err.Error(), "body")
+}
+
+func (s *JobDetailsSuite) TestParseReplyWithMalformedField() {
+	reply := currentShowReply()
+	reply[9] = []byte("forever")
+
+	jobDetails, err := parseJobDetails(reply)
+
+	s.NotNil(err)
+	s.Nil(jobDetails)
+	s.Contains(err.Error(), "ttl")
+}
+
+func (s *JobDetailsSuite) TestParseReplyWithOddNumberOfElements() {
+	reply := currentShowReply()[:29]
+
+	jobDetails, err := parseJobDetails(reply)
+
+	s.NotNil(err)
+	s.Nil(jobDetails)
+}
+
+func (s *JobDetailsSuite) TestParseEmptyReply() {
+	jobDetails, err := parseJobDetails([]interface{}{})
+
+	s.NotNil(err)
+	s.Nil(jobDetails)
+}
@@ -0,0 +1,174 @@
+package disque
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"golang.org/x/net/context"
+)
+
+// minimum interval between two WORKING calls for the same job
+const minLeaseInterval = 100 * time.Millisecond
+
+// Working tells Disque that the job is still being processed, postponing
+// its redelivery. The returned duration is the time by which the next
+// delivery attempt was postponed.
+func (d *Disque) Working(jobID string) (postpone time.Duration, err error) {
+	var seconds int
+	if seconds, err = redis.Int(d.call("WORKING", redis.Args{}.Add(jobID))); err == nil {
+		postpone = time.Duration(seconds) * time.Second
+	}
+	return
+}
+
+// KeepWorking extends the lease on a job for as long as it is being processed.
+// It calls WORKING immediately, then keeps calling it in the background at
+// half the postpone time reported by Disque. The lease is extended until the
+// job is acknowledged, NACK'd or deleted through this connection, the
+// connection is closed, or ctx is done.
+//
+// WORKING is sent on a second connection to the node the job was fetched
+// from, so leases keep being extended while this connection is blocked in
+// a fetch.
+func (d *Disque) KeepWorking(ctx context.Context, jobID string) (err error) {
+	host := d.node()
+	var postpone time.Duration
+	if postpone, err = d.working(host, jobID); err == nil {
+		ctx = d.leases.start(ctx, jobID)
+		go d.extendLease(ctx, host, jobID, postpone)
+	}
+	return
+}
+
+func (d *Disque) extendLease(ctx context.Context, host string, jobID string, postpone time.Duration) {
+	defer d.leases.release(ctx, jobID)
+
+	for {
+		interval := postpone / 2
+		if interval < minLeaseInterval {
+			interval = minLeaseInterval
+		}
+
+		timer := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		var err error
+		if postpone, err = d.working(host, jobID); err != nil {
+			select {
+			case <-ctx.Done():
+				// the job was acknowledged while the call was in flight
+			default:
+				log.Printf("Error while extending lease on job %s, exception: %s", jobID, err)
+			}
+			return
+		}
+	}
+}
+
+// working calls WORKING on the lease connection to the given node, dialing
+// it if needed
+func (d *Disque) working(host string, jobID string) (postpone time.Duration, err error) {
+	d.leaseMu.Lock()
+	defer d.leaseMu.Unlock()
+
+	if host == "" || d.leaseClosed {
+		return 0, errNotConnected
+	}
+	if d.leaseClient != nil && d.leaseHost != host {
+		d.leaseClient.Close()
+		d.leaseClient = nil
+	}
+	if d.leaseClient == nil {
+		if d.leaseClient, err = redis.Dial("tcp", host); err != nil {
+			d.leaseClient = nil
+			return
+		}
+		d.leaseHost = host
+	}
+
+	var seconds int
+	if seconds, err = redis.Int(d.leaseClient.Do("WORKING", jobID)); err == nil {
+		postpone = time.Duration(seconds) * time.Second
+	} else if _, rejected := err.(redis.Error); !rejected {
+		// dial again on the next call
+		d.leaseClient.Close()
+		d.leaseClient = nil
+	}
+	return
+}
+
+// leases tracks the jobs whose leases are being extended
+type leases struct {
+	mu      sync.Mutex
+	cancels map[string]*lease
+}
+
+type lease struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func newLeases() *leases {
+	return &leases{
+		cancels: make(map[string]*lease),
+	}
+}
+
+// start registers a lease for the job, replacing any existing lease,
+// and returns the context governing it.
+func (l *leases) start(parent context.Context, jobID string) context.Context {
+	ctx, cancel := context.WithCancel(parent)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if existing, ok := l.cancels[jobID]; ok {
+		existing.cancel()
+	}
+	l.cancels[jobID] = &lease{ctx: ctx, cancel: cancel}
+	return ctx
+}
+
+// stop cancels the lease for the job, if any
+func (l *leases) stop(jobID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if existing, ok := l.cancels[jobID]; ok {
+		existing.cancel()
+		delete(l.cancels, jobID)
+	}
+}
+
+// release forgets the lease governed by ctx once its goroutine exits,
+// leaving any newer lease for the same job in place.
+func (l *leases) release(ctx context.Context, jobID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if existing, ok := l.cancels[jobID]; ok && existing.ctx == ctx {
+		existing.cancel()
+		delete(l.cancels, jobID)
+	}
+}
+
+// stopAll cancels every lease
+func (l *leases) stopAll() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for jobID, existing := range l.cancels {
+		existing.cancel()
+		delete(l.cancels, jobID)
+	}
+}
+
+// count returns the number of leases being extended
+func (l *leases) count() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.cancels)
+}
@@ -0,0 +1,151 @@
+package disque
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+	"golang.org/x/net/context"
+)
+
+type LeaseSuite struct {
+	suite.Suite
+}
+
+func TestLeaseSuite(t *testing.T) {
+	suite.Run(t, new(LeaseSuite))
+}
+
+func (s *LeaseSuite) SetupTest() {
+}
+
+func (s *LeaseSuite) SetupSuite() {
+}
+
+func (s *LeaseSuite) TestWorking() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	options := map[string]string{"RETRY": "30"}
+	_, err := d.PushWithOptions("queueLease1", "asdf", time.Second, options)
+	s.Nil(err)
+
+	job, err := d.Fetch("queueLease1", time.Second)
+	s.Nil(err)
+
+	postpone, err := d.Working(job.JobID)
+	s.Nil(err)
+	s.Equal(30*time.Second, postpone)
+	d.Ack(job.JobID)
+}
+
+func (s *LeaseSuite) TestWorkingWithMalformedJobID() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+
+	_, err := d.Working("foobaz")
+	s.NotNil(err)
+}
+
+func (s *LeaseSuite) TestKeepWorkingPreventsRedelivery() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	options := map[string]string{"RETRY": "1"}
+	_, err := d.PushWithOptions("queueLease2", "asdf", time.Second, options)
+	s.Nil(err)
+
+	job, err := d.Fetch("queueLease2", time.Second)
+	s.Nil(err)
+	s.Nil(d.KeepWorking(context.Background(), job.JobID))
+	s.Equal(1, d.leases.count())
+
+	// without the lease the job would be redelivered after one second
+	time.Sleep(2500 * time.Millisecond)
+	var queueLength int
+	queueLength, err = d.QueueLength("queueLease2")
+	s.Nil(err)
+	s.Equal(0, queueLength)
+
+	s.Nil(d.Ack(job.JobID))
+	s.Equal(0, d.leases.count())
+}
+
+func (s *LeaseSuite) TestKeepWorkingStopsWithContext() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	options := map[string]string{"RETRY": "1"}
+	_, err := d.PushWithOptions("queueLease3", "asdf", time.Second, options)
+	s.Nil(err)
+
+	job, err := d.Fetch("queueLease3", time.Second)
+	s.Nil(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	s.Nil(d.KeepWorking(ctx, job.JobID))
+	cancel()
+
+	// the job is redelivered once the lease is no longer extended
+	job, err = d.Fetch("queueLease3", 3*time.Second)
+	s.Nil(err)
+	s.NotNil(job)
+	s.EqualValues(1, job.AdditionalDeliveries)
+	s.Equal(0, d.leases.count())
+	d.Ack(job.JobID)
+}
+
+func (s *LeaseSuite) TestKeepWorkingWithUnknownJob() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+
+	err := d.KeepWorking(context.Background(), "D-dcb833cf-8YL1NT17e9+wsA/09NqxscQI-05a1")
+	s.NotNil(err)
+	s.Equal(0, d.leases.count())
+}
+
+func (s *LeaseSuite) TestKeepWorkingDuringBlockingFetch() {
+	server := disquetest.NewServer()
+	defer server.Close()
+	d := NewDisque([]string{server.Addr}, 1000)
+	s.Nil(d.Initialize())
+	defer d.Close()
+	_, err := d.PushWithOptions("queueLease5", "asdf", time.Second, map[string]string{"RETRY": "1"})
+	s.Nil(err)
+	job, err := d.Fetch("queueLease5", time.Second)
+	s.Nil(err)
+	s.Nil(d.KeepWorking(context.Background(), job.JobID))
+
+	// the fetch holds the main connection while the lease is extended
+	_, err = d.Fetch("queueLease5Empty", 1500*time.Millisecond)
+	s.Nil(err)
+	s.True(server.CommandCount("WORKING") >= 3)
+	s.Nil(d.Ack(job.JobID))
+}
+
+func (s *LeaseSuite) TestStopAllLeasesOnClose() {
+	l := newLeases()
+	ctx1 := l.start(context.Background(), "job1")
+	ctx2 := l.start(context.Background(), "job2")
+	s.Equal(2, l.count())
+
+	l.stopAll()
+
+	s.Equal(0, l.count())
+	s.NotNil(ctx1.Err())
+	s.NotNil(ctx2.Err())
+}
+
+func (s *LeaseSuite) TestReleaseKeepsNewerLease() {
+	l := newLeases()
+	older := l.start(context.Background(), "job1")
+	newer := l.start(context.Background(), "job1")
+	s.NotNil(older.Err())
+
+	l.release(older, "job1")
+
+	s.Equal(1, l.count())
+	s.Nil(newer.Err())
+}
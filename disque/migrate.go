@@ -0,0 +1,383 @@
+package disque
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"golang.org/x/net/context"
+)
+
+// Defaults used by a Migrator when the corresponding option is unset
+const (
+	DefaultMigrateBatchSize    = 100
+	DefaultMigrateFetchTimeout = time.Second
+)
+
+// MigratorOptions configures a Migrator
+type MigratorOptions struct {
+	// BatchSize is the number of jobs moved at once, DefaultMigrateBatchSize if unset
+	BatchSize int
+	// Rate is the largest number of jobs moved per second, unlimited if unset
+	Rate float64
+	// Timeout for adding jobs to the destination, one second if unset
+	Timeout time.Duration
+	// FetchTimeout is the time to wait for jobs on the source before the queue
+	// is considered drained, DefaultMigrateFetchTimeout if unset
+	FetchTimeout time.Duration
+	// DryRun only reports the jobs that would be moved, leaving both clusters untouched
+	DryRun bool
+	// OnProgress, if set, is invoked after every batch
+	OnProgress func(progress *MigrationProgress)
+}
+
+// MigrationProgress reports the progress of the migration of a queue
+type MigrationProgress struct {
+	QueueName string
+	// Migrated is the number of jobs moved, or that would be moved in a dry run
+	Migrated int
+	// Expired is the number of jobs dropped because their TTL elapsed
+	Expired int
+	// Failed is the number of jobs that could not be added to the destination,
+	// which were put back in the source queue
+	Failed int
+	// Unacknowledged is the number of jobs added to the destination that could
+	// not be acknowledged on the source, and may be moved again
+	Unacknowledged int
+	// Remaining is the number of jobs left in the source queue
+	Remaining int
+	// Pending is the number of jobs of the queue left on the source because
+	// they were not queued, such as delayed jobs and jobs being processed,
+	// including those counted in Unacknowledged. It is counted once the
+	// queue is drained; run the migration again once these jobs are queued.
+	Pending int
+	Elapsed time.Duration
+	DryRun  bool
+}
+
+// Migrator moves the jobs of queues from a source cluster to a destination
+// cluster. Each job is re-added with its remaining TTL and delay, its retry
+// and, up to the number of destination nodes, its replication factor. Jobs
+// are only acknowledged on the source once the destination has accepted
+// them, so a job may be delivered twice if the migration is interrupted,
+// but is never lost. Only queued jobs are moved: delayed jobs and jobs being
+// processed stay on the source, and are reported as Pending.
+type Migrator struct {
+	source      *Pool
+	destination *Pool
+	options     MigratorOptions
+	limiter     *RateLimiter
+
+	// now returns the current time, replaced in tests
+	now func() time.Time
+}
+
+// NewMigrator creates a migrator moving jobs between the given pools
+func NewMigrator(source *Pool, destination *Pool, options MigratorOptions) *Migrator {
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultMigrateBatchSize
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = time.Second
+	}
+	if options.FetchTimeout <= 0 {
+		options.FetchTimeout = DefaultMigrateFetchTimeout
+	}
+	m := &Migrator{
+		source:      source,
+		destination: destination,
+		options:     options,
+		now:         time.Now,
+	}
+	if options.Rate > 0 {
+		m.limiter = NewRateLimiter()
+	}
+	return m
+}
+
+// Migrate drains a queue of the source cluster into the queue of the same
+// name on the destination cluster, until no job is left or ctx is done.
+// A dry run scans the source queue instead, without dequeuing any job.
+func (m *Migrator) Migrate(ctx context.Context, queueName string) (progress *MigrationProgress, err error) {
+	progress = &MigrationProgress{QueueName: queueName, DryRun: m.options.DryRun}
+	start := m.now()
+	if m.limiter != nil {
+		m.limiter.SetLimit(queueName, m.options.Rate, m.options.BatchSize)
+	}
+
+	var src, dst *Disque
+	if src, err = m.source.Get(ctx); err != nil {
+		return
+	}
+	defer m.source.Put(src)
+	if dst, err = m.destination.Get(ctx); err != nil {
+		return
+	}
+	defer m.destination.Put(dst)
+
+	if m.options.DryRun {
+		err = m.scan(ctx, src, dst, progress, start)
+		return
+	}
+	for ctx.Err() == nil {
+		count := m.options.BatchSize
+		if m.limiter != nil {
+			// wait for tokens a little at a time, so that ctx is checked in between
+			if count, _ = m.limiter.acquire(queueName, count, m.options.FetchTimeout); count == 0 {
+				continue
+			}
+		}
+
+		var moved int
+		if moved, err = m.moveBatch(src, dst, queueName, count, progress); err != nil {
+			return
+		}
+		if progress.Remaining, err = src.QueueLength(queueName); err != nil {
+			return
+		}
+		if moved == 0 {
+			if progress.Pending, err = pendingJobs(src, queueName); err != nil {
+				return
+			}
+		}
+		progress.Elapsed = m.now().Sub(start)
+		m.report(progress)
+		if moved == 0 {
+			break
+		}
+	}
+	return progress, ctx.Err()
+}
+
+// pendingJobs counts the jobs of a queue that are not queued
+func pendingJobs(d *Disque, queueName string) (pending int, err error) {
+	var jobIDs []string
+	if jobIDs, err = d.ScanAll(ScanOptions{Queue: queueName, States: []string{JobStateActive, JobStateWaitRepl}}); err == nil {
+		pending = len(jobIDs)
+	}
+	return
+}
+
+// moveBatch moves up to count jobs, returning the number of jobs fetched from the source
+func (m *Migrator) moveBatch(src *Disque, dst *Disque, queueName string, count int, progress *MigrationProgress) (fetched int, err error) {
+	var jobs []*Job
+	if jobs, err = src.FetchMultiple(queueName, count, m.options.FetchTimeout); err != nil || len(jobs) == 0 {
+		return
+	}
+	fetched = len(jobs)
+	if m.limiter != nil && fetched < count {
+		m.limiter.refund(queueName, count-fetched)
+	}
+
+	var details []*JobDetails
+	if details, err = jobDetails(src, jobs); err != nil {
+		// put the jobs back rather than wait for them to be requeued
+		m.release(src, jobs, nil)
+		return
+	}
+
+	replicas := len(dst.Nodes())
+	push := dst.Pipeline()
+	pushed := make([]*Job, 0, len(jobs))
+	expired := make([]*Job, 0)
+	for i, job := range jobs {
+		if details[i] == nil {
+			// acknowledged or expired since it was fetched
+			progress.Expired++
+			continue
+		}
+		options, ok := m.migrationOptions(details[i], replicas)
+		if !ok {
+			expired = append(expired, job)
+			progress.Expired++
+			continue
+		}
+		push.PushWithOptions(queueName, job.Message, m.options.Timeout, options)
+		pushed = append(pushed, job)
+	}
+
+	var results []*PipelineResult
+	if len(pushed) > 0 {
+		if results, err = push.Execute(); err != nil {
+			m.release(src, pushed, expired)
+			progress.Failed += len(pushed)
+			return
+		}
+	}
+	accepted := make([]*Job, 0, len(pushed))
+	rejected := make([]*Job, 0)
+	for i, result := range results {
+		if result.Err != nil {
+			err = fmt.Errorf("Unable to add job %s to the destination: %s", pushed[i].JobID, result.Err)
+			rejected = append(rejected, pushed[i])
+		} else {
+			accepted = append(accepted, pushed[i])
+		}
+	}
+	progress.Failed += len(rejected)
+
+	unacked, releaseErr := m.release(src, rejected, append(accepted, expired...))
+	moved := len(accepted)
+	for _, i := range unacked {
+		if i < len(accepted) {
+			// the job is on both clusters
+			moved--
+			progress.Unacknowledged++
+		}
+	}
+	progress.Migrated += moved
+	if err == nil {
+		err = releaseErr
+	}
+	return
+}
+
+// release puts jobs back in the source queue and acknowledges others,
+// returning the indexes in ack of the jobs that could not be acknowledged
+func (m *Migrator) release(src *Disque, nack []*Job, ack []*Job) (unacked []int, err error) {
+	pipeline := src.Pipeline()
+	jobs := append(append([]*Job{}, nack...), ack...)
+	for _, job := range nack {
+		pipeline.Nack(job.JobID)
+	}
+	for _, job := range ack {
+		pipeline.Ack(job.JobID)
+	}
+	if pipeline.Len() == 0 {
+		return
+	}
+
+	var results []*PipelineResult
+	if results, err = pipeline.Execute(); err != nil {
+		for i := range ack {
+			unacked = append(unacked, i)
+		}
+		return unacked, fmt.Errorf("Unable to release jobs on the source: %s", err)
+	}
+	for i, result := range results {
+		if result.Err == nil {
+			continue
+		}
+		if i >= len(nack) {
+			unacked = append(unacked, i-len(nack))
+		}
+		if err == nil {
+			err = fmt.Errorf("Unable to release job %s on the source: %s", jobs[i].JobID, result.Err)
+		}
+	}
+	return
+}
+
+// scan reports the jobs of the source queue that would be moved
+func (m *Migrator) scan(ctx context.Context, src *Disque, dst *Disque, progress *MigrationProgress, start time.Time) (err error) {
+	replicas := len(dst.Nodes())
+	options := ScanOptions{Queue: progress.QueueName, States: []string{JobStateQueued}, Count: m.options.BatchSize}
+	for cursor := "0"; ctx.Err() == nil; {
+		var page []*JobDetails
+		if cursor, page, err = src.ScanDetails(cursor, options); err != nil {
+			return
+		}
+		for _, details := range page {
+			if _, ok := m.migrationOptions(details, replicas); ok {
+				progress.Migrated++
+			} else {
+				progress.Expired++
+			}
+		}
+		if progress.Remaining, err = src.QueueLength(progress.QueueName); err != nil {
+			return
+		}
+		if cursor == "0" {
+			if progress.Pending, err = pendingJobs(src, progress.QueueName); err != nil {
+				return
+			}
+		}
+		progress.Elapsed = m.now().Sub(start)
+		m.report(progress)
+		if cursor == "0" {
+			return
+		}
+	}
+	return ctx.Err()
+}
+
+// migrationOptions computes the ADDJOB options preserving the state of a
+// job, returning false if its TTL has elapsed
+func (m *Migrator) migrationOptions(details *JobDetails, replicas int) (options map[string]string, ok bool) {
+	return preservingOptions(details, m.now(), replicas)
+}
+
+// preservingOptions computes the ADDJOB options re-creating a job with the
+// TTL and delay it has left at the given time, its retry and, up to the given
+// number of nodes, its replication factor. It returns false if the TTL of the
+// job has elapsed.
+func preservingOptions(details *JobDetails, now time.Time, replicas int) (options map[string]string, ok bool) {
+	age := now.Sub(details.CreatedAt)
+	ttl := int64(math.Ceil((details.TTL - age).Seconds()))
+	if ttl <= 0 {
+		return nil, false
+	}
+	options = map[string]string{"TTL": strconv.FormatInt(ttl, 10)}
+
+	// the TTL must exceed the retry, which must stay above zero so that the
+	// job is still delivered at least once
+	retry := int64(details.Retry.Seconds())
+	if retry >= ttl {
+		if retry = ttl - 1; retry == 0 {
+			retry = 1
+			ttl = 2
+			options["TTL"] = "2"
+		}
+	}
+	options["RETRY"] = strconv.FormatInt(retry, 10)
+
+	if delay := int64(math.Ceil((details.Delay - age).Seconds())); delay > 0 && delay < ttl {
+		options["DELAY"] = strconv.FormatInt(delay, 10)
+	}
+	if replicate := details.ReplicationFactor; replicate > 0 {
+		if replicas > 0 && replicate > replicas {
+			replicate = replicas
+		}
+		options["REPLICATE"] = strconv.Itoa(replicate)
+	}
+	return options, true
+}
+
+func (m *Migrator) report(progress *MigrationProgress) {
+	if m.options.OnProgress != nil {
+		p := *progress
+		m.options.OnProgress(&p)
+	}
+}
+
+// jobDetails retrieves the details of jobs in a single pipeline. The details
+// of jobs that no longer exist are nil.
+func jobDetails(d *Disque, jobs []*Job) (details []*JobDetails, err error) {
+	pipeline := d.Pipeline()
+	for _, job := range jobs {
+		pipeline.Send("SHOW", job.JobID)
+	}
+	var results []*PipelineResult
+	if results, err = pipeline.Execute(); err != nil {
+		return
+	}
+	details = make([]*JobDetails, len(jobs))
+	for i, result := range results {
+		if result.Err != nil {
+			return nil, result.Err
+		}
+		if result.Reply == nil {
+			continue
+		}
+		var values []interface{}
+		if values, err = redis.Values(result.Reply, nil); err != nil {
+			return nil, err
+		}
+		if details[i], err = parseJobDetails(values); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
@@ -0,0 +1,254 @@
+package disque
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+	"golang.org/x/net/context"
+)
+
+type MigratorSuite struct {
+	suite.Suite
+	source      *disquetest.Server
+	destination *disquetest.Server
+	src         *Pool
+	dst         *Pool
+}
+
+func TestMigratorSuite(t *testing.T) {
+	suite.Run(t, new(MigratorSuite))
+}
+
+func (s *MigratorSuite) SetupTest() {
+	s.source = disquetest.NewServer()
+	s.destination = disquetest.NewServer()
+	s.src = NewPool([]string{s.source.Addr}, 1000, 2, 2, time.Hour)
+	s.dst = NewPool([]string{s.destination.Addr}, 1000, 2, 2, time.Hour)
+}
+
+func (s *MigratorSuite) TearDownTest() {
+	s.src.Close()
+	s.dst.Close()
+	s.source.Close()
+	s.destination.Close()
+}
+
+func (s *MigratorSuite) SetupSuite() {
+}
+
+func (s *MigratorSuite) conn(p *Pool) *Disque {
+	d, err := p.Get(context.Background())
+	s.Nil(err)
+	return d
+}
+
+func (s *MigratorSuite) push(queueName string, count int, options map[string]string) {
+	d := s.conn(s.src)
+	defer s.src.Put(d)
+	for i := 0; i < count; i++ {
+		_, err := d.PushWithOptions(queueName, "job"+string(rune('a'+i)), time.Second, options)
+		s.Nil(err)
+	}
+}
+
+func (s *MigratorSuite) queueLength(p *Pool, queueName string) int {
+	d := s.conn(p)
+	defer p.Put(d)
+	queueLength, err := d.QueueLength(queueName)
+	s.Nil(err)
+	return queueLength
+}
+
+func (s *MigratorSuite) TestMigrate() {
+	s.push("queueMigrate", 5, map[string]string{"TTL": "3600", "RETRY": "30"})
+
+	var reports []*MigrationProgress
+	m := NewMigrator(s.src, s.dst, MigratorOptions{
+		BatchSize:    2,
+		FetchTimeout: 10 * time.Millisecond,
+		OnProgress: func(progress *MigrationProgress) {
+			reports = append(reports, progress)
+		},
+	})
+	progress, err := m.Migrate(context.Background(), "queueMigrate")
+	s.Nil(err)
+	s.Equal(5, progress.Migrated)
+	s.Equal(0, progress.Remaining)
+	s.Equal(4, len(reports))
+	s.Equal(2, reports[0].Migrated)
+	s.Equal(3, reports[0].Remaining)
+
+	s.Equal(0, s.queueLength(s.src, "queueMigrate"))
+	s.Equal(5, s.queueLength(s.dst, "queueMigrate"))
+
+	d := s.conn(s.dst)
+	defer s.dst.Put(d)
+	jobs, err := d.FetchMultiple("queueMigrate", 5, time.Second)
+	s.Nil(err)
+	s.Equal("joba", jobs[0].Message)
+	s.Equal("jobe", jobs[4].Message)
+	details, err := d.GetJobDetails(jobs[0].JobID)
+	s.Nil(err)
+	s.True(details.TTL <= time.Hour && details.TTL > 59*time.Minute)
+	s.Equal(30*time.Second, details.Retry)
+}
+
+func (s *MigratorSuite) TestDryRun() {
+	s.push("queueMigrate", 3, nil)
+
+	m := NewMigrator(s.src, s.dst, MigratorOptions{DryRun: true})
+	progress, err := m.Migrate(context.Background(), "queueMigrate")
+	s.Nil(err)
+	s.True(progress.DryRun)
+	s.Equal(3, progress.Migrated)
+	s.Equal(3, progress.Remaining)
+
+	s.Equal(3, s.queueLength(s.src, "queueMigrate"))
+	s.Equal(0, s.queueLength(s.dst, "queueMigrate"))
+}
+
+func (s *MigratorSuite) TestExpiredJobs() {
+	s.push("queueMigrate", 2, map[string]string{"TTL": "60"})
+
+	m := NewMigrator(s.src, s.dst, MigratorOptions{FetchTimeout: 10 * time.Millisecond})
+	clock := &fakeClock{now: time.Now().Add(time.Hour)}
+	m.now = clock.Now
+	progress, err := m.Migrate(context.Background(), "queueMigrate")
+	s.Nil(err)
+	s.Equal(0, progress.Migrated)
+	s.Equal(2, progress.Expired)
+
+	// expired jobs are dropped from the source
+	s.Equal(0, s.queueLength(s.src, "queueMigrate"))
+	s.Equal(0, s.queueLength(s.dst, "queueMigrate"))
+}
+
+func (s *MigratorSuite) TestDestinationFailure() {
+	s.push("queueMigrate", 3, nil)
+	s.destination.FailNext("ADDJOB", "ERR rejected")
+
+	m := NewMigrator(s.src, s.dst, MigratorOptions{FetchTimeout: 10 * time.Millisecond})
+	progress, err := m.Migrate(context.Background(), "queueMigrate")
+	s.NotNil(err)
+	s.Equal(2, progress.Migrated)
+	s.Equal(1, progress.Failed)
+
+	// the rejected job is put back in the source queue
+	s.Equal(1, s.queueLength(s.src, "queueMigrate"))
+	s.Equal(2, s.queueLength(s.dst, "queueMigrate"))
+}
+
+func (s *MigratorSuite) TestThrottle() {
+	s.push("queueMigrate", 10, nil)
+
+	m := NewMigrator(s.src, s.dst, MigratorOptions{BatchSize: 5, Rate: 20, FetchTimeout: 10 * time.Millisecond})
+	progress, err := m.Migrate(context.Background(), "queueMigrate")
+	s.Nil(err)
+	s.Equal(10, progress.Migrated)
+	// the first batch uses the burst, the second waits for tokens
+	s.True(progress.Elapsed >= 200*time.Millisecond)
+}
+
+func (s *MigratorSuite) TestCancel() {
+	s.push("queueMigrate", 3, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := NewMigrator(s.src, s.dst, MigratorOptions{
+		BatchSize: 1,
+		OnProgress: func(progress *MigrationProgress) {
+			cancel()
+		},
+	})
+	progress, err := m.Migrate(ctx, "queueMigrate")
+	s.Equal(context.Canceled, err)
+	s.Equal(1, progress.Migrated)
+	s.Equal(2, s.queueLength(s.src, "queueMigrate"))
+}
+
+func (s *MigratorSuite) TestMigrationOptions() {
+	clock := &fakeClock{now: time.Now()}
+	m := NewMigrator(s.src, s.dst, MigratorOptions{})
+	m.now = clock.Now
+
+	details := &JobDetails{
+		CreatedAt:         clock.Now().Add(-10 * time.Second),
+		TTL:               time.Minute,
+		Retry:             5 * time.Minute,
+		Delay:             30 * time.Second,
+		ReplicationFactor: 3,
+	}
+	options, ok := m.migrationOptions(details, 2)
+	s.True(ok)
+	s.Equal(map[string]string{"TTL": "50", "RETRY": "49", "DELAY": "20", "REPLICATE": "2"}, options)
+
+	// a retry is kept when a single second of TTL is left
+	clock.Advance(49500 * time.Millisecond)
+	options, ok = m.migrationOptions(details, 2)
+	s.True(ok)
+	s.Equal("2", options["TTL"])
+	s.Equal("1", options["RETRY"])
+
+	clock.Advance(time.Minute)
+	_, ok = m.migrationOptions(details, 2)
+	s.False(ok)
+}
+
+func (s *MigratorSuite) TestPendingJobs() {
+	s.push("queueMigrate", 2, nil)
+	s.push("queueMigrate", 1, map[string]string{"DELAY": "60", "TTL": "3600"})
+
+	m := NewMigrator(s.src, s.dst, MigratorOptions{FetchTimeout: 10 * time.Millisecond})
+	progress, err := m.Migrate(context.Background(), "queueMigrate")
+	s.Nil(err)
+	s.Equal(2, progress.Migrated)
+	s.Equal(0, progress.Remaining)
+	// the delayed job is left on the source
+	s.Equal(1, progress.Pending)
+
+	m = NewMigrator(s.src, s.dst, MigratorOptions{DryRun: true})
+	progress, err = m.Migrate(context.Background(), "queueMigrate")
+	s.Nil(err)
+	s.Equal(0, progress.Migrated)
+	s.Equal(1, progress.Pending)
+}
+
+func (s *MigratorSuite) TestSourceAckFailure() {
+	s.push("queueMigrate", 2, nil)
+	s.source.FailNext("ACKJOB", "ERR unavailable")
+
+	m := NewMigrator(s.src, s.dst, MigratorOptions{FetchTimeout: 10 * time.Millisecond})
+	progress, err := m.Migrate(context.Background(), "queueMigrate")
+	s.NotNil(err)
+	// the job that could not be acknowledged is not reported as moved
+	s.Equal(1, progress.Migrated)
+	s.Equal(1, progress.Unacknowledged)
+	s.Equal(2, s.queueLength(s.dst, "queueMigrate"))
+}
+
+func (s *MigratorSuite) TestCancelWhileThrottled() {
+	s.push("queueMigrate", 3, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	m := NewMigrator(s.src, s.dst, MigratorOptions{
+		BatchSize:    1,
+		Rate:         0.001,
+		FetchTimeout: 10 * time.Millisecond,
+		OnProgress: func(progress *MigrationProgress) {
+			time.AfterFunc(50*time.Millisecond, cancel)
+		},
+	})
+	done := make(chan struct{})
+	go func() {
+		progress, err := m.Migrate(ctx, "queueMigrate")
+		s.Equal(context.Canceled, err)
+		s.Equal(1, progress.Migrated)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		s.Fail("Migration not cancelled while waiting for tokens")
+	}
+}
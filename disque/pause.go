@@ -0,0 +1,66 @@
+package disque
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrQueuePaused is returned when pushing a job onto a queue whose input is paused
+var ErrQueuePaused = errors.New("Queue paused in input")
+
+// PauseMode describes which direction of a queue is paused
+type PauseMode string
+
+// Pause modes accepted and reported by PAUSE
+const (
+	// PauseNone clears any pause on the queue
+	PauseNone PauseMode = "none"
+	// PauseIn refuses new jobs pushed onto the queue
+	PauseIn PauseMode = "in"
+	// PauseOut stops jobs from being fetched from the queue
+	PauseOut PauseMode = "out"
+	// PauseAll pauses both input and output
+	PauseAll PauseMode = "all"
+)
+
+// PauseOptions controls how a queue is paused
+type PauseOptions struct {
+	// Mode is the pause state to apply to the queue
+	Mode PauseMode
+	// Broadcast propagates the pause state to every node in the cluster
+	Broadcast bool
+}
+
+// PauseQueue changes the pause state of a queue, returning the resulting state.
+// Without Broadcast, the state only applies to the node this connection is using.
+func (d *Disque) PauseQueue(queueName string, options PauseOptions) (state PauseMode, err error) {
+	if options.Mode == "" {
+		return "", errors.New("Pause mode not specified")
+	}
+	args := redis.Args{}.Add(queueName).Add(string(options.Mode))
+	if options.Broadcast {
+		args = args.Add("bcast")
+	}
+	return d.pause(args)
+}
+
+// QueuePauseState returns the pause state of a queue on the node this connection is using
+func (d *Disque) QueuePauseState(queueName string) (state PauseMode, err error) {
+	return d.pause(redis.Args{}.Add(queueName).Add("state"))
+}
+
+func (d *Disque) pause(args redis.Args) (state PauseMode, err error) {
+	var reply string
+	if reply, err = redis.String(d.call("PAUSE", args)); err == nil {
+		state = PauseMode(reply)
+	}
+	return
+}
+
+// isPausedError returns true if the server refused a job because the queue is paused
+func isPausedError(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(string(e), "PAUSED")
+}
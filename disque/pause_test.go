@@ -0,0 +1,95 @@
+package disque
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/suite"
+)
+
+type PauseSuite struct {
+	suite.Suite
+}
+
+func TestPauseSuite(t *testing.T) {
+	suite.Run(t, new(PauseSuite))
+}
+
+func (s *PauseSuite) SetupTest() {
+}
+
+func (s *PauseSuite) SetupSuite() {
+}
+
+func (s *PauseSuite) TestIsPausedError() {
+	s.True(isPausedError(redis.Error("PAUSED Queue paused in input, try later")))
+	s.False(isPausedError(redis.Error("ERR syntax error")))
+	s.False(isPausedError(ErrQueuePaused))
+}
+
+func (s *PauseSuite) TestPauseInput() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+
+	state, err := d.PauseQueue("queuePause1", PauseOptions{Mode: PauseIn})
+	s.Nil(err)
+	s.Equal(PauseIn, state)
+
+	state, err = d.QueuePauseState("queuePause1")
+	s.Nil(err)
+	s.Equal(PauseIn, state)
+
+	_, err = d.Push("queuePause1", "asdf", time.Second)
+	s.Equal(ErrQueuePaused, err)
+
+	state, err = d.PauseQueue("queuePause1", PauseOptions{Mode: PauseNone, Broadcast: true})
+	s.Nil(err)
+	s.Equal(PauseNone, state)
+
+	jobID, err := d.Push("queuePause1", "asdf", time.Second)
+	s.Nil(err)
+	d.Delete(jobID)
+}
+
+func (s *PauseSuite) TestPauseOutput() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	jobID, err := d.Push("queuePause2", "asdf", time.Second)
+	s.Nil(err)
+
+	state, err := d.PauseQueue("queuePause2", PauseOptions{Mode: PauseOut})
+	s.Nil(err)
+	s.Equal(PauseOut, state)
+
+	job, err := d.Fetch("queuePause2", 100*time.Millisecond)
+	s.Nil(err)
+	s.Nil(job)
+
+	d.PauseQueue("queuePause2", PauseOptions{Mode: PauseNone})
+	job, err = d.Fetch("queuePause2", time.Second)
+	s.Nil(err)
+	s.Equal(jobID, job.JobID)
+	d.Ack(job.JobID)
+}
+
+func (s *PauseSuite) TestPauseWithoutMode() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+
+	_, err := d.PauseQueue("queuePause3", PauseOptions{})
+	s.NotNil(err)
+}
+
+func (s *PauseSuite) TestQueuePauseStateForUnpausedQueue() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+
+	state, err := d.QueuePauseState("queuePause4")
+	s.Nil(err)
+	s.Equal(PauseNone, state)
+}
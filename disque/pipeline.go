@@ -0,0 +1,183 @@
+package disque
+
+import (
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Pipeline queues commands to be sent to the node in a single write.
+// Replies are read back once every command has been sent, saving a
+// round trip per command. A Pipeline is not safe for concurrent use.
+type Pipeline struct {
+	d        *Disque
+	commands []*pipelinedCommand
+}
+
+type pipelinedCommand struct {
+	name string
+	args redis.Args
+	// release is the job whose lease stops once the command succeeded
+	release string
+}
+
+// readOnlyCommands may be sent again when it is unknown whether the server
+// received them, as they change nothing
+var readOnlyCommands = map[string]bool{
+	"QLEN":  true,
+	"QPEEK": true,
+	"QSTAT": true,
+	"SHOW":  true,
+	"JSCAN": true,
+	"QSCAN": true,
+	"INFO":  true,
+	"HELLO": true,
+}
+
+// PipelineResult holds the reply to a pipelined command, or the error
+// returned by the server for that command
+type PipelineResult struct {
+	Reply interface{}
+	Err   error
+}
+
+// Pipeline creates an empty pipeline executed through this connection
+func (d *Disque) Pipeline() *Pipeline {
+	return &Pipeline{
+		d:        d,
+		commands: make([]*pipelinedCommand, 0),
+	}
+}
+
+// Send queues an arbitrary command
+func (p *Pipeline) Send(command string, args ...interface{}) *Pipeline {
+	p.commands = append(p.commands, &pipelinedCommand{name: command, args: redis.Args(args)})
+	return p
+}
+
+// Push queues an ADDJOB with the default set of options.
+// The reply is the ID of the job.
+func (p *Pipeline) Push(queueName string, job string, timeout time.Duration) *Pipeline {
+	return p.PushWithOptions(queueName, job, timeout, nil)
+}
+
+// PushWithOptions queues an ADDJOB with options given in the options map.
+// The reply is the ID of the job.
+func (p *Pipeline) PushWithOptions(queueName string, job string, timeout time.Duration, options map[string]string) *Pipeline {
+	args := redis.Args{}.
+		Add(queueName).
+		Add(job).
+		Add(int64(timeout.Seconds() * 1000)).
+		AddFlat(optionsToArguments(options))
+	return p.Send("ADDJOB", args...)
+}
+
+// Ack queues an ACKJOB
+func (p *Pipeline) Ack(jobID string) *Pipeline {
+	return p.sendReleasing("ACKJOB", jobID)
+}
+
+// Nack queues a NACK
+func (p *Pipeline) Nack(jobID string) *Pipeline {
+	return p.sendReleasing("NACK", jobID)
+}
+
+// Delete queues a DELJOB
+func (p *Pipeline) Delete(jobID string) *Pipeline {
+	return p.sendReleasing("DELJOB", jobID)
+}
+
+// sendReleasing queues a command on a job whose lease stops once the command succeeded
+func (p *Pipeline) sendReleasing(command string, jobID string) *Pipeline {
+	p.commands = append(p.commands, &pipelinedCommand{name: command, args: redis.Args{jobID}, release: jobID})
+	return p
+}
+
+// QueueLength queues a QLEN. The reply is the length of the queue.
+func (p *Pipeline) QueueLength(queueName string) *Pipeline {
+	return p.Send("QLEN", queueName)
+}
+
+// Len returns the number of queued commands
+func (p *Pipeline) Len() int {
+	return len(p.commands)
+}
+
+// Execute sends every queued command in a single write and reads back the
+// replies, returning one result per command in the order they were queued.
+// Errors returned by the server for individual commands are reported in the
+// results; err is only set when the connection failed. If the commands could
+// not be written, the cluster is explored, and the write is attempted once
+// more only if the commands change nothing on the server: the server may have
+// received some of them, so that sending them again could add jobs twice.
+// Leases of acknowledged, nacked or deleted jobs stop once the command
+// succeeded. The pipeline is emptied once executed.
+func (p *Pipeline) Execute() (results []*PipelineResult, err error) {
+	commands := p.commands
+	p.commands = make([]*pipelinedCommand, 0)
+	results = make([]*PipelineResult, 0, len(commands))
+	if len(commands) == 0 {
+		return
+	}
+
+	d := p.d
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if err = sendCommands(d.client, commands); err != nil {
+		resend := d.client == nil || readOnly(commands)
+		if exploreErr := d.explore(); exploreErr != nil || !resend {
+			return nil, err
+		}
+		if err = sendCommands(d.client, commands); err != nil {
+			return nil, err
+		}
+	}
+
+	for range commands {
+		var reply interface{}
+		reply, err = d.client.Receive()
+		if _, ok := err.(redis.Error); ok || err == nil {
+			if isPausedError(err) {
+				err = ErrQueuePaused
+			}
+			results = append(results, &PipelineResult{Reply: reply, Err: err})
+			continue
+		}
+
+		// the connection failed, the remaining replies are lost
+		for len(results) < len(commands) {
+			results = append(results, &PipelineResult{Err: err})
+		}
+		return
+	}
+	d.lastUsed = time.Now()
+	for i, command := range commands {
+		if command.release != "" && results[i].Err == nil {
+			d.leases.stop(command.release)
+		}
+	}
+	return results, nil
+}
+
+// readOnly returns true if none of the commands change anything on the server
+func readOnly(commands []*pipelinedCommand) bool {
+	for _, command := range commands {
+		if !readOnlyCommands[command.name] {
+			return false
+		}
+	}
+	return true
+}
+
+func sendCommands(client redis.Conn, commands []*pipelinedCommand) (err error) {
+	if client == nil {
+		return errNotConnected
+	}
+	for _, command := range commands {
+		if err = client.Send(command.name, command.args...); err != nil {
+			return
+		}
+	}
+	return client.Flush()
+}
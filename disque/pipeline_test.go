@@ -0,0 +1,201 @@
+package disque
+
+import (
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+	"golang.org/x/net/context"
+)
+
+type PipelineSuite struct {
+	suite.Suite
+	server *disquetest.Server
+}
+
+func TestPipelineSuite(t *testing.T) {
+	suite.Run(t, new(PipelineSuite))
+}
+
+func (s *PipelineSuite) SetupTest() {
+	s.server = disquetest.NewServer()
+}
+
+func (s *PipelineSuite) TearDownTest() {
+	s.server.Close()
+}
+
+func (s *PipelineSuite) SetupSuite() {
+}
+
+func (s *PipelineSuite) TestPushAndQueueLength() {
+	hosts := []string{s.server.Addr}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	defer d.Close()
+
+	p := d.Pipeline()
+	for i := 0; i < 10; i++ {
+		p.Push("queuePipeline1", "asdf", time.Second)
+	}
+	p.QueueLength("queuePipeline1")
+	s.Equal(11, p.Len())
+
+	results, err := p.Execute()
+	s.Nil(err)
+	s.Equal(11, len(results))
+	for _, result := range results[:10] {
+		jobID, err := redis.String(result.Reply, result.Err)
+		s.Nil(err)
+		s.NotEmpty(jobID)
+	}
+	queueLength, err := redis.Int(results[10].Reply, results[10].Err)
+	s.Nil(err)
+	s.Equal(10, queueLength)
+
+	// the pipeline is emptied once executed
+	s.Equal(0, p.Len())
+}
+
+func (s *PipelineSuite) TestAck() {
+	hosts := []string{s.server.Addr}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	defer d.Close()
+
+	jobs := make([]*Job, 0)
+	for i := 0; i < 3; i++ {
+		d.Push("queuePipeline2", "asdf", time.Second)
+		job, err := d.Fetch("queuePipeline2", time.Second)
+		s.Nil(err)
+		jobs = append(jobs, job)
+	}
+
+	p := d.Pipeline()
+	for _, job := range jobs {
+		p.Ack(job.JobID)
+	}
+	results, err := p.Execute()
+	s.Nil(err)
+	s.Equal(3, len(results))
+	for _, result := range results {
+		s.Nil(result.Err)
+	}
+}
+
+func (s *PipelineSuite) TestErrorsAreReportedPerCommand() {
+	hosts := []string{s.server.Addr}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	defer d.Close()
+
+	results, err := d.Pipeline().
+		Push("queuePipeline3", "asdf", time.Second).
+		Ack("foobaz").
+		QueueLength("queuePipeline3").
+		Execute()
+	s.Nil(err)
+	s.Equal(3, len(results))
+	s.Nil(results[0].Err)
+	s.NotNil(results[1].Err)
+	queueLength, err := redis.Int(results[2].Reply, results[2].Err)
+	s.Nil(err)
+	s.Equal(1, queueLength)
+}
+
+func (s *PipelineSuite) TestSend() {
+	hosts := []string{s.server.Addr}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	defer d.Close()
+
+	results, err := d.Pipeline().Send("PING").Execute()
+	s.Nil(err)
+	s.Equal(1, len(results))
+	reply, err := redis.String(results[0].Reply, results[0].Err)
+	s.Nil(err)
+	s.Equal("PONG", reply)
+}
+
+func (s *PipelineSuite) TestExecuteEmptyPipeline() {
+	hosts := []string{s.server.Addr}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	defer d.Close()
+
+	results, err := d.Pipeline().Execute()
+	s.Nil(err)
+	s.Equal(0, len(results))
+}
+
+func (s *PipelineSuite) TestExecuteOnClosedConnection() {
+	hosts := []string{s.server.Addr}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	d.client.Close()
+
+	// the cluster is explored again and the commands sent once more
+	results, err := d.Pipeline().QueueLength("queuePipeline4").Execute()
+	s.Nil(err)
+	s.Equal(1, len(results))
+	s.Nil(results[0].Err)
+	d.Close()
+}
+
+func (s *PipelineSuite) TestExecuteWithoutAvailableNodes() {
+	hosts := []string{s.server.Addr}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	d.client.Close()
+	d.servers = []string{"127.0.0.1:8800"}
+
+	results, err := d.Pipeline().QueueLength("queuePipeline5").Execute()
+	s.NotNil(err)
+	s.Nil(results)
+}
+
+func (s *PipelineSuite) TestExecuteDoesNotResendChanges() {
+	hosts := []string{s.server.Addr}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	defer d.Close()
+	d.client.Close()
+
+	// the server may have received the job, so it is not added again
+	results, err := d.Pipeline().Push("queuePipeline6", "asdf", time.Second).Execute()
+	s.NotNil(err)
+	s.Nil(results)
+
+	// the cluster was explored all the same
+	queueLength, err := d.QueueLength("queuePipeline6")
+	s.Nil(err)
+	s.Equal(0, queueLength)
+}
+
+func (s *PipelineSuite) TestLeaseStopsOnceExecuted() {
+	hosts := []string{s.server.Addr}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	defer d.Close()
+
+	d.Push("queuePipeline7", "asdf", time.Second)
+	job, err := d.Fetch("queuePipeline7", time.Second)
+	s.Nil(err)
+	d.leases.start(context.Background(), job.JobID)
+
+	p := d.Pipeline().Ack(job.JobID)
+	s.Equal(1, d.leases.count())
+
+	// the lease is kept while the job may still be leased
+	d.client.Close()
+	_, err = p.Execute()
+	s.NotNil(err)
+	s.Equal(1, d.leases.count())
+
+	results, err := d.Pipeline().Ack(job.JobID).Execute()
+	s.Nil(err)
+	s.Nil(results[0].Err)
+	s.Equal(0, d.leases.count())
+}
@@ -0,0 +1,238 @@
+package disque
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"golang.org/x/net/context"
+)
+
+// ErrProducerClosed is returned for jobs pushed onto a closed AsyncProducer
+var ErrProducerClosed = errors.New("Producer closed")
+
+// Defaults used by an AsyncProducer when the corresponding option is unset
+const (
+	DefaultProducerBufferSize = 1000
+	DefaultProducerBatchSize  = 100
+	DefaultProducerLinger     = 10 * time.Millisecond
+)
+
+// AsyncProducerOptions configures an AsyncProducer
+type AsyncProducerOptions struct {
+	// BufferSize is the number of jobs waiting to be pushed beyond which
+	// Push blocks, DefaultProducerBufferSize if unset
+	BufferSize int
+	// BatchSize is the largest number of jobs pushed in a single pipeline,
+	// DefaultProducerBatchSize if unset
+	BatchSize int
+	// Linger is the longest time a job waits for its batch to fill up,
+	// DefaultProducerLinger if unset
+	Linger time.Duration
+	// Flushers is the number of batches pushed concurrently, each through its
+	// own pool connection, 1 if unset
+	Flushers int
+	// Timeout for adding jobs, one second if unset
+	Timeout time.Duration
+	// OnResult, if set, is invoked with the outcome of every job
+	OnResult func(message *ProducerMessage, jobID string, err error)
+}
+
+// ProducerMessage is a job to be pushed by an AsyncProducer
+type ProducerMessage struct {
+	QueueName string
+	Job       string
+	// Options passed to ADDJOB
+	Options map[string]string
+
+	future *PushFuture
+}
+
+// PushFuture is the eventual outcome of a job pushed through an AsyncProducer
+type PushFuture struct {
+	done  chan struct{}
+	jobID string
+	err   error
+}
+
+func newPushFuture() *PushFuture {
+	return &PushFuture{done: make(chan struct{})}
+}
+
+// Done returns a channel closed once the job has been pushed or has failed
+func (f *PushFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the job has been pushed, returning its ID
+func (f *PushFuture) Wait() (jobID string, err error) {
+	<-f.done
+	return f.jobID, f.err
+}
+
+func (f *PushFuture) resolve(jobID string, err error) {
+	f.jobID = jobID
+	f.err = err
+	close(f.done)
+}
+
+// AsyncProducer pushes jobs in the background, grouping them into pipelined
+// batches that are sent once they reach the batch size or once their first job
+// has waited for the linger time. When the buffer is full, Push blocks until
+// there is room.
+type AsyncProducer struct {
+	pool    *Pool
+	options AsyncProducerOptions
+
+	input   chan *ProducerMessage
+	batches chan []*ProducerMessage
+
+	// mu guards closed, and keeps the input open while jobs are being pushed
+	mu      sync.RWMutex
+	closed  bool
+	drained sync.WaitGroup
+}
+
+// NewAsyncProducer creates a producer pushing jobs through connections of the pool
+func NewAsyncProducer(pool *Pool, options AsyncProducerOptions) *AsyncProducer {
+	if options.BufferSize <= 0 {
+		options.BufferSize = DefaultProducerBufferSize
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = DefaultProducerBatchSize
+	}
+	if options.Linger <= 0 {
+		options.Linger = DefaultProducerLinger
+	}
+	if options.Flushers <= 0 {
+		options.Flushers = 1
+	}
+	if options.Timeout <= 0 {
+		options.Timeout = time.Second
+	}
+
+	p := &AsyncProducer{
+		pool:    pool,
+		options: options,
+		input:   make(chan *ProducerMessage, options.BufferSize),
+		batches: make(chan []*ProducerMessage, options.Flushers),
+	}
+	p.drained.Add(1 + options.Flushers)
+	go p.dispatch()
+	for i := 0; i < options.Flushers; i++ {
+		go p.flush()
+	}
+	return p
+}
+
+// Input returns the channel jobs can be sent on directly. Their outcome is
+// only reported through the OnResult callback. Nothing may be sent on the
+// channel once Close has been called.
+func (p *AsyncProducer) Input() chan<- *ProducerMessage {
+	return p.input
+}
+
+// Push queues a job with the default set of options
+func (p *AsyncProducer) Push(queueName string, job string) *PushFuture {
+	return p.PushWithOptions(queueName, job, nil)
+}
+
+// PushWithOptions queues a job with options given in the options map,
+// blocking while the buffer is full
+func (p *AsyncProducer) PushWithOptions(queueName string, job string, options map[string]string) *PushFuture {
+	message := &ProducerMessage{
+		QueueName: queueName,
+		Job:       job,
+		Options:   options,
+		future:    newPushFuture(),
+	}
+
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.closed {
+		message.future.resolve("", ErrProducerClosed)
+		return message.future
+	}
+	p.input <- message
+	return message.future
+}
+
+// Close stops accepting jobs and blocks until every queued job has been pushed
+func (p *AsyncProducer) Close() {
+	p.mu.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.input)
+	}
+	p.mu.Unlock()
+	p.drained.Wait()
+}
+
+// dispatch groups queued jobs into batches
+func (p *AsyncProducer) dispatch() {
+	defer p.drained.Done()
+	defer close(p.batches)
+
+	var batch []*ProducerMessage
+	var linger <-chan time.Time
+	for {
+		select {
+		case message, ok := <-p.input:
+			if !ok {
+				if len(batch) > 0 {
+					p.batches <- batch
+				}
+				return
+			}
+			if len(batch) == 0 {
+				linger = time.After(p.options.Linger)
+			}
+			batch = append(batch, message)
+			if len(batch) < p.options.BatchSize {
+				continue
+			}
+		case <-linger:
+		}
+		p.batches <- batch
+		batch = nil
+		linger = nil
+	}
+}
+
+// flush pushes batches until the dispatcher is done
+func (p *AsyncProducer) flush() {
+	defer p.drained.Done()
+	for batch := range p.batches {
+		p.push(batch)
+	}
+}
+
+// push sends a batch in a single pipeline and reports the outcome of every job
+func (p *AsyncProducer) push(batch []*ProducerMessage) {
+	var results []*PipelineResult
+	conn, err := p.pool.Get(context.Background())
+	if err == nil {
+		pipeline := conn.Pipeline()
+		for _, message := range batch {
+			pipeline.PushWithOptions(message.QueueName, message.Job, p.options.Timeout, message.Options)
+		}
+		results, err = pipeline.Execute()
+		p.pool.Put(conn)
+	}
+
+	for i, message := range batch {
+		// results are missing if the connection could not be obtained or used
+		pushErr := err
+		var jobID string
+		if results != nil {
+			jobID, pushErr = redis.String(results[i].Reply, results[i].Err)
+		}
+		if message.future != nil {
+			message.future.resolve(jobID, pushErr)
+		}
+		if p.options.OnResult != nil {
+			p.options.OnResult(message, jobID, pushErr)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package disque
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+	"golang.org/x/net/context"
+)
+
+type AsyncProducerSuite struct {
+	suite.Suite
+	server *disquetest.Server
+	pool   *Pool
+}
+
+func TestAsyncProducerSuite(t *testing.T) {
+	suite.Run(t, new(AsyncProducerSuite))
+}
+
+func (s *AsyncProducerSuite) SetupTest() {
+	s.server = disquetest.NewServer()
+	s.pool = NewPool([]string{s.server.Addr}, 1000, 1, 1, time.Hour)
+}
+
+func (s *AsyncProducerSuite) TearDownTest() {
+	s.pool.Close()
+	s.server.Close()
+}
+
+func (s *AsyncProducerSuite) SetupSuite() {
+}
+
+func (s *AsyncProducerSuite) queueLength(queueName string) int {
+	d, err := s.pool.Get(context.Background())
+	s.Nil(err)
+	defer s.pool.Put(d)
+	queueLength, err := d.QueueLength(queueName)
+	s.Nil(err)
+	return queueLength
+}
+
+func (s *AsyncProducerSuite) TestPush() {
+	producer := NewAsyncProducer(s.pool, AsyncProducerOptions{})
+	defer producer.Close()
+
+	futures := make([]*PushFuture, 0)
+	for i := 0; i < 10; i++ {
+		futures = append(futures, producer.Push("queueProducer", "asdf"))
+	}
+	for _, future := range futures {
+		jobID, err := future.Wait()
+		s.Nil(err)
+		s.NotEmpty(jobID)
+	}
+	s.Equal(10, s.queueLength("queueProducer"))
+}
+
+func (s *AsyncProducerSuite) TestBatchSize() {
+	producer := NewAsyncProducer(s.pool, AsyncProducerOptions{BatchSize: 5, Linger: time.Hour})
+	defer producer.Close()
+
+	futures := make([]*PushFuture, 0)
+	for i := 0; i < 5; i++ {
+		futures = append(futures, producer.Push("queueProducer", "asdf"))
+	}
+	// a full batch is pushed without waiting for the linger time
+	for _, future := range futures {
+		select {
+		case <-future.Done():
+		case <-time.After(time.Second):
+			s.Fail("Batch not pushed")
+			return
+		}
+	}
+	s.Equal(5, s.server.CommandCount("ADDJOB"))
+}
+
+func (s *AsyncProducerSuite) TestLinger() {
+	producer := NewAsyncProducer(s.pool, AsyncProducerOptions{Linger: 20 * time.Millisecond})
+	defer producer.Close()
+
+	start := time.Now()
+	_, err := producer.Push("queueProducer", "asdf").Wait()
+	s.Nil(err)
+	s.True(time.Since(start) >= 20*time.Millisecond)
+	s.Equal(1, s.queueLength("queueProducer"))
+}
+
+func (s *AsyncProducerSuite) TestOnResult() {
+	var mu sync.Mutex
+	results := make(map[string]string)
+	producer := NewAsyncProducer(s.pool, AsyncProducerOptions{
+		OnResult: func(message *ProducerMessage, jobID string, err error) {
+			s.Nil(err)
+			mu.Lock()
+			results[message.Job] = jobID
+			mu.Unlock()
+		},
+	})
+
+	producer.Input() <- &ProducerMessage{QueueName: "queueProducer", Job: "job1"}
+	producer.Input() <- &ProducerMessage{QueueName: "queueProducer", Job: "job2", Options: map[string]string{"TTL": "60"}}
+	producer.Close()
+
+	s.Equal(2, len(results))
+	s.NotEmpty(results["job1"])
+	s.NotEmpty(results["job2"])
+}
+
+func (s *AsyncProducerSuite) TestFailedJob() {
+	s.server.FailNext("ADDJOB", "ERR rejected")
+	producer := NewAsyncProducer(s.pool, AsyncProducerOptions{Linger: time.Hour})
+
+	first := producer.Push("queueProducer", "asdf")
+	second := producer.Push("queueProducer", "asdf")
+	producer.Close()
+
+	_, err := first.Wait()
+	s.NotNil(err)
+	jobID, err := second.Wait()
+	s.Nil(err)
+	s.NotEmpty(jobID)
+}
+
+func (s *AsyncProducerSuite) TestCloseDrains() {
+	producer := NewAsyncProducer(s.pool, AsyncProducerOptions{Linger: time.Hour})
+
+	futures := make([]*PushFuture, 0)
+	for i := 0; i < 3; i++ {
+		futures = append(futures, producer.Push("queueProducer", "asdf"))
+	}
+	producer.Close()
+
+	for _, future := range futures {
+		select {
+		case <-future.Done():
+		default:
+			s.Fail("Job not pushed on close")
+		}
+	}
+	s.Equal(3, s.queueLength("queueProducer"))
+
+	_, err := producer.Push("queueProducer", "asdf").Wait()
+	s.Equal(ErrProducerClosed, err)
+	// closing again is harmless
+	producer.Close()
+}
+
+func (s *AsyncProducerSuite) TestBackpressure() {
+	producer := NewAsyncProducer(s.pool, AsyncProducerOptions{BatchSize: 1, BufferSize: 1})
+	defer producer.Close()
+
+	// hold the only connection of the pool so that nothing can be pushed
+	d, err := s.pool.Get(context.Background())
+	s.Nil(err)
+
+	// one job waits for a connection, one for a flusher, one for the
+	// dispatcher and one in the buffer
+	for i := 0; i < 4; i++ {
+		producer.Push("queueProducer", "asdf")
+	}
+
+	pushed := make(chan struct{})
+	go func() {
+		producer.Push("queueProducer", "asdf")
+		close(pushed)
+	}()
+	select {
+	case <-pushed:
+		s.Fail("Push did not block on a full buffer")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	s.pool.Put(d)
+	select {
+	case <-pushed:
+	case <-time.After(time.Second):
+		s.Fail("Push still blocked")
+	}
+}
@@ -0,0 +1,212 @@
+package disque
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrNoOutbox is returned when draining the outbox of a publisher without one
+var ErrNoOutbox = errors.New("No outbox configured")
+
+// TopicRegistry maps topics to the queues subscribed to them
+type TopicRegistry interface {
+	Queues(topic string) (queueNames []string, err error)
+}
+
+// StaticTopics is a TopicRegistry backed by a fixed map of topics to queues
+type StaticTopics map[string][]string
+
+// Queues returns the queues subscribed to the topic
+func (t StaticTopics) Queues(topic string) (queueNames []string, err error) {
+	var ok bool
+	if queueNames, ok = t[topic]; !ok {
+		err = fmt.Errorf("Unknown topic: %s", topic)
+	}
+	return
+}
+
+// PublishResult reports the outcome of publishing to every queue of a topic
+type PublishResult struct {
+	// JobIDs maps queues to the ID of the job pushed onto them
+	JobIDs map[string]string
+	// Failed maps queues that could not be pushed to their error
+	Failed map[string]error
+	// Outboxed maps failed queues to the ID of their entry on the outbox queue
+	Outboxed map[string]string
+}
+
+// OutboxEntry is the payload of a job stored on the outbox queue
+type OutboxEntry struct {
+	Topic     string            `json:"topic"`
+	QueueName string            `json:"queue"`
+	Message   string            `json:"message"`
+	Options   map[string]string `json:"options,omitempty"`
+	Error     string            `json:"error"`
+	FailedAt  time.Time         `json:"failed_at"`
+}
+
+// Publisher pushes messages onto every queue subscribed to a topic. The
+// pushes are pipelined, queues that fail are retried, and queues that still
+// fail are optionally saved on an outbox queue to be delivered later.
+type Publisher struct {
+	d      *Disque
+	topics TopicRegistry
+
+	// Timeout for adding jobs, one second if unset
+	Timeout time.Duration
+	// Options passed to ADDJOB for every job
+	Options map[string]string
+	// Retries is the number of additional attempts made for failed queues
+	Retries int
+	// RetryBackoff is the time waited before each additional attempt
+	RetryBackoff time.Duration
+	// Outbox is the name of the queue failed pushes are saved on, none if empty
+	Outbox string
+}
+
+// NewPublisher creates a publisher pushing through the given connection
+func NewPublisher(d *Disque, topics TopicRegistry) *Publisher {
+	return &Publisher{
+		d:      d,
+		topics: topics,
+	}
+}
+
+// Publish pushes the message onto every queue subscribed to the topic. The
+// result reports the job IDs of the successful pushes and the queues that
+// failed. An error is returned if the topic could not be resolved, or if any
+// queue failed without being saved on the outbox.
+func (p *Publisher) Publish(topic string, message string) (result *PublishResult, err error) {
+	var queueNames []string
+	if queueNames, err = p.topics.Queues(topic); err != nil {
+		return
+	}
+
+	result = &PublishResult{
+		JobIDs:   make(map[string]string),
+		Failed:   make(map[string]error),
+		Outboxed: make(map[string]string),
+	}
+	pending := queueNames
+	for attempt := 0; attempt <= p.Retries && len(pending) > 0; attempt++ {
+		if attempt > 0 && p.RetryBackoff > 0 {
+			time.Sleep(p.RetryBackoff)
+		}
+		pending = p.push(pending, message, result)
+	}
+
+	if p.Outbox != "" {
+		for _, queueName := range pending {
+			var jobID string
+			if jobID, err = p.saveToOutbox(topic, queueName, message, result.Failed[queueName]); err == nil {
+				result.Outboxed[queueName] = jobID
+			}
+		}
+	}
+
+	err = nil
+	lost := make([]string, 0)
+	for queueName := range result.Failed {
+		if _, ok := result.Outboxed[queueName]; !ok {
+			lost = append(lost, queueName)
+		}
+	}
+	if len(lost) > 0 {
+		sort.Strings(lost)
+		err = fmt.Errorf("Unable to publish to topic %s on queues: %s", topic, strings.Join(lost, ", "))
+	}
+	return
+}
+
+// push pipelines an ADDJOB for every queue, recording the outcome in result
+// and returning the queues that failed
+func (p *Publisher) push(queueNames []string, message string, result *PublishResult) (failed []string) {
+	pipeline := p.d.Pipeline()
+	for _, queueName := range queueNames {
+		pipeline.PushWithOptions(queueName, message, p.timeout(), p.Options)
+	}
+
+	failed = make([]string, 0)
+	results, err := pipeline.Execute()
+	for i, queueName := range queueNames {
+		// results are missing if the commands could not be sent at all
+		pushErr := err
+		var jobID string
+		if results != nil {
+			jobID, pushErr = redis.String(results[i].Reply, results[i].Err)
+		}
+		if pushErr != nil {
+			result.Failed[queueName] = pushErr
+			failed = append(failed, queueName)
+			continue
+		}
+		result.JobIDs[queueName] = jobID
+		delete(result.Failed, queueName)
+	}
+	return
+}
+
+func (p *Publisher) saveToOutbox(topic string, queueName string, message string, cause error) (jobID string, err error) {
+	entry := &OutboxEntry{
+		Topic:     topic,
+		QueueName: queueName,
+		Message:   message,
+		Options:   p.Options,
+		FailedAt:  time.Now(),
+	}
+	if cause != nil {
+		entry.Error = cause.Error()
+	}
+	var payload []byte
+	if payload, err = json.Marshal(entry); err == nil {
+		jobID, err = p.d.addJob(p.Outbox, string(payload), p.timeout(), nil)
+	}
+	return
+}
+
+// DrainOutbox fetches up to count entries from the outbox queue and pushes
+// each message onto the queue it was meant for. Entries are acknowledged once
+// they have been delivered; entries that fail again are left on the outbox
+// and redelivered once their retry period elapses. Entries that cannot be
+// decoded are skipped: they are moved to the dead-letter queue if a
+// dead-letter policy is configured, and dropped otherwise.
+func (p *Publisher) DrainOutbox(count int, timeout time.Duration) (delivered int, err error) {
+	if p.Outbox == "" {
+		return 0, ErrNoOutbox
+	}
+
+	var jobs []*Job
+	if jobs, err = p.d.FetchMultiple(p.Outbox, count, timeout); err != nil {
+		return
+	}
+	for _, job := range jobs {
+		entry := &OutboxEntry{}
+		if json.Unmarshal([]byte(job.Message), entry) != nil {
+			log.Printf("Skipping malformed outbox entry %s on queue %s", job.JobID, p.Outbox)
+			p.d.discard(job, "malformed outbox entry")
+			continue
+		}
+		if _, err = p.d.addJob(entry.QueueName, entry.Message, p.timeout(), entry.Options); err != nil {
+			return
+		}
+		if err = p.d.Ack(job.JobID); err != nil {
+			return
+		}
+		delivered++
+	}
+	return
+}
+
+func (p *Publisher) timeout() time.Duration {
+	if p.Timeout == 0 {
+		return time.Second
+	}
+	return p.Timeout
+}
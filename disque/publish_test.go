@@ -0,0 +1,176 @@
+package disque
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+)
+
+type PublishSuite struct {
+	suite.Suite
+	server *disquetest.Server
+	d      *Disque
+}
+
+func TestPublishSuite(t *testing.T) {
+	suite.Run(t, new(PublishSuite))
+}
+
+func (s *PublishSuite) SetupTest() {
+	s.server = disquetest.NewServer()
+	s.d = NewDisque([]string{s.server.Addr}, 1000)
+	s.Nil(s.d.Initialize())
+}
+
+func (s *PublishSuite) TearDownTest() {
+	s.d.Close()
+	s.server.Close()
+}
+
+func (s *PublishSuite) SetupSuite() {
+}
+
+var testTopics = StaticTopics{
+	"orders": []string{"billing", "shipping", "analytics"},
+}
+
+func (s *PublishSuite) TestStaticTopics() {
+	queueNames, err := testTopics.Queues("orders")
+	s.Nil(err)
+	s.Equal([]string{"billing", "shipping", "analytics"}, queueNames)
+
+	_, err = testTopics.Queues("refunds")
+	s.NotNil(err)
+}
+
+func (s *PublishSuite) TestPublish() {
+	publisher := NewPublisher(s.d, testTopics)
+
+	result, err := publisher.Publish("orders", "order-1")
+	s.Nil(err)
+	s.Equal(3, len(result.JobIDs))
+	s.Equal(0, len(result.Failed))
+
+	for _, queueName := range []string{"billing", "shipping", "analytics"} {
+		job, err := s.d.Fetch(queueName, time.Second)
+		s.Nil(err)
+		s.Equal(result.JobIDs[queueName], job.JobID)
+		s.Equal("order-1", job.Message)
+	}
+
+	// the pushes were sent in a single pipeline
+	s.Equal(3, s.server.CommandCount("ADDJOB"))
+}
+
+func (s *PublishSuite) TestPublishToUnknownTopic() {
+	publisher := NewPublisher(s.d, testTopics)
+
+	result, err := publisher.Publish("refunds", "refund-1")
+	s.NotNil(err)
+	s.Nil(result)
+}
+
+func (s *PublishSuite) TestPartialFailure() {
+	s.d.PauseQueue("shipping", PauseOptions{Mode: PauseIn})
+	publisher := NewPublisher(s.d, testTopics)
+
+	result, err := publisher.Publish("orders", "order-1")
+	s.Equal("Unable to publish to topic orders on queues: shipping", err.Error())
+	s.Equal(2, len(result.JobIDs))
+	s.NotEmpty(result.JobIDs["billing"])
+	s.NotEmpty(result.JobIDs["analytics"])
+	s.Equal(ErrQueuePaused, result.Failed["shipping"])
+}
+
+func (s *PublishSuite) TestRetry() {
+	s.server.FailNext("ADDJOB", "ERR transient failure")
+	publisher := NewPublisher(s.d, testTopics)
+	publisher.Retries = 1
+
+	result, err := publisher.Publish("orders", "order-1")
+	s.Nil(err)
+	s.Equal(3, len(result.JobIDs))
+	s.Equal(0, len(result.Failed))
+	// only the failed queue was retried
+	s.Equal(4, s.server.CommandCount("ADDJOB"))
+}
+
+func (s *PublishSuite) TestOutbox() {
+	s.d.PauseQueue("shipping", PauseOptions{Mode: PauseIn})
+	publisher := NewPublisher(s.d, testTopics)
+	publisher.Outbox = "orders-outbox"
+
+	result, err := publisher.Publish("orders", "order-1")
+	s.Nil(err)
+	s.Equal(1, len(result.Failed))
+	s.NotEmpty(result.Outboxed["shipping"])
+
+	// nothing is delivered while the queue is paused
+	delivered, err := publisher.DrainOutbox(10, time.Second)
+	s.Equal(ErrQueuePaused, err)
+	s.Equal(0, delivered)
+
+	s.d.PauseQueue("shipping", PauseOptions{Mode: PauseNone})
+	s.d.Enqueue(result.Outboxed["shipping"])
+	delivered, err = publisher.DrainOutbox(10, time.Second)
+	s.Nil(err)
+	s.Equal(1, delivered)
+
+	job, err := s.d.Fetch("shipping", time.Second)
+	s.Nil(err)
+	s.Equal("order-1", job.Message)
+	queueLength, _ := s.d.QueueLength("orders-outbox")
+	s.Equal(0, queueLength)
+}
+
+func (s *PublishSuite) TestDrainOutboxSkipsMalformedEntries() {
+	publisher := NewPublisher(s.d, testTopics)
+	publisher.Outbox = "orders-outbox"
+	s.d.Push("orders-outbox", "not json", time.Second)
+	entry, err := json.Marshal(&OutboxEntry{QueueName: "shipping", Message: "order-1"})
+	s.Nil(err)
+	s.d.Push("orders-outbox", string(entry), time.Second)
+
+	// the malformed entry is dropped without holding up the others
+	delivered, err := publisher.DrainOutbox(10, time.Second)
+	s.Nil(err)
+	s.Equal(1, delivered)
+	job, err := s.d.Fetch("shipping", time.Second)
+	s.Nil(err)
+	s.Equal("order-1", job.Message)
+	jobIDs, err := s.d.ScanAll(ScanOptions{Queue: "orders-outbox", States: []string{JobStateActive, JobStateQueued}})
+	s.Nil(err)
+	s.Equal(0, len(jobIDs))
+
+	// it is dead-lettered with a dead-letter policy
+	s.d.SetDeadLetterPolicy(&DeadLetterPolicy{Queue: "orders-dead"})
+	s.d.Push("orders-outbox", "not json", time.Second)
+	delivered, err = publisher.DrainOutbox(10, time.Second)
+	s.Nil(err)
+	s.Equal(0, delivered)
+	job, err = s.d.Fetch("orders-dead", time.Second)
+	s.Nil(err)
+	deadLetter, err := ParseDeadLetter(job)
+	s.Nil(err)
+	s.Equal("malformed outbox entry", deadLetter.Reason)
+}
+
+func (s *PublishSuite) TestDrainOutboxWithoutOutbox() {
+	publisher := NewPublisher(s.d, testTopics)
+
+	_, err := publisher.DrainOutbox(10, time.Second)
+	s.Equal(ErrNoOutbox, err)
+}
+
+func (s *PublishSuite) TestConnectionFailure() {
+	publisher := NewPublisher(s.d, testTopics)
+	s.server.Close()
+
+	result, err := publisher.Publish("orders", "order-1")
+	s.NotNil(err)
+	s.Equal(0, len(result.JobIDs))
+	s.Equal(3, len(result.Failed))
+}
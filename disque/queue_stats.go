@@ -0,0 +1,90 @@
+package disque
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// QueueStats contains the state of a queue as reported by QSTAT.
+// Fields reported by the server that are not recognized are kept in Extra.
+type QueueStats struct {
+	Name string
+	// Length is the number of jobs queued
+	Length int64
+	// Age is the time since the queue was created
+	Age time.Duration
+	// Idle is the time since the queue was last involved in an operation
+	Idle       time.Duration
+	Blocked    int64
+	ImportFrom []string
+	ImportRate int64
+	// JobsIn and JobsOut count the jobs queued and dequeued since the queue was created
+	JobsIn  int64
+	JobsOut int64
+	Pause   PauseMode
+	Extra   map[string]interface{}
+}
+
+// QueueStats retrieves the state of a queue on the node this connection is
+// using. A queue unknown to the node reports zero values.
+func (d *Disque) QueueStats(queueName string) (stats *QueueStats, err error) {
+	var reply interface{}
+	if reply, err = d.call("QSTAT", redis.Args{}.Add(queueName)); err != nil {
+		return
+	}
+	if reply == nil {
+		return &QueueStats{Name: queueName, Pause: PauseNone, Extra: map[string]interface{}{}}, nil
+	}
+	var values []interface{}
+	if values, err = redis.Values(reply, nil); err == nil {
+		stats, err = parseQueueStats(values)
+	}
+	return
+}
+
+// parseQueueStats walks the name/value pairs of a QSTAT reply
+func parseQueueStats(values []interface{}) (stats *QueueStats, err error) {
+	if len(values)%2 != 0 {
+		return nil, fmt.Errorf("Malformed queue stats: odd number of elements (%d)", len(values))
+	}
+	stats = &QueueStats{Extra: map[string]interface{}{}}
+	for i := 0; i < len(values); i += 2 {
+		var name string
+		if name, err = redis.String(values[i], nil); err != nil {
+			return nil, fmt.Errorf("Malformed queue stats: field name at position %d: %s", i, err)
+		}
+		value := values[i+1]
+		switch name {
+		case "name":
+			stats.Name, err = redis.String(value, nil)
+		case "len":
+			stats.Length, err = redis.Int64(value, nil)
+		case "age":
+			stats.Age, err = parseDuration(value, time.Second)
+		case "idle":
+			stats.Idle, err = parseDuration(value, time.Second)
+		case "blocked":
+			stats.Blocked, err = redis.Int64(value, nil)
+		case "import-from":
+			stats.ImportFrom, err = parseStrings(value)
+		case "import-rate":
+			stats.ImportRate, err = redis.Int64(value, nil)
+		case "jobs-in":
+			stats.JobsIn, err = redis.Int64(value, nil)
+		case "jobs-out":
+			stats.JobsOut, err = redis.Int64(value, nil)
+		case "pause":
+			var pause string
+			pause, err = redis.String(value, nil)
+			stats.Pause = PauseMode(pause)
+		default:
+			stats.Extra[name] = convertReply(value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Malformed queue stats: field %q: %s", name, err)
+		}
+	}
+	return
+}
@@ -0,0 +1,94 @@
+package disque
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+)
+
+type QueueStatsSuite struct {
+	suite.Suite
+	server *disquetest.Server
+	d      *Disque
+}
+
+func TestQueueStatsSuite(t *testing.T) {
+	suite.Run(t, new(QueueStatsSuite))
+}
+
+func (s *QueueStatsSuite) SetupTest() {
+	s.server = disquetest.NewServer()
+	s.d = NewDisque([]string{s.server.Addr}, 1000)
+	s.Nil(s.d.Initialize())
+}
+
+func (s *QueueStatsSuite) TearDownTest() {
+	s.d.Close()
+	s.server.Close()
+}
+
+func (s *QueueStatsSuite) SetupSuite() {
+}
+
+func (s *QueueStatsSuite) TestParseQueueStats() {
+	values := []interface{}{
+		[]byte("name"), []byte("queue1"),
+		[]byte("len"), int64(3),
+		[]byte("age"), int64(120),
+		[]byte("idle"), int64(5),
+		[]byte("blocked"), int64(1),
+		[]byte("import-from"), []interface{}{[]byte("node1")},
+		[]byte("import-rate"), int64(2),
+		[]byte("jobs-in"), int64(10),
+		[]byte("jobs-out"), int64(7),
+		[]byte("pause"), []byte("out"),
+		[]byte("future-field"), []byte("value"),
+	}
+
+	stats, err := parseQueueStats(values)
+	s.Nil(err)
+	s.Equal(&QueueStats{
+		Name:       "queue1",
+		Length:     3,
+		Age:        2 * time.Minute,
+		Idle:       5 * time.Second,
+		Blocked:    1,
+		ImportFrom: []string{"node1"},
+		ImportRate: 2,
+		JobsIn:     10,
+		JobsOut:    7,
+		Pause:      PauseOut,
+		Extra:      map[string]interface{}{"future-field": "value"},
+	}, stats)
+}
+
+func (s *QueueStatsSuite) TestParseMalformedQueueStats() {
+	_, err := parseQueueStats([]interface{}{[]byte("len")})
+	s.NotNil(err)
+
+	_, err = parseQueueStats([]interface{}{[]byte("len"), []byte("many")})
+	s.NotNil(err)
+}
+
+func (s *QueueStatsSuite) TestQueueStats() {
+	s.d.Push("queueStats1", "asdf", time.Second)
+	s.d.Push("queueStats1", "asdf", time.Second)
+	s.d.Fetch("queueStats1", time.Second)
+
+	stats, err := s.d.QueueStats("queueStats1")
+	s.Nil(err)
+	s.Equal("queueStats1", stats.Name)
+	s.EqualValues(1, stats.Length)
+	s.EqualValues(2, stats.JobsIn)
+	s.EqualValues(1, stats.JobsOut)
+	s.Equal(PauseNone, stats.Pause)
+}
+
+func (s *QueueStatsSuite) TestQueueStatsWithUnknownQueue() {
+	stats, err := s.d.QueueStats("queueStats2")
+	s.Nil(err)
+	s.Equal("queueStats2", stats.Name)
+	s.EqualValues(0, stats.Length)
+}
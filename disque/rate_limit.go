@@ -0,0 +1,247 @@
+package disque
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate at which jobs are fetched, using a token bucket
+// per queue or per group of queues. Each fetched job takes a token; when no
+// token is available, fetches wait for one, up to their timeout, and fetch no
+// more jobs than there are tokens. Limits can be changed at any time, and a
+// limiter can be shared by several connections.
+type RateLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+	// groups maps queues to the name of the bucket they share
+	groups map[string]string
+
+	// now returns the current time and sleep waits, replaced in tests
+	now   func() time.Time
+	sleep func(time.Duration)
+}
+
+// minLimitedBlock is the shortest time a GETJOB of a limited queue blocks
+// while holding tokens, so that an empty queue is not polled continuously
+const minLimitedBlock = 10 * time.Millisecond
+
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens accumulated since the last refill
+func (b *tokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens += elapsed.Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+// NewRateLimiter creates a rate limiter without any limit
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		buckets: make(map[string]*tokenBucket),
+		groups:  make(map[string]string),
+		now:     time.Now,
+		sleep:   time.Sleep,
+	}
+}
+
+// SetLimit limits the rate at which jobs are fetched from the queue to rate
+// jobs per second, with bursts of up to burst jobs. Changing the limit of a
+// queue keeps the tokens it accumulated, up to the new burst.
+func (l *RateLimiter) SetLimit(queueName string, rate float64, burst int) {
+	l.SetGroupLimit(queueName, []string{queueName}, rate, burst)
+}
+
+// SetGroupLimit limits the combined rate at which jobs are fetched from every
+// queue of the group, as SetLimit does for a single queue
+func (l *RateLimiter) SetGroupLimit(group string, queueNames []string, rate float64, burst int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := l.now()
+	bucket, ok := l.buckets[group]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(burst), last: now}
+		l.buckets[group] = bucket
+	}
+	bucket.refill(now)
+	bucket.rate = rate
+	bucket.burst = float64(burst)
+	if bucket.tokens > bucket.burst {
+		bucket.tokens = bucket.burst
+	}
+	for _, queueName := range queueNames {
+		l.groups[queueName] = group
+	}
+}
+
+// RemoveLimit removes the limit of a queue or group, along with the
+// membership of every queue in it
+func (l *RateLimiter) RemoveLimit(group string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.buckets, group)
+	for queueName, name := range l.groups {
+		if name == group {
+			delete(l.groups, queueName)
+		}
+	}
+}
+
+// Available returns the number of jobs that can be fetched from the queue
+// right away, or -1 if the queue is not limited
+func (l *RateLimiter) Available(queueName string) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket := l.bucket(queueName)
+	if bucket == nil {
+		return -1
+	}
+	bucket.refill(l.now())
+	return int(bucket.tokens)
+}
+
+// bucket returns the bucket limiting the queue, nil if it is not limited.
+// Callers must hold l.mu.
+func (l *RateLimiter) bucket(queueName string) *tokenBucket {
+	if group, ok := l.groups[queueName]; ok {
+		return l.buckets[group]
+	}
+	return nil
+}
+
+// reserve takes up to count tokens for the queue. If none is available, it
+// returns the time until the next token is. Unlimited queues are granted count.
+func (l *RateLimiter) reserve(queueName string, count int) (granted int, wait time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket := l.bucket(queueName)
+	if bucket == nil {
+		return count, 0
+	}
+	bucket.refill(l.now())
+	if granted = int(bucket.tokens); granted > count {
+		granted = count
+	}
+	if granted > 0 {
+		bucket.tokens -= float64(granted)
+		return granted, 0
+	}
+	if bucket.rate <= 0 {
+		// no token will ever be available, until the limit changes
+		return 0, time.Second
+	}
+	return 0, time.Duration((1 - bucket.tokens) / bucket.rate * float64(time.Second))
+}
+
+// refund returns tokens that were reserved for jobs that were not fetched
+func (l *RateLimiter) refund(queueName string, count int) {
+	if count <= 0 {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if bucket := l.bucket(queueName); bucket != nil {
+		bucket.tokens += float64(count)
+		if bucket.tokens > bucket.burst {
+			bucket.tokens = bucket.burst
+		}
+	}
+}
+
+// acquire waits up to timeout for tokens to fetch up to count jobs from the
+// queue, returning the number of jobs that may be fetched and how long the
+// fetch may block: the part of the timeout that is left, but no longer than
+// the bucket takes to refill a token, so that the tokens of a group are not
+// held while waiting on an empty queue. A timeout of 0 waits indefinitely.
+func (l *RateLimiter) acquire(queueName string, count int, timeout time.Duration) (granted int, block time.Duration) {
+	start := l.now()
+	for {
+		var wait time.Duration
+		if granted, wait = l.reserve(queueName, count); granted > 0 {
+			break
+		}
+		if timeout > 0 {
+			left := timeout - l.now().Sub(start)
+			if left <= 0 {
+				return 0, 0
+			}
+			if wait > left {
+				wait = left
+			}
+		}
+		l.sleep(wait)
+	}
+
+	if timeout > 0 {
+		if block = timeout - l.now().Sub(start); block < time.Millisecond {
+			// GETJOB treats a timeout of 0 as blocking forever
+			block = time.Millisecond
+		}
+	}
+	if refill := l.refillInterval(queueName); refill > 0 && (block == 0 || block > refill) {
+		block = refill
+	}
+	return
+}
+
+// refillInterval returns the time the bucket of the queue takes to refill a
+// token, at least minLimitedBlock, or 0 if the queue is not limited
+func (l *RateLimiter) refillInterval(queueName string) (interval time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bucket := l.bucket(queueName)
+	if bucket == nil {
+		return 0
+	}
+	if bucket.rate <= 0 {
+		interval = time.Second
+	} else {
+		interval = time.Duration(float64(time.Second) / bucket.rate)
+	}
+	if interval < minLimitedBlock {
+		interval = minLimitedBlock
+	}
+	return
+}
+
+// fetchLimited fetches jobs from a rate limited queue, taking tokens before
+// each GETJOB and giving back those of jobs that were not fetched. As a
+// GETJOB holding tokens blocks no longer than the refill interval of the
+// bucket, a long wait on an empty queue takes several of them.
+func (d *Disque) fetchLimited(queueName string, count int, timeout time.Duration) (jobs []*Job, err error) {
+	limiter := d.limiter
+	deadline := limiter.now().Add(timeout)
+	for {
+		var left time.Duration
+		if timeout > 0 {
+			if left = deadline.Sub(limiter.now()); left <= 0 {
+				return make([]*Job, 0), nil
+			}
+		}
+		granted, block := limiter.acquire(queueName, count, left)
+		if granted == 0 {
+			return make([]*Job, 0), nil
+		}
+		jobs, err = d.fetch(queueName, granted, block)
+		limiter.refund(queueName, granted-len(jobs))
+		if err != nil || len(jobs) > 0 {
+			return
+		}
+	}
+}
+
+// SetRateLimiter configures the rate limiter applied when fetching jobs.
+// A nil limiter disables rate limiting.
+func (d *Disque) SetRateLimiter(limiter *RateLimiter) {
+	d.limiter = limiter
+}
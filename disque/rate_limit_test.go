@@ -0,0 +1,229 @@
+package disque
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+	"golang.org/x/net/context"
+)
+
+type RateLimitSuite struct {
+	suite.Suite
+	server *disquetest.Server
+	d      *Disque
+}
+
+func TestRateLimitSuite(t *testing.T) {
+	suite.Run(t, new(RateLimitSuite))
+}
+
+func (s *RateLimitSuite) SetupTest() {
+	s.server = disquetest.NewServer()
+	s.d = NewDisque([]string{s.server.Addr}, 1000)
+	s.Nil(s.d.Initialize())
+}
+
+func (s *RateLimitSuite) TearDownTest() {
+	s.d.Close()
+	s.server.Close()
+}
+
+func (s *RateLimitSuite) SetupSuite() {
+}
+
+func newTestRateLimiter(clock *fakeClock) *RateLimiter {
+	l := NewRateLimiter()
+	l.now = clock.Now
+	l.sleep = clock.Advance
+	return l
+}
+
+func (s *RateLimitSuite) TestUnlimitedQueue() {
+	l := NewRateLimiter()
+
+	granted, wait := l.reserve("queue1", 10)
+	s.Equal(10, granted)
+	s.Equal(time.Duration(0), wait)
+	s.Equal(-1, l.Available("queue1"))
+}
+
+func (s *RateLimitSuite) TestReserve() {
+	clock := &fakeClock{now: time.Now()}
+	l := newTestRateLimiter(clock)
+	l.SetLimit("queue1", 2, 3)
+
+	granted, _ := l.reserve("queue1", 5)
+	s.Equal(3, granted)
+
+	granted, wait := l.reserve("queue1", 5)
+	s.Equal(0, granted)
+	s.Equal(500*time.Millisecond, wait)
+
+	clock.Advance(time.Second)
+	granted, _ = l.reserve("queue1", 5)
+	s.Equal(2, granted)
+
+	// tokens never exceed the burst
+	clock.Advance(time.Hour)
+	s.Equal(3, l.Available("queue1"))
+}
+
+func (s *RateLimitSuite) TestRefund() {
+	clock := &fakeClock{now: time.Now()}
+	l := newTestRateLimiter(clock)
+	l.SetLimit("queue1", 1, 5)
+
+	granted, _ := l.reserve("queue1", 5)
+	s.Equal(5, granted)
+	l.refund("queue1", 3)
+	s.Equal(3, l.Available("queue1"))
+
+	l.refund("queue1", 10)
+	s.Equal(5, l.Available("queue1"))
+}
+
+func (s *RateLimitSuite) TestGroupLimit() {
+	clock := &fakeClock{now: time.Now()}
+	l := newTestRateLimiter(clock)
+	l.SetGroupLimit("partner-api", []string{"queue1", "queue2"}, 1, 4)
+
+	granted, _ := l.reserve("queue1", 3)
+	s.Equal(3, granted)
+	granted, _ = l.reserve("queue2", 3)
+	s.Equal(1, granted)
+	s.Equal(-1, l.Available("queue3"))
+
+	l.RemoveLimit("partner-api")
+	s.Equal(-1, l.Available("queue1"))
+	s.Equal(-1, l.Available("queue2"))
+}
+
+func (s *RateLimitSuite) TestChangeLimitAtRuntime() {
+	clock := &fakeClock{now: time.Now()}
+	l := newTestRateLimiter(clock)
+	l.SetLimit("queue1", 1, 10)
+	l.reserve("queue1", 4)
+
+	// accumulated tokens are kept, up to the new burst
+	l.SetLimit("queue1", 100, 20)
+	s.Equal(6, l.Available("queue1"))
+	l.SetLimit("queue1", 100, 2)
+	s.Equal(2, l.Available("queue1"))
+
+	clock.Advance(10 * time.Millisecond)
+	l.reserve("queue1", 2)
+	l.SetLimit("queue1", 0, 2)
+	granted, wait := l.reserve("queue1", 1)
+	s.Equal(0, granted)
+	s.Equal(time.Second, wait)
+}
+
+func (s *RateLimitSuite) TestAcquireTimeout() {
+	clock := &fakeClock{now: time.Now()}
+	l := newTestRateLimiter(clock)
+	l.SetLimit("queue1", 1, 1)
+	l.reserve("queue1", 1)
+
+	start := clock.Now()
+	granted, _ := l.acquire("queue1", 1, 50*time.Millisecond)
+	s.Equal(0, granted)
+	s.Equal(50*time.Millisecond, clock.Now().Sub(start))
+}
+
+func (s *RateLimitSuite) TestAcquireWaitsForToken() {
+	clock := &fakeClock{now: time.Now()}
+	l := newTestRateLimiter(clock)
+	l.SetLimit("queue1", 0.5, 1)
+	l.reserve("queue1", 1)
+
+	// waits 2s for a token, then blocks for the refill interval rather than the 8s left
+	start := clock.Now()
+	granted, block := l.acquire("queue1", 5, 10*time.Second)
+	s.Equal(1, granted)
+	s.Equal(2*time.Second, clock.Now().Sub(start))
+	s.Equal(2*time.Second, block)
+}
+
+func (s *RateLimitSuite) TestAcquireBlocksNoLongerThanRefill() {
+	clock := &fakeClock{now: time.Now()}
+	l := newTestRateLimiter(clock)
+	l.SetLimit("queue1", 5, 5)
+
+	// the fetch blocks while the bucket refills a token at most
+	granted, block := l.acquire("queue1", 5, 10*time.Second)
+	s.Equal(5, granted)
+	s.Equal(200*time.Millisecond, block)
+	granted, _ = l.acquire("queue1", 1, 100*time.Millisecond)
+	s.Equal(0, granted)
+	clock.Advance(time.Second)
+	granted, block = l.acquire("queue1", 1, 0)
+	s.Equal(1, granted)
+	s.Equal(200*time.Millisecond, block)
+
+	// unlimited queues block for the whole timeout
+	granted, block = l.acquire("queue2", 1, 10*time.Second)
+	s.Equal(1, granted)
+	s.Equal(10*time.Second, block)
+}
+
+func (s *RateLimitSuite) TestFetchMultipleIsLimited() {
+	for i := 0; i < 5; i++ {
+		s.d.Push("queueRateLimit1", "asdf", time.Second)
+	}
+	l := NewRateLimiter()
+	l.SetLimit("queueRateLimit1", 1, 2)
+	s.d.SetRateLimiter(l)
+
+	jobs, err := s.d.FetchMultiple("queueRateLimit1", 5, time.Second)
+	s.Nil(err)
+	s.Equal(2, len(jobs))
+
+	// no token becomes available within the timeout
+	jobs, err = s.d.FetchMultiple("queueRateLimit1", 5, 100*time.Millisecond)
+	s.Nil(err)
+	s.Equal(0, len(jobs))
+
+	// the remaining jobs were left on the queue rather than fetched and NACK'd
+	queueLength, _ := s.d.QueueLength("queueRateLimit1")
+	s.Equal(3, queueLength)
+	s.Equal(0, s.server.CommandCount("NACK"))
+}
+
+func (s *RateLimitSuite) TestUnusedTokensAreRefunded() {
+	s.d.Push("queueRateLimit2", "asdf", time.Second)
+	l := NewRateLimiter()
+	l.SetLimit("queueRateLimit2", 0.001, 5)
+	s.d.SetRateLimiter(l)
+
+	jobs, err := s.d.FetchMultiple("queueRateLimit2", 5, 100*time.Millisecond)
+	s.Nil(err)
+	s.Equal(1, len(jobs))
+	s.Equal(4, l.Available("queueRateLimit2"))
+}
+
+func (s *RateLimitSuite) TestWaitOnEmptyQueueGivesTokensBack() {
+	l := NewRateLimiter()
+	l.SetGroupLimit("group", []string{"queueRateLimit3", "queueRateLimit4"}, 10, 5)
+	s.d.SetRateLimiter(l)
+
+	// tokens are taken for one refill interval at a time, rather than for the whole wait
+	jobs, err := s.d.FetchMultiple("queueRateLimit3", 5, 350*time.Millisecond)
+	s.Nil(err)
+	s.Equal(0, len(jobs))
+	s.True(s.server.CommandCount("GETJOB") >= 3)
+	s.Equal(5, l.Available("queueRateLimit4"))
+}
+
+func (s *RateLimitSuite) TestPoolSharesRateLimiter() {
+	l := NewRateLimiter()
+	p := NewPool([]string{s.server.Addr}, 1000, 1, 1, time.Hour)
+	defer p.Close()
+	p.SetRateLimiter(l)
+
+	c, err := p.Get(context.Background())
+	s.Nil(err)
+	s.True(c.limiter == l)
+	p.Put(c)
+}
@@ -0,0 +1,291 @@
+package disque
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Defaults used by Call and Responder
+const (
+	// DefaultCallTimeout bounds calls whose context has no deadline
+	DefaultCallTimeout = 30 * time.Second
+	// DefaultReplyTTL is the time replies to requests without a deadline are kept
+	DefaultReplyTTL = time.Minute
+)
+
+const (
+	// longest time a single GETJOB blocks the connection while waiting for a reply or request
+	rpcPollInterval = 100 * time.Millisecond
+	// prefix of the per-connection reply queues
+	replyQueuePrefix = "disque-go:reply:"
+)
+
+// Kinds of envelope, telling what an envelope was created for
+const (
+	EnvelopeRequest    = "request"
+	EnvelopeReply      = "reply"
+	EnvelopeIdempotent = "idempotent"
+	EnvelopeWorkflow   = "workflow"
+	// EnvelopeImported wraps a plain job restored by Import with PreserveCounters
+	EnvelopeImported = "imported"
+)
+
+// Envelope wraps the payload of an RPC request or reply, of a job pushed
+// with an idempotency key, or of a step of a workflow. Kind tells which,
+// so that a plain job whose message happens to be JSON is never mistaken
+// for an envelope.
+type Envelope struct {
+	Kind string `json:"envelope"`
+	// CorrelationID matches a reply to its request
+	CorrelationID string `json:"correlation_id,omitempty"`
+	// ReplyTo is the queue the reply is pushed onto, only set on requests
+	ReplyTo string `json:"reply_to,omitempty"`
+	// Deadline is the time after which the caller no longer waits for a reply
+	Deadline time.Time `json:"deadline,omitempty"`
+	Payload  string    `json:"payload"`
+	// Error is the error returned by the handler, only set on replies and on
+	// jobs routed to the failure step of a workflow
+	Error string `json:"error,omitempty"`
+	// IdempotencyKey identifies jobs pushed with PushIdempotent
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// WorkflowID identifies the run of a workflow the job belongs to
+	WorkflowID string `json:"workflow_id,omitempty"`
+	// Step is the workflow step the job is queued for
+	Step string `json:"step,omitempty"`
+	// FailedStep is the step whose handler failed, only set on jobs routed to a failure step
+	FailedStep string `json:"failed_step,omitempty"`
+	// Nacks and AdditionalDeliveries are the delivery counters recorded in a
+	// backup, only set on jobs restored by Import with PreserveCounters
+	Nacks                int64 `json:"nacks,omitempty"`
+	AdditionalDeliveries int64 `json:"additional_deliveries,omitempty"`
+}
+
+// wrapped returns true if the envelope was decoded from a job wrapped by this package
+func (e *Envelope) wrapped() bool {
+	switch e.Kind {
+	case EnvelopeRequest, EnvelopeReply, EnvelopeIdempotent, EnvelopeWorkflow, EnvelopeImported:
+		return true
+	}
+	return false
+}
+
+// parseEnvelope decodes a message wrapped by this package in an envelope of the given kind
+func parseEnvelope(message string, kind string) (envelope *Envelope, ok bool) {
+	envelope = &Envelope{}
+	if json.Unmarshal([]byte(message), envelope) != nil || envelope.Kind != kind {
+		return nil, false
+	}
+	return envelope, true
+}
+
+// RemoteError is returned by Call when the handler of the request failed
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+// Call pushes a request onto the given queue and waits for its reply,
+// returning the reply payload. The request is wrapped in an Envelope carrying
+// the reply queue of this connection, a correlation ID and the deadline of ctx,
+// DefaultCallTimeout from now if ctx has none. Requests not processed by the
+// deadline expire, and replies arriving after the caller gave up are dropped.
+//
+// Calls through the same connection are serialized; use a Pool to issue
+// concurrent calls.
+func (d *Disque) Call(ctx context.Context, queueName string, payload string) (reply string, err error) {
+	d.rpcMu.Lock()
+	defer d.rpcMu.Unlock()
+
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = d.now().Add(DefaultCallTimeout)
+	}
+	if d.replyQueue == "" {
+		d.replyQueue = replyQueuePrefix + randomID()
+	}
+
+	request := &Envelope{
+		Kind:          EnvelopeRequest,
+		CorrelationID: randomID(),
+		ReplyTo:       d.replyQueue,
+		Deadline:      deadline,
+		Payload:       payload,
+	}
+	var body []byte
+	if body, err = json.Marshal(request); err != nil {
+		return
+	}
+	remaining := deadline.Sub(d.now())
+	options := map[string]string{"TTL": strconv.FormatInt(ttlSeconds(remaining), 10)}
+	if _, err = d.addJob(queueName, string(body), remaining, options); err != nil {
+		return
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		default:
+		}
+		remaining = deadline.Sub(d.now())
+		if remaining <= 0 {
+			return "", context.DeadlineExceeded
+		}
+		if remaining > rpcPollInterval {
+			remaining = rpcPollInterval
+		} else if remaining < time.Millisecond {
+			// GETJOB treats a timeout of 0 as blocking forever
+			remaining = time.Millisecond
+		}
+
+		var job *Job
+		if job, err = d.Fetch(d.replyQueue, remaining); err != nil {
+			return
+		}
+		if job == nil {
+			continue
+		}
+		if err = d.Ack(job.JobID); err != nil {
+			return
+		}
+
+		response, ok := parseEnvelope(job.Message, EnvelopeReply)
+		if !ok || response.CorrelationID != request.CorrelationID {
+			// a late reply to a call that gave up
+			log.Printf("Dropping orphaned reply %s on queue %s", job.JobID, d.replyQueue)
+			continue
+		}
+		if response.Error != "" {
+			return "", &RemoteError{Message: response.Error}
+		}
+		return response.Payload, nil
+	}
+}
+
+// Handler processes the payload of an RPC request, returning the reply payload
+type Handler func(ctx context.Context, payload string) (reply string, err error)
+
+// Responder fetches RPC requests from a queue, processes them through a
+// handler and pushes the replies onto the queue given by each request.
+type Responder struct {
+	d         *Disque
+	queueName string
+	handler   Handler
+
+	// Count is the number of requests fetched at once, 1 if unset
+	Count int
+	// Timeout for pushing replies, one second if unset
+	Timeout time.Duration
+}
+
+// NewResponder creates a responder serving requests from the given queue
+func NewResponder(d *Disque, queueName string, handler Handler) *Responder {
+	return &Responder{
+		d:         d,
+		queueName: queueName,
+		handler:   handler,
+	}
+}
+
+// Run serves requests until ctx is done, backing off while requests cannot be fetched
+func (r *Responder) Run(ctx context.Context) {
+	runWorker(ctx, "serving requests from queue "+r.queueName, func() (err error) {
+		_, err = r.serve(ctx, rpcPollInterval)
+		return
+	})
+}
+
+// serve fetches pending requests, waiting up to timeout, and processes them,
+// returning the number of requests that were answered
+func (r *Responder) serve(ctx context.Context, timeout time.Duration) (answered int, err error) {
+	count := r.Count
+	if count <= 0 {
+		count = 1
+	}
+	var jobs []*Job
+	if jobs, err = r.d.FetchMultiple(r.queueName, count, timeout); err != nil {
+		return
+	}
+	for _, job := range jobs {
+		var replied bool
+		if replied, err = r.respond(ctx, job); err != nil {
+			return
+		}
+		if replied {
+			answered++
+		}
+	}
+	return
+}
+
+// respond processes a single request. Malformed requests and requests whose
+// caller already gave up are acknowledged without being processed.
+func (r *Responder) respond(ctx context.Context, job *Job) (replied bool, err error) {
+	request, ok := parseEnvelope(job.Message, EnvelopeRequest)
+	if !ok || request.ReplyTo == "" {
+		log.Printf("Dropping malformed request %s on queue %s", job.JobID, r.queueName)
+		return false, r.d.Ack(job.JobID)
+	}
+
+	handlerCtx := ctx
+	var ttl time.Duration
+	if request.Deadline.IsZero() {
+		ttl = DefaultReplyTTL
+	} else {
+		if ttl = request.Deadline.Sub(r.d.now()); ttl <= 0 {
+			log.Printf("Dropping expired request %s on queue %s", job.JobID, r.queueName)
+			return false, r.d.Ack(job.JobID)
+		}
+		var cancel context.CancelFunc
+		handlerCtx, cancel = context.WithDeadline(ctx, request.Deadline)
+		defer cancel()
+	}
+
+	response := &Envelope{Kind: EnvelopeReply, CorrelationID: request.CorrelationID}
+	if reply, handlerErr := r.handler(handlerCtx, request.Payload); handlerErr != nil {
+		response.Error = handlerErr.Error()
+	} else {
+		response.Payload = reply
+	}
+
+	var body []byte
+	if body, err = json.Marshal(response); err != nil {
+		return
+	}
+	timeout := r.Timeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	// replies expire once the caller stops waiting for them
+	options := map[string]string{"TTL": strconv.FormatInt(ttlSeconds(ttl), 10)}
+	if _, err = r.d.addJob(request.ReplyTo, string(body), timeout, options); err == nil {
+		err = r.d.Ack(job.JobID)
+		replied = true
+	}
+	return
+}
+
+// ttlSeconds converts a duration to a TTL in seconds, at least one
+func ttlSeconds(ttl time.Duration) int64 {
+	if seconds := delaySeconds(ttl); seconds > 0 {
+		return seconds
+	}
+	return 1
+}
+
+func randomID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
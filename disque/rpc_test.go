@@ -0,0 +1,240 @@
+package disque
+
+import (
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+	"golang.org/x/net/context"
+)
+
+type RPCSuite struct {
+	suite.Suite
+	server *disquetest.Server
+	d      *Disque
+}
+
+func TestRPCSuite(t *testing.T) {
+	suite.Run(t, new(RPCSuite))
+}
+
+func (s *RPCSuite) SetupTest() {
+	s.server = disquetest.NewServer()
+	s.d = s.connect()
+}
+
+func (s *RPCSuite) TearDownTest() {
+	s.d.Close()
+	s.server.Close()
+}
+
+func (s *RPCSuite) SetupSuite() {
+}
+
+func (s *RPCSuite) connect() *Disque {
+	d := NewDisque([]string{s.server.Addr}, 1000)
+	s.Nil(d.Initialize())
+	return d
+}
+
+// respond runs a responder on its own connection until the returned function is called
+func (s *RPCSuite) respond(queueName string, handler Handler) (stop func()) {
+	d := s.connect()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		NewResponder(d, queueName, handler).Run(ctx)
+		close(done)
+	}()
+	return func() {
+		cancel()
+		<-done
+		d.Close()
+	}
+}
+
+func upper(ctx context.Context, payload string) (string, error) {
+	return strings.ToUpper(payload), nil
+}
+
+func (s *RPCSuite) TestCall() {
+	stop := s.respond("queueRPC1", upper)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := s.d.Call(ctx, "queueRPC1", "hello")
+	s.Nil(err)
+	s.Equal("HELLO", reply)
+
+	// the reply queue of the connection is reused
+	reply, err = s.d.Call(ctx, "queueRPC1", "again")
+	s.Nil(err)
+	s.Equal("AGAIN", reply)
+}
+
+func (s *RPCSuite) TestCallWithHandlerError() {
+	stop := s.respond("queueRPC2", func(ctx context.Context, payload string) (string, error) {
+		return "", errors.New("Invalid payload")
+	})
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := s.d.Call(ctx, "queueRPC2", "hello")
+	s.Equal(&RemoteError{Message: "Invalid payload"}, err)
+}
+
+func (s *RPCSuite) TestCallTimeout() {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := s.d.Call(ctx, "queueRPC3", "hello")
+	s.Equal(context.DeadlineExceeded, err)
+	s.True(time.Since(start) < 2*time.Second)
+}
+
+func (s *RPCSuite) TestCallCancelled() {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		cancel()
+	}()
+	_, err := s.d.Call(ctx, "queueRPC4", "hello")
+	s.Equal(context.Canceled, err)
+}
+
+func (s *RPCSuite) TestRequestEnvelope() {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	s.d.Call(ctx, "queueRPC5", "hello")
+
+	job, err := s.d.Fetch("queueRPC5", time.Second)
+	s.Nil(err)
+	request := &Envelope{}
+	s.Nil(json.Unmarshal([]byte(job.Message), request))
+	s.Equal(EnvelopeRequest, request.Kind)
+	s.Equal("hello", request.Payload)
+	s.Equal(s.d.replyQueue, request.ReplyTo)
+	s.True(strings.HasPrefix(request.ReplyTo, replyQueuePrefix))
+	s.NotEmpty(request.CorrelationID)
+	s.False(request.Deadline.IsZero())
+
+	jobDetails, err := s.d.GetJobDetails(job.JobID)
+	s.Nil(err)
+	s.Equal(time.Second, jobDetails.TTL)
+}
+
+func (s *RPCSuite) TestOrphanedRepliesAreDropped() {
+	// a reply to an earlier call that gave up
+	s.d.replyQueue = replyQueuePrefix + "orphans"
+	orphan, _ := json.Marshal(&Envelope{Kind: EnvelopeReply, CorrelationID: "stale", Payload: "late"})
+	_, err := s.d.Push(s.d.replyQueue, string(orphan), time.Second)
+	s.Nil(err)
+
+	stop := s.respond("queueRPC6", upper)
+	defer stop()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reply, err := s.d.Call(ctx, "queueRPC6", "hello")
+	s.Nil(err)
+	s.Equal("HELLO", reply)
+
+	queueLength, err := s.d.QueueLength(s.d.replyQueue)
+	s.Nil(err)
+	s.Equal(0, queueLength)
+}
+
+func (s *RPCSuite) TestResponderDropsExpiredRequests() {
+	request, _ := json.Marshal(&Envelope{
+		Kind:          EnvelopeRequest,
+		CorrelationID: "expired",
+		ReplyTo:       "queueRPCReplies7",
+		Deadline:      time.Now().Add(-time.Second),
+		Payload:       "hello",
+	})
+	s.d.Push("queueRPC7", string(request), time.Second)
+
+	called := false
+	responder := NewResponder(s.d, "queueRPC7", func(ctx context.Context, payload string) (string, error) {
+		called = true
+		return payload, nil
+	})
+	answered, err := responder.serve(context.Background(), time.Second)
+	s.Nil(err)
+	s.Equal(0, answered)
+	s.False(called)
+
+	// the request was acknowledged and no reply was pushed
+	queueLength, _ := s.d.QueueLength("queueRPC7")
+	s.Equal(0, queueLength)
+	queueLength, _ = s.d.QueueLength("queueRPCReplies7")
+	s.Equal(0, queueLength)
+}
+
+func (s *RPCSuite) TestResponderDropsMalformedRequests() {
+	s.d.Push("queueRPC8", "not an envelope", time.Second)
+	// JSON with the fields of a request, but not wrapped by Call
+	s.d.Push("queueRPC8", `{"reply_to": "queueRPCReplies8", "payload": "hello"}`, time.Second)
+
+	responder := NewResponder(s.d, "queueRPC8", upper)
+	responder.Count = 2
+	answered, err := responder.serve(context.Background(), time.Second)
+	s.Nil(err)
+	s.Equal(0, answered)
+
+	queueLength, _ := s.d.QueueLength("queueRPC8")
+	s.Equal(0, queueLength)
+}
+
+func (s *RPCSuite) TestWrapped() {
+	s.True((&Envelope{Kind: EnvelopeIdempotent, IdempotencyKey: "k"}).wrapped())
+	s.False((&Envelope{Kind: "order", WorkflowID: "w", Nacks: 1}).wrapped())
+	s.False((&Envelope{CorrelationID: "c", IdempotencyKey: "k"}).wrapped())
+
+	_, ok := parseEnvelope(`{"workflow_id": "w", "total": 3}`, EnvelopeWorkflow)
+	s.False(ok)
+	envelope, ok := parseEnvelope(`{"envelope": "workflow", "workflow_id": "w"}`, EnvelopeWorkflow)
+	s.True(ok)
+	s.Equal("w", envelope.WorkflowID)
+}
+
+func (s *RPCSuite) TestResponderPassesDeadlineToHandler() {
+	deadline := time.Now().Add(time.Minute).Truncate(time.Second)
+	request, _ := json.Marshal(&Envelope{
+		Kind:          EnvelopeRequest,
+		CorrelationID: "c1",
+		ReplyTo:       "queueRPCReplies9",
+		Deadline:      deadline,
+		Payload:       "hello",
+	})
+	s.d.Push("queueRPC9", string(request), time.Second)
+
+	var handlerDeadline time.Time
+	responder := NewResponder(s.d, "queueRPC9", func(ctx context.Context, payload string) (string, error) {
+		handlerDeadline, _ = ctx.Deadline()
+		return payload, nil
+	})
+	answered, err := responder.serve(context.Background(), time.Second)
+	s.Nil(err)
+	s.Equal(1, answered)
+	s.True(deadline.Equal(handlerDeadline))
+
+	job, err := s.d.Fetch("queueRPCReplies9", time.Second)
+	s.Nil(err)
+	reply := &Envelope{}
+	s.Nil(json.Unmarshal([]byte(job.Message), reply))
+	s.Equal(EnvelopeReply, reply.Kind)
+	s.Equal("c1", reply.CorrelationID)
+	s.Equal("hello", reply.Payload)
+
+	// the reply expires once the caller stops waiting for it
+	jobDetails, err := s.d.GetJobDetails(job.JobID)
+	s.Nil(err)
+	s.True(jobDetails.TTL <= time.Minute)
+}
@@ -0,0 +1,155 @@
+package disque
+
+import (
+	"errors"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// Job states reported by SHOW and accepted by JSCAN
+const (
+	JobStateWaitRepl = "wait-repl"
+	JobStateActive   = "active"
+	JobStateQueued   = "queued"
+	JobStateAcked    = "acked"
+)
+
+// number of job IDs passed to a single ENQUEUE when requeueing
+const requeueBatchSize = 100
+
+// ScanOptions filters the jobs returned by a JSCAN
+type ScanOptions struct {
+	// Queue restricts the scan to jobs in the given queue
+	Queue string
+	// States restricts the scan to jobs in any of the given states
+	States []string
+	// Count is a hint for the number of jobs returned per call
+	Count int
+	// BusyLoop blocks the server until the whole scan is complete
+	BusyLoop bool
+}
+
+func (o ScanOptions) arguments(cursor string) (args redis.Args) {
+	if cursor == "" {
+		cursor = "0"
+	}
+	args = redis.Args{}.Add(cursor)
+	if o.Count > 0 {
+		args = args.Add("COUNT").Add(o.Count)
+	}
+	if o.BusyLoop {
+		args = args.Add("BUSYLOOP")
+	}
+	if o.Queue != "" {
+		args = args.Add("QUEUE").Add(o.Queue)
+	}
+	for _, state := range o.States {
+		args = args.Add("STATE").Add(state)
+	}
+	return
+}
+
+// Scan performs a single JSCAN iteration, starting at cursor ("0" or empty for
+// the first call). A returned nextCursor of "0" indicates the scan is complete.
+func (d *Disque) Scan(cursor string, options ScanOptions) (nextCursor string, jobIDs []string, err error) {
+	var items []interface{}
+	if nextCursor, items, err = d.scan(cursor, options, "id"); err == nil {
+		jobIDs, err = redis.Strings(items, nil)
+	}
+	return
+}
+
+// ScanDetails performs a single JSCAN iteration like Scan, returning the full
+// details of every job instead of its ID.
+func (d *Disque) ScanDetails(cursor string, options ScanOptions) (nextCursor string, jobs []*JobDetails, err error) {
+	var items []interface{}
+	if nextCursor, items, err = d.scan(cursor, options, "all"); err == nil {
+		jobs = make([]*JobDetails, 0, len(items))
+		for _, item := range items {
+			var values []interface{}
+			var jobDetails *JobDetails
+			if values, err = redis.Values(item, nil); err != nil {
+				return
+			}
+			if jobDetails, err = parseJobDetails(values); err != nil {
+				return
+			}
+			jobs = append(jobs, jobDetails)
+		}
+	}
+	return
+}
+
+// ScanAll iterates over the whole job space, returning the IDs of every job
+// matching the options.
+func (d *Disque) ScanAll(options ScanOptions) (jobIDs []string, err error) {
+	jobIDs = make([]string, 0)
+	cursor := "0"
+	for {
+		var ids []string
+		if cursor, ids, err = d.Scan(cursor, options); err != nil {
+			return
+		}
+		jobIDs = append(jobIDs, ids...)
+		if cursor == "0" {
+			return
+		}
+	}
+}
+
+// RequeueActive puts every active job in the given queue (or in every queue,
+// if queueName is empty) back into its queue, without waiting for its retry
+// period to elapse. This is useful to recover jobs held by stuck consumers.
+// If filter is not nil, only jobs for which it returns true are requeued.
+func (d *Disque) RequeueActive(queueName string, filter func(*JobDetails) bool) (count int, err error) {
+	options := ScanOptions{
+		Queue:  queueName,
+		States: []string{JobStateActive},
+	}
+
+	jobIDs := make([]string, 0)
+	cursor := "0"
+	for {
+		var jobs []*JobDetails
+		if cursor, jobs, err = d.ScanDetails(cursor, options); err != nil {
+			return
+		}
+		for _, job := range jobs {
+			if filter == nil || filter(job) {
+				jobIDs = append(jobIDs, job.JobID)
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+
+	for len(jobIDs) > 0 {
+		batch := jobIDs
+		if len(batch) > requeueBatchSize {
+			batch = batch[:requeueBatchSize]
+		}
+		jobIDs = jobIDs[len(batch):]
+
+		var queued int
+		if queued, err = d.Enqueue(batch...); err != nil {
+			return
+		}
+		count += queued
+	}
+	return
+}
+
+func (d *Disque) scan(cursor string, options ScanOptions, reply string) (nextCursor string, items []interface{}, err error) {
+	var values []interface{}
+	args := options.arguments(cursor).Add("REPLY").Add(reply)
+	if values, err = redis.Values(d.call("JSCAN", args)); err == nil {
+		if len(values) != 2 {
+			return "", nil, errors.New("Malformed JSCAN reply")
+		}
+		if nextCursor, err = redis.String(values[0], nil); err == nil {
+			items, err = redis.Values(values[1], nil)
+		}
+	}
+	return
+}
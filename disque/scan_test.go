@@ -0,0 +1,139 @@
+package disque
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+)
+
+type ScanSuite struct {
+	suite.Suite
+	server *disquetest.Server
+}
+
+func TestScanSuite(t *testing.T) {
+	suite.Run(t, new(ScanSuite))
+}
+
+func (s *ScanSuite) SetupTest() {
+	s.server = disquetest.NewServer()
+}
+
+func (s *ScanSuite) TearDownTest() {
+	s.server.Close()
+}
+
+func (s *ScanSuite) SetupSuite() {
+}
+
+func (s *ScanSuite) TestScanArguments() {
+	options := ScanOptions{
+		Queue:    "queue1",
+		States:   []string{JobStateActive, JobStateQueued},
+		Count:    10,
+		BusyLoop: true,
+	}
+
+	args := options.arguments("")
+
+	s.Equal([]interface{}{"0", "COUNT", 10, "BUSYLOOP", "QUEUE", "queue1", "STATE", "active", "STATE", "queued"}, []interface{}(args))
+}
+
+func (s *ScanSuite) TestScanArgumentsWithCursor() {
+	args := ScanOptions{}.arguments("123")
+
+	s.Equal([]interface{}{"123"}, []interface{}(args))
+}
+
+func (s *ScanSuite) TestScanAllByQueue() {
+	hosts := []string{s.server.Addr}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	jobID1, _ := d.Push("queueScan1", "msg1", time.Second)
+	jobID2, _ := d.Push("queueScan1", "msg2", time.Second)
+	d.Push("queueScan2", "msg3", time.Second)
+
+	jobIDs, err := d.ScanAll(ScanOptions{Queue: "queueScan1", Count: 1})
+	s.Nil(err)
+	s.Equal(2, len(jobIDs))
+	s.Contains(jobIDs, jobID1)
+	s.Contains(jobIDs, jobID2)
+}
+
+func (s *ScanSuite) TestScanDetails() {
+	hosts := []string{s.server.Addr}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	jobID, _ := d.Push("queueScan3", "msg1", time.Second)
+
+	cursor := "0"
+	found := false
+	for {
+		var jobs []*JobDetails
+		var err error
+		cursor, jobs, err = d.ScanDetails(cursor, ScanOptions{Queue: "queueScan3"})
+		s.Require().Nil(err)
+		for _, job := range jobs {
+			s.Equal(jobID, job.JobID)
+			s.Equal("msg1", job.Message)
+			s.Equal(JobStateQueued, job.State)
+			found = true
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+	s.True(found)
+	d.Delete(jobID)
+}
+
+func (s *ScanSuite) TestRequeueActive() {
+	hosts := []string{s.server.Addr}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	d.Push("queueScan4", "msg1", time.Second)
+	d.Push("queueScan4", "msg2", time.Second)
+	jobs, err := d.FetchMultiple("queueScan4", 2, time.Second)
+	s.Nil(err)
+	s.Equal(2, len(jobs))
+
+	count, err := d.RequeueActive("queueScan4", nil)
+	s.Nil(err)
+	s.Equal(2, count)
+
+	queueLength, err := d.QueueLength("queueScan4")
+	s.Nil(err)
+	s.Equal(2, queueLength)
+
+	jobs, _ = d.FetchMultiple("queueScan4", 2, time.Second)
+	for _, job := range jobs {
+		d.Ack(job.JobID)
+	}
+}
+
+func (s *ScanSuite) TestRequeueActiveWithFilter() {
+	hosts := []string{s.server.Addr}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	d.Push("queueScan5", "msg1", time.Second)
+	d.Push("queueScan5", "msg2", time.Second)
+	jobs, err := d.FetchMultiple("queueScan5", 2, time.Second)
+	s.Nil(err)
+	s.Equal(2, len(jobs))
+
+	count, err := d.RequeueActive("queueScan5", func(job *JobDetails) bool {
+		return job.Message == "msg2"
+	})
+	s.Nil(err)
+	s.Equal(1, count)
+
+	job, err := d.Fetch("queueScan5", time.Second)
+	s.Nil(err)
+	s.Equal("msg2", job.Message)
+
+	for _, job := range jobs {
+		d.Ack(job.JobID)
+	}
+}
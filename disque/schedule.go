@@ -0,0 +1,164 @@
+package disque
+
+import (
+	"encoding/json"
+	"log"
+	"strconv"
+	"time"
+)
+
+// Defaults used when scheduling jobs without a SchedulePolicy
+const (
+	DefaultStagingQueue = "disque-go:staging"
+	DefaultMaxDelay     = 30 * 24 * time.Hour
+	DefaultScheduledTTL = 24 * time.Hour
+)
+
+// SchedulePolicy determines how jobs pushed with PushAt are scheduled.
+// Jobs due further away than MaxDelay are kept on a staging queue and
+// rescheduled in hops of at most MaxDelay until they are due.
+type SchedulePolicy struct {
+	// StagingQueue is the name of the queue holding jobs that are not yet due, DefaultStagingQueue if unset
+	StagingQueue string
+	// MaxDelay is the longest DELAY requested from the server, DefaultMaxDelay if unset
+	MaxDelay time.Duration
+	// Timeout for adding jobs to the staging queue, one second if unset
+	Timeout time.Duration
+}
+
+// stagedJob is the payload of a job stored on the staging queue
+type stagedJob struct {
+	QueueName string            `json:"queue"`
+	Message   string            `json:"message"`
+	RunAt     time.Time         `json:"run_at"`
+	TTL       int64             `json:"ttl"`
+	Options   map[string]string `json:"options,omitempty"`
+}
+
+func (p *SchedulePolicy) stagingQueue() string {
+	if p == nil || p.StagingQueue == "" {
+		return DefaultStagingQueue
+	}
+	return p.StagingQueue
+}
+
+func (p *SchedulePolicy) maxDelay() time.Duration {
+	if p == nil || p.MaxDelay == 0 {
+		return DefaultMaxDelay
+	}
+	return p.MaxDelay
+}
+
+func (p *SchedulePolicy) timeout() time.Duration {
+	if p == nil || p.Timeout == 0 {
+		return time.Second
+	}
+	return p.Timeout
+}
+
+// SetSchedulePolicy configures how jobs pushed with PushAt are scheduled.
+// A nil policy restores the defaults.
+func (d *Disque) SetSchedulePolicy(policy *SchedulePolicy) {
+	d.schedule = policy
+}
+
+// PushAt pushes a job that is delivered once runAt has passed, computing the
+// DELAY and TTL of the job. Jobs due in the past are delivered immediately.
+// The TTL given in options, in seconds, is counted from runAt and defaults to
+// DefaultScheduledTTL; any DELAY given in options is ignored.
+//
+// Jobs due further away than the maximum delay of the schedule policy are
+// pushed onto the staging queue instead, and the returned job ID is the ID of
+// the staged job. PromoteStaged must be called regularly to move staged jobs
+// along as they become due.
+func (d *Disque) PushAt(queueName string, job string, runAt time.Time, timeout time.Duration, options map[string]string) (jobID string, err error) {
+	ttl := int64(DefaultScheduledTTL.Seconds())
+	if value, ok := options["TTL"]; ok {
+		if ttl, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return
+		}
+	}
+	return d.scheduleAt(&stagedJob{
+		QueueName: queueName,
+		Message:   job,
+		RunAt:     runAt,
+		TTL:       ttl,
+		Options:   options,
+	}, timeout)
+}
+
+// PromoteStaged fetches up to count staged jobs whose hop has elapsed and
+// schedules each of them again, either onto its destination queue if it is due
+// within the maximum delay, or back onto the staging queue for another hop.
+// Staged jobs are acknowledged once they have been scheduled again. Staged
+// jobs that cannot be decoded are skipped: they are moved to the dead-letter
+// queue if a dead-letter policy is configured, and dropped otherwise.
+func (d *Disque) PromoteStaged(count int, timeout time.Duration) (promoted int, err error) {
+	var jobs []*Job
+	if jobs, err = d.FetchMultiple(d.schedule.stagingQueue(), count, timeout); err != nil {
+		return
+	}
+	for _, job := range jobs {
+		staged := &stagedJob{}
+		if json.Unmarshal([]byte(job.Message), staged) != nil {
+			log.Printf("Skipping malformed staged job %s on queue %s", job.JobID, job.QueueName)
+			d.discard(job, "malformed staged job")
+			continue
+		}
+		if _, err = d.scheduleAt(staged, d.schedule.timeout()); err != nil {
+			return
+		}
+		if err = d.Ack(job.JobID); err != nil {
+			return
+		}
+		promoted++
+	}
+	return
+}
+
+// scheduleAt pushes the job onto its destination queue if it is due within the
+// maximum delay, otherwise onto the staging queue for a single hop
+func (d *Disque) scheduleAt(staged *stagedJob, timeout time.Duration) (jobID string, err error) {
+	remaining := staged.RunAt.Sub(d.now())
+	maxDelay := d.schedule.maxDelay()
+
+	if remaining <= maxDelay {
+		options := make(map[string]string)
+		for key, value := range staged.Options {
+			options[key] = value
+		}
+		delay := delaySeconds(remaining)
+		if delay > 0 {
+			options["DELAY"] = strconv.FormatInt(delay, 10)
+		} else {
+			delete(options, "DELAY")
+		}
+		options["TTL"] = strconv.FormatInt(delay+staged.TTL, 10)
+		return d.addJob(staged.QueueName, staged.Message, timeout, options)
+	}
+
+	// hop so that the job is within the maximum delay when it comes back
+	hop := remaining - maxDelay
+	if hop > maxDelay {
+		hop = maxDelay
+	}
+	delay := delaySeconds(hop)
+
+	var payload []byte
+	if payload, err = json.Marshal(staged); err == nil {
+		options := map[string]string{
+			"DELAY": strconv.FormatInt(delay, 10),
+			"TTL":   strconv.FormatInt(delay+int64(DefaultScheduledTTL.Seconds()), 10),
+		}
+		jobID, err = d.addJob(d.schedule.stagingQueue(), string(payload), timeout, options)
+	}
+	return
+}
+
+// delaySeconds rounds a delay up to the next second, as DELAY is expressed in seconds
+func delaySeconds(delay time.Duration) int64 {
+	if delay <= 0 {
+		return 0
+	}
+	return int64((delay + time.Second - 1) / time.Second)
+}
@@ -0,0 +1,217 @@
+package disque
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+)
+
+type ScheduleSuite struct {
+	suite.Suite
+	server *disquetest.Server
+}
+
+func TestScheduleSuite(t *testing.T) {
+	suite.Run(t, new(ScheduleSuite))
+}
+
+func (s *ScheduleSuite) SetupTest() {
+	s.server = disquetest.NewServer()
+}
+
+func (s *ScheduleSuite) TearDownTest() {
+	s.server.Close()
+}
+
+func (s *ScheduleSuite) SetupSuite() {
+}
+
+// fakeClock is a clock that only moves when advanced
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func (s *ScheduleSuite) newScheduledDisque(clock *fakeClock, policy *SchedulePolicy) *Disque {
+	hosts := []string{s.server.Addr}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	d.now = clock.Now
+	d.SetSchedulePolicy(policy)
+	return d
+}
+
+func (s *ScheduleSuite) TestDelaySeconds() {
+	s.EqualValues(0, delaySeconds(-time.Second))
+	s.EqualValues(0, delaySeconds(0))
+	s.EqualValues(1, delaySeconds(time.Millisecond))
+	s.EqualValues(1, delaySeconds(time.Second))
+	s.EqualValues(2, delaySeconds(1500*time.Millisecond))
+}
+
+func (s *ScheduleSuite) TestPushAtWithinMaxDelay() {
+	clock := &fakeClock{now: time.Now()}
+	d := s.newScheduledDisque(clock, nil)
+	defer d.Close()
+
+	jobID, err := d.PushAt("queueSchedule1", "asdf", clock.Now().Add(90*time.Second), time.Second, nil)
+	s.Nil(err)
+
+	jobDetails, err := d.GetJobDetails(jobID)
+	s.Nil(err)
+	s.Equal("queueSchedule1", jobDetails.QueueName)
+	s.Equal(90*time.Second, jobDetails.Delay)
+	s.Equal(90*time.Second+DefaultScheduledTTL, jobDetails.TTL)
+}
+
+func (s *ScheduleSuite) TestPushAtWithTTL() {
+	clock := &fakeClock{now: time.Now()}
+	d := s.newScheduledDisque(clock, nil)
+	defer d.Close()
+
+	options := map[string]string{"TTL": "60", "DELAY": "5"}
+	jobID, err := d.PushAt("queueSchedule2", "asdf", clock.Now().Add(30*time.Second), time.Second, options)
+	s.Nil(err)
+
+	jobDetails, err := d.GetJobDetails(jobID)
+	s.Nil(err)
+	s.Equal(30*time.Second, jobDetails.Delay)
+	s.Equal(90*time.Second, jobDetails.TTL)
+	// the options given by the caller are left untouched
+	s.Equal("5", options["DELAY"])
+}
+
+func (s *ScheduleSuite) TestPushAtWithMalformedTTL() {
+	clock := &fakeClock{now: time.Now()}
+	d := s.newScheduledDisque(clock, nil)
+	defer d.Close()
+
+	_, err := d.PushAt("queueSchedule3", "asdf", clock.Now(), time.Second, map[string]string{"TTL": "soon"})
+	s.NotNil(err)
+}
+
+func (s *ScheduleSuite) TestPushAtInThePast() {
+	clock := &fakeClock{now: time.Now()}
+	d := s.newScheduledDisque(clock, nil)
+	defer d.Close()
+
+	_, err := d.PushAt("queueSchedule4", "asdf", clock.Now().Add(-time.Hour), time.Second, nil)
+	s.Nil(err)
+
+	job, err := d.Fetch("queueSchedule4", time.Second)
+	s.Nil(err)
+	s.NotNil(job)
+	s.Equal("asdf", job.Message)
+	d.Ack(job.JobID)
+}
+
+func (s *ScheduleSuite) TestPushAtBeyondMaxDelayIsStaged() {
+	clock := &fakeClock{now: time.Now()}
+	d := s.newScheduledDisque(clock, &SchedulePolicy{StagingQueue: "queueStaging1", MaxDelay: 10 * time.Second})
+	defer d.Close()
+
+	jobID, err := d.PushAt("queueSchedule5", "asdf", clock.Now().Add(25*time.Second), time.Second, nil)
+	s.Nil(err)
+
+	jobDetails, err := d.GetJobDetails(jobID)
+	s.Nil(err)
+	s.Equal("queueStaging1", jobDetails.QueueName)
+	s.Equal(10*time.Second, jobDetails.Delay)
+}
+
+func (s *ScheduleSuite) TestPromoteStagedInHops() {
+	clock := &fakeClock{now: time.Now()}
+	d := s.newScheduledDisque(clock, &SchedulePolicy{StagingQueue: "queueStaging2", MaxDelay: 10 * time.Second})
+	defer d.Close()
+
+	// due in 25s: a first hop of 10s, a second hop of 5s, then a delay of 10s
+	stagedID, err := d.PushAt("queueSchedule6", "asdf", clock.Now().Add(25*time.Second), time.Second, nil)
+	s.Nil(err)
+
+	clock.Advance(10 * time.Second)
+	d.Enqueue(stagedID)
+	promoted, err := d.PromoteStaged(10, time.Second)
+	s.Nil(err)
+	s.Equal(1, promoted)
+
+	jobIDs, err := d.ScanAll(ScanOptions{Queue: "queueStaging2"})
+	s.Nil(err)
+	s.Equal(1, len(jobIDs))
+	jobDetails, err := d.GetJobDetails(jobIDs[0])
+	s.Nil(err)
+	s.Equal(5*time.Second, jobDetails.Delay)
+
+	clock.Advance(5 * time.Second)
+	d.Enqueue(jobIDs[0])
+	promoted, err = d.PromoteStaged(10, time.Second)
+	s.Nil(err)
+	s.Equal(1, promoted)
+
+	jobIDs, err = d.ScanAll(ScanOptions{Queue: "queueSchedule6"})
+	s.Nil(err)
+	s.Equal(1, len(jobIDs))
+	jobDetails, err = d.GetJobDetails(jobIDs[0])
+	s.Nil(err)
+	s.Equal("asdf", jobDetails.Message)
+	s.Equal(10*time.Second, jobDetails.Delay)
+
+	// every staged job was acknowledged
+	jobIDs, err = d.ScanAll(ScanOptions{Queue: "queueStaging2", States: []string{JobStateActive, JobStateQueued}})
+	s.Nil(err)
+	s.Equal(0, len(jobIDs))
+}
+
+func (s *ScheduleSuite) TestPromoteStagedWithNoJobs() {
+	clock := &fakeClock{now: time.Now()}
+	d := s.newScheduledDisque(clock, &SchedulePolicy{StagingQueue: "queueStaging3"})
+	defer d.Close()
+
+	promoted, err := d.PromoteStaged(10, 100*time.Millisecond)
+	s.Nil(err)
+	s.Equal(0, promoted)
+}
+
+func (s *ScheduleSuite) TestPromoteStagedSkipsMalformedJobs() {
+	clock := &fakeClock{now: time.Now()}
+	d := s.newScheduledDisque(clock, &SchedulePolicy{StagingQueue: "queueStaging4"})
+	defer d.Close()
+
+	d.Push("queueStaging4", "not json", time.Second)
+	staged, err := json.Marshal(&stagedJob{QueueName: "queueSchedule7", Message: "qwer", RunAt: clock.Now(), TTL: 60})
+	s.Nil(err)
+	d.Push("queueStaging4", string(staged), time.Second)
+
+	// the malformed job is dropped without holding up the others
+	promoted, err := d.PromoteStaged(10, time.Second)
+	s.Nil(err)
+	s.Equal(1, promoted)
+	queueLength, err := d.QueueLength("queueSchedule7")
+	s.Nil(err)
+	s.Equal(1, queueLength)
+	jobIDs, err := d.ScanAll(ScanOptions{Queue: "queueStaging4", States: []string{JobStateActive, JobStateQueued}})
+	s.Nil(err)
+	s.Equal(0, len(jobIDs))
+
+	// it is dead-lettered with a dead-letter policy
+	d.SetDeadLetterPolicy(&DeadLetterPolicy{Queue: "queueStagingDead"})
+	d.Push("queueStaging4", "not json", time.Second)
+	promoted, err = d.PromoteStaged(10, time.Second)
+	s.Nil(err)
+	s.Equal(0, promoted)
+	job, err := d.Fetch("queueStagingDead", time.Second)
+	s.Nil(err)
+	deadLetter, err := ParseDeadLetter(job)
+	s.Nil(err)
+	s.Equal("not json", deadLetter.Message)
+	s.Equal("malformed staged job", deadLetter.Reason)
+}
@@ -0,0 +1,434 @@
+package disque
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Defaults used by a Scheduler when the corresponding option is unset
+const (
+	DefaultSchedulerPollInterval = time.Second
+	DefaultSchedulerLeaseTTL     = 10 * time.Second
+)
+
+const (
+	// checkpoints record the last tick fired for every entry
+	checkpointTTL = 90 * 24 * time.Hour
+	// time spent waiting for the lease job when trying to become the leader
+	leaseFetchTimeout = 10 * time.Millisecond
+	// upper bound on the number of ticks of an entry handled in a single step
+	maxTicksPerStep = 1000
+)
+
+// SchedulerOptions configures a Scheduler
+type SchedulerOptions struct {
+	// PollInterval is the time between two checks for due ticks, DefaultSchedulerPollInterval if unset
+	PollInterval time.Duration
+	// LeaseTTL is the time after which the lease of a vanished leader passes to another replica,
+	// DefaultSchedulerLeaseTTL if unset
+	LeaseTTL time.Duration
+	// Timeout for adding jobs, one second if unset
+	Timeout time.Duration
+	// CatchUp pushes a job for every missed tick instead of only the most recent one
+	CatchUp bool
+	// OnMissed is invoked with the ticks of an entry that were not fired on time,
+	// for instance because every replica was down. At most 1000 ticks are
+	// reported at once.
+	OnMissed func(name string, missed []time.Time)
+	// Node is the address of the node holding the lease and checkpoints, the
+	// first seed of the connection if unset. JSCAN only reports the jobs known
+	// to the node it runs on, so every replica must use the same node.
+	Node string
+}
+
+// Scheduler pushes jobs onto Disque queues on a recurring schedule.
+//
+// Several replicas of a scheduler sharing the same name coordinate through a
+// lease held in Disque, so that only the leader pushes jobs. The lease is a job
+// on the "<name>:lease" queue, held by the replica that fetched it and extended
+// with WORKING; it is redelivered to another replica once LeaseTTL elapses
+// without the leader extending it. The last tick fired for each entry is
+// recorded on the "<name>:checkpoint" queue, so that a new leader resumes where
+// the previous one stopped and reports the ticks missed in between.
+//
+// The lease and checkpoints are handled through a separate connection to
+// SchedulerOptions.Node, and a replica that cannot reach that node does not
+// lead, since replicas using different nodes would not see each other's lease.
+//
+// Jobs are pushed at least once: a leader that fails between pushing a job and
+// recording its checkpoint causes the next leader to push the job again.
+type Scheduler struct {
+	d *Disque
+	// coord is the connection to the node holding the lease and checkpoints
+	coord   *Disque
+	name    string
+	options SchedulerOptions
+
+	// now returns the current time, replaced in tests
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries []*scheduledEntry
+	// leaseID is the ID of the lease job held by this replica, empty unless leader
+	leaseID   string
+	renewedAt time.Time
+}
+
+type scheduledEntry struct {
+	name      string
+	schedule  Schedule
+	queueName string
+	job       string
+	options   map[string]string
+	// last is the time of the last tick fired, zero until leadership is acquired
+	last time.Time
+}
+
+// checkpoint is the payload of a job stored on the checkpoint queue
+type checkpoint struct {
+	SavedAt time.Time            `json:"saved_at"`
+	Ticks   map[string]time.Time `json:"ticks"`
+}
+
+// NewScheduler creates a scheduler pushing jobs through the given connection.
+// Replicas of the same scheduler must share its name.
+func NewScheduler(d *Disque, name string, options SchedulerOptions) *Scheduler {
+	if options.PollInterval == 0 {
+		options.PollInterval = DefaultSchedulerPollInterval
+	}
+	if options.LeaseTTL == 0 {
+		options.LeaseTTL = DefaultSchedulerLeaseTTL
+	}
+	if options.Timeout == 0 {
+		options.Timeout = time.Second
+	}
+	if options.Node == "" && len(d.servers) > 0 {
+		options.Node = d.servers[0]
+	}
+	return &Scheduler{
+		d:       d,
+		coord:   NewDisque([]string{options.Node}, d.cycle),
+		name:    name,
+		options: options,
+		now:     time.Now,
+		entries: make([]*scheduledEntry, 0),
+	}
+}
+
+// Add registers an entry pushing job onto the given queue, with the given
+// ADDJOB options, every time the schedule is due. Entry names must be unique
+// and stable across replicas and restarts.
+func (s *Scheduler) Add(name string, schedule Schedule, queueName string, job string, options map[string]string) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, entry := range s.entries {
+		if entry.name == name {
+			return fmt.Errorf("Duplicate scheduler entry: %s", name)
+		}
+	}
+	entry := &scheduledEntry{
+		name:      name,
+		schedule:  schedule,
+		queueName: queueName,
+		job:       job,
+		options:   options,
+	}
+	if s.leaseID != "" {
+		entry.last = s.now()
+	}
+	s.entries = append(s.entries, entry)
+	return
+}
+
+// AddCron registers an entry like Add, parsing the schedule with ParseCron
+func (s *Scheduler) AddCron(name string, expr string, queueName string, job string, options map[string]string) (err error) {
+	var schedule Schedule
+	if schedule, err = ParseCron(expr); err == nil {
+		err = s.Add(name, schedule, queueName, job, options)
+	}
+	return
+}
+
+// Leader returns true if this replica currently holds the lease
+func (s *Scheduler) Leader() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.leaseID != ""
+}
+
+// Run pushes jobs as they become due until ctx is done, at which point the
+// lease is handed back so that another replica can take over immediately
+// and the connection to the coordination node is closed.
+func (s *Scheduler) Run(ctx context.Context) {
+	ticker := time.NewTicker(s.options.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := s.step(); err != nil {
+			log.Printf("Error while running scheduler %s, exception: %s", s.name, err)
+		}
+		select {
+		case <-ctx.Done():
+			s.release()
+			s.coord.Close()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// step tries to acquire or extend the lease, then pushes the jobs that are due
+func (s *Scheduler) step() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err = s.coordinate(); err != nil {
+		s.leaseID = ""
+		return
+	}
+
+	now := s.now()
+	if s.leaseID == "" {
+		if err = s.acquire(now); err != nil || s.leaseID == "" {
+			return
+		}
+	} else if now.Sub(s.renewedAt) >= s.options.LeaseTTL/3 {
+		if _, err = s.coord.Working(s.leaseID); err != nil {
+			s.leaseID = ""
+			return
+		}
+		s.renewedAt = now
+	}
+	if err = s.resolveDuplicateLeases(); err != nil || s.leaseID == "" {
+		return
+	}
+
+	fired := false
+	for _, entry := range s.entries {
+		var advanced bool
+		advanced, err = s.fire(entry, now)
+		fired = fired || advanced
+		if err != nil {
+			break
+		}
+	}
+	if fired {
+		if saveErr := s.saveCheckpoint(now); err == nil {
+			err = saveErr
+		}
+	}
+	return
+}
+
+// fire pushes the jobs of an entry that are due, returning true if any was pushed
+func (s *Scheduler) fire(entry *scheduledEntry, now time.Time) (advanced bool, err error) {
+	due := make([]time.Time, 0)
+	for tick := entry.schedule.Next(entry.last); !tick.IsZero() && !tick.After(now); tick = entry.schedule.Next(tick) {
+		due = append(due, tick)
+		if len(due) == maxTicksPerStep {
+			break
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	if !s.options.CatchUp {
+		missed := due[:len(due)-1]
+		if len(due) == maxTicksPerStep {
+			// more ticks were missed than collected, skip straight to the most recent one
+			if latest := latestTick(entry.schedule, due[len(due)-1], now); latest.After(due[len(due)-1]) {
+				missed = due
+				due = []time.Time{latest}
+			}
+		}
+		if len(missed) > 0 && s.options.OnMissed != nil {
+			s.options.OnMissed(entry.name, missed)
+		}
+		due = due[len(due)-1:]
+	} else if len(due) > 1 && s.options.OnMissed != nil {
+		s.options.OnMissed(entry.name, due[:len(due)-1])
+	}
+
+	for _, tick := range due {
+		if _, err = s.d.addJob(entry.queueName, entry.job, s.options.Timeout, entry.options); err != nil {
+			return
+		}
+		entry.last = tick
+		advanced = true
+	}
+	return
+}
+
+// latestTick returns the most recent tick of a schedule that is not after
+// now, or last if there is none after it. Rather than walking every tick
+// since last, it looks for ticks in a window ending at now, doubling the
+// window until it holds one.
+func latestTick(schedule Schedule, last time.Time, now time.Time) time.Time {
+	for window := time.Second; ; window *= 2 {
+		from := last
+		if window < now.Sub(last) {
+			from = now.Add(-window)
+		}
+		if tick := schedule.Next(from); !tick.IsZero() && !tick.After(now) {
+			for next := schedule.Next(tick); !next.IsZero() && !next.After(now); next = schedule.Next(next) {
+				tick = next
+			}
+			return tick
+		}
+		if from.Equal(last) {
+			return last
+		}
+	}
+}
+
+// coordinate connects to the coordination node, failing if the connection
+// is using any other node
+func (s *Scheduler) coordinate() (err error) {
+	if s.coord.node() == "" {
+		if err = s.coord.Initialize(); err != nil {
+			return
+		}
+	}
+	if node := s.coord.node(); node != s.options.Node {
+		return fmt.Errorf("Scheduler %s must coordinate through node %s, connected to %s", s.name, s.options.Node, node)
+	}
+	return
+}
+
+// acquire tries to fetch the lease job, creating it if it does not exist
+func (s *Scheduler) acquire(now time.Time) (err error) {
+	var job *Job
+	if job, err = s.coord.Fetch(s.leaseQueue(), leaseFetchTimeout); err != nil {
+		return
+	}
+	if job == nil {
+		var leaseIDs []string
+		if leaseIDs, err = s.coord.ScanAll(ScanOptions{Queue: s.leaseQueue()}); err == nil && len(leaseIDs) == 0 {
+			// no replica ever created the lease, or it expired
+			options := map[string]string{
+				"RETRY": strconv.FormatInt(delaySeconds(s.options.LeaseTTL), 10),
+				"TTL":   strconv.FormatInt(int64(checkpointTTL.Seconds()), 10),
+			}
+			_, err = s.coord.addJob(s.leaseQueue(), s.name, s.options.Timeout, options)
+		}
+		return
+	}
+
+	s.leaseID = job.JobID
+	s.renewedAt = now
+	return s.loadCheckpoint(now)
+}
+
+// resolveDuplicateLeases gives up the lease if another lease job exists with a
+// smaller ID, which happens when replicas create the lease concurrently
+func (s *Scheduler) resolveDuplicateLeases() (err error) {
+	var leaseIDs []string
+	if leaseIDs, err = s.coord.ScanAll(ScanOptions{Queue: s.leaseQueue()}); err != nil {
+		return
+	}
+	held := false
+	for _, leaseID := range leaseIDs {
+		if leaseID == s.leaseID {
+			held = true
+		} else if leaseID < s.leaseID {
+			log.Printf("Scheduler %s found lease %s, giving up lease %s", s.name, leaseID, s.leaseID)
+			err = s.coord.Delete(s.leaseID)
+			s.leaseID = ""
+			return
+		}
+	}
+	if !held {
+		// the lease expired
+		s.leaseID = ""
+	}
+	return
+}
+
+// release hands the lease back, if held
+func (s *Scheduler) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.leaseID != "" {
+		if err := s.coord.Nack(s.leaseID); err != nil {
+			log.Printf("Error while releasing lease %s of scheduler %s, exception: %s", s.leaseID, s.name, err)
+		}
+		s.leaseID = ""
+	}
+}
+
+// loadCheckpoint resumes every entry from the most recent checkpoint, entries
+// without a checkpoint start from now
+func (s *Scheduler) loadCheckpoint(now time.Time) (err error) {
+	latest := &checkpoint{Ticks: map[string]time.Time{}}
+	cursor := "0"
+	for {
+		var jobs []*JobDetails
+		if cursor, jobs, err = s.coord.ScanDetails(cursor, ScanOptions{Queue: s.checkpointQueue()}); err != nil {
+			return
+		}
+		for _, job := range jobs {
+			c := &checkpoint{}
+			if json.Unmarshal([]byte(job.Message), c) == nil && c.SavedAt.After(latest.SavedAt) {
+				latest = c
+			}
+		}
+		if cursor == "0" {
+			break
+		}
+	}
+
+	for _, entry := range s.entries {
+		if last, ok := latest.Ticks[entry.name]; ok {
+			entry.last = last
+		} else {
+			entry.last = now
+		}
+	}
+	return
+}
+
+// saveCheckpoint records the last tick of every entry, deleting older checkpoints
+func (s *Scheduler) saveCheckpoint(now time.Time) (err error) {
+	c := &checkpoint{SavedAt: now, Ticks: map[string]time.Time{}}
+	for _, entry := range s.entries {
+		c.Ticks[entry.name] = entry.last
+	}
+
+	var payload []byte
+	var checkpointID string
+	if payload, err = json.Marshal(c); err != nil {
+		return
+	}
+	options := map[string]string{"TTL": strconv.FormatInt(int64(checkpointTTL.Seconds()), 10)}
+	if checkpointID, err = s.coord.addJob(s.checkpointQueue(), string(payload), s.options.Timeout, options); err != nil {
+		return
+	}
+
+	var checkpointIDs []string
+	if checkpointIDs, err = s.coord.ScanAll(ScanOptions{Queue: s.checkpointQueue()}); err != nil {
+		return
+	}
+	for _, id := range checkpointIDs {
+		if id != checkpointID {
+			if err = s.coord.Delete(id); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+func (s *Scheduler) leaseQueue() string {
+	return s.name + ":lease"
+}
+
+func (s *Scheduler) checkpointQueue() string {
+	return s.name + ":checkpoint"
+}
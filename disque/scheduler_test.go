@@ -0,0 +1,309 @@
+package disque
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+	"golang.org/x/net/context"
+)
+
+type SchedulerSuite struct {
+	suite.Suite
+	server *disquetest.Server
+}
+
+func TestSchedulerSuite(t *testing.T) {
+	suite.Run(t, new(SchedulerSuite))
+}
+
+func (s *SchedulerSuite) SetupTest() {
+	s.server = disquetest.NewServer()
+}
+
+func (s *SchedulerSuite) TearDownTest() {
+	s.server.Close()
+}
+
+func (s *SchedulerSuite) SetupSuite() {
+}
+
+func (s *SchedulerSuite) newTestScheduler(name string, clock *fakeClock, options SchedulerOptions) *Scheduler {
+	hosts := []string{s.server.Addr}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	scheduler := NewScheduler(d, name, options)
+	scheduler.now = clock.Now
+	return scheduler
+}
+
+func closeTestScheduler(scheduler *Scheduler) {
+	scheduler.d.Close()
+	scheduler.coord.Close()
+}
+
+func (s *SchedulerSuite) queueLength(queueName string) int {
+	hosts := []string{s.server.Addr}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	defer d.Close()
+	queueLength, err := d.QueueLength(queueName)
+	s.Nil(err)
+	return queueLength
+}
+
+func (s *SchedulerSuite) TestAddDuplicateEntry() {
+	clock := &fakeClock{now: at("2016-03-01 10:00")}
+	scheduler := s.newTestScheduler("scheduler1", clock, SchedulerOptions{})
+	defer closeTestScheduler(scheduler)
+
+	s.Nil(scheduler.Add("entry", Every(time.Minute), "queueScheduler1", "tick", nil))
+	s.NotNil(scheduler.Add("entry", Every(time.Minute), "queueScheduler1", "tick", nil))
+	s.NotNil(scheduler.AddCron("entry2", "* * *", "queueScheduler1", "tick", nil))
+}
+
+func (s *SchedulerSuite) TestFiresDueTicks() {
+	clock := &fakeClock{now: at("2016-03-01 10:00")}
+	scheduler := s.newTestScheduler("scheduler2", clock, SchedulerOptions{})
+	defer closeTestScheduler(scheduler)
+	s.Nil(scheduler.AddCron("entry", "*/5 * * * *", "queueScheduler2", "tick", nil))
+
+	// the first step creates the lease, the second acquires it
+	s.Nil(scheduler.step())
+	s.Nil(scheduler.step())
+	s.True(scheduler.Leader())
+	s.Equal(0, s.queueLength("queueScheduler2"))
+
+	clock.Advance(4 * time.Minute)
+	s.Nil(scheduler.step())
+	s.Equal(0, s.queueLength("queueScheduler2"))
+
+	clock.Advance(time.Minute)
+	s.Nil(scheduler.step())
+	s.Equal(1, s.queueLength("queueScheduler2"))
+
+	// a tick is only fired once
+	s.Nil(scheduler.step())
+	s.Equal(1, s.queueLength("queueScheduler2"))
+
+	job, err := scheduler.d.Fetch("queueScheduler2", time.Second)
+	s.Nil(err)
+	s.Equal("tick", job.Message)
+}
+
+func (s *SchedulerSuite) TestOnlyOneReplicaLeads() {
+	clock := &fakeClock{now: at("2016-03-01 10:00")}
+	replicas := []*Scheduler{
+		s.newTestScheduler("scheduler3", clock, SchedulerOptions{}),
+		s.newTestScheduler("scheduler3", clock, SchedulerOptions{}),
+		s.newTestScheduler("scheduler3", clock, SchedulerOptions{}),
+	}
+	for _, replica := range replicas {
+		defer closeTestScheduler(replica)
+		s.Nil(replica.Add("entry", Every(time.Minute), "queueScheduler3", "tick", nil))
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, replica := range replicas {
+			s.Nil(replica.step())
+		}
+	}
+	leaders := 0
+	for _, replica := range replicas {
+		if replica.Leader() {
+			leaders++
+		}
+	}
+	s.Equal(1, leaders)
+
+	clock.Advance(time.Minute)
+	for _, replica := range replicas {
+		s.Nil(replica.step())
+	}
+	s.Equal(1, s.queueLength("queueScheduler3"))
+}
+
+func (s *SchedulerSuite) TestDuplicateLeasesAreResolved() {
+	clock := &fakeClock{now: at("2016-03-01 10:00")}
+	first := s.newTestScheduler("scheduler4", clock, SchedulerOptions{})
+	second := s.newTestScheduler("scheduler4", clock, SchedulerOptions{})
+	defer closeTestScheduler(first)
+	defer closeTestScheduler(second)
+
+	// both replicas create a lease before either fetches one
+	options := map[string]string{"RETRY": "10"}
+	_, err := first.d.PushWithOptions("scheduler4:lease", "scheduler4", time.Second, options)
+	s.Nil(err)
+	_, err = second.d.PushWithOptions("scheduler4:lease", "scheduler4", time.Second, options)
+	s.Nil(err)
+
+	s.Nil(first.step())
+	s.Nil(second.step())
+	s.Nil(first.step())
+	s.Nil(second.step())
+	s.True(first.Leader() != second.Leader())
+
+	leaseIDs, err := first.d.ScanAll(ScanOptions{Queue: "scheduler4:lease"})
+	s.Nil(err)
+	s.Equal(1, len(leaseIDs))
+}
+
+func (s *SchedulerSuite) TestMissedTicksAfterDowntime() {
+	clock := &fakeClock{now: at("2016-03-01 10:00")}
+	first := s.newTestScheduler("scheduler5", clock, SchedulerOptions{})
+	defer closeTestScheduler(first)
+	s.Nil(first.Add("entry", Every(time.Minute), "queueScheduler5", "tick", nil))
+	s.Nil(first.step())
+	s.Nil(first.step())
+	clock.Advance(time.Minute)
+	s.Nil(first.step())
+	s.Equal(1, s.queueLength("queueScheduler5"))
+	first.release()
+
+	// every replica is down for a few minutes
+	clock.Advance(3*time.Minute + 30*time.Second)
+
+	var missed []time.Time
+	second := s.newTestScheduler("scheduler5", clock, SchedulerOptions{
+		OnMissed: func(name string, ticks []time.Time) {
+			s.Equal("entry", name)
+			missed = ticks
+		},
+	})
+	defer closeTestScheduler(second)
+	s.Nil(second.Add("entry", Every(time.Minute), "queueScheduler5", "tick", nil))
+	s.Nil(second.step())
+	s.True(second.Leader())
+
+	s.Equal([]time.Time{at("2016-03-01 10:02"), at("2016-03-01 10:03")}, missed)
+	// only the most recent tick is fired
+	s.Equal(2, s.queueLength("queueScheduler5"))
+}
+
+func (s *SchedulerSuite) TestCatchUpFiresMissedTicks() {
+	clock := &fakeClock{now: at("2016-03-01 10:00")}
+	first := s.newTestScheduler("scheduler6", clock, SchedulerOptions{})
+	defer closeTestScheduler(first)
+	s.Nil(first.Add("entry", Every(time.Minute), "queueScheduler6", "tick", nil))
+	s.Nil(first.step())
+	s.Nil(first.step())
+	clock.Advance(time.Minute)
+	s.Nil(first.step())
+	first.release()
+
+	clock.Advance(3 * time.Minute)
+
+	second := s.newTestScheduler("scheduler6", clock, SchedulerOptions{CatchUp: true})
+	defer closeTestScheduler(second)
+	s.Nil(second.Add("entry", Every(time.Minute), "queueScheduler6", "tick", nil))
+	s.Nil(second.step())
+
+	s.Equal(4, s.queueLength("queueScheduler6"))
+
+	// a single checkpoint is kept
+	checkpointIDs, err := second.d.ScanAll(ScanOptions{Queue: "scheduler6:checkpoint"})
+	s.Nil(err)
+	s.Equal(1, len(checkpointIDs))
+}
+
+func (s *SchedulerSuite) TestRunReleasesLease() {
+	clock := &fakeClock{now: at("2016-03-01 10:00")}
+	scheduler := s.newTestScheduler("scheduler7", clock, SchedulerOptions{PollInterval: 10 * time.Millisecond})
+	defer closeTestScheduler(scheduler)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		scheduler.Run(ctx)
+		close(done)
+	}()
+
+	for i := 0; i < 100 && !scheduler.Leader(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.True(scheduler.Leader())
+
+	cancel()
+	<-done
+	s.False(scheduler.Leader())
+
+	// the lease is immediately available to another replica
+	other := s.newTestScheduler("scheduler7", clock, SchedulerOptions{})
+	defer closeTestScheduler(other)
+	s.Nil(other.step())
+	s.True(other.Leader())
+}
+
+func (s *SchedulerSuite) TestReplicasCoordinateThroughOneNode() {
+	cluster := disquetest.NewCluster(2)
+	defer cluster.Close()
+	addrs := cluster.Addrs()
+
+	clock := &fakeClock{now: at("2016-03-01 10:00")}
+	replicas := make([]*Scheduler, 0)
+	for _, seeds := range [][]string{addrs, {addrs[1], addrs[0]}} {
+		d := NewDisque(seeds, 1000)
+		s.Nil(d.Initialize())
+		replica := NewScheduler(d, "scheduler8", SchedulerOptions{Node: addrs[0]})
+		replica.now = clock.Now
+		defer closeTestScheduler(replica)
+		s.Nil(replica.Add("entry", Every(time.Minute), "queueScheduler8", "tick", nil))
+		replicas = append(replicas, replica)
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, replica := range replicas {
+			s.Nil(replica.step())
+		}
+	}
+	s.True(replicas[0].Leader() != replicas[1].Leader())
+	s.True(cluster.Servers[0].CommandCount("JSCAN") > 0)
+	s.Equal(0, cluster.Servers[1].CommandCount("JSCAN"))
+}
+
+func (s *SchedulerSuite) TestUnreachableCoordinationNode() {
+	clock := &fakeClock{now: at("2016-03-01 10:00")}
+	scheduler := s.newTestScheduler("scheduler9", clock, SchedulerOptions{Node: "127.0.0.1:1"})
+	defer closeTestScheduler(scheduler)
+
+	s.NotNil(scheduler.step())
+	s.False(scheduler.Leader())
+}
+
+func (s *SchedulerSuite) TestLongDowntimeFiresLatestTick() {
+	clock := &fakeClock{now: at("2016-03-01 10:00")}
+	var missed []time.Time
+	scheduler := s.newTestScheduler("scheduler10", clock, SchedulerOptions{
+		OnMissed: func(name string, ticks []time.Time) {
+			missed = ticks
+		},
+	})
+	defer closeTestScheduler(scheduler)
+	s.Nil(scheduler.Add("entry", Every(time.Minute), "queueScheduler10", "tick", nil))
+	s.Nil(scheduler.step())
+	s.Nil(scheduler.step())
+	s.True(scheduler.Leader())
+
+	// more ticks are missed than are handled in a single step
+	clock.Advance(2000*time.Minute + 30*time.Second)
+	s.Nil(scheduler.step())
+	s.Equal(maxTicksPerStep, len(missed))
+	s.Equal(1, s.queueLength("queueScheduler10"))
+	s.Equal(at("2016-03-01 10:00").Add(2000*time.Minute), scheduler.entries[0].last)
+
+	missed = nil
+	s.Nil(scheduler.step())
+	s.Nil(missed)
+	s.Equal(1, s.queueLength("queueScheduler10"))
+}
+
+func (s *SchedulerSuite) TestLatestTick() {
+	now := at("2016-03-01 10:00").Add(30 * time.Second)
+	s.Equal(at("2016-03-01 10:00"), latestTick(Every(time.Minute), at("2016-01-01 00:00"), now))
+	s.Equal(at("2016-03-01 10:00"), latestTick(Every(time.Minute), at("2016-03-01 10:00"), now))
+
+	schedule, err := ParseCron("30 2 * * *")
+	s.Nil(err)
+	s.Equal(at("2016-03-01 02:30"), latestTick(schedule, at("2015-03-01 00:00"), now))
+}
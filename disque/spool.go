@@ -0,0 +1,584 @@
+package disque
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// ErrSpooled is returned by Push when the cluster could not be reached and
+// the job was recorded in the spool, to be delivered once the cluster is
+// reachable again
+var ErrSpooled = errors.New("Job spooled for later delivery")
+
+// ErrSpoolFull is returned when a job does not fit within the limits of the spool
+var ErrSpoolFull = errors.New("Spool full")
+
+// errSpoolExpired is returned for spooled jobs whose TTL elapsed before they could be replayed
+var errSpoolExpired = errors.New("TTL elapsed while spooled")
+
+// SpoolSync controls when the spool is flushed to disk
+type SpoolSync int
+
+// Sync policies of a spool
+const (
+	// SpoolSyncAlways flushes the spool to disk after every change
+	SpoolSyncAlways SpoolSync = iota
+	// SpoolSyncInterval flushes the spool to disk at most once per SyncInterval
+	SpoolSyncInterval
+	// SpoolSyncNever leaves flushing to the operating system
+	SpoolSyncNever
+)
+
+// Defaults used by a spool when the corresponding option is unset
+const (
+	DefaultSpoolSyncInterval   = time.Second
+	DefaultSpoolReplayInterval = 5 * time.Second
+)
+
+// SpoolOptions configures a spool
+type SpoolOptions struct {
+	// MaxBytes and MaxJobs limit the size of the jobs awaiting delivery,
+	// unlimited if unset. The log is compacted so that it stays within MaxBytes on disk.
+	MaxBytes int64
+	MaxJobs  int
+	// Sync is the policy used to flush the spool to disk
+	Sync SpoolSync
+	// SyncInterval is the longest time changes stay unflushed with
+	// SpoolSyncInterval, DefaultSpoolSyncInterval if unset
+	SyncInterval time.Duration
+	// ReplayInterval is the time between two attempts to replay spooled jobs
+	// in the background, DefaultSpoolReplayInterval if unset
+	ReplayInterval time.Duration
+}
+
+// SpoolStats contains statistics about a spool
+type SpoolStats struct {
+	// Depth is the number of jobs awaiting delivery, and Bytes their size on disk
+	Depth int
+	Bytes int64
+	// Spooled, Replayed and Dropped count the jobs recorded, delivered and
+	// rejected by the cluster or expired since the spool was opened
+	Spooled  int64
+	Replayed int64
+	Dropped  int64
+}
+
+// spooledJob is a record of the spool
+type spooledJob struct {
+	QueueName string            `json:"queue"`
+	Message   string            `json:"message"`
+	Timeout   int64             `json:"timeout"`
+	Options   map[string]string `json:"options,omitempty"`
+	SpooledAt time.Time         `json:"spooled_at"`
+}
+
+// Spool records jobs that could not be delivered because the cluster was
+// unreachable. Jobs are appended, one JSON record per line, to a log on local
+// disk and replayed in order once the cluster is reachable again. The position
+// of the next job to replay is kept in a file alongside the log, so that
+// delivered jobs are not replayed after a restart. The log is truncated once
+// every job has been delivered, and compacted once delivered jobs take up
+// half of it.
+//
+// Relative DELAY and TTL options are reduced by the time a job spent in the
+// spool, and jobs whose TTL elapsed are dropped instead of being replayed.
+type Spool struct {
+	options SpoolOptions
+	path    string
+
+	mu       sync.Mutex
+	log      *os.File
+	position *os.File
+	// offset is the position in the log of the next job to replay
+	offset   int64
+	size     int64
+	depth    int
+	lastSync time.Time
+	// dirty is set while changes await a flush, which is scheduled while flushing is set
+	dirty    bool
+	flushing bool
+
+	spooled  int64
+	replayed int64
+	dropped  int64
+
+	// replaying is set while jobs are being replayed, which happens once at a time
+	replaying bool
+
+	// stop ends the background replay, which closes done once it returned
+	stop   chan struct{}
+	done   chan struct{}
+	closed bool
+}
+
+// OpenSpool opens the spool stored at path, creating it if needed. Jobs
+// recorded before the spool was last closed are kept.
+func OpenSpool(path string, options SpoolOptions) (spool *Spool, err error) {
+	if options.SyncInterval <= 0 {
+		options.SyncInterval = DefaultSpoolSyncInterval
+	}
+	if options.ReplayInterval <= 0 {
+		options.ReplayInterval = DefaultSpoolReplayInterval
+	}
+	spool = &Spool{options: options, path: path}
+	if spool.log, err = os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		return nil, err
+	}
+	if spool.position, err = os.OpenFile(path+".pos", os.O_RDWR|os.O_CREATE, 0644); err != nil {
+		spool.log.Close()
+		return nil, err
+	}
+	if err = spool.recover(); err != nil {
+		spool.Close()
+		return nil, err
+	}
+	return
+}
+
+// recover reads the position of the next job and counts the jobs after it,
+// dropping any record left incomplete by a crash
+func (s *Spool) recover() (err error) {
+	var position [8]byte
+	if _, err = s.position.ReadAt(position[:], 0); err == nil {
+		s.offset = int64(binary.BigEndian.Uint64(position[:]))
+	} else if err != io.EOF {
+		return
+	}
+
+	reader := bufio.NewReader(s.log)
+	var line []byte
+	for {
+		if line, err = reader.ReadBytes('\n'); err != nil {
+			break
+		}
+		if s.size >= s.offset {
+			s.depth++
+		}
+		s.size += int64(len(line))
+	}
+	if err != io.EOF {
+		return
+	}
+	if len(line) > 0 {
+		log.Printf("Error while reading spool, exception: discarding incomplete record of %d bytes", len(line))
+		if err = s.log.Truncate(s.size); err != nil {
+			return
+		}
+	}
+	if s.offset > s.size {
+		// the log was truncated before the position was reset
+		s.offset = 0
+		s.depth = 0
+	}
+	_, err = s.log.Seek(s.size, os.SEEK_SET)
+	return
+}
+
+// Close stops the background replay, flushes the spool to disk and closes its files
+func (s *Spool) Close() (err error) {
+	s.mu.Lock()
+	stop, done := s.stop, s.done
+	s.stop = nil
+	s.closed = true
+	s.mu.Unlock()
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err = s.log.Sync(); err == nil {
+		err = s.position.Sync()
+	}
+	s.log.Close()
+	s.position.Close()
+	return
+}
+
+// Depth returns the number of jobs awaiting delivery
+func (s *Spool) Depth() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.depth
+}
+
+// Stats returns statistics about the spool
+func (s *Spool) Stats() SpoolStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return SpoolStats{
+		Depth:    s.depth,
+		Bytes:    s.size - s.offset,
+		Spooled:  s.spooled,
+		Replayed: s.replayed,
+		Dropped:  s.dropped,
+	}
+}
+
+// append records a job at the end of the log
+func (s *Spool) append(job *spooledJob) (err error) {
+	var record []byte
+	if record, err = json.Marshal(job); err != nil {
+		return
+	}
+	record = append(record, '\n')
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.options.MaxJobs > 0 && s.depth >= s.options.MaxJobs {
+		return ErrSpoolFull
+	}
+	if s.options.MaxBytes > 0 && s.offset > 0 && s.size+int64(len(record)) > s.options.MaxBytes {
+		// drop delivered jobs from the log before it outgrows MaxBytes
+		if err = s.compact(); err != nil {
+			return
+		}
+	}
+	if s.options.MaxBytes > 0 && s.size-s.offset+int64(len(record)) > s.options.MaxBytes {
+		return ErrSpoolFull
+	}
+	if _, err = s.log.Write(record); err != nil {
+		// drop whatever part of the record was written
+		s.log.Truncate(s.size)
+		s.log.Seek(s.size, os.SEEK_SET)
+		return
+	}
+	s.size += int64(len(record))
+	s.depth++
+	s.spooled++
+	return s.sync(s.log)
+}
+
+// replay hands the jobs awaiting delivery, oldest first, to deliver until it
+// fails. Jobs for which deliver returns a redis.Error were rejected by the
+// cluster and are dropped, as are expired jobs, any other error stops the
+// replay. Jobs are delivered without holding the lock of the spool, so that
+// jobs can be spooled meanwhile; a replay started while another one is
+// running returns at once.
+func (s *Spool) replay(deliver func(job *spooledJob) error) (replayed int, err error) {
+	s.mu.Lock()
+	if s.replaying || s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.replaying = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		s.replaying = false
+		s.mu.Unlock()
+	}()
+
+	for {
+		var line []byte
+		if line, err = s.next(); err != nil || line == nil {
+			return
+		}
+		job := &spooledJob{}
+		delivered := false
+		if err = json.Unmarshal(line, job); err != nil {
+			log.Printf("Error while decoding spooled job, exception: %s", err)
+		} else if err = deliver(job); err == nil {
+			delivered = true
+			replayed++
+		} else if _, rejected := err.(redis.Error); !rejected && err != errSpoolExpired {
+			s.mu.Lock()
+			s.compactDelivered()
+			s.mu.Unlock()
+			return
+		} else {
+			log.Printf("Error while replaying spooled job to queue %s, exception: %s", job.QueueName, err)
+		}
+		if err = s.advance(int64(len(line)), delivered); err != nil {
+			return
+		}
+	}
+}
+
+// next reads the next job to replay, returning a nil line once every job was
+// delivered, in which case the log is truncated
+func (s *Spool) next() (line []byte, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return
+	}
+	if s.depth > 0 {
+		reader := bufio.NewReader(io.NewSectionReader(s.log, s.offset, s.size-s.offset))
+		return reader.ReadBytes('\n')
+	}
+	if s.size > 0 {
+		// every job was delivered, start over with an empty log
+		if err = s.log.Truncate(0); err != nil {
+			return
+		}
+		if _, err = s.log.Seek(0, os.SEEK_SET); err != nil {
+			return
+		}
+		s.size = 0
+		s.offset = 0
+		err = s.savePosition()
+	}
+	return
+}
+
+// advance moves the position past the job that was just replayed. Jobs
+// appended meanwhile may have caused the log to be compacted, which keeps the
+// job at the position.
+func (s *Spool) advance(length int64, delivered bool) (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if delivered {
+		s.replayed++
+	} else {
+		s.dropped++
+	}
+	s.offset += length
+	s.depth--
+	return s.savePosition()
+}
+
+// compactDelivered compacts the log once delivered jobs take up half of it
+func (s *Spool) compactDelivered() {
+	if s.offset > 0 && s.offset >= s.size-s.offset {
+		if err := s.compact(); err != nil {
+			log.Printf("Error while compacting spool, exception: %s", err)
+		}
+	}
+}
+
+// compact rewrites the log without the jobs already delivered. The position
+// is reset before the log is replaced, so that a crash in between causes
+// delivered jobs to be replayed again rather than pending jobs to be skipped.
+func (s *Spool) compact() (err error) {
+	var compacted *os.File
+	if compacted, err = os.OpenFile(s.path+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644); err != nil {
+		return
+	}
+	pending := s.size - s.offset
+	if _, err = io.Copy(compacted, io.NewSectionReader(s.log, s.offset, pending)); err == nil {
+		err = compacted.Sync()
+	}
+	if err != nil {
+		compacted.Close()
+		os.Remove(compacted.Name())
+		return
+	}
+
+	offset := s.offset
+	s.offset = 0
+	if err = s.savePosition(); err == nil {
+		err = os.Rename(compacted.Name(), s.path)
+	}
+	if err != nil {
+		s.offset = offset
+		s.savePosition()
+		compacted.Close()
+		os.Remove(compacted.Name())
+		return
+	}
+	s.log.Close()
+	s.log = compacted
+	s.size = pending
+	return
+}
+
+// savePosition records the position of the next job to replay
+func (s *Spool) savePosition() (err error) {
+	var position [8]byte
+	binary.BigEndian.PutUint64(position[:], uint64(s.offset))
+	if _, err = s.position.WriteAt(position[:], 0); err == nil {
+		err = s.sync(s.position)
+	}
+	return
+}
+
+// sync flushes a file of the spool according to the sync policy
+func (s *Spool) sync(file *os.File) (err error) {
+	switch s.options.Sync {
+	case SpoolSyncAlways:
+		return file.Sync()
+	case SpoolSyncInterval:
+		if elapsed := time.Since(s.lastSync); elapsed >= s.options.SyncInterval {
+			err = s.syncFiles()
+		} else if s.dirty = true; !s.flushing {
+			// flush the change even if nothing else is written in the meantime
+			s.flushing = true
+			time.AfterFunc(s.options.SyncInterval-elapsed, s.flush)
+		}
+	}
+	return
+}
+
+// syncFiles flushes both files of the spool to disk
+func (s *Spool) syncFiles() (err error) {
+	if err = s.log.Sync(); err == nil {
+		err = s.position.Sync()
+	}
+	s.lastSync = time.Now()
+	s.dirty = false
+	return
+}
+
+// flush flushes the changes made since the spool was last flushed
+func (s *Spool) flush() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flushing = false
+	if s.closed || !s.dirty {
+		return
+	}
+	if err := s.syncFiles(); err != nil {
+		log.Printf("Error while flushing spool, exception: %s", err)
+	}
+}
+
+// startReplay replays the spool in the background through a connection of
+// its own to the given servers, unless it is already being replayed
+func (s *Spool) startReplay(servers []string, cycle int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil || s.closed {
+		return
+	}
+	s.stop = make(chan struct{})
+	s.done = make(chan struct{})
+	go s.replayEvery(NewDisque(servers, cycle), s.stop, s.done)
+}
+
+// replayEvery replays the spool through d whenever jobs are waiting, until stop is closed
+func (s *Spool) replayEvery(d *Disque, stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	defer d.Close()
+
+	ticker := time.NewTicker(s.options.ReplayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		if s.Depth() == 0 {
+			continue
+		}
+		if _, err := s.replay(d.deliverSpooled); err != nil {
+			log.Printf("Error while replaying spool, exception: %s", err)
+		}
+	}
+}
+
+// SetSpool configures the spool recording jobs that could not be pushed
+// because the cluster was unreachable, and starts replaying it in the
+// background. A nil spool disables spooling.
+func (d *Disque) SetSpool(spool *Spool) {
+	d.spool = spool
+	if spool != nil {
+		spool.startReplay(d.servers, d.cycle)
+	}
+}
+
+// ReplaySpool pushes the jobs recorded in the spool, oldest first, stopping
+// at the first job that cannot be delivered. It returns the number of jobs
+// that were delivered, or returns at once if the spool is being replayed.
+func (d *Disque) ReplaySpool() (replayed int, err error) {
+	if d.spool == nil {
+		return
+	}
+	return d.spool.replay(d.deliverSpooled)
+}
+
+// deliverSpooled adds a spooled job, counting the time it spent in the spool
+// against its delay and TTL
+func (d *Disque) deliverSpooled(job *spooledJob) (err error) {
+	options, expired := job.remainingOptions(d.now())
+	if expired {
+		return errSpoolExpired
+	}
+	_, err = d.addJob(job.QueueName, job.Message, time.Duration(job.Timeout)*time.Millisecond, options)
+	return
+}
+
+// remainingOptions returns the options of a spooled job with DELAY and TTL
+// reduced by the time elapsed since it was spooled, and whether its TTL elapsed
+func (job *spooledJob) remainingOptions(now time.Time) (options map[string]string, expired bool) {
+	elapsed := int64(now.Sub(job.SpooledAt) / time.Second)
+	if elapsed <= 0 || len(job.Options) == 0 {
+		return job.Options, false
+	}
+	options = make(map[string]string)
+	for key, value := range job.Options {
+		option := strings.ToUpper(key)
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if (option != "DELAY" && option != "TTL") || err != nil {
+			options[key] = value
+			continue
+		}
+		if seconds -= elapsed; seconds > 0 {
+			options[key] = strconv.FormatInt(seconds, 10)
+		} else if option == "TTL" {
+			return nil, true
+		}
+	}
+	return
+}
+
+// addJob pushes a job without spooling it. Features of this package that
+// push jobs handle failed pushes themselves, and use it rather than Push.
+func (d *Disque) addJob(queueName string, job string, timeout time.Duration, options map[string]string) (jobID string, err error) {
+	args := redis.Args{}.
+		Add(queueName).
+		Add(job).
+		Add(int64(timeout.Seconds() * 1000)).
+		AddFlat(optionsToArguments(options))
+	return redis.String(d.call("ADDJOB", args))
+}
+
+// pushOrSpool pushes a job, recording it in the spool if one is configured
+// and the cluster cannot be reached. Jobs are also spooled while older jobs
+// remain in the spool, so that the background replay delivers them in order.
+func (d *Disque) pushOrSpool(queueName string, job string, timeout time.Duration, options map[string]string) (jobID string, err error) {
+	spool := d.spool
+	if spool != nil && spool.Depth() > 0 {
+		return "", d.spoolJob(queueName, job, timeout, options)
+	}
+	if jobID, err = d.addJob(queueName, job, timeout, options); err != nil && spool != nil && unreachable(err) {
+		return "", d.spoolJob(queueName, job, timeout, options)
+	}
+	return
+}
+
+func (d *Disque) spoolJob(queueName string, job string, timeout time.Duration, options map[string]string) (err error) {
+	err = d.spool.append(&spooledJob{
+		QueueName: queueName,
+		Message:   job,
+		Timeout:   int64(timeout.Seconds() * 1000),
+		Options:   options,
+		SpooledAt: d.now(),
+	})
+	if err == nil {
+		err = ErrSpooled
+	}
+	return
+}
+
+// unreachable returns true if err was not returned by a node of the cluster
+func unreachable(err error) bool {
+	if err == ErrQueuePaused {
+		return false
+	}
+	_, rejected := err.(redis.Error)
+	return !rejected
+}
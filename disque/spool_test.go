@@ -0,0 +1,418 @@
+package disque
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+)
+
+type SpoolSuite struct {
+	suite.Suite
+	dir string
+}
+
+func TestSpoolSuite(t *testing.T) {
+	suite.Run(t, new(SpoolSuite))
+}
+
+func (s *SpoolSuite) SetupTest() {
+	var err error
+	s.dir, err = ioutil.TempDir("", "disque-spool")
+	s.Nil(err)
+}
+
+func (s *SpoolSuite) TearDownTest() {
+	os.RemoveAll(s.dir)
+}
+
+func (s *SpoolSuite) SetupSuite() {
+}
+
+func (s *SpoolSuite) openSpool(options SpoolOptions) *Spool {
+	spool, err := OpenSpool(filepath.Join(s.dir, "spool"), options)
+	s.Nil(err)
+	return spool
+}
+
+func (s *SpoolSuite) appendJobs(spool *Spool, messages ...string) {
+	for _, message := range messages {
+		s.Nil(spool.append(&spooledJob{QueueName: "queueSpool", Message: message, Timeout: 1000}))
+	}
+}
+
+// collect returns a delivery function recording messages, failing with err
+// once limit messages were delivered
+func collect(messages *[]string, limit int, err error) func(job *spooledJob) error {
+	return func(job *spooledJob) error {
+		if len(*messages) >= limit {
+			return err
+		}
+		*messages = append(*messages, job.Message)
+		return nil
+	}
+}
+
+func (s *SpoolSuite) TestReplayInOrder() {
+	spool := s.openSpool(SpoolOptions{})
+	defer spool.Close()
+	s.appendJobs(spool, "job1", "job2", "job3")
+	s.Equal(3, spool.Depth())
+
+	var messages []string
+	replayed, err := spool.replay(collect(&messages, 3, nil))
+	s.Nil(err)
+	s.Equal(3, replayed)
+	s.Equal([]string{"job1", "job2", "job3"}, messages)
+	s.Equal(SpoolStats{Spooled: 3, Replayed: 3}, spool.Stats())
+
+	// the log is emptied once every job was delivered
+	info, err := os.Stat(filepath.Join(s.dir, "spool"))
+	s.Nil(err)
+	s.Equal(int64(0), info.Size())
+}
+
+func (s *SpoolSuite) TestReplayStopsOnFailure() {
+	spool := s.openSpool(SpoolOptions{})
+	s.appendJobs(spool, "job1", "job2", "job3")
+
+	var messages []string
+	replayed, err := spool.replay(collect(&messages, 1, errors.New("Nodes unavailable")))
+	s.NotNil(err)
+	s.Equal(1, replayed)
+	s.Equal(2, spool.Depth())
+	s.Nil(spool.Close())
+
+	// delivered jobs are not replayed after reopening the spool
+	spool = s.openSpool(SpoolOptions{})
+	defer spool.Close()
+	s.Equal(2, spool.Depth())
+	s.appendJobs(spool, "job4")
+
+	messages = nil
+	replayed, err = spool.replay(collect(&messages, 3, nil))
+	s.Nil(err)
+	s.Equal(3, replayed)
+	s.Equal([]string{"job2", "job3", "job4"}, messages)
+}
+
+func (s *SpoolSuite) TestRejectedJobsAreDropped() {
+	spool := s.openSpool(SpoolOptions{})
+	defer spool.Close()
+	s.appendJobs(spool, "job1", "job2")
+
+	var messages []string
+	replayed, err := spool.replay(collect(&messages, 1, redis.Error("ERR bad option")))
+	s.Nil(err)
+	s.Equal(1, replayed)
+	s.Equal(0, spool.Depth())
+	s.Equal(int64(1), spool.Stats().Dropped)
+}
+
+func (s *SpoolSuite) TestLimits() {
+	spool := s.openSpool(SpoolOptions{MaxJobs: 2, Sync: SpoolSyncNever})
+	s.appendJobs(spool, "job1", "job2")
+	s.Equal(ErrSpoolFull, spool.append(&spooledJob{QueueName: "queueSpool", Message: "job3"}))
+	s.Nil(spool.Close())
+
+	spool = s.openSpool(SpoolOptions{MaxBytes: 200, Sync: SpoolSyncInterval})
+	defer spool.Close()
+	s.True(spool.Stats().Bytes < 200)
+	s.Equal(ErrSpoolFull, spool.append(&spooledJob{QueueName: "queueSpool", Message: "job3"}))
+}
+
+func (s *SpoolSuite) TestIncompleteRecord() {
+	spool := s.openSpool(SpoolOptions{})
+	s.appendJobs(spool, "job1")
+	bytes := spool.Stats().Bytes
+	s.Nil(spool.Close())
+
+	// a crash left half a record at the end of the log
+	f, err := os.OpenFile(filepath.Join(s.dir, "spool"), os.O_APPEND|os.O_WRONLY, 0644)
+	s.Nil(err)
+	_, err = f.WriteString(`{"queue":"queueSp`)
+	s.Nil(err)
+	f.Close()
+
+	spool = s.openSpool(SpoolOptions{})
+	defer spool.Close()
+	s.Equal(1, spool.Depth())
+	s.Equal(bytes, spool.Stats().Bytes)
+	s.appendJobs(spool, "job2")
+
+	var messages []string
+	_, err = spool.replay(collect(&messages, 2, nil))
+	s.Nil(err)
+	s.Equal([]string{"job1", "job2"}, messages)
+}
+
+func (s *SpoolSuite) TestPushWhileUnreachable() {
+	server := disquetest.NewServer()
+	addr := server.Addr
+	d := NewDisque([]string{addr}, 1000)
+	s.Nil(d.Initialize())
+	defer d.Close()
+	spool := s.openSpool(SpoolOptions{})
+	defer spool.Close()
+	d.SetSpool(spool)
+
+	server.Close()
+	_, err := d.Push("queueSpool", "job1", time.Second)
+	s.Equal(ErrSpooled, err)
+	_, err = d.PushWithOptions("queueSpool", "job2", time.Second, map[string]string{"TTL": "60"})
+	s.Equal(ErrSpooled, err)
+	s.Equal(2, spool.Depth())
+
+	server, err = disquetest.NewServerOn(addr)
+	s.Nil(err)
+	defer server.Close()
+
+	// the job being pushed is spooled behind the others, and all are delivered in order
+	_, err = d.Push("queueSpool", "job3", time.Second)
+	s.Equal(ErrSpooled, err)
+	replayed, err := d.ReplaySpool()
+	s.Nil(err)
+	s.Equal(3, replayed)
+	s.Equal(0, spool.Depth())
+
+	jobs, err := d.FetchMultiple("queueSpool", 3, time.Second)
+	s.Nil(err)
+	s.Equal(3, len(jobs))
+	for i, job := range jobs {
+		s.Equal([]string{"job1", "job2", "job3"}[i], job.Message)
+	}
+}
+
+func (s *SpoolSuite) TestAppendWhileReplaying() {
+	spool := s.openSpool(SpoolOptions{})
+	defer spool.Close()
+	s.appendJobs(spool, "job1", "job2")
+
+	delivering := make(chan struct{})
+	resume := make(chan struct{})
+	var messages []string
+	replayed := make(chan int)
+	go func() {
+		count, err := spool.replay(func(job *spooledJob) error {
+			if job.Message == "job1" {
+				close(delivering)
+				<-resume
+			}
+			messages = append(messages, job.Message)
+			return nil
+		})
+		s.Nil(err)
+		replayed <- count
+	}()
+
+	// jobs are spooled while a delivery is in flight, and a second replay returns at once
+	<-delivering
+	s.appendJobs(spool, "job3")
+	s.Equal(3, spool.Depth())
+	count, err := spool.replay(collect(&[]string{}, 3, nil))
+	s.Nil(err)
+	s.Equal(0, count)
+	close(resume)
+
+	s.Equal(3, <-replayed)
+	s.Equal([]string{"job1", "job2", "job3"}, messages)
+	s.Equal(0, spool.Depth())
+}
+
+func (s *SpoolSuite) TestIntervalSyncFlushesTrailingWrites() {
+	spool := s.openSpool(SpoolOptions{Sync: SpoolSyncInterval, SyncInterval: 20 * time.Millisecond})
+	defer spool.Close()
+	s.appendJobs(spool, "job1", "job2")
+
+	dirty := func() bool {
+		spool.mu.Lock()
+		defer spool.mu.Unlock()
+		return spool.dirty
+	}
+	s.True(dirty())
+	for i := 0; i < 100 && dirty(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.False(dirty())
+}
+
+func (s *SpoolSuite) TestReplaySpool() {
+	server := disquetest.NewServer()
+	addr := server.Addr
+	d := NewDisque([]string{addr}, 1000)
+	s.Nil(d.Initialize())
+	defer d.Close()
+
+	replayed, err := d.ReplaySpool()
+	s.Nil(err)
+	s.Equal(0, replayed)
+
+	spool := s.openSpool(SpoolOptions{})
+	defer spool.Close()
+	d.SetSpool(spool)
+
+	server.Close()
+	_, err = d.Push("queueSpool", "job1", time.Second)
+	s.Equal(ErrSpooled, err)
+	_, err = d.ReplaySpool()
+	s.NotNil(err)
+	s.Equal(1, spool.Depth())
+
+	server, err = disquetest.NewServerOn(addr)
+	s.Nil(err)
+	defer server.Close()
+
+	replayed, err = d.ReplaySpool()
+	s.Nil(err)
+	s.Equal(1, replayed)
+	queueLength, err := d.QueueLength("queueSpool")
+	s.Nil(err)
+	s.Equal(1, queueLength)
+}
+
+func (s *SpoolSuite) TestLogIsCompacted() {
+	spool := s.openSpool(SpoolOptions{})
+	s.appendJobs(spool, "job1", "job2", "job3", "job4")
+	recordSize := spool.Stats().Bytes / 4
+
+	var messages []string
+	_, err := spool.replay(collect(&messages, 3, errors.New("Nodes unavailable")))
+	s.NotNil(err)
+
+	// delivered jobs take up more than half of the log
+	info, err := os.Stat(filepath.Join(s.dir, "spool"))
+	s.Nil(err)
+	s.Equal(recordSize, info.Size())
+	s.Nil(spool.Close())
+
+	spool = s.openSpool(SpoolOptions{})
+	defer spool.Close()
+	s.Equal(1, spool.Depth())
+	messages = nil
+	_, err = spool.replay(collect(&messages, 1, nil))
+	s.Nil(err)
+	s.Equal([]string{"job4"}, messages)
+}
+
+func (s *SpoolSuite) TestLogStaysWithinMaxBytes() {
+	spool := s.openSpool(SpoolOptions{})
+	s.appendJobs(spool, "job1")
+	recordSize := spool.Stats().Bytes
+	s.Nil(spool.Close())
+	os.Remove(filepath.Join(s.dir, "spool"))
+	os.Remove(filepath.Join(s.dir, "spool.pos"))
+
+	spool = s.openSpool(SpoolOptions{MaxBytes: 3 * recordSize})
+	defer spool.Close()
+	s.appendJobs(spool, "job1", "job2", "job3")
+	var messages []string
+	_, err := spool.replay(collect(&messages, 1, errors.New("Nodes unavailable")))
+	s.NotNil(err)
+
+	s.appendJobs(spool, "job4")
+	info, err := os.Stat(filepath.Join(s.dir, "spool"))
+	s.Nil(err)
+	s.Equal(3*recordSize, info.Size())
+
+	messages = nil
+	_, err = spool.replay(collect(&messages, 3, nil))
+	s.Nil(err)
+	s.Equal([]string{"job2", "job3", "job4"}, messages)
+}
+
+func (s *SpoolSuite) TestRemainingOptions() {
+	spooledAt := time.Now()
+	job := &spooledJob{
+		Options:   map[string]string{"DELAY": "100", "ttl": "200", "RETRY": "10", "ASYNC": "true"},
+		SpooledAt: spooledAt,
+	}
+	options, expired := job.remainingOptions(spooledAt.Add(30 * time.Second))
+	s.False(expired)
+	s.Equal(map[string]string{"DELAY": "70", "ttl": "170", "RETRY": "10", "ASYNC": "true"}, options)
+
+	// the job is due once its delay elapsed
+	options, expired = job.remainingOptions(spooledAt.Add(150 * time.Second))
+	s.False(expired)
+	s.Equal(map[string]string{"ttl": "50", "RETRY": "10", "ASYNC": "true"}, options)
+
+	_, expired = job.remainingOptions(spooledAt.Add(200 * time.Second))
+	s.True(expired)
+}
+
+func (s *SpoolSuite) TestReplayCountsTimeSpooled() {
+	server := disquetest.NewServer()
+	defer server.Close()
+	d := NewDisque([]string{server.Addr}, 1000)
+	s.Nil(d.Initialize())
+	defer d.Close()
+	spool := s.openSpool(SpoolOptions{})
+	defer spool.Close()
+	d.SetSpool(spool)
+
+	spooledAt := time.Now().Add(-30 * time.Second)
+	s.Nil(spool.append(&spooledJob{QueueName: "queueSpool", Message: "expired", Timeout: 1000, Options: map[string]string{"TTL": "10"}, SpooledAt: spooledAt}))
+	s.Nil(spool.append(&spooledJob{QueueName: "queueSpool", Message: "job1", Timeout: 1000, Options: map[string]string{"DELAY": "100", "TTL": "200"}, SpooledAt: spooledAt}))
+
+	replayed, err := d.ReplaySpool()
+	s.Nil(err)
+	s.Equal(1, replayed)
+	s.Equal(int64(1), spool.Stats().Dropped)
+
+	jobIDs, err := d.ScanAll(ScanOptions{Queue: "queueSpool"})
+	s.Nil(err)
+	s.Equal(1, len(jobIDs))
+	details, err := d.GetJobDetails(jobIDs[0])
+	s.Nil(err)
+	s.Equal(70*time.Second, details.Delay)
+	s.Equal(170*time.Second, details.TTL)
+}
+
+func (s *SpoolSuite) TestBackgroundReplay() {
+	server := disquetest.NewServer()
+	addr := server.Addr
+	d := NewDisque([]string{addr}, 1000)
+	s.Nil(d.Initialize())
+	defer d.Close()
+	spool := s.openSpool(SpoolOptions{ReplayInterval: 10 * time.Millisecond})
+	defer spool.Close()
+	d.SetSpool(spool)
+
+	server.Close()
+	_, err := d.Push("queueSpool", "job1", time.Second)
+	s.Equal(ErrSpooled, err)
+
+	server, err = disquetest.NewServerOn(addr)
+	s.Nil(err)
+	defer server.Close()
+
+	// the job is delivered without any further push
+	for i := 0; i < 500 && spool.Depth() > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Equal(0, spool.Depth())
+	queueLength, err := d.QueueLength("queueSpool")
+	s.Nil(err)
+	s.Equal(1, queueLength)
+}
+
+func (s *SpoolSuite) TestInternalPushesAreNotSpooled() {
+	server := disquetest.NewServer()
+	d := NewDisque([]string{server.Addr}, 1000)
+	s.Nil(d.Initialize())
+	defer d.Close()
+	spool := s.openSpool(SpoolOptions{})
+	defer spool.Close()
+	d.SetSpool(spool)
+
+	server.Close()
+	_, err := d.PushAt("queueSpool", "job1", time.Now().Add(time.Hour), time.Second, nil)
+	s.NotNil(err)
+	s.NotEqual(ErrSpooled, err)
+	s.Equal(0, spool.Depth())
+}
@@ -0,0 +1,140 @@
+package disque
+
+import (
+	"errors"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// clusterView is the result of exploring the cluster through CLUSTER NODES
+type clusterView struct {
+	// nodes maps node prefixes to node addresses
+	nodes map[string]string
+	// entry is the address of the seed that answered, and entryPrefix its node prefix
+	entry       string
+	entryPrefix string
+}
+
+// topology holds the view of the cluster shared by one or more connections,
+// along with the nodes that recently failed. Refreshes are coalesced: callers
+// that ask for a refresh while one is in progress wait for its result instead
+// of exploring the cluster themselves.
+type topology struct {
+	discover func(servers []string) (*clusterView, error)
+
+	mu         sync.Mutex
+	generation int64
+	view       *clusterView
+	err        error
+	refreshing chan struct{}
+	failed     map[string]time.Time
+}
+
+func newTopology() *topology {
+	return &topology{
+		discover: discoverCluster,
+		view:     &clusterView{nodes: map[string]string{}},
+		failed:   make(map[string]time.Time),
+	}
+}
+
+// refresh explores the cluster through the given seed servers, unless a
+// successful refresh already completed after the generation seen by the
+// caller. It returns the view of the cluster along with its generation.
+func (t *topology) refresh(servers []string, seen int64) (view *clusterView, generation int64, err error) {
+	t.mu.Lock()
+	if t.generation > seen && t.err == nil {
+		// another connection refreshed the topology since the caller last looked
+		defer t.mu.Unlock()
+		return t.view, t.generation, nil
+	}
+	if done := t.refreshing; done != nil {
+		t.mu.Unlock()
+		<-done
+
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		return t.view, t.generation, t.err
+	}
+	done := make(chan struct{})
+	t.refreshing = done
+	t.mu.Unlock()
+
+	view, err = t.discover(servers)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if view == nil {
+		view = &clusterView{nodes: map[string]string{}}
+	}
+	t.view = view
+	t.err = err
+	t.generation++
+	t.failed = make(map[string]time.Time)
+	t.refreshing = nil
+	close(done)
+	return t.view, t.generation, t.err
+}
+
+// markFailed records that a node could not be reached. The node is
+// considered unhealthy until the next refresh.
+func (t *topology) markFailed(host string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.failed[host] = time.Now()
+}
+
+// healthy returns false if the node failed since the last refresh
+func (t *topology) healthy(host string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, failed := t.failed[host]
+	return !failed
+}
+
+// discoverCluster queries the seed servers in turn for CLUSTER NODES,
+// returning the view of the first one that answers.
+func discoverCluster(servers []string) (view *clusterView, err error) {
+	view = &clusterView{nodes: map[string]string{}}
+
+	for _, host := range servers {
+		var scout redis.Conn
+		if scout, err = redis.Dial("tcp", host); err == nil {
+			defer scout.Close()
+
+			if lines, err := redis.String(scout.Do("CLUSTER", "NODES")); err == nil {
+				for _, line := range strings.Split(lines, "\n") {
+					if strings.TrimSpace(line) != "" {
+						fields := strings.Fields(line)
+
+						id := fields[0]
+						clusterHost := fields[1]
+						flag := fields[2]
+						prefix := id[0:8]
+
+						if flag == "myself" {
+							// keep track of the node that answered
+							view.entry = host
+							view.entryPrefix = prefix
+						}
+
+						view.nodes[prefix] = clusterHost
+					}
+				}
+				return view, nil
+			}
+			log.Printf("Error returned when querying for cluster nodes on host: %s, exception: %s", host, err)
+		} else {
+			log.Printf("Error while exploring connection to host: %s, exception: %s", host, err)
+		}
+	}
+
+	if len(view.nodes) == 0 {
+		err = errors.New("Nodes unavailable")
+	}
+	return view, err
+}
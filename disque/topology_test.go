@@ -0,0 +1,162 @@
+package disque
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/youtube/vitess/go/sync2"
+	"golang.org/x/net/context"
+)
+
+type TopologySuite struct {
+	suite.Suite
+}
+
+func TestTopologySuite(t *testing.T) {
+	suite.Run(t, new(TopologySuite))
+}
+
+func (s *TopologySuite) SetupTest() {
+}
+
+func (s *TopologySuite) SetupSuite() {
+}
+
+// countingDiscover returns a discover function that counts its invocations
+// and takes the given time to complete
+func countingDiscover(calls *sync2.AtomicInt64, delay time.Duration, err error) func([]string) (*clusterView, error) {
+	return func(servers []string) (*clusterView, error) {
+		calls.Add(1)
+		time.Sleep(delay)
+		view := &clusterView{
+			nodes:       map[string]string{"dcb833cf": "127.0.0.1:7711"},
+			entry:       "127.0.0.1:7711",
+			entryPrefix: "dcb833cf",
+		}
+		return view, err
+	}
+}
+
+func (s *TopologySuite) TestConcurrentRefreshesAreCoalesced() {
+	var calls sync2.AtomicInt64
+	t := newTopology()
+	t.discover = countingDiscover(&calls, 50*time.Millisecond, nil)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			view, generation, err := t.refresh(nil, 0)
+			s.Nil(err)
+			s.EqualValues(1, generation)
+			s.Equal("127.0.0.1:7711", view.entry)
+		}()
+	}
+	wg.Wait()
+
+	s.EqualValues(1, calls.Get())
+}
+
+func (s *TopologySuite) TestRefreshSkippedWhenNewerGenerationExists() {
+	var calls sync2.AtomicInt64
+	t := newTopology()
+	t.discover = countingDiscover(&calls, 0, nil)
+
+	_, generation, err := t.refresh(nil, 0)
+	s.Nil(err)
+
+	// a connection that has not seen the latest generation reuses it
+	_, _, err = t.refresh(nil, 0)
+	s.Nil(err)
+	s.EqualValues(1, calls.Get())
+
+	// a connection that has seen the latest generation triggers a new refresh
+	_, generation, err = t.refresh(nil, generation)
+	s.Nil(err)
+	s.EqualValues(2, generation)
+	s.EqualValues(2, calls.Get())
+}
+
+func (s *TopologySuite) TestFailedRefreshIsNotReused() {
+	var calls sync2.AtomicInt64
+	t := newTopology()
+	t.discover = countingDiscover(&calls, 0, errors.New("Nodes unavailable"))
+
+	_, _, err := t.refresh(nil, 0)
+	s.NotNil(err)
+
+	_, _, err = t.refresh(nil, 0)
+	s.NotNil(err)
+	s.EqualValues(2, calls.Get())
+}
+
+func (s *TopologySuite) TestNodeHealth() {
+	var calls sync2.AtomicInt64
+	t := newTopology()
+	t.discover = countingDiscover(&calls, 0, nil)
+
+	s.True(t.healthy("127.0.0.1:7722"))
+	t.markFailed("127.0.0.1:7722")
+	s.False(t.healthy("127.0.0.1:7722"))
+
+	// failures are forgotten once the topology is refreshed
+	t.refresh(nil, 0)
+	s.True(t.healthy("127.0.0.1:7722"))
+}
+
+func (s *TopologySuite) TestPickClientSkipsFailedNode() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	d.nodes["host2"] = "127.0.0.1:7722"
+	d.stats["host2"] = 600
+	d.count = 1000
+	d.topology.markFailed("127.0.0.1:7722")
+
+	d.pickClient()
+
+	s.NotEqual("host2", d.prefix)
+	s.Nil(d.Ping())
+}
+
+func (s *TopologySuite) TestPickClientKeepsConnectionWhenNodeUnreachable() {
+	hosts := []string{"127.0.0.1:7711"}
+	d := NewDisque(hosts, 1000)
+	d.Initialize()
+	prefix := d.prefix
+	d.nodes["host2"] = "127.0.0.1:7722"
+	d.stats["host2"] = 600
+	d.count = 1000
+
+	d.pickClient()
+
+	s.Equal(prefix, d.prefix)
+	s.Nil(d.Ping())
+	s.False(d.topology.healthy("127.0.0.1:7722"))
+}
+
+func (s *TopologySuite) TestPoolSharesTopology() {
+	hosts := []string{"127.0.0.1:7711"}
+	p := NewPool(hosts, 1000, 5, 5, time.Hour)
+
+	conns := make([]*Disque, 0)
+	for i := 0; i < 5; i++ {
+		c, err := p.Get(context.Background())
+		s.Nil(err)
+		s.True(c.topology == p.topology)
+		s.Equal(1, len(c.nodes))
+		conns = append(conns, c)
+	}
+
+	// the cluster was explored once for all connections
+	s.EqualValues(1, p.topology.generation)
+
+	for _, c := range conns {
+		p.Put(c)
+	}
+	p.Close()
+}
@@ -0,0 +1,46 @@
+package disque
+
+import (
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Bounds of the time a worker loop waits after failing
+const (
+	workerMinBackoff = 100 * time.Millisecond
+	workerMaxBackoff = 10 * time.Second
+)
+
+// runWorker calls serve until ctx is done. After a failure, which is logged
+// along with what the worker was doing, it waits before calling serve again,
+// twice as long after every consecutive failure, so that a worker does not
+// spin while the cluster is unreachable.
+func runWorker(ctx context.Context, doing string, serve func() error) {
+	var backoff time.Duration
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+		}
+		err := serve()
+		if err == nil {
+			backoff = 0
+			continue
+		}
+		log.Printf("Error while %s, exception: %s", doing, err)
+
+		if backoff *= 2; backoff < workerMinBackoff {
+			backoff = workerMinBackoff
+		} else if backoff > workerMaxBackoff {
+			backoff = workerMaxBackoff
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package disque
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"golang.org/x/net/context"
+)
+
+type WorkerSuite struct {
+	suite.Suite
+}
+
+func TestWorkerSuite(t *testing.T) {
+	suite.Run(t, new(WorkerSuite))
+}
+
+func (s *WorkerSuite) SetupTest() {
+}
+
+func (s *WorkerSuite) SetupSuite() {
+}
+
+func (s *WorkerSuite) TestBackoffOnFailure() {
+	ctx, cancel := context.WithTimeout(context.Background(), 350*time.Millisecond)
+	defer cancel()
+	calls := 0
+	runWorker(ctx, "testing", func() error {
+		calls++
+		return errors.New("Nodes unavailable")
+	})
+	// waiting 100ms, then 200ms
+	s.Equal(3, calls)
+}
+
+func (s *WorkerSuite) TestBackoffResetOnSuccess() {
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	start := time.Now()
+	runWorker(ctx, "testing", func() error {
+		if calls++; calls == 10 {
+			cancel()
+		}
+		if calls%2 == 0 {
+			return nil
+		}
+		return errors.New("Nodes unavailable")
+	})
+	s.Equal(10, calls)
+	// every failure follows a success, so the shortest backoff applies
+	s.True(time.Since(start) < 900*time.Millisecond)
+}
@@ -0,0 +1,317 @@
+package disque
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// longest time a single GETJOB blocks the connection of a workflow worker
+const workflowPollInterval = 100 * time.Millisecond
+
+// StepHandler processes the payload of a workflow step, returning the payload
+// passed on to the following steps
+type StepHandler func(ctx context.Context, job *WorkflowJob) (output string, err error)
+
+// WorkflowJob is a job of a workflow, as handed to a StepHandler
+type WorkflowJob struct {
+	// WorkflowID identifies the run of the workflow, shared by all its jobs
+	WorkflowID string
+	Step       string
+	Payload    string
+	// Error and FailedStep are the error of the step that failed and its
+	// name, only set on jobs routed to a failure step
+	Error      string
+	FailedStep string
+	// Job is the job fetched from the queue of the step
+	Job *Job
+}
+
+// WorkflowStep is a step of a workflow, backed by a queue
+type WorkflowStep struct {
+	Name string
+	// Queue is the queue of the step, "<workflow>:<step>" if unset
+	Queue string
+	// Handler processes the jobs of the step. A step without handler only
+	// collects jobs, for instance failed jobs awaiting inspection.
+	Handler StepHandler
+	// Next are the steps receiving the output of the handler on success
+	Next []string
+	// OnFailure is the step receiving the payload once the handler failed
+	// MaxAttempts times. Without a failure step, failed jobs are retried
+	// until their TTL elapses.
+	OnFailure string
+	// MaxAttempts is the number of deliveries of a job before it is routed
+	// to the failure step, 1 if unset
+	MaxAttempts int64
+	// Options passed to ADDJOB when adding jobs to the queue of the step
+	Options map[string]string
+	// Timeout for adding jobs to the queue of the step, one second if unset
+	Timeout time.Duration
+}
+
+// Workflow is a directed acyclic graph of steps. Each run starts at the
+// first step; on success the output of a step is pushed onto the queue of
+// every following step, on failure the payload is routed to the failure
+// step. A step following several others receives one job from each of them.
+type Workflow struct {
+	Name  string
+	steps map[string]*WorkflowStep
+	entry *WorkflowStep
+}
+
+// NewWorkflow creates a workflow starting at the first of the given steps,
+// checking that the steps form a directed acyclic graph
+func NewWorkflow(name string, steps ...WorkflowStep) (w *Workflow, err error) {
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("Workflow %s has no steps", name)
+	}
+	w = &Workflow{Name: name, steps: make(map[string]*WorkflowStep)}
+	for i := range steps {
+		step := steps[i]
+		if _, ok := w.steps[step.Name]; ok || step.Name == "" {
+			return nil, fmt.Errorf("Invalid or duplicate step name in workflow %s: %q", name, step.Name)
+		}
+		if step.Queue == "" {
+			step.Queue = name + ":" + step.Name
+		}
+		if step.MaxAttempts <= 0 {
+			step.MaxAttempts = 1
+		}
+		if step.Timeout <= 0 {
+			step.Timeout = time.Second
+		}
+		w.steps[step.Name] = &step
+		if i == 0 {
+			w.entry = &step
+		}
+	}
+	for _, step := range w.steps {
+		for _, next := range step.successors() {
+			if _, ok := w.steps[next]; !ok {
+				return nil, fmt.Errorf("Step %s of workflow %s refers to unknown step %s", step.Name, name, next)
+			}
+		}
+	}
+
+	// depth-first search for a step reachable from itself
+	visiting := make(map[string]bool)
+	visited := make(map[string]bool)
+	var visit func(name string) error
+	visit = func(stepName string) error {
+		if visiting[stepName] {
+			return fmt.Errorf("Workflow %s has a cycle through step %s", name, stepName)
+		}
+		if visited[stepName] {
+			return nil
+		}
+		visiting[stepName] = true
+		for _, next := range w.steps[stepName].successors() {
+			if err := visit(next); err != nil {
+				return err
+			}
+		}
+		visiting[stepName] = false
+		visited[stepName] = true
+		return nil
+	}
+	for stepName := range w.steps {
+		if err = visit(stepName); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// Step returns the step of the given name, or nil if there is none
+func (w *Workflow) Step(name string) *WorkflowStep {
+	return w.steps[name]
+}
+
+// successors returns the steps a job may be pushed to after this one
+func (s *WorkflowStep) successors() []string {
+	if s.OnFailure == "" {
+		return s.Next
+	}
+	return append(append([]string{}, s.Next...), s.OnFailure)
+}
+
+// StartWorkflow starts a run of the workflow by pushing the payload onto the
+// queue of its first step, returning the ID shared by all jobs of the run
+func (d *Disque) StartWorkflow(w *Workflow, payload string) (workflowID string, err error) {
+	workflowID = randomID()
+	envelope := &Envelope{WorkflowID: workflowID, Step: w.entry.Name, Payload: payload}
+	pipeline := d.Pipeline()
+	if err = pushStep(pipeline, w.entry, envelope); err != nil {
+		return "", err
+	}
+	var results []*PipelineResult
+	if results, err = pipeline.Execute(); err == nil {
+		err = results[0].Err
+	}
+	if err != nil {
+		workflowID = ""
+	}
+	return
+}
+
+// WorkflowWorker fetches the jobs of a step of a workflow and processes them
+// through its handler. On success the output of the handler is pushed onto
+// the queue of every following step before the job is acknowledged, so a job
+// may be processed twice if the worker fails in between, but never lost.
+// A job that is not part of a run starts a new run at the first step, and is
+// sent to the failure step, or dropped, at any other step.
+type WorkflowWorker struct {
+	d        *Disque
+	workflow *Workflow
+	step     *WorkflowStep
+
+	// Count is the number of jobs fetched at once, 1 if unset
+	Count int
+}
+
+// NewWorkflowWorker creates a worker processing the jobs of the given step
+func NewWorkflowWorker(d *Disque, w *Workflow, stepName string) (worker *WorkflowWorker, err error) {
+	step := w.Step(stepName)
+	if step == nil {
+		return nil, fmt.Errorf("Unknown step %s of workflow %s", stepName, w.Name)
+	}
+	if step.Handler == nil {
+		return nil, fmt.Errorf("Step %s of workflow %s has no handler", stepName, w.Name)
+	}
+	return &WorkflowWorker{d: d, workflow: w, step: step}, nil
+}
+
+// Run processes jobs until ctx is done, backing off while jobs cannot be fetched
+func (w *WorkflowWorker) Run(ctx context.Context) {
+	runWorker(ctx, "processing jobs from queue "+w.step.Queue, func() (err error) {
+		_, err = w.serve(ctx, workflowPollInterval)
+		return
+	})
+}
+
+// serve fetches pending jobs, waiting up to timeout, and processes them,
+// returning the number of jobs that were processed
+func (w *WorkflowWorker) serve(ctx context.Context, timeout time.Duration) (processed int, err error) {
+	count := w.Count
+	if count <= 0 {
+		count = 1
+	}
+	var jobs []*Job
+	if jobs, err = w.d.FetchMultiple(w.step.Queue, count, timeout); err != nil {
+		return
+	}
+	for _, job := range jobs {
+		if err = w.process(ctx, job); err != nil {
+			return
+		}
+		processed++
+	}
+	return
+}
+
+// process runs the handler on a job and passes its outcome on to the
+// following steps, or to the failure step
+func (w *WorkflowWorker) process(ctx context.Context, job *Job) (err error) {
+	envelope, ok := parseEnvelope(job.Message, EnvelopeWorkflow)
+	if !ok || envelope.WorkflowID == "" {
+		if w.step != w.workflow.entry {
+			return w.reject(job)
+		}
+		// a job pushed onto the first step without StartWorkflow starts a new run
+		envelope = &Envelope{WorkflowID: randomID(), Payload: job.Message}
+	}
+	workflowJob := &WorkflowJob{
+		WorkflowID: envelope.WorkflowID,
+		Step:       w.step.Name,
+		Payload:    envelope.Payload,
+		Error:      envelope.Error,
+		FailedStep: envelope.FailedStep,
+		Job:        job,
+	}
+
+	pipeline := w.d.Pipeline()
+	output, handlerErr := w.step.Handler(ctx, workflowJob)
+	if handlerErr == nil {
+		for _, next := range w.step.Next {
+			step := w.workflow.steps[next]
+			if err = pushStep(pipeline, step, &Envelope{WorkflowID: envelope.WorkflowID, Step: next, Payload: output}); err != nil {
+				return
+			}
+		}
+	} else {
+		log.Printf("Error while processing job %s of workflow %s at step %s, exception: %s", job.JobID, envelope.WorkflowID, w.step.Name, handlerErr)
+		attempts := job.Nacks + job.AdditionalDeliveries + 1
+		if w.step.OnFailure == "" || attempts < w.step.MaxAttempts {
+			return w.d.Nack(job.JobID)
+		}
+		step := w.workflow.steps[w.step.OnFailure]
+		failure := &Envelope{
+			WorkflowID: envelope.WorkflowID,
+			Step:       step.Name,
+			Payload:    envelope.Payload,
+			Error:      handlerErr.Error(),
+			FailedStep: w.step.Name,
+		}
+		if err = pushStep(pipeline, step, failure); err != nil {
+			return
+		}
+	}
+	return w.forward(pipeline, job)
+}
+
+// reject sends a job that is not part of a run of the workflow to the
+// failure step, as a new run so that the handler of the failure step takes
+// it, or drops it if the step has no failure step
+func (w *WorkflowWorker) reject(job *Job) (err error) {
+	log.Printf("Rejecting job %s on queue %s, which is not a job of workflow %s", job.JobID, w.step.Queue, w.workflow.Name)
+	pipeline := w.d.Pipeline()
+	if w.step.OnFailure != "" {
+		step := w.workflow.steps[w.step.OnFailure]
+		failure := &Envelope{
+			WorkflowID: randomID(),
+			Step:       step.Name,
+			Payload:    job.Message,
+			Error:      fmt.Sprintf("Not a job of workflow %s", w.workflow.Name),
+			FailedStep: w.step.Name,
+		}
+		if err = pushStep(pipeline, step, failure); err != nil {
+			return
+		}
+	}
+	return w.forward(pipeline, job)
+}
+
+// forward executes the pushes queued in the pipeline, then acknowledges the job
+func (w *WorkflowWorker) forward(pipeline *Pipeline, job *Job) (err error) {
+	if pipeline.Len() > 0 {
+		var results []*PipelineResult
+		if results, err = pipeline.Execute(); err == nil {
+			for _, result := range results {
+				if result.Err != nil {
+					err = result.Err
+					break
+				}
+			}
+		}
+		if err != nil {
+			// the job is processed again, possibly pushing some jobs twice
+			w.d.Nack(job.JobID)
+			return
+		}
+	}
+	return w.d.Ack(job.JobID)
+}
+
+// pushStep queues the push of a job onto the queue of a step
+func pushStep(pipeline *Pipeline, step *WorkflowStep, envelope *Envelope) (err error) {
+	envelope.Kind = EnvelopeWorkflow
+	var body []byte
+	if body, err = json.Marshal(envelope); err == nil {
+		pipeline.PushWithOptions(step.Queue, string(body), step.Timeout, step.Options)
+	}
+	return
+}
@@ -0,0 +1,318 @@
+package disque
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disquetest"
+	"golang.org/x/net/context"
+)
+
+type WorkflowSuite struct {
+	suite.Suite
+	server *disquetest.Server
+	d      *Disque
+}
+
+func TestWorkflowSuite(t *testing.T) {
+	suite.Run(t, new(WorkflowSuite))
+}
+
+func (s *WorkflowSuite) SetupTest() {
+	s.server = disquetest.NewServer()
+	s.d = NewDisque([]string{s.server.Addr}, 1000)
+	s.Nil(s.d.Initialize())
+}
+
+func (s *WorkflowSuite) TearDownTest() {
+	s.d.Close()
+	s.server.Close()
+}
+
+func (s *WorkflowSuite) SetupSuite() {
+}
+
+// serve processes the pending jobs of a step, returning the number of jobs processed
+func (s *WorkflowSuite) serve(w *Workflow, stepName string) int {
+	worker, err := NewWorkflowWorker(s.d, w, stepName)
+	s.Nil(err)
+	processed, err := worker.serve(context.Background(), 10*time.Millisecond)
+	s.Nil(err)
+	return processed
+}
+
+// envelope fetches the next job of a queue and decodes its envelope
+func (s *WorkflowSuite) envelope(queueName string) (*Job, *Envelope) {
+	job, err := s.d.Fetch(queueName, 10*time.Millisecond)
+	s.Nil(err)
+	s.NotNil(job)
+	envelope, err := ParseEnvelope(job)
+	s.Nil(err)
+	return job, envelope
+}
+
+func (s *WorkflowSuite) queueLength(queueName string) int {
+	queueLength, err := s.d.QueueLength(queueName)
+	s.Nil(err)
+	return queueLength
+}
+
+func suffix(text string) StepHandler {
+	return func(ctx context.Context, job *WorkflowJob) (string, error) {
+		return job.Payload + text, nil
+	}
+}
+
+func (s *WorkflowSuite) TestChain() {
+	var notified []*WorkflowJob
+	w, err := NewWorkflow("media",
+		WorkflowStep{Name: "transcode", Handler: suffix(".mp4"), Next: []string{"thumbnail"}},
+		WorkflowStep{Name: "thumbnail", Handler: suffix("+thumb"), Next: []string{"notify"}},
+		WorkflowStep{Name: "notify", Options: map[string]string{"TTL": "600"}, Handler: func(ctx context.Context, job *WorkflowJob) (string, error) {
+			notified = append(notified, job)
+			return "", nil
+		}},
+	)
+	s.Nil(err)
+
+	workflowID, err := s.d.StartWorkflow(w, "video")
+	s.Nil(err)
+	s.NotEmpty(workflowID)
+	s.Equal(1, s.queueLength("media:transcode"))
+
+	s.Equal(1, s.serve(w, "transcode"))
+	s.Equal(0, s.queueLength("media:transcode"))
+	s.Equal(1, s.queueLength("media:thumbnail"))
+
+	s.Equal(1, s.serve(w, "thumbnail"))
+	// the options of the next step apply to the jobs pushed onto its queue
+	jobs, err := s.d.Peek("media:notify", 1)
+	s.Nil(err)
+	details, err := s.d.GetJobDetails(jobs[0].JobID)
+	s.Nil(err)
+	s.Equal(600*time.Second, details.TTL)
+
+	s.Equal(1, s.serve(w, "notify"))
+	s.Equal(1, len(notified))
+	s.Equal(workflowID, notified[0].WorkflowID)
+	s.Equal("notify", notified[0].Step)
+	s.Equal("video.mp4+thumb", notified[0].Payload)
+	s.Equal(0, s.queueLength("media:notify"))
+}
+
+func (s *WorkflowSuite) TestFanOut() {
+	w, err := NewWorkflow("fan",
+		WorkflowStep{Name: "split", Handler: suffix("!"), Next: []string{"left", "right"}},
+		WorkflowStep{Name: "left", Queue: "queueLeft"},
+		WorkflowStep{Name: "right", Queue: "queueRight"},
+	)
+	s.Nil(err)
+	workflowID, err := s.d.StartWorkflow(w, "asdf")
+	s.Nil(err)
+	s.Equal(1, s.serve(w, "split"))
+
+	_, left := s.envelope("queueLeft")
+	_, right := s.envelope("queueRight")
+	s.Equal("asdf!", left.Payload)
+	s.Equal("left", left.Step)
+	s.Equal(workflowID, left.WorkflowID)
+	s.Equal(workflowID, right.WorkflowID)
+}
+
+func (s *WorkflowSuite) TestFailureRouting() {
+	attempts := 0
+	w, err := NewWorkflow("failing",
+		WorkflowStep{
+			Name: "transcode",
+			Handler: func(ctx context.Context, job *WorkflowJob) (string, error) {
+				attempts++
+				return "", errors.New("corrupt input")
+			},
+			Next:        []string{"notify"},
+			OnFailure:   "failed",
+			MaxAttempts: 2,
+		},
+		WorkflowStep{Name: "notify"},
+		WorkflowStep{Name: "failed"},
+	)
+	s.Nil(err)
+	workflowID, err := s.d.StartWorkflow(w, "video")
+	s.Nil(err)
+
+	// the first failure puts the job back in the queue
+	s.Equal(1, s.serve(w, "transcode"))
+	s.Equal(1, s.queueLength("failing:transcode"))
+	s.Equal(0, s.queueLength("failing:failed"))
+
+	s.Equal(1, s.serve(w, "transcode"))
+	s.Equal(2, attempts)
+	s.Equal(0, s.queueLength("failing:transcode"))
+	s.Equal(0, s.queueLength("failing:notify"))
+
+	_, failure := s.envelope("failing:failed")
+	s.Equal(workflowID, failure.WorkflowID)
+	s.Equal("failed", failure.Step)
+	s.Equal("transcode", failure.FailedStep)
+	s.Equal("corrupt input", failure.Error)
+	s.Equal("video", failure.Payload)
+}
+
+func (s *WorkflowSuite) TestFailureWithoutFailureStep() {
+	w, err := NewWorkflow("retrying", WorkflowStep{
+		Name: "transcode",
+		Handler: func(ctx context.Context, job *WorkflowJob) (string, error) {
+			return "", errors.New("unavailable")
+		},
+	})
+	s.Nil(err)
+	_, err = s.d.StartWorkflow(w, "video")
+	s.Nil(err)
+
+	s.Equal(1, s.serve(w, "transcode"))
+	s.Equal(1, s.serve(w, "transcode"))
+	s.Equal(1, s.queueLength("retrying:transcode"))
+}
+
+func (s *WorkflowSuite) TestFailedPushIsRetried() {
+	w, err := NewWorkflow("pushing",
+		WorkflowStep{Name: "transcode", Handler: suffix(".mp4"), Next: []string{"notify"}},
+		WorkflowStep{Name: "notify"},
+	)
+	s.Nil(err)
+	_, err = s.d.StartWorkflow(w, "video")
+	s.Nil(err)
+
+	s.server.FailNext("ADDJOB", "ERR rejected")
+	worker, err := NewWorkflowWorker(s.d, w, "transcode")
+	s.Nil(err)
+	_, err = worker.serve(context.Background(), 10*time.Millisecond)
+	s.NotNil(err)
+
+	// the job is not acknowledged until the next step has it
+	s.Equal(1, s.queueLength("pushing:transcode"))
+	s.Equal(0, s.queueLength("pushing:notify"))
+	s.Equal(1, s.serve(w, "transcode"))
+	s.Equal(1, s.queueLength("pushing:notify"))
+}
+
+func (s *WorkflowSuite) TestPlainJob() {
+	var received *WorkflowJob
+	w, err := NewWorkflow("plain", WorkflowStep{
+		Name: "transcode",
+		Handler: func(ctx context.Context, job *WorkflowJob) (string, error) {
+			received = job
+			return "", nil
+		},
+	})
+	s.Nil(err)
+
+	// jobs pushed without StartWorkflow start a new run
+	_, err = s.d.Push("plain:transcode", "video", time.Second)
+	s.Nil(err)
+	s.Equal(1, s.serve(w, "transcode"))
+	s.Equal("video", received.Payload)
+	s.NotEmpty(received.WorkflowID)
+}
+
+func (s *WorkflowSuite) TestPlainJobAtLaterStep() {
+	var failed []*WorkflowJob
+	handled := 0
+	count := func(ctx context.Context, job *WorkflowJob) (string, error) {
+		handled++
+		return "", nil
+	}
+	w, err := NewWorkflow("strict",
+		WorkflowStep{Name: "transcode", Handler: count, Next: []string{"notify", "archive"}},
+		WorkflowStep{Name: "notify", Handler: count, OnFailure: "failed"},
+		WorkflowStep{Name: "archive", Handler: count},
+		WorkflowStep{Name: "failed", Handler: func(ctx context.Context, job *WorkflowJob) (string, error) {
+			failed = append(failed, job)
+			return "", nil
+		}},
+	)
+	s.Nil(err)
+
+	// a plain job is routed to the failure step, whose handler takes it, rather than starting a run
+	_, err = s.d.Push("strict:notify", "video", time.Second)
+	s.Nil(err)
+	s.Equal(1, s.serve(w, "notify"))
+	s.Equal(0, handled)
+	s.Equal(0, s.queueLength("strict:notify"))
+	s.Equal(1, s.serve(w, "failed"))
+	s.Equal(1, len(failed))
+	s.NotEmpty(failed[0].WorkflowID)
+	s.Equal("video", failed[0].Payload)
+	s.Equal("notify", failed[0].FailedStep)
+	s.Equal("Not a job of workflow strict", failed[0].Error)
+	s.Equal(0, s.queueLength("strict:failed"))
+
+	// and dropped without a failure step
+	_, err = s.d.Push("strict:archive", "video", time.Second)
+	s.Nil(err)
+	s.Equal(1, s.serve(w, "archive"))
+	s.Equal(0, handled)
+	s.Equal(0, s.queueLength("strict:archive"))
+}
+
+func (s *WorkflowSuite) TestRun() {
+	done := make(chan string, 1)
+	w, err := NewWorkflow("running", WorkflowStep{
+		Name: "transcode",
+		Handler: func(ctx context.Context, job *WorkflowJob) (string, error) {
+			done <- job.Payload
+			return "", nil
+		},
+	})
+	s.Nil(err)
+	worker, err := NewWorkflowWorker(s.d, w, "transcode")
+	s.Nil(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		worker.Run(ctx)
+		close(stopped)
+	}()
+
+	d := NewDisque([]string{s.server.Addr}, 1000)
+	s.Nil(d.Initialize())
+	defer d.Close()
+	_, err = d.StartWorkflow(w, "video")
+	s.Nil(err)
+
+	select {
+	case payload := <-done:
+		s.Equal("video", payload)
+	case <-time.After(5 * time.Second):
+		s.Fail("Job not processed")
+	}
+	cancel()
+	<-stopped
+}
+
+func (s *WorkflowSuite) TestInvalidWorkflows() {
+	_, err := NewWorkflow("empty")
+	s.NotNil(err)
+
+	_, err = NewWorkflow("duplicate", WorkflowStep{Name: "a"}, WorkflowStep{Name: "a"})
+	s.NotNil(err)
+
+	_, err = NewWorkflow("unknown", WorkflowStep{Name: "a", Next: []string{"b"}})
+	s.Equal("Step a of workflow unknown refers to unknown step b", err.Error())
+
+	_, err = NewWorkflow("cycle",
+		WorkflowStep{Name: "a", Next: []string{"b"}},
+		WorkflowStep{Name: "b", OnFailure: "a"},
+	)
+	s.True(strings.HasPrefix(err.Error(), "Workflow cycle has a cycle"))
+
+	w, err := NewWorkflow("worker", WorkflowStep{Name: "a"})
+	s.Nil(err)
+	_, err = NewWorkflowWorker(s.d, w, "a")
+	s.Equal("Step a of workflow worker has no handler", err.Error())
+	_, err = NewWorkflowWorker(s.d, w, "b")
+	s.Equal("Unknown step b of workflow worker", err.Error())
+}
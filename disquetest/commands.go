@@ -0,0 +1,755 @@
+package disquetest
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type handler func(s *Server, w *bufio.Writer, args []string)
+
+var commands map[string]handler
+
+func init() {
+	commands = map[string]handler{
+		"PING":     cmdPing,
+		"CLUSTER":  cmdCluster,
+		"HELLO":    cmdHello,
+		"INFO":     cmdInfo,
+		"DEBUG":    cmdDebug,
+		"ADDJOB":   cmdAddJob,
+		"GETJOB":   cmdGetJob,
+		"ACKJOB":   cmdAckJob,
+		"FASTACK":  cmdAckJob,
+		"NACK":     cmdNack,
+		"DELJOB":   cmdDelJob,
+		"SHOW":     cmdShow,
+		"WORKING":  cmdWorking,
+		"ENQUEUE":  cmdEnqueue,
+		"DEQUEUE":  cmdDequeue,
+		"QLEN":     cmdQueueLength,
+		"QPEEK":    cmdQueuePeek,
+		"QSTAT":    cmdQueueStat,
+		"JSCAN":    cmdJobScan,
+		"PAUSE":    cmdPause,
+		"QUIT":     cmdQuit,
+		"SHUTDOWN": cmdQuit,
+	}
+}
+
+const (
+	defaultTTL   = 24 * time.Hour
+	defaultRetry = 5 * time.Minute
+)
+
+const errBadID = "BADID Invalid Job ID format."
+
+func wrongArgs(w *bufio.Writer, command string) {
+	writeError(w, fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(command)))
+}
+
+func cmdPing(s *Server, w *bufio.Writer, args []string) {
+	writeStatus(w, "PONG")
+}
+
+func cmdQuit(s *Server, w *bufio.Writer, args []string) {
+	writeStatus(w, "OK")
+}
+
+func cmdCluster(s *Server, w *bufio.Writer, args []string) {
+	if len(args) == 0 || strings.ToUpper(args[0]) != "NODES" {
+		writeError(w, "ERR unsupported CLUSTER subcommand")
+		return
+	}
+	var lines []string
+	for _, node := range s.cluster.Servers {
+		flags := "-"
+		if node == s {
+			flags = "myself"
+		}
+		lines = append(lines, fmt.Sprintf("%s %s %s 0 0 connected", node.ID, node.Addr, flags))
+	}
+	writeBulk(w, strings.Join(lines, "\n")+"\n")
+}
+
+func cmdHello(s *Server, w *bufio.Writer, args []string) {
+	reply := []interface{}{int64(1), s.ID}
+	for _, node := range s.cluster.Servers {
+		host, port := splitAddr(node.Addr)
+		reply = append(reply, []interface{}{node.ID, host, port, "1"})
+	}
+	writeValue(w, reply)
+}
+
+func cmdDebug(s *Server, w *bufio.Writer, args []string) {
+	if len(args) == 0 || strings.ToUpper(args[0]) != "FLUSHALL" {
+		writeError(w, "ERR unsupported DEBUG subcommand")
+		return
+	}
+	st := s.store
+	st.mu.Lock()
+	st.jobs = make(map[string]*job)
+	st.queues = make(map[string][]string)
+	st.stats = make(map[string]*queueStats)
+	st.mu.Unlock()
+	writeStatus(w, "OK")
+}
+
+func cmdAddJob(s *Server, w *bufio.Writer, args []string) {
+	if len(args) < 3 {
+		wrongArgs(w, "ADDJOB")
+		return
+	}
+	if _, err := strconv.ParseInt(args[2], 10, 64); err != nil {
+		writeError(w, "ERR Invalid timeout")
+		return
+	}
+
+	now := time.Now()
+	j := &job{
+		queue: args[0],
+		body:  args[1],
+		repl:  1,
+		ttl:   defaultTTL,
+		retry: defaultRetry,
+		ctime: now,
+		nodes: []string{s.ID},
+	}
+	maxlen := -1
+	retrySet := false
+	for i := 3; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		if option == "ASYNC" {
+			continue
+		}
+		if i+1 >= len(args) {
+			writeError(w, "ERR syntax error")
+			return
+		}
+		n, err := strconv.Atoi(args[i+1])
+		if err != nil || n < 0 {
+			writeError(w, fmt.Sprintf("ERR Invalid %s value", option))
+			return
+		}
+		i++
+		switch option {
+		case "REPLICATE":
+			j.repl = n
+		case "DELAY":
+			j.delay = time.Duration(n) * time.Second
+		case "RETRY":
+			j.retry = time.Duration(n) * time.Second
+			retrySet = true
+		case "TTL":
+			j.ttl = time.Duration(n) * time.Second
+		case "MAXLEN":
+			maxlen = n
+		default:
+			writeError(w, "ERR syntax error")
+			return
+		}
+	}
+	if !retrySet && j.retry > j.ttl/2 {
+		j.retry = j.ttl / 2
+	}
+	if j.delay > 0 && j.delay >= j.ttl {
+		writeError(w, "ERR The specified DELAY is greater than TTL. Job refused since would never be delivered")
+		return
+	}
+	if j.repl > len(s.cluster.Servers) {
+		writeError(w, "NOREPL Not enough reachable nodes for the requested replication level")
+		return
+	}
+
+	st := s.store
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	qs := st.queueStats(j.queue)
+	if qs.pause == "in" || qs.pause == "all" {
+		writeError(w, "PAUSED Queue paused in input, try later")
+		return
+	}
+	if maxlen >= 0 && len(st.queues[j.queue]) >= maxlen {
+		writeError(w, "MAXLEN Queue is already longer than the specified MAXLEN count")
+		return
+	}
+
+	j.id = newJobID(s.Prefix())
+	st.jobs[j.id] = j
+	if j.delay > 0 {
+		j.state = stateActive
+		j.awakeAt = now.Add(j.delay)
+	} else {
+		st.enqueue(j, now)
+	}
+	writeStatus(w, j.id)
+}
+
+func cmdGetJob(s *Server, w *bufio.Writer, args []string) {
+	timeout := time.Duration(0)
+	count := 1
+	noHang := false
+	withCounters := false
+	var queues []string
+	for i := 0; i < len(args); i++ {
+		switch option := strings.ToUpper(args[i]); option {
+		case "NOHANG":
+			noHang = true
+		case "WITHCOUNTERS":
+			withCounters = true
+		case "TIMEOUT", "COUNT":
+			if i+1 >= len(args) {
+				writeError(w, "ERR syntax error")
+				return
+			}
+			n, err := strconv.Atoi(args[i+1])
+			if err != nil || n < 0 {
+				writeError(w, fmt.Sprintf("ERR Invalid %s value", option))
+				return
+			}
+			i++
+			if option == "TIMEOUT" {
+				timeout = time.Duration(n) * time.Millisecond
+			} else {
+				count = n
+			}
+		case "FROM":
+			queues = args[i+1:]
+			i = len(args)
+		default:
+			writeError(w, "ERR syntax error")
+			return
+		}
+	}
+	if len(queues) == 0 {
+		writeError(w, "ERR syntax error")
+		return
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		if jobs := s.takeJobs(queues, count); len(jobs) > 0 {
+			reply := make([]interface{}, 0, len(jobs))
+			for _, j := range jobs {
+				entry := []interface{}{j.queue, j.id, j.body}
+				if withCounters {
+					entry = append(entry, "nacks", j.nacks, "additional-deliveries", j.additionalDeliveries)
+				}
+				reply = append(reply, entry)
+			}
+			writeValue(w, reply)
+			return
+		}
+		if noHang || (timeout > 0 && time.Now().After(deadline)) || s.isClosed() {
+			writeNilArray(w)
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) takeJobs(queues []string, count int) (jobs []*job) {
+	st := s.store
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	st.tick(now)
+	for _, name := range queues {
+		qs := st.queueStats(name)
+		if qs.pause == "out" || qs.pause == "all" {
+			continue
+		}
+		jobs = append(jobs, st.dequeue(name, count-len(jobs), now)...)
+		if len(jobs) >= count {
+			break
+		}
+	}
+	return
+}
+
+// withJobs validates the job IDs and invokes fn for each job known to the
+// store, replying with the number of jobs for which fn returned true.
+func (s *Server) withJobs(w *bufio.Writer, command string, ids []string, fn func(st *store, j *job, now time.Time) bool) {
+	if len(ids) == 0 {
+		wrongArgs(w, command)
+		return
+	}
+	for _, id := range ids {
+		if !validJobID(id) {
+			writeError(w, errBadID)
+			return
+		}
+	}
+
+	st := s.store
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	st.tick(now)
+	count := int64(0)
+	for _, id := range ids {
+		if j, ok := st.jobs[id]; ok && fn(st, j, now) {
+			count++
+		}
+	}
+	writeInt(w, count)
+}
+
+func cmdAckJob(s *Server, w *bufio.Writer, args []string) {
+	s.withJobs(w, "ACKJOB", args, func(st *store, j *job, now time.Time) bool {
+		st.remove(j)
+		delete(st.jobs, j.id)
+		return true
+	})
+}
+
+func cmdDelJob(s *Server, w *bufio.Writer, args []string) {
+	s.withJobs(w, "DELJOB", args, func(st *store, j *job, now time.Time) bool {
+		st.remove(j)
+		delete(st.jobs, j.id)
+		return true
+	})
+}
+
+func cmdNack(s *Server, w *bufio.Writer, args []string) {
+	s.withJobs(w, "NACK", args, func(st *store, j *job, now time.Time) bool {
+		if j.state == stateQueued {
+			return false
+		}
+		j.nacks++
+		st.enqueue(j, now)
+		return true
+	})
+}
+
+func cmdEnqueue(s *Server, w *bufio.Writer, args []string) {
+	s.withJobs(w, "ENQUEUE", args, func(st *store, j *job, now time.Time) bool {
+		if j.state == stateQueued {
+			return false
+		}
+		st.enqueue(j, now)
+		return true
+	})
+}
+
+func cmdDequeue(s *Server, w *bufio.Writer, args []string) {
+	s.withJobs(w, "DEQUEUE", args, func(st *store, j *job, now time.Time) bool {
+		if j.state != stateQueued {
+			return false
+		}
+		st.remove(j)
+		j.state = stateActive
+		j.delivered = true
+		j.requeueAt = now.Add(j.retry)
+		return true
+	})
+}
+
+func cmdWorking(s *Server, w *bufio.Writer, args []string) {
+	if len(args) != 1 {
+		wrongArgs(w, "WORKING")
+		return
+	}
+	if !validJobID(args[0]) {
+		writeError(w, errBadID)
+		return
+	}
+
+	st := s.store
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	j, ok := st.jobs[args[0]]
+	if !ok {
+		writeError(w, "NOJOB Job not known in the context of this node.")
+		return
+	}
+	if j.retry == 0 {
+		writeError(w, "TOOLATE Job has no retry period, cannot postpone")
+		return
+	}
+	j.requeueAt = time.Now().Add(j.retry)
+	writeInt(w, int64(j.retry/time.Second))
+}
+
+func showReply(j *job, now time.Time) []interface{} {
+	var requeueWithin, awakeWithin int64
+	if j.delivered && j.retry > 0 {
+		requeueWithin = int64(j.requeueAt.Sub(now) / time.Millisecond)
+	}
+	if !j.awakeAt.IsZero() {
+		awakeWithin = int64(j.awakeAt.Sub(now) / time.Millisecond)
+	}
+	return []interface{}{
+		"id", j.id,
+		"queue", j.queue,
+		"state", j.state,
+		"repl", int64(j.repl),
+		"ttl", int64(j.ttl / time.Second),
+		"ctime", j.ctime.UnixNano(),
+		"delay", int64(j.delay / time.Second),
+		"retry", int64(j.retry / time.Second),
+		"nacks", j.nacks,
+		"additional-deliveries", j.additionalDeliveries,
+		"nodes-delivered", j.nodes,
+		"nodes-confirmed", []string{},
+		"next-requeue-within", requeueWithin,
+		"next-awake-within", awakeWithin,
+		"body", j.body,
+	}
+}
+
+func cmdShow(s *Server, w *bufio.Writer, args []string) {
+	if len(args) != 1 {
+		wrongArgs(w, "SHOW")
+		return
+	}
+	if !validJobID(args[0]) {
+		writeError(w, errBadID)
+		return
+	}
+
+	st := s.store
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	st.tick(now)
+	if j, ok := st.jobs[args[0]]; ok {
+		writeValue(w, showReply(j, now))
+	} else {
+		writeNil(w)
+	}
+}
+
+func cmdQueueLength(s *Server, w *bufio.Writer, args []string) {
+	if len(args) != 1 {
+		wrongArgs(w, "QLEN")
+		return
+	}
+	st := s.store
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.tick(time.Now())
+	writeInt(w, int64(len(st.queues[args[0]])))
+}
+
+func cmdQueuePeek(s *Server, w *bufio.Writer, args []string) {
+	if len(args) != 2 {
+		wrongArgs(w, "QPEEK")
+		return
+	}
+	count, err := strconv.Atoi(args[1])
+	if err != nil {
+		writeError(w, "ERR value is not an integer or out of range")
+		return
+	}
+
+	st := s.store
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	st.tick(time.Now())
+	ids := st.queues[args[0]]
+	var selected []string
+	if count >= 0 {
+		for i := 0; i < len(ids) && i < count; i++ {
+			selected = append(selected, ids[i])
+		}
+	} else {
+		for i := len(ids) - 1; i >= 0 && len(selected) < -count; i-- {
+			selected = append(selected, ids[i])
+		}
+	}
+	reply := make([]interface{}, 0, len(selected))
+	for _, id := range selected {
+		j := st.jobs[id]
+		reply = append(reply, []interface{}{j.queue, j.id, j.body})
+	}
+	writeValue(w, reply)
+}
+
+func cmdQueueStat(s *Server, w *bufio.Writer, args []string) {
+	if len(args) != 1 {
+		wrongArgs(w, "QSTAT")
+		return
+	}
+	st := s.store
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	st.tick(now)
+	qs, ok := st.stats[args[0]]
+	if !ok {
+		writeNil(w)
+		return
+	}
+	ids := st.queues[args[0]]
+	age := int64(now.Sub(qs.created) / time.Second)
+	idle := int64(0)
+	if len(ids) > 0 {
+		idle = int64(now.Sub(st.jobs[ids[0]].queuedAt) / time.Second)
+	}
+	writeValue(w, []interface{}{
+		"name", args[0],
+		"len", int64(len(ids)),
+		"age", age,
+		"idle", idle,
+		"blocked", int64(0),
+		"import-from", []string{},
+		"import-rate", int64(0),
+		"jobs-in", qs.jobsIn,
+		"jobs-out", qs.jobsOut,
+		"pause", qs.pause,
+	})
+}
+
+func cmdJobScan(s *Server, w *bufio.Writer, args []string) {
+	cursor := 0
+	count := 100
+	reply := "id"
+	var queues, states []string
+
+	i := 0
+	if len(args) > 0 {
+		if n, err := strconv.Atoi(args[0]); err == nil {
+			cursor = n
+			i = 1
+		}
+	}
+	for ; i < len(args); i++ {
+		option := strings.ToUpper(args[i])
+		if option == "BUSYLOOP" {
+			continue
+		}
+		if i+1 >= len(args) {
+			writeError(w, "ERR syntax error")
+			return
+		}
+		value := args[i+1]
+		i++
+		switch option {
+		case "COUNT":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				writeError(w, "ERR syntax error")
+				return
+			}
+			count = n
+		case "QUEUE":
+			queues = append(queues, value)
+		case "STATE":
+			states = append(states, strings.ToLower(value))
+		case "REPLY":
+			reply = strings.ToLower(value)
+			if reply != "id" && reply != "all" {
+				writeError(w, "ERR syntax error")
+				return
+			}
+		default:
+			writeError(w, "ERR syntax error")
+			return
+		}
+	}
+
+	st := s.store
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	now := time.Now()
+	st.tick(now)
+	ids := st.sortedIDs()
+	end := cursor + count
+	next := strconv.Itoa(end)
+	if end >= len(ids) {
+		end = len(ids)
+		next = "0"
+	}
+	start := cursor
+	if start > len(ids) {
+		start = len(ids)
+	}
+	items := make([]interface{}, 0)
+	for _, id := range ids[start:end] {
+		j := st.jobs[id]
+		if len(queues) > 0 && !contains(queues, j.queue) {
+			continue
+		}
+		if len(states) > 0 && !contains(states, j.state) {
+			continue
+		}
+		if reply == "all" {
+			items = append(items, showReply(j, now))
+		} else {
+			items = append(items, j.id)
+		}
+	}
+	writeValue(w, []interface{}{next, items})
+}
+
+func cmdPause(s *Server, w *bufio.Writer, args []string) {
+	if len(args) < 2 {
+		wrongArgs(w, "PAUSE")
+		return
+	}
+	st := s.store
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	qs := st.queueStats(args[0])
+	in := qs.pause == "in" || qs.pause == "all"
+	out := qs.pause == "out" || qs.pause == "all"
+	for _, option := range args[1:] {
+		switch strings.ToLower(option) {
+		case "in":
+			in = true
+		case "out":
+			out = true
+		case "all":
+			in, out = true, true
+		case "none":
+			in, out = false, false
+		case "state", "bcast":
+		default:
+			writeError(w, "ERR syntax error")
+			return
+		}
+	}
+	switch {
+	case in && out:
+		qs.pause = "all"
+	case in:
+		qs.pause = "in"
+	case out:
+		qs.pause = "out"
+	default:
+		qs.pause = "none"
+	}
+	writeStatus(w, qs.pause)
+}
+
+func cmdInfo(s *Server, w *bufio.Writer, args []string) {
+	st := s.store
+	st.mu.Lock()
+	registeredJobs := len(st.jobs)
+	registeredQueues := len(st.stats)
+	st.mu.Unlock()
+
+	s.mu.Lock()
+	clients := len(s.conns)
+	processed := 0
+	for _, n := range s.counts {
+		processed += n
+	}
+	s.mu.Unlock()
+
+	_, port := splitAddr(s.Addr)
+	sections := map[string][]string{
+		"server": {
+			"disque_version:1.0-rc1",
+			"disque_git_sha1:00000000",
+			"disque_git_dirty:0",
+			"os:fake",
+			"arch_bits:64",
+			"multiplexing_api:fake",
+			"process_id:1",
+			"run_id:" + s.ID,
+			"tcp_port:" + port,
+			"uptime_in_seconds:1",
+			"uptime_in_days:0",
+			"hz:10",
+			"config_file:",
+		},
+		"clients": {
+			fmt.Sprintf("connected_clients:%d", clients),
+			"client_longest_output_list:0",
+			"client_biggest_input_buf:0",
+			"blocked_clients:0",
+		},
+		"memory": {
+			"used_memory:1048576",
+			"used_memory_human:1.00M",
+			"used_memory_rss:2097152",
+			"used_memory_peak:1048576",
+			"used_memory_peak_human:1.00M",
+			"mem_fragmentation_ratio:2.00",
+			"mem_allocator:libc",
+		},
+		"jobs": {
+			fmt.Sprintf("registered_jobs:%d", registeredJobs),
+		},
+		"queues": {
+			fmt.Sprintf("registered_queues:%d", registeredQueues),
+		},
+		"persistence": {
+			"loading:0",
+			"aof_enabled:0",
+			"aof_state:off",
+			"aof_rewrite_in_progress:0",
+			"aof_rewrite_scheduled:0",
+			"aof_last_rewrite_time_sec:-1",
+			"aof_current_rewrite_time_sec:-1",
+			"aof_last_bgrewrite_status:ok",
+			"aof_last_write_status:ok",
+		},
+		"stats": {
+			"total_connections_received:1",
+			fmt.Sprintf("total_commands_processed:%d", processed),
+			"instantaneous_ops_per_sec:0",
+			"total_net_input_bytes:0",
+			"total_net_output_bytes:0",
+			"instantaneous_input_kbps:0.00",
+			"instantaneous_output_kbps:0.00",
+			"rejected_connections:0",
+			"latest_fork_usec:0",
+		},
+	}
+	order := []string{"server", "clients", "memory", "jobs", "queues", "persistence", "stats"}
+	if len(args) > 0 && strings.ToLower(args[0]) != "all" && strings.ToLower(args[0]) != "default" {
+		order = []string{strings.ToLower(args[0])}
+	}
+
+	var b bytes.Buffer
+	for _, name := range order {
+		lines, ok := sections[name]
+		if !ok {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		b.WriteString("# " + strings.ToUpper(name[:1]) + name[1:] + "\r\n")
+		for _, line := range lines {
+			b.WriteString(line + "\r\n")
+		}
+	}
+	writeBulk(w, b.String())
+}
+
+func splitAddr(addr string) (host string, port string) {
+	i := strings.LastIndex(addr, ":")
+	return addr[:i], addr[i+1:]
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,344 @@
+// Package disquetest provides an in-process fake Disque server for use in
+// tests and tools. It speaks enough of the Disque protocol to exercise the
+// disque package without a real cluster.
+package disquetest
+
+import (
+	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Server is a fake Disque node listening on a local TCP port.
+// Servers created through NewCluster share their job store, which
+// stands in for replication between the nodes of a real cluster.
+type Server struct {
+	// Addr is the host:port the server is listening on
+	Addr string
+	// ID is the 40 character node identifier reported by CLUSTER NODES
+	ID string
+
+	store    *store
+	cluster  *Cluster
+	listener net.Listener
+
+	mu       sync.Mutex
+	conns    map[net.Conn]struct{}
+	counts   map[string]int
+	failures map[string][]string
+	closed   bool
+	wg       sync.WaitGroup
+}
+
+// Cluster is a group of fake Disque nodes that know about each other.
+type Cluster struct {
+	Servers []*Server
+}
+
+// NewServer starts a single fake Disque node on a random local port.
+func NewServer() *Server {
+	s, err := NewServerOn("127.0.0.1:0")
+	if err != nil {
+		panic(fmt.Sprintf("disquetest: failed to listen: %s", err))
+	}
+	return s
+}
+
+// NewServerOn starts a single fake Disque node on the given address.
+func NewServerOn(addr string) (s *Server, err error) {
+	c := &Cluster{}
+	if s, err = newServer(addr, newStore(), c); err == nil {
+		c.Servers = []*Server{s}
+	}
+	return
+}
+
+// NewCluster starts n fake Disque nodes sharing a single job store.
+func NewCluster(n int) *Cluster {
+	c := &Cluster{}
+	st := newStore()
+	for i := 0; i < n; i++ {
+		s, err := newServer("127.0.0.1:0", st, c)
+		if err != nil {
+			c.Close()
+			panic(fmt.Sprintf("disquetest: failed to listen: %s", err))
+		}
+		c.Servers = append(c.Servers, s)
+	}
+	return c
+}
+
+// Addrs returns the addresses of all nodes in the cluster.
+func (c *Cluster) Addrs() (addrs []string) {
+	for _, s := range c.Servers {
+		addrs = append(addrs, s.Addr)
+	}
+	return
+}
+
+// Close stops every node in the cluster.
+func (c *Cluster) Close() {
+	for _, s := range c.Servers {
+		s.Close()
+	}
+}
+
+func newServer(addr string, st *store, c *Cluster) (s *Server, err error) {
+	var l net.Listener
+	if l, err = net.Listen("tcp", addr); err != nil {
+		return
+	}
+	s = &Server{
+		Addr:     l.Addr().String(),
+		ID:       randomHex(20),
+		store:    st,
+		cluster:  c,
+		listener: l,
+		conns:    make(map[net.Conn]struct{}),
+		counts:   make(map[string]int),
+		failures: make(map[string][]string),
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return
+}
+
+// Close stops the server and drops all client connections.
+func (s *Server) Close() {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	s.closed = true
+	s.listener.Close()
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+}
+
+// Prefix returns the 8 character node prefix embedded in job IDs created by this node.
+func (s *Server) Prefix() string {
+	return s.ID[0:8]
+}
+
+// CommandCount returns the number of times the named command was received.
+func (s *Server) CommandCount(command string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.counts[strings.ToUpper(command)]
+}
+
+// FailNext makes the next invocation of command return the given error
+// message (for example "ERR something broke") instead of executing.
+func (s *Server) FailNext(command string, message string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	command = strings.ToUpper(command)
+	s.failures[command] = append(s.failures[command], message)
+}
+
+// DropConnections closes every open client connection without stopping the server.
+func (s *Server) DropConnections() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		s.conns[conn] = struct{}{}
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer s.wg.Done()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		s.dispatch(w, args)
+		// flush only once the pipeline has been drained
+		if r.Buffered() == 0 {
+			if err = w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) dispatch(w *bufio.Writer, args []string) {
+	command := strings.ToUpper(args[0])
+
+	s.mu.Lock()
+	s.counts[command]++
+	if pending := s.failures[command]; len(pending) > 0 {
+		s.failures[command] = pending[1:]
+		s.mu.Unlock()
+		writeError(w, pending[0])
+		return
+	}
+	s.mu.Unlock()
+
+	handler, ok := commands[command]
+	if !ok {
+		writeError(w, fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	handler(s, w, args[1:])
+}
+
+var errProtocol = errors.New("disquetest: protocol error")
+
+func readLine(r *bufio.Reader) (line string, err error) {
+	if line, err = r.ReadString('\n'); err != nil {
+		return
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func readCommand(r *bufio.Reader) (args []string, err error) {
+	var line string
+	if line, err = readLine(r); err != nil {
+		return
+	}
+	if !strings.HasPrefix(line, "*") {
+		// inline command
+		return strings.Fields(line), nil
+	}
+	var n int
+	if n, err = strconv.Atoi(line[1:]); err != nil {
+		return nil, errProtocol
+	}
+	args = make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if line, err = readLine(r); err != nil {
+			return
+		}
+		if !strings.HasPrefix(line, "$") {
+			return nil, errProtocol
+		}
+		var size int
+		if size, err = strconv.Atoi(line[1:]); err != nil {
+			return nil, errProtocol
+		}
+		buf := make([]byte, size+2)
+		if _, err = io.ReadFull(r, buf); err != nil {
+			return
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return
+}
+
+func writeStatus(w *bufio.Writer, status string) {
+	fmt.Fprintf(w, "+%s\r\n", status)
+}
+
+func writeError(w *bufio.Writer, message string) {
+	fmt.Fprintf(w, "-%s\r\n", message)
+}
+
+func writeInt(w *bufio.Writer, n int64) {
+	fmt.Fprintf(w, ":%d\r\n", n)
+}
+
+func writeBulk(w *bufio.Writer, s string) {
+	fmt.Fprintf(w, "$%d\r\n%s\r\n", len(s), s)
+}
+
+func writeNil(w *bufio.Writer) {
+	w.WriteString("$-1\r\n")
+}
+
+func writeNilArray(w *bufio.Writer) {
+	w.WriteString("*-1\r\n")
+}
+
+func writeArrayHeader(w *bufio.Writer, n int) {
+	fmt.Fprintf(w, "*%d\r\n", n)
+}
+
+// writeValue writes strings as bulk strings, integers as integers,
+// nil as a null bulk and slices as nested arrays.
+func writeValue(w *bufio.Writer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		writeNil(w)
+	case string:
+		writeBulk(w, v)
+	case int:
+		writeInt(w, int64(v))
+	case int64:
+		writeInt(w, v)
+	case []string:
+		writeArrayHeader(w, len(v))
+		for _, s := range v {
+			writeBulk(w, s)
+		}
+	case []interface{}:
+		writeArrayHeader(w, len(v))
+		for _, element := range v {
+			writeValue(w, element)
+		}
+	default:
+		panic(fmt.Sprintf("disquetest: unsupported reply type %T", v))
+	}
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// newJobID generates an identifier shaped like a real Disque job ID:
+// D-<node prefix>-<24 characters>-<4 characters>
+func newJobID(prefix string) string {
+	return "D-" + prefix + "-" + randomHex(12) + "-" + randomHex(2)
+}
+
+func validJobID(id string) bool {
+	return len(id) == 40 && strings.HasPrefix(id, "D-") && id[10] == '-' && id[35] == '-'
+}
@@ -0,0 +1,95 @@
+package disquetest
+
+import (
+	"testing"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/suite"
+)
+
+type ServerSuite struct {
+	suite.Suite
+}
+
+func TestServerSuite(t *testing.T) {
+	suite.Run(t, new(ServerSuite))
+}
+
+func (s *ServerSuite) SetupTest() {
+}
+
+func (s *ServerSuite) SetupSuite() {
+}
+
+func (s *ServerSuite) TestAddAndGetJob() {
+	server := NewServer()
+	defer server.Close()
+	conn, err := redis.Dial("tcp", server.Addr)
+	s.Nil(err)
+	defer conn.Close()
+
+	jobID, err := redis.String(conn.Do("ADDJOB", "queue1", "body", 1000))
+	s.Nil(err)
+	s.True(validJobID(jobID))
+	s.Equal(server.Prefix(), jobID[2:10])
+
+	values, err := redis.Values(conn.Do("GETJOB", "NOHANG", "FROM", "queue1"))
+	s.Nil(err)
+	s.Equal(1, len(values))
+	job, err := redis.Strings(values[0], nil)
+	s.Nil(err)
+	s.Equal([]string{"queue1", jobID, "body"}, job)
+	s.Equal(1, server.CommandCount("addjob"))
+}
+
+func (s *ServerSuite) TestFailNext() {
+	server := NewServer()
+	defer server.Close()
+	conn, err := redis.Dial("tcp", server.Addr)
+	s.Nil(err)
+	defer conn.Close()
+
+	server.FailNext("PING", "ERR something broke")
+	_, err = conn.Do("PING")
+	s.Equal(redis.Error("ERR something broke"), err)
+
+	reply, err := redis.String(conn.Do("PING"))
+	s.Nil(err)
+	s.Equal("PONG", reply)
+}
+
+func (s *ServerSuite) TestClusterSharesJobs() {
+	cluster := NewCluster(2)
+	defer cluster.Close()
+	s.Equal(2, len(cluster.Addrs()))
+
+	first, err := redis.Dial("tcp", cluster.Addrs()[0])
+	s.Nil(err)
+	defer first.Close()
+	second, err := redis.Dial("tcp", cluster.Addrs()[1])
+	s.Nil(err)
+	defer second.Close()
+
+	_, err = first.Do("ADDJOB", "queue1", "body", 1000)
+	s.Nil(err)
+	length, err := redis.Int(second.Do("QLEN", "queue1"))
+	s.Nil(err)
+	s.Equal(1, length)
+
+	nodes, err := redis.String(second.Do("CLUSTER", "NODES"))
+	s.Nil(err)
+	s.Contains(nodes, cluster.Servers[0].ID)
+	s.Contains(nodes, cluster.Servers[1].ID)
+}
+
+func (s *ServerSuite) TestDropConnections() {
+	server := NewServer()
+	defer server.Close()
+	conn, err := redis.Dial("tcp", server.Addr)
+	s.Nil(err)
+	defer conn.Close()
+
+	server.DropConnections()
+	_, err = conn.Do("PING")
+	s.NotNil(err)
+}
@@ -0,0 +1,138 @@
+package disquetest
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// job states as reported by SHOW and JSCAN
+const (
+	stateActive = "active"
+	stateQueued = "queued"
+	stateAcked  = "acked"
+)
+
+type job struct {
+	id                   string
+	queue                string
+	body                 string
+	state                string
+	repl                 int
+	ttl                  time.Duration
+	delay                time.Duration
+	retry                time.Duration
+	ctime                time.Time
+	nacks                int64
+	additionalDeliveries int64
+	delivered            bool
+	queuedAt             time.Time
+	awakeAt              time.Time
+	requeueAt            time.Time
+	nodes                []string
+}
+
+type queueStats struct {
+	jobsIn  int64
+	jobsOut int64
+	pause   string
+	created time.Time
+}
+
+// store holds the jobs and queues shared by the nodes of a fake cluster.
+type store struct {
+	mu     sync.Mutex
+	jobs   map[string]*job
+	queues map[string][]string
+	stats  map[string]*queueStats
+}
+
+func newStore() *store {
+	return &store{
+		jobs:   make(map[string]*job),
+		queues: make(map[string][]string),
+		stats:  make(map[string]*queueStats),
+	}
+}
+
+func (st *store) queueStats(name string) *queueStats {
+	qs, ok := st.stats[name]
+	if !ok {
+		qs = &queueStats{pause: "none", created: time.Now()}
+		st.stats[name] = qs
+	}
+	return qs
+}
+
+// tick moves delayed jobs whose time has come and active jobs whose retry
+// period has elapsed back into their queue, and expires jobs past their TTL.
+// Callers must hold st.mu.
+func (st *store) tick(now time.Time) {
+	for id, j := range st.jobs {
+		if j.ttl > 0 && now.After(j.ctime.Add(j.ttl)) {
+			st.remove(j)
+			delete(st.jobs, id)
+			continue
+		}
+		if j.state != stateActive {
+			continue
+		}
+		if !j.delivered && !j.awakeAt.IsZero() && !now.Before(j.awakeAt) {
+			st.enqueue(j, now)
+		} else if j.delivered && j.retry > 0 && !now.Before(j.requeueAt) {
+			j.additionalDeliveries++
+			st.enqueue(j, now)
+		}
+	}
+}
+
+// enqueue appends a job to its queue. Callers must hold st.mu.
+func (st *store) enqueue(j *job, now time.Time) {
+	if j.state == stateQueued {
+		return
+	}
+	j.state = stateQueued
+	j.queuedAt = now
+	st.queues[j.queue] = append(st.queues[j.queue], j.id)
+	st.queueStats(j.queue).jobsIn++
+}
+
+// remove takes a job out of its queue, if it is queued. Callers must hold st.mu.
+func (st *store) remove(j *job) {
+	ids := st.queues[j.queue]
+	for i, id := range ids {
+		if id == j.id {
+			st.queues[j.queue] = append(ids[:i:i], ids[i+1:]...)
+			break
+		}
+	}
+}
+
+// dequeue pops up to count jobs from the named queue. Callers must hold st.mu.
+func (st *store) dequeue(name string, count int, now time.Time) (jobs []*job) {
+	ids := st.queues[name]
+	for len(ids) > 0 && len(jobs) < count {
+		j := st.jobs[ids[0]]
+		ids = ids[1:]
+		j.state = stateActive
+		j.delivered = true
+		if j.retry > 0 {
+			j.requeueAt = now.Add(j.retry)
+		}
+		jobs = append(jobs, j)
+	}
+	st.queues[name] = ids
+	if len(jobs) > 0 {
+		st.queueStats(name).jobsOut += int64(len(jobs))
+	}
+	return
+}
+
+// sortedIDs returns the IDs of all known jobs in a stable order. Callers must hold st.mu.
+func (st *store) sortedIDs() (ids []string) {
+	for id := range st.jobs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return
+}
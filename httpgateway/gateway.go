@@ -0,0 +1,242 @@
+// Package httpgateway exposes queue operations of a Disque cluster as a
+// JSON over HTTP API, for clients that cannot speak the Disque protocol.
+//
+//     POST /queues/{queue}/jobs             push a job
+//     GET  /queues/{queue}/jobs?count&timeout  fetch jobs, waiting up to timeout
+//     GET  /queues/{queue}/stats            state of a queue
+//     GET  /jobs/{id}                       details of a job
+//     POST /jobs/{id}/ack                   acknowledge a job
+//     POST /jobs/{id}/nack                  put a job back in its queue
+//
+// Errors are reported as {"error": "..."} along with a matching status code.
+package httpgateway
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/zencoder/disque-go/disque"
+	"golang.org/x/net/context"
+)
+
+// Defaults used by a Gateway when the corresponding option is unset
+const (
+	DefaultMaxBodyBytes   = 1 << 20
+	DefaultMaxPollTimeout = 30 * time.Second
+	DefaultMaxFetchCount  = 100
+	DefaultPushTimeout    = time.Second
+	DefaultMaxPushTimeout = 10 * time.Second
+	DefaultGetTimeout     = 5 * time.Second
+)
+
+var errBodyTooLarge = errors.New("Request body too large")
+
+// Options configures a Gateway
+type Options struct {
+	// Token, if set, must be given by every request as a bearer token
+	Token string
+	// MaxBodyBytes is the size beyond which request bodies are refused,
+	// DefaultMaxBodyBytes if unset
+	MaxBodyBytes int64
+	// MaxPollTimeout bounds the time a fetch waits for jobs,
+	// DefaultMaxPollTimeout if unset
+	MaxPollTimeout time.Duration
+	// MaxFetchCount bounds the number of jobs returned by a fetch,
+	// DefaultMaxFetchCount if unset
+	MaxFetchCount int
+	// PushTimeout is the ADDJOB timeout used when a push does not specify
+	// one, DefaultPushTimeout if unset
+	PushTimeout time.Duration
+	// MaxPushTimeout bounds the ADDJOB timeout a push may specify,
+	// DefaultMaxPushTimeout if unset
+	MaxPushTimeout time.Duration
+	// GetTimeout is the time to wait for a connection from the pool,
+	// DefaultGetTimeout if unset
+	GetTimeout time.Duration
+}
+
+// Gateway is an http.Handler serving queue operations through connections
+// of a pool. A fetch holds on to its connection while waiting for jobs, so
+// the capacity of the pool bounds the number of concurrent long polls.
+type Gateway struct {
+	pool    *disque.Pool
+	options Options
+}
+
+// New creates a gateway serving requests through connections of the pool
+func New(pool *disque.Pool, options Options) *Gateway {
+	if options.MaxBodyBytes <= 0 {
+		options.MaxBodyBytes = DefaultMaxBodyBytes
+	}
+	if options.MaxPollTimeout <= 0 {
+		options.MaxPollTimeout = DefaultMaxPollTimeout
+	}
+	if options.MaxFetchCount <= 0 {
+		options.MaxFetchCount = DefaultMaxFetchCount
+	}
+	if options.PushTimeout <= 0 {
+		options.PushTimeout = DefaultPushTimeout
+	}
+	if options.MaxPushTimeout <= 0 {
+		options.MaxPushTimeout = DefaultMaxPushTimeout
+	}
+	if options.GetTimeout <= 0 {
+		options.GetTimeout = DefaultGetTimeout
+	}
+	return &Gateway{pool: pool, options: options}
+}
+
+// ServeHTTP authenticates and routes a request
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !g.authorized(r) {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="disque"`)
+		writeError(w, http.StatusUnauthorized, errors.New("Unauthorized"))
+		return
+	}
+
+	// job IDs and queue names may contain slashes, so the ID or name is
+	// everything between the collection and the action
+	path := strings.Trim(r.URL.Path, "/")
+	switch {
+	case strings.HasPrefix(path, "queues/") && strings.HasSuffix(path, "/jobs") && len(path) > len("queues//jobs"):
+		queueName := strings.TrimSuffix(strings.TrimPrefix(path, "queues/"), "/jobs")
+		switch r.Method {
+		case "POST":
+			g.push(w, r, queueName)
+		case "GET":
+			g.fetch(w, r, queueName)
+		default:
+			methodNotAllowed(w, "GET, POST")
+		}
+	case strings.HasPrefix(path, "queues/") && strings.HasSuffix(path, "/stats") && len(path) > len("queues//stats"):
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		g.queueStats(w, r, strings.TrimSuffix(strings.TrimPrefix(path, "queues/"), "/stats"))
+	case strings.HasPrefix(path, "jobs/") && (strings.HasSuffix(path, "/ack") || strings.HasSuffix(path, "/nack")):
+		if r.Method != "POST" {
+			methodNotAllowed(w, "POST")
+			return
+		}
+		jobID := strings.TrimPrefix(path, "jobs/")
+		ack := strings.HasSuffix(jobID, "/ack")
+		jobID = jobID[:strings.LastIndex(jobID, "/")]
+		g.acknowledge(w, r, jobID, ack)
+	case strings.HasPrefix(path, "jobs/"):
+		if r.Method != "GET" {
+			methodNotAllowed(w, "GET")
+			return
+		}
+		g.show(w, r, strings.TrimPrefix(path, "jobs/"))
+	default:
+		writeError(w, http.StatusNotFound, errors.New("Not found"))
+	}
+}
+
+// authorized checks the bearer token of a request, if one is required
+func (g *Gateway) authorized(r *http.Request) bool {
+	if g.options.Token == "" {
+		return true
+	}
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return false
+	}
+	token := strings.TrimPrefix(header, "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(g.options.Token)) == 1
+}
+
+// withConn runs fn with a connection from the pool, reporting errors to the client
+func (g *Gateway) withConn(w http.ResponseWriter, fn func(d *disque.Disque) error) {
+	ctx, cancel := context.WithTimeout(context.Background(), g.options.GetTimeout)
+	defer cancel()
+
+	d, err := g.pool.Get(ctx)
+	if err != nil {
+		log.Printf("Error while getting a connection from the pool, exception: %s", err)
+		writeError(w, http.StatusServiceUnavailable, errors.New("Cluster unavailable"))
+		return
+	}
+	defer g.pool.Put(d)
+
+	if err = fn(d); err != nil {
+		writeError(w, statusOf(err), err)
+	}
+}
+
+// readBody reads the body of a request, up to the size limit
+func (g *Gateway) readBody(r *http.Request) (body []byte, err error) {
+	if r.ContentLength > g.options.MaxBodyBytes {
+		return nil, errBodyTooLarge
+	}
+	if body, err = ioutil.ReadAll(io.LimitReader(r.Body, g.options.MaxBodyBytes+1)); err == nil {
+		if int64(len(body)) > g.options.MaxBodyBytes {
+			return nil, errBodyTooLarge
+		}
+	}
+	return
+}
+
+// requestError is an error caused by the request rather than the cluster
+type requestError struct {
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+// statusOf maps an error to the status code reported to the client. Disque
+// replies ERR to commands with invalid arguments, such as a DELAY beyond the
+// TTL, which come from the request; other error replies, such as NOREPL,
+// report the state of the cluster.
+func statusOf(err error) int {
+	switch err.(type) {
+	case *requestError:
+		return http.StatusBadRequest
+	case redis.Error:
+		if strings.HasPrefix(err.Error(), "BADID") || strings.HasPrefix(err.Error(), "ERR ") {
+			return http.StatusBadRequest
+		}
+		return http.StatusBadGateway
+	}
+	switch err {
+	case errBodyTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case redis.ErrNil:
+		return http.StatusNotFound
+	case disque.ErrQueuePaused:
+		return http.StatusConflict
+	}
+	return http.StatusBadGateway
+}
+
+func methodNotAllowed(w http.ResponseWriter, allowed string) {
+	w.Header().Set("Allow", allowed)
+	writeError(w, http.StatusMethodNotAllowed, errors.New("Method not allowed"))
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	message := err.Error()
+	if err == redis.ErrNil {
+		message = "Job not found"
+	}
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		log.Printf("Error while writing response, exception: %s", err)
+	}
+}
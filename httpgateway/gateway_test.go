@@ -0,0 +1,162 @@
+package httpgateway
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disque"
+	"github.com/zencoder/disque-go/disquetest"
+	"golang.org/x/net/context"
+)
+
+type GatewaySuite struct {
+	suite.Suite
+	server  *disquetest.Server
+	pool    *disque.Pool
+	gateway *httptest.Server
+}
+
+func TestGatewaySuite(t *testing.T) {
+	suite.Run(t, new(GatewaySuite))
+}
+
+func (s *GatewaySuite) SetupTest() {
+	s.server = disquetest.NewServer()
+	s.pool = disque.NewPool([]string{s.server.Addr}, 1000, 2, 2, time.Hour)
+	s.gateway = httptest.NewServer(New(s.pool, Options{Token: "secret", MaxBodyBytes: 64}))
+}
+
+func (s *GatewaySuite) TearDownTest() {
+	s.gateway.Close()
+	s.pool.Close()
+	s.server.Close()
+}
+
+func (s *GatewaySuite) SetupSuite() {
+}
+
+// request sends a request with the given bearer token, returning the status
+// code and the error reported in the body, if any
+func (s *GatewaySuite) request(method string, path string, token string, body io.Reader) (status int, message string) {
+	request, err := http.NewRequest(method, s.gateway.URL+path, body)
+	s.Nil(err)
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	s.Nil(err)
+	defer response.Body.Close()
+
+	reply := make(map[string]string)
+	json.NewDecoder(response.Body).Decode(&reply)
+	return response.StatusCode, reply["error"]
+}
+
+func (s *GatewaySuite) TestAuthentication() {
+	status, message := s.request("GET", "/queues/queueGateway/stats", "", nil)
+	s.Equal(http.StatusUnauthorized, status)
+	s.Equal("Unauthorized", message)
+
+	status, _ = s.request("GET", "/queues/queueGateway/stats", "wrong", nil)
+	s.Equal(http.StatusUnauthorized, status)
+
+	status, _ = s.request("GET", "/queues/queueGateway/stats", "secret", nil)
+	s.Equal(http.StatusOK, status)
+}
+
+func (s *GatewaySuite) TestWithoutToken() {
+	gateway := httptest.NewServer(New(s.pool, Options{}))
+	defer gateway.Close()
+
+	response, err := http.Get(gateway.URL + "/queues/queueGateway/stats")
+	s.Nil(err)
+	response.Body.Close()
+	s.Equal(http.StatusOK, response.StatusCode)
+}
+
+func (s *GatewaySuite) TestRouting() {
+	status, _ := s.request("GET", "/unknown", "secret", nil)
+	s.Equal(http.StatusNotFound, status)
+
+	status, _ = s.request("DELETE", "/queues/queueGateway/jobs", "secret", nil)
+	s.Equal(http.StatusMethodNotAllowed, status)
+
+	status, _ = s.request("GET", "/jobs/D-1234/ack", "secret", nil)
+	s.Equal(http.StatusMethodNotAllowed, status)
+
+	status, _ = s.request("GET", "/queues/jobs", "secret", nil)
+	s.Equal(http.StatusNotFound, status)
+
+	// job IDs may contain slashes
+	status, message := s.request("GET", "/jobs/D-dcb833cf-8YL1NT17e9+wsA/09NqxscQI-05a1", "secret", nil)
+	s.Equal(http.StatusNotFound, status)
+	s.Equal("Job not found", message)
+	status, _ = s.request("POST", "/jobs/D-dcb833cf-8YL1NT17e9+wsA/09NqxscQI-05a1/nack", "secret", nil)
+	s.Equal(http.StatusNoContent, status)
+
+	// as may queue names
+	status, _ = s.request("POST", "/queues/queue/gateway/jobs", "secret", strings.NewReader(`{"job": "asdf"}`))
+	s.Equal(http.StatusCreated, status)
+	status, _ = s.request("GET", "/queues/queue/gateway/stats", "secret", nil)
+	s.Equal(http.StatusOK, status)
+}
+
+func (s *GatewaySuite) TestBodyTooLarge() {
+	body := `{"job": "` + strings.Repeat("a", 64) + `"}`
+	status, message := s.request("POST", "/queues/queueGateway/jobs", "secret", strings.NewReader(body))
+	s.Equal(http.StatusRequestEntityTooLarge, status)
+	s.Equal("Request body too large", message)
+}
+
+func (s *GatewaySuite) TestMalformedRequests() {
+	status, _ := s.request("POST", "/queues/queueGateway/jobs", "secret", strings.NewReader("{"))
+	s.Equal(http.StatusBadRequest, status)
+
+	status, message := s.request("GET", "/queues/queueGateway/jobs?count=none", "secret", nil)
+	s.Equal(http.StatusBadRequest, status)
+	s.Equal("Invalid count: none", message)
+
+	status, message = s.request("GET", "/queues/queueGateway/jobs?timeout=soon", "secret", nil)
+	s.Equal(http.StatusBadRequest, status)
+	s.Equal("Invalid timeout: soon", message)
+
+	status, _ = s.request("POST", "/jobs/not-a-job-id/ack", "secret", nil)
+	s.Equal(http.StatusBadRequest, status)
+
+	// options refused by Disque are the client's mistake
+	status, message = s.request("POST", "/queues/queueGateway/jobs", "secret", strings.NewReader(`{"job": "asdf", "delay": 60, "ttl": 10}`))
+	s.Equal(http.StatusBadRequest, status)
+	s.Contains(message, "DELAY")
+}
+
+func (s *GatewaySuite) TestStatusOf() {
+	s.Equal(http.StatusBadRequest, statusOf(redis.Error("ERR syntax error")))
+	s.Equal(http.StatusBadRequest, statusOf(redis.Error("BADID Invalid Job ID format.")))
+	s.Equal(http.StatusBadGateway, statusOf(redis.Error("NOREPL Not enough reachable nodes for the requested replication level")))
+}
+
+func (s *GatewaySuite) TestClusterUnavailable() {
+	s.server.Close()
+	status, message := s.request("GET", "/queues/queueGateway/stats", "secret", nil)
+	s.Equal(http.StatusServiceUnavailable, status)
+	s.Equal("Cluster unavailable", message)
+}
+
+func (s *GatewaySuite) TestPausedQueue() {
+	d, err := s.pool.Get(context.Background())
+	s.Nil(err)
+	_, err = d.PauseQueue("queueGateway", disque.PauseOptions{Mode: disque.PauseIn})
+	s.Nil(err)
+	s.pool.Put(d)
+
+	status, message := s.request("POST", "/queues/queueGateway/jobs", "secret", strings.NewReader(`{"job": "asdf"}`))
+	s.Equal(http.StatusConflict, status)
+	s.Equal(disque.ErrQueuePaused.Error(), message)
+}
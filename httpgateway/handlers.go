@@ -0,0 +1,247 @@
+package httpgateway
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/zencoder/disque-go/disque"
+)
+
+// PushRequest is the body of a push. Times are given in seconds.
+type PushRequest struct {
+	Job string `json:"job"`
+	// Timeout is the time to wait for the job to be replicated
+	Timeout   float64 `json:"timeout,omitempty"`
+	Delay     int     `json:"delay,omitempty"`
+	Retry     *int    `json:"retry,omitempty"`
+	TTL       int     `json:"ttl,omitempty"`
+	Replicate int     `json:"replicate,omitempty"`
+	MaxLen    int     `json:"maxlen,omitempty"`
+	Async     bool    `json:"async,omitempty"`
+}
+
+// PushResponse is the reply to a push
+type PushResponse struct {
+	ID string `json:"id"`
+}
+
+// Job is a job returned by a fetch
+type Job struct {
+	ID                   string `json:"id"`
+	Queue                string `json:"queue"`
+	Job                  string `json:"job"`
+	Nacks                int64  `json:"nacks"`
+	AdditionalDeliveries int64  `json:"additional_deliveries"`
+}
+
+// FetchResponse is the reply to a fetch
+type FetchResponse struct {
+	Jobs []*Job `json:"jobs"`
+}
+
+// JobDetails is the reply to a request for the details of a job. Times are
+// given in seconds.
+type JobDetails struct {
+	ID                   string                 `json:"id"`
+	Queue                string                 `json:"queue"`
+	State                string                 `json:"state"`
+	Replicate            int                    `json:"replicate"`
+	TTL                  float64                `json:"ttl"`
+	CreatedAt            time.Time              `json:"created_at"`
+	Delay                float64                `json:"delay"`
+	Retry                float64                `json:"retry"`
+	Nacks                int64                  `json:"nacks"`
+	AdditionalDeliveries int64                  `json:"additional_deliveries"`
+	NodesDelivered       []string               `json:"nodes_delivered"`
+	NodesConfirmed       []string               `json:"nodes_confirmed"`
+	NextRequeueWithin    float64                `json:"next_requeue_within"`
+	NextAwakeWithin      float64                `json:"next_awake_within"`
+	Job                  string                 `json:"job"`
+	Extra                map[string]interface{} `json:"extra,omitempty"`
+}
+
+// QueueStats is the reply to a request for the state of a queue. Times are
+// given in seconds.
+type QueueStats struct {
+	Queue      string                 `json:"queue"`
+	Length     int64                  `json:"len"`
+	Age        float64                `json:"age"`
+	Idle       float64                `json:"idle"`
+	Blocked    int64                  `json:"blocked"`
+	ImportFrom []string               `json:"import_from"`
+	ImportRate int64                  `json:"import_rate"`
+	JobsIn     int64                  `json:"jobs_in"`
+	JobsOut    int64                  `json:"jobs_out"`
+	Pause      string                 `json:"pause"`
+	Extra      map[string]interface{} `json:"extra,omitempty"`
+}
+
+func (g *Gateway) push(w http.ResponseWriter, r *http.Request, queueName string) {
+	body, err := g.readBody(r)
+	if err != nil {
+		writeError(w, statusOf(err), err)
+		return
+	}
+	request := &PushRequest{}
+	if err = json.Unmarshal(body, request); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	timeout := g.options.PushTimeout
+	if request.Timeout > 0 {
+		timeout = time.Duration(request.Timeout * float64(time.Second))
+	}
+	if timeout > g.options.MaxPushTimeout {
+		timeout = g.options.MaxPushTimeout
+	}
+	options := make(map[string]string)
+	for option, value := range map[string]int{"DELAY": request.Delay, "TTL": request.TTL, "REPLICATE": request.Replicate, "MAXLEN": request.MaxLen} {
+		if value > 0 {
+			options[option] = strconv.Itoa(value)
+		}
+	}
+	if request.Retry != nil {
+		options["RETRY"] = strconv.Itoa(*request.Retry)
+	}
+	if request.Async {
+		options["ASYNC"] = "true"
+	}
+
+	g.withConn(w, func(d *disque.Disque) (err error) {
+		var jobID string
+		if jobID, err = d.PushWithOptions(queueName, request.Job, timeout, options); err == nil {
+			writeJSON(w, http.StatusCreated, &PushResponse{ID: jobID})
+		}
+		return
+	})
+}
+
+// fetch returns up to count jobs, waiting up to timeout for at least one.
+// The timeout is given in seconds or as a duration such as "500ms", and
+// defaults to returning immediately.
+func (g *Gateway) fetch(w http.ResponseWriter, r *http.Request, queueName string) {
+	query := r.URL.Query()
+	count := 1
+	if value := query.Get("count"); value != "" {
+		var err error
+		if count, err = strconv.Atoi(value); err != nil || count <= 0 {
+			writeError(w, http.StatusBadRequest, &requestError{"Invalid count: " + value})
+			return
+		}
+	}
+	if count > g.options.MaxFetchCount {
+		count = g.options.MaxFetchCount
+	}
+	timeout, err := parseTimeout(query.Get("timeout"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if timeout > g.options.MaxPollTimeout {
+		timeout = g.options.MaxPollTimeout
+	}
+	if timeout < time.Millisecond {
+		// GETJOB waits forever with a timeout of 0
+		timeout = time.Millisecond
+	}
+
+	g.withConn(w, func(d *disque.Disque) (err error) {
+		var jobs []*disque.Job
+		if jobs, err = d.FetchMultiple(queueName, count, timeout); err == nil {
+			response := &FetchResponse{Jobs: make([]*Job, 0, len(jobs))}
+			for _, job := range jobs {
+				response.Jobs = append(response.Jobs, &Job{
+					ID:                   job.JobID,
+					Queue:                job.QueueName,
+					Job:                  job.Message,
+					Nacks:                job.Nacks,
+					AdditionalDeliveries: job.AdditionalDeliveries,
+				})
+			}
+			writeJSON(w, http.StatusOK, response)
+		}
+		return
+	})
+}
+
+func (g *Gateway) acknowledge(w http.ResponseWriter, r *http.Request, jobID string, ack bool) {
+	g.withConn(w, func(d *disque.Disque) (err error) {
+		if ack {
+			err = d.Ack(jobID)
+		} else {
+			err = d.Nack(jobID)
+		}
+		if err == nil {
+			w.WriteHeader(http.StatusNoContent)
+		}
+		return
+	})
+}
+
+func (g *Gateway) show(w http.ResponseWriter, r *http.Request, jobID string) {
+	g.withConn(w, func(d *disque.Disque) (err error) {
+		var details *disque.JobDetails
+		if details, err = d.GetJobDetails(jobID); err == nil {
+			writeJSON(w, http.StatusOK, &JobDetails{
+				ID:                   details.JobID,
+				Queue:                details.QueueName,
+				State:                details.State,
+				Replicate:            details.ReplicationFactor,
+				TTL:                  details.TTL.Seconds(),
+				CreatedAt:            details.CreatedAt,
+				Delay:                details.Delay.Seconds(),
+				Retry:                details.Retry.Seconds(),
+				Nacks:                details.Nacks,
+				AdditionalDeliveries: details.AdditionalDeliveries,
+				NodesDelivered:       details.NodesDelivered,
+				NodesConfirmed:       details.NodesConfirmed,
+				NextRequeueWithin:    details.NextRequeueWithin.Seconds(),
+				NextAwakeWithin:      details.NextAwakeWithin.Seconds(),
+				Job:                  details.Message,
+				Extra:                details.Extra,
+			})
+		}
+		return
+	})
+}
+
+func (g *Gateway) queueStats(w http.ResponseWriter, r *http.Request, queueName string) {
+	g.withConn(w, func(d *disque.Disque) (err error) {
+		var stats *disque.QueueStats
+		if stats, err = d.QueueStats(queueName); err == nil {
+			writeJSON(w, http.StatusOK, &QueueStats{
+				Queue:      stats.Name,
+				Length:     stats.Length,
+				Age:        stats.Age.Seconds(),
+				Idle:       stats.Idle.Seconds(),
+				Blocked:    stats.Blocked,
+				ImportFrom: stats.ImportFrom,
+				ImportRate: stats.ImportRate,
+				JobsIn:     stats.JobsIn,
+				JobsOut:    stats.JobsOut,
+				Pause:      string(stats.Pause),
+				Extra:      stats.Extra,
+			})
+		}
+		return
+	})
+}
+
+// parseTimeout parses a number of seconds or a duration
+func parseTimeout(value string) (timeout time.Duration, err error) {
+	if value == "" {
+		return 0, nil
+	}
+	if seconds, parseErr := strconv.ParseFloat(value, 64); parseErr == nil {
+		timeout = time.Duration(seconds * float64(time.Second))
+	} else if timeout, err = time.ParseDuration(value); err != nil {
+		return 0, &requestError{"Invalid timeout: " + value}
+	}
+	if timeout < 0 {
+		return 0, &requestError{"Invalid timeout: " + value}
+	}
+	return
+}
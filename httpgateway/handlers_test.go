@@ -0,0 +1,172 @@
+package httpgateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/suite"
+	"github.com/zencoder/disque-go/disque"
+	"github.com/zencoder/disque-go/disquetest"
+)
+
+type HandlersSuite struct {
+	suite.Suite
+	server  *disquetest.Server
+	pool    *disque.Pool
+	gateway *httptest.Server
+}
+
+func TestHandlersSuite(t *testing.T) {
+	suite.Run(t, new(HandlersSuite))
+}
+
+func (s *HandlersSuite) SetupTest() {
+	s.server = disquetest.NewServer()
+	s.pool = disque.NewPool([]string{s.server.Addr}, 1000, 2, 2, time.Hour)
+	s.gateway = httptest.NewServer(New(s.pool, Options{MaxPollTimeout: time.Second, MaxFetchCount: 2}))
+}
+
+func (s *HandlersSuite) TearDownTest() {
+	s.gateway.Close()
+	s.pool.Close()
+	s.server.Close()
+}
+
+func (s *HandlersSuite) SetupSuite() {
+}
+
+// do sends a request, decoding the reply into reply if given
+func (s *HandlersSuite) do(method string, path string, request interface{}, reply interface{}) (status int) {
+	var body bytes.Buffer
+	if request != nil {
+		s.Nil(json.NewEncoder(&body).Encode(request))
+	}
+	r, err := http.NewRequest(method, s.gateway.URL+path, &body)
+	s.Nil(err)
+	response, err := http.DefaultClient.Do(r)
+	s.Nil(err)
+	defer response.Body.Close()
+	if reply != nil {
+		s.Nil(json.NewDecoder(response.Body).Decode(reply))
+	}
+	return response.StatusCode
+}
+
+func (s *HandlersSuite) push(queueName string, job string) string {
+	reply := &PushResponse{}
+	s.Equal(http.StatusCreated, s.do("POST", "/queues/"+queueName+"/jobs", &PushRequest{Job: job}, reply))
+	s.NotEmpty(reply.ID)
+	return reply.ID
+}
+
+func (s *HandlersSuite) TestPushAndShow() {
+	retry := 0
+	reply := &PushResponse{}
+	status := s.do("POST", "/queues/queueGateway/jobs", &PushRequest{Job: "asdf", TTL: 3600, Retry: &retry, Timeout: 0.5}, reply)
+	s.Equal(http.StatusCreated, status)
+
+	details := &JobDetails{}
+	s.Equal(http.StatusOK, s.do("GET", "/jobs/"+reply.ID, nil, details))
+	s.Equal(reply.ID, details.ID)
+	s.Equal("queueGateway", details.Queue)
+	s.Equal("queued", details.State)
+	s.Equal("asdf", details.Job)
+	s.Equal(float64(3600), details.TTL)
+	s.Equal(float64(0), details.Retry)
+}
+
+func (s *HandlersSuite) TestShowUnknownJob() {
+	jobID := s.push("queueGateway", "asdf")
+	s.Equal(http.StatusNoContent, s.do("POST", "/jobs/"+jobID+"/ack", nil, nil))
+
+	reply := make(map[string]string)
+	s.Equal(http.StatusNotFound, s.do("GET", "/jobs/"+jobID, nil, &reply))
+	s.Equal("Job not found", reply["error"])
+}
+
+func (s *HandlersSuite) TestFetch() {
+	first := s.push("queueGateway", "job1")
+	s.push("queueGateway", "job2")
+	s.push("queueGateway", "job3")
+
+	// the count is bounded by MaxFetchCount
+	reply := &FetchResponse{}
+	s.Equal(http.StatusOK, s.do("GET", "/queues/queueGateway/jobs?count=5", nil, reply))
+	s.Equal(2, len(reply.Jobs))
+	s.Equal(first, reply.Jobs[0].ID)
+	s.Equal("queueGateway", reply.Jobs[0].Queue)
+	s.Equal("job1", reply.Jobs[0].Job)
+
+	s.Equal(http.StatusOK, s.do("GET", "/queues/queueGateway/jobs", nil, reply))
+	s.Equal(1, len(reply.Jobs))
+	s.Equal("job3", reply.Jobs[0].Job)
+}
+
+func (s *HandlersSuite) TestLongPoll() {
+	// without a timeout, a fetch returns immediately
+	reply := &FetchResponse{}
+	s.Equal(http.StatusOK, s.do("GET", "/queues/queueGateway/jobs", nil, reply))
+	s.Equal(0, len(reply.Jobs))
+
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		d := disque.NewDisque([]string{s.server.Addr}, 1000)
+		d.Initialize()
+		defer d.Close()
+		d.Push("queueGateway", "late", time.Second)
+	}()
+	s.Equal(http.StatusOK, s.do("GET", "/queues/queueGateway/jobs?timeout=5s", nil, reply))
+	s.Equal(1, len(reply.Jobs))
+	s.Equal("late", reply.Jobs[0].Job)
+
+	// the timeout is bounded by MaxPollTimeout
+	start := time.Now()
+	s.Equal(http.StatusOK, s.do("GET", "/queues/queueGateway/jobs?timeout=60", nil, reply))
+	s.Equal(0, len(reply.Jobs))
+	s.True(time.Since(start) < 5*time.Second)
+}
+
+func (s *HandlersSuite) TestAckAndNack() {
+	s.push("queueGateway", "asdf")
+	reply := &FetchResponse{}
+	s.Equal(http.StatusOK, s.do("GET", "/queues/queueGateway/jobs", nil, reply))
+	jobID := reply.Jobs[0].ID
+
+	s.Equal(http.StatusNoContent, s.do("POST", "/jobs/"+jobID+"/nack", nil, nil))
+	s.Equal(http.StatusOK, s.do("GET", "/queues/queueGateway/jobs", nil, reply))
+	s.Equal(jobID, reply.Jobs[0].ID)
+	s.Equal(int64(1), reply.Jobs[0].Nacks)
+
+	s.Equal(http.StatusNoContent, s.do("POST", "/jobs/"+jobID+"/ack", nil, nil))
+	details := &JobDetails{}
+	s.Equal(http.StatusNotFound, s.do("GET", "/jobs/"+jobID, nil, details))
+}
+
+func (s *HandlersSuite) TestQueueStats() {
+	s.push("queueGateway", "job1")
+	s.push("queueGateway", "job2")
+
+	stats := &QueueStats{}
+	s.Equal(http.StatusOK, s.do("GET", "/queues/queueGateway/stats", nil, stats))
+	s.Equal("queueGateway", stats.Queue)
+	s.Equal(int64(2), stats.Length)
+	s.Equal(int64(2), stats.JobsIn)
+	s.Equal("none", stats.Pause)
+}
+
+func (s *HandlersSuite) TestParseTimeout() {
+	timeout, err := parseTimeout("1.5")
+	s.Nil(err)
+	s.Equal(1500*time.Millisecond, timeout)
+
+	timeout, err = parseTimeout("250ms")
+	s.Nil(err)
+	s.Equal(250*time.Millisecond, timeout)
+
+	_, err = parseTimeout("-1")
+	s.NotNil(err)
+}